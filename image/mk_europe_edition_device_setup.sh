@@ -26,7 +26,8 @@ apt clean
 
 PATH=/root/fake:$PATH apt install --yes libjpeg8-dev libconfig9 rpi-update hostapd isc-dhcp-server tcpdump git cmake \
     libusb-1.0-0-dev build-essential mercurial build-essential autoconf libtool i2c-tools python-smbus \
-    python-pip python-dev python-pil python-daemon python-serial screen librtlsdr-dev rtl-sdr libfftw3-dev libncurses-dev
+    python-pip python-dev python-pil python-daemon python-serial screen librtlsdr-dev rtl-sdr libfftw3-dev libncurses-dev \
+    alsa-utils espeak-ng bluealsa python3-dbus python3-gi
 apt clean
 #echo y | rpi-update
 
@@ -188,8 +189,13 @@ mkdir -p /etc/stratux-screen/
 cp -f /root/stratux/test/screen/stratux-logo-64x64.bmp /etc/stratux-screen/stratux-logo-64x64.bmp
 cp -f /root/stratux/test/screen/CnC_Red_Alert.ttf /etc/stratux-screen/CnC_Red_Alert.ttf
 
+#Bluetooth NMEA output helper
+cp -f stratux-bluetooth.py /usr/bin/stratux-bluetooth.py
+chmod 755 /usr/bin/stratux-bluetooth.py
+
 #startup scripts
 cp -f ../__lib__systemd__system__stratux.service /lib/systemd/system/stratux.service
+cp -f ../__lib__systemd__system__stratux.socket /lib/systemd/system/stratux.socket
 cp -f ../__root__stratux-pre-start.sh /root/stratux-pre-start.sh
 cp -f rc.local /etc/rc.local
 
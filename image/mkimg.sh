@@ -159,6 +159,7 @@ cp -f /root/stratux/test/screen/CnC_Red_Alert.ttf /etc/stratux-screen/CnC_Red_Al
 
 #startup scripts
 cp -f ../__lib__systemd__system__stratux.service mnt/lib/systemd/system/stratux.service
+cp -f ../__lib__systemd__system__stratux.socket mnt/lib/systemd/system/stratux.socket
 cp -f ../__root__stratux-pre-start.sh mnt/root/stratux-pre-start.sh
 cp -f rc.local mnt/etc/rc.local
 
@@ -0,0 +1,354 @@
+#!/usr/bin/env python3
+#
+# stratux-bluetooth.py: Bluetooth NMEA output for gen_gdl90, see main/bluetooth.go.
+#	Reads NMEA from stdin and sends it to all connected Bluetooth clients:
+#	  --spp  Serial Port Profile (classic Bluetooth, most Android EFBs)
+#	  --ble  BLE UART (Nordic UART Service, iOS apps). Data is notified on the TX characteristic.
+#	Talks to bluetoothd via D-Bus, needs python3-dbus and python3-gi.
+#	Connects and disconnects are printed to stdout, one line each.
+#
+
+import argparse
+import os
+import socket
+import sys
+
+import dbus
+import dbus.exceptions
+import dbus.mainloop.glib
+import dbus.service
+from gi.repository import GLib
+
+BLUEZ = 'org.bluez'
+DBUS_OM_IFACE = 'org.freedesktop.DBus.ObjectManager'
+DBUS_PROP_IFACE = 'org.freedesktop.DBus.Properties'
+ADAPTER_IFACE = 'org.bluez.Adapter1'
+AGENT_MANAGER_IFACE = 'org.bluez.AgentManager1'
+AGENT_IFACE = 'org.bluez.Agent1'
+PROFILE_MANAGER_IFACE = 'org.bluez.ProfileManager1'
+PROFILE_IFACE = 'org.bluez.Profile1'
+GATT_MANAGER_IFACE = 'org.bluez.GattManager1'
+GATT_SERVICE_IFACE = 'org.bluez.GattService1'
+GATT_CHRC_IFACE = 'org.bluez.GattCharacteristic1'
+LE_ADVERTISING_MANAGER_IFACE = 'org.bluez.LEAdvertisingManager1'
+LE_ADVERTISEMENT_IFACE = 'org.bluez.LEAdvertisement1'
+
+SPP_UUID = '00001101-0000-1000-8000-00805f9b34fb'
+NUS_SERVICE_UUID = '6e400001-b5a3-f393-e0a9-e50e24dcca9e'
+NUS_RX_UUID = '6e400002-b5a3-f393-e0a9-e50e24dcca9e'
+NUS_TX_UUID = '6e400003-b5a3-f393-e0a9-e50e24dcca9e'
+
+BLE_CHUNK = 20  # Default ATT MTU (23) - 3, works with every central
+
+AGENT_PATH = '/org/stratux/agent'
+PROFILE_PATH = '/org/stratux/spp'
+APP_PATH = '/org/stratux/ble'
+ADV_PATH = '/org/stratux/ble/advertisement0'
+
+
+def status(msg):
+	print(msg, flush=True)
+
+
+class InvalidArgs(dbus.exceptions.DBusException):
+	_dbus_error_name = 'org.freedesktop.DBus.Error.InvalidArgs'
+
+
+class NotSupported(dbus.exceptions.DBusException):
+	_dbus_error_name = 'org.bluez.Error.NotSupported'
+
+
+# Pairing without PIN ("just works"), there is no way to enter or confirm one on the stratux.
+class Agent(dbus.service.Object):
+	@dbus.service.method(AGENT_IFACE, in_signature='', out_signature='')
+	def Release(self):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='os', out_signature='')
+	def AuthorizeService(self, device, uuid):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='o', out_signature='s')
+	def RequestPinCode(self, device):
+		return '0000'
+
+	@dbus.service.method(AGENT_IFACE, in_signature='o', out_signature='u')
+	def RequestPasskey(self, device):
+		return dbus.UInt32(0)
+
+	@dbus.service.method(AGENT_IFACE, in_signature='ouq', out_signature='')
+	def DisplayPasskey(self, device, passkey, entered):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='os', out_signature='')
+	def DisplayPinCode(self, device, pincode):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='ou', out_signature='')
+	def RequestConfirmation(self, device, passkey):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='o', out_signature='')
+	def RequestAuthorization(self, device):
+		pass
+
+	@dbus.service.method(AGENT_IFACE, in_signature='', out_signature='')
+	def Cancel(self):
+		pass
+
+
+# SPP: bluetoothd accepts the RFCOMM connections and hands us the sockets.
+class SerialProfile(dbus.service.Object):
+	def __init__(self, bus, path):
+		dbus.service.Object.__init__(self, bus, path)
+		self.clients = {}
+
+	@dbus.service.method(PROFILE_IFACE, in_signature='', out_signature='')
+	def Release(self):
+		pass
+
+	@dbus.service.method(PROFILE_IFACE, in_signature='oha{sv}', out_signature='')
+	def NewConnection(self, device, fd, properties):
+		sock = socket.socket(fileno=fd.take())
+		sock.setblocking(False)
+		self.close(device)
+		self.clients[device] = sock
+		status('connected spp %s' % device)
+
+	@dbus.service.method(PROFILE_IFACE, in_signature='o', out_signature='')
+	def RequestDisconnection(self, device):
+		self.close(device)
+
+	def close(self, device):
+		sock = self.clients.pop(device, None)
+		if sock is not None:
+			sock.close()
+			status('disconnected spp %s' % device)
+
+	def send(self, data):
+		for device, sock in list(self.clients.items()):
+			try:
+				sock.send(data)
+			except BlockingIOError:
+				pass  # Client too slow, drop
+			except OSError:
+				self.close(device)
+
+
+class Application(dbus.service.Object):
+	def __init__(self, bus):
+		dbus.service.Object.__init__(self, bus, APP_PATH)
+		self.services = []
+
+	@dbus.service.method(DBUS_OM_IFACE, out_signature='a{oa{sa{sv}}}')
+	def GetManagedObjects(self):
+		response = {}
+		for service in self.services:
+			response[service.path] = service.get_properties()
+			for chrc in service.characteristics:
+				response[chrc.path] = chrc.get_properties()
+		return response
+
+
+class Service(dbus.service.Object):
+	def __init__(self, bus, index, uuid):
+		self.path = APP_PATH + '/service' + str(index)
+		self.uuid = uuid
+		self.characteristics = []
+		dbus.service.Object.__init__(self, bus, self.path)
+
+	def get_properties(self):
+		return {GATT_SERVICE_IFACE: {
+			'UUID': self.uuid,
+			'Primary': True,
+			'Characteristics': dbus.Array([c.path for c in self.characteristics], signature='o'),
+		}}
+
+	@dbus.service.method(DBUS_PROP_IFACE, in_signature='s', out_signature='a{sv}')
+	def GetAll(self, interface):
+		if interface != GATT_SERVICE_IFACE:
+			raise InvalidArgs()
+		return self.get_properties()[GATT_SERVICE_IFACE]
+
+
+class Characteristic(dbus.service.Object):
+	def __init__(self, bus, index, uuid, flags, service):
+		self.path = service.path + '/char' + str(index)
+		self.uuid = uuid
+		self.flags = flags
+		self.service = service
+		dbus.service.Object.__init__(self, bus, self.path)
+
+	def get_properties(self):
+		return {GATT_CHRC_IFACE: {
+			'Service': self.service.path,
+			'UUID': self.uuid,
+			'Flags': self.flags,
+		}}
+
+	@dbus.service.method(DBUS_PROP_IFACE, in_signature='s', out_signature='a{sv}')
+	def GetAll(self, interface):
+		if interface != GATT_CHRC_IFACE:
+			raise InvalidArgs()
+		return self.get_properties()[GATT_CHRC_IFACE]
+
+	@dbus.service.method(GATT_CHRC_IFACE, in_signature='a{sv}', out_signature='ay')
+	def ReadValue(self, options):
+		raise NotSupported()
+
+	@dbus.service.method(GATT_CHRC_IFACE, in_signature='aya{sv}')
+	def WriteValue(self, value, options):
+		raise NotSupported()
+
+	@dbus.service.method(GATT_CHRC_IFACE)
+	def StartNotify(self):
+		raise NotSupported()
+
+	@dbus.service.method(GATT_CHRC_IFACE)
+	def StopNotify(self):
+		raise NotSupported()
+
+	@dbus.service.signal(DBUS_PROP_IFACE, signature='sa{sv}as')
+	def PropertiesChanged(self, interface, changed, invalidated):
+		pass
+
+
+class TxCharacteristic(Characteristic):
+	def __init__(self, bus, index, service):
+		Characteristic.__init__(self, bus, index, NUS_TX_UUID, ['notify'], service)
+		self.notifying = False
+
+	def StartNotify(self):
+		if not self.notifying:
+			self.notifying = True
+			status('connected ble')
+
+	def StopNotify(self):
+		if self.notifying:
+			self.notifying = False
+			status('disconnected ble')
+
+	def send(self, data):
+		if not self.notifying:
+			return
+		for i in range(0, len(data), BLE_CHUNK):
+			value = dbus.Array([dbus.Byte(b) for b in data[i:i + BLE_CHUNK]], signature='y')
+			self.PropertiesChanged(GATT_CHRC_IFACE, {'Value': value}, [])
+
+
+# Apps write their commands here. We only send, but accept the writes so they don't fail.
+class RxCharacteristic(Characteristic):
+	def __init__(self, bus, index, service):
+		Characteristic.__init__(self, bus, index, NUS_RX_UUID, ['write', 'write-without-response'], service)
+
+	def WriteValue(self, value, options):
+		pass
+
+
+class Advertisement(dbus.service.Object):
+	def __init__(self, bus, name):
+		self.name = name
+		dbus.service.Object.__init__(self, bus, ADV_PATH)
+
+	def get_properties(self):
+		return {
+			'Type': 'peripheral',
+			'ServiceUUIDs': dbus.Array([NUS_SERVICE_UUID], signature='s'),
+			'LocalName': dbus.String(self.name),
+		}
+
+	@dbus.service.method(DBUS_PROP_IFACE, in_signature='s', out_signature='a{sv}')
+	def GetAll(self, interface):
+		if interface != LE_ADVERTISEMENT_IFACE:
+			raise InvalidArgs()
+		return self.get_properties()
+
+	@dbus.service.method(LE_ADVERTISEMENT_IFACE, in_signature='', out_signature='')
+	def Release(self):
+		pass
+
+
+def find_adapter(bus):
+	objects = dbus.Interface(bus.get_object(BLUEZ, '/'), DBUS_OM_IFACE).GetManagedObjects()
+	for path, ifaces in objects.items():
+		if ADAPTER_IFACE in ifaces:
+			return path
+	return None
+
+
+def main():
+	parser = argparse.ArgumentParser(description='Bluetooth NMEA output for stratux')
+	parser.add_argument('--name', default='Stratux')
+	parser.add_argument('--spp', action='store_true')
+	parser.add_argument('--ble', action='store_true')
+	args = parser.parse_args()
+
+	dbus.mainloop.glib.DBusGMainLoop(set_as_default=True)
+	bus = dbus.SystemBus()
+	mainloop = GLib.MainLoop()
+
+	adapter_path = find_adapter(bus)
+	if adapter_path is None:
+		sys.stderr.write('no Bluetooth adapter found\n')
+		sys.exit(1)
+	adapter = dbus.Interface(bus.get_object(BLUEZ, adapter_path), DBUS_PROP_IFACE)
+	adapter.Set(ADAPTER_IFACE, 'Powered', dbus.Boolean(True))
+	adapter.Set(ADAPTER_IFACE, 'Alias', dbus.String(args.name))
+	adapter.Set(ADAPTER_IFACE, 'Pairable', dbus.Boolean(True))
+	adapter.Set(ADAPTER_IFACE, 'PairableTimeout', dbus.UInt32(0))
+	adapter.Set(ADAPTER_IFACE, 'DiscoverableTimeout', dbus.UInt32(0))
+	adapter.Set(ADAPTER_IFACE, 'Discoverable', dbus.Boolean(True))
+
+	Agent(bus, AGENT_PATH)
+	agent_manager = dbus.Interface(bus.get_object(BLUEZ, '/org/bluez'), AGENT_MANAGER_IFACE)
+	agent_manager.RegisterAgent(AGENT_PATH, 'NoInputNoOutput')
+	agent_manager.RequestDefaultAgent(AGENT_PATH)
+
+	outputs = []
+	if args.spp:
+		profile = SerialProfile(bus, PROFILE_PATH)
+		dbus.Interface(bus.get_object(BLUEZ, '/org/bluez'), PROFILE_MANAGER_IFACE).RegisterProfile(PROFILE_PATH, SPP_UUID, {
+			'Name': 'Stratux NMEA',
+			'Role': 'server',
+			'Channel': dbus.UInt16(1),
+			'RequireAuthentication': False,
+			'RequireAuthorization': False,
+		})
+		outputs.append(profile)
+
+	if args.ble:
+		app = Application(bus)
+		service = Service(bus, 0, NUS_SERVICE_UUID)
+		tx = TxCharacteristic(bus, 0, service)
+		service.characteristics = [tx, RxCharacteristic(bus, 1, service)]
+		app.services.append(service)
+		Advertisement(bus, args.name)
+
+		def failed(error):
+			sys.stderr.write('BLE registration failed: %s\n' % error)
+			mainloop.quit()
+
+		gatt_manager = dbus.Interface(bus.get_object(BLUEZ, adapter_path), GATT_MANAGER_IFACE)
+		gatt_manager.RegisterApplication(APP_PATH, {}, reply_handler=lambda: None, error_handler=failed)
+		adv_manager = dbus.Interface(bus.get_object(BLUEZ, adapter_path), LE_ADVERTISING_MANAGER_IFACE)
+		adv_manager.RegisterAdvertisement(ADV_PATH, {}, reply_handler=lambda: None, error_handler=failed)
+		outputs.append(tx)
+
+	stdin = sys.stdin.buffer.raw
+
+	def on_input(fd, condition):
+		data = os.read(fd, 4096)
+		if not data:
+			mainloop.quit()  # gen_gdl90 went away
+			return False
+		for out in outputs:
+			out.send(data)
+		return True
+
+	GLib.io_add_watch(stdin.fileno(), GLib.IO_IN | GLib.IO_HUP, on_input)
+	status('ready')
+	mainloop.run()
+
+
+if __name__ == '__main__':
+	main()
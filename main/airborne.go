@@ -0,0 +1,163 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	airborne.go: Ground/airborne state of our own aircraft. Takeoff is detected from the GPS
+		ground speed, confirmed by a climb away from the altitude we were rolling at (baro
+		if available, else GPS) or a sustained climb rate. Landing needs the ground speed to
+		stay low for a while, so a slow flying glider or a gyro in a headwind isn't "landed".
+		On the ground, traffic alarms are suppressed (globalSettings.GroundAlarmSuppress):
+		targets are still sent as PFLAA/GDL90 traffic, but without alarm level. Sitting at the
+		hold short with aircraft in the pattern otherwise gives continuous alarms.
+		As long as the state is unknown (no GPS fix since startup), we assume airborne.
+		Close to the ground after takeoff and in the pattern, alarms are de-escalated like a FLARM
+		does: below globalSettings.LowAlarmAGL ft above the ground reference (the terrain if we have
+		elevation data, else the altitude we last rolled at, usually the home field) or within globalSettings.TakeoffAlarmTime seconds after
+		takeoff, the alarm level is capped at globalSettings.LowAlarmMaxLevel and audio alerts are muted.
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	AIRBORNE_UNKNOWN = 0
+	AIRBORNE_GROUND  = 1
+	AIRBORNE_FLYING  = 2
+)
+
+const (
+	airborneTakeoffSpeed = 40  // kts, airborne above this, sustained airborneTakeoffTime
+	airborneClimbSpeed   = 25  // kts, airborne above this if also climbing
+	airborneClimbAlt     = 150 // ft above the altitude we were rolling at
+	airborneClimbRate    = 300 // ft/min, sustained airborneTakeoffTime
+	airborneTakeoffTime  = 5 * time.Second
+	airborneLandingSpeed = 20 // kts, on ground below this, sustained airborneLandingTime
+	airborneLandingTime  = 20 * time.Second
+)
+
+var airborneState = AIRBORNE_UNKNOWN
+var airborneGroundAlt float32 // Ground reference, altitude we were last rolling at (ft, airborneAltitude())
+var airborneGroundAltValid bool
+var airborneTakeoffAt time.Time
+
+// ownshipAirborne returns false only if we know we are on the ground.
+func ownshipAirborne() bool {
+	return airborneState != AIRBORNE_GROUND
+}
+
+// alarmsSuppressedOnGround returns true if traffic alarms are currently suppressed because we are on the ground.
+func alarmsSuppressedOnGround() bool {
+	return globalSettings.GroundAlarmSuppress && !ownshipAirborne()
+}
+
+// heightAboveGroundRef returns our height above the ground reference in ft, false if we have none.
+// With terrain data that's the height above the terrain below us.
+func heightAboveGroundRef() (float32, bool) {
+	if s := getSituation(); s.GPSValid && s.TerrainValid {
+		return s.TerrainHeightAbove, true
+	}
+	if !airborneGroundAltValid || !isGPSValid() {
+		return 0, false
+	}
+	alt, _ := airborneAltitude()
+	return alt - airborneGroundAlt, true
+}
+
+// lowAltitudeAlarmPhase returns true if we are airborne, but just took off or are still close to the ground.
+func lowAltitudeAlarmPhase() bool {
+	if airborneState != AIRBORNE_FLYING {
+		return false
+	}
+	if globalSettings.TakeoffAlarmTime > 0 && !airborneTakeoffAt.IsZero() &&
+		stratuxClock.Since(airborneTakeoffAt) < time.Duration(globalSettings.TakeoffAlarmTime)*time.Second {
+		return true
+	}
+	if h, ok := heightAboveGroundRef(); ok && globalSettings.LowAlarmAGL > 0 && h < float32(globalSettings.LowAlarmAGL) {
+		return true
+	}
+	return false
+}
+
+// limitLowAltitudeAlarm caps the alarm level in the low altitude phase.
+func limitLowAltitudeAlarm(alarmLevel uint8) uint8 {
+	if alarmLevel > uint8(globalSettings.LowAlarmMaxLevel) && lowAltitudeAlarmPhase() {
+		return uint8(globalSettings.LowAlarmMaxLevel)
+	}
+	return alarmLevel
+}
+
+// airborneAltitude returns the altitude used for the climb check, baro if available.
+func airborneAltitude() (alt float32, vs float32) {
+	if isTempPressValid() {
+		return mySituation.BaroPressureAltitude, mySituation.BaroVerticalSpeed
+	}
+	return mySituation.GPSAltitudeMSL, mySituation.GPSVerticalSpeed * 60
+}
+
+func airborneDetector() {
+	ticker := time.NewTicker(1 * time.Second)
+	var fastSince, climbSince, slowSince time.Time
+	for {
+		<-ticker.C
+		if !isGPSValid() {
+			fastSince, climbSince, slowSince = time.Time{}, time.Time{}, time.Time{}
+			continue
+		}
+		speed := mySituation.GPSGroundSpeed
+		alt, vs := airborneAltitude()
+		if airborneState == AIRBORNE_UNKNOWN {
+			// First fix: decide by speed, and take it from there
+			if speed < airborneLandingSpeed {
+				airborneState = AIRBORNE_GROUND
+				airborneGroundAlt, airborneGroundAltValid = alt, true
+			} else if speed > airborneTakeoffSpeed {
+				airborneState = AIRBORNE_FLYING
+			}
+		}
+
+		switch airborneState {
+		case AIRBORNE_GROUND:
+			if speed < airborneLandingSpeed {
+				airborneGroundAlt = alt // Follow the terrain while taxiing
+			}
+			fastSince = timeSinceCondition(fastSince, speed > airborneTakeoffSpeed)
+			climbSince = timeSinceCondition(climbSince, speed > airborneClimbSpeed && vs > airborneClimbRate)
+			climbedAway := speed > airborneClimbSpeed && alt > airborneGroundAlt+airborneClimbAlt
+			if climbedAway || (!fastSince.IsZero() && stratuxClock.Since(fastSince) > airborneTakeoffTime) ||
+				(!climbSince.IsZero() && stratuxClock.Since(climbSince) > airborneTakeoffTime) {
+				log.Printf("Takeoff detected: %.0f kts, %.0f ft above ground reference\n", speed, alt-airborneGroundAlt)
+				airborneState = AIRBORNE_FLYING
+				airborneTakeoffAt = stratuxClock.Time
+				slowSince = time.Time{}
+			}
+		case AIRBORNE_FLYING:
+			slowSince = timeSinceCondition(slowSince, speed < airborneLandingSpeed)
+			if !slowSince.IsZero() && stratuxClock.Since(slowSince) > airborneLandingTime {
+				log.Printf("Landing detected\n")
+				airborneState = AIRBORNE_GROUND
+				airborneGroundAlt, airborneGroundAltValid = alt, true
+				fastSince, climbSince = time.Time{}, time.Time{}
+			}
+		}
+		globalStatus.Airborne = ownshipAirborne()
+		globalStatus.GroundAlarmSuppressed = alarmsSuppressedOnGround()
+		globalStatus.LowAltitudeAlarmLimit = lowAltitudeAlarmPhase() && (globalSettings.LowAlarmAGL > 0 || globalSettings.TakeoffAlarmTime > 0)
+	}
+}
+
+// timeSinceCondition returns the time a condition became true, zero time if it isn't.
+func timeSinceCondition(since time.Time, cond bool) time.Time {
+	if !cond {
+		return time.Time{}
+	}
+	if since.IsZero() {
+		return stratuxClock.Time
+	}
+	return since
+}
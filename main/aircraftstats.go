@@ -0,0 +1,171 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	aircraftstats.go: Reception statistics per aircraft for this session: first/last seen, number of
+		messages, maximum range and the distribution of the signal level. Comparing these between
+		flights or evenings tells objectively which antenna or placement receives better.
+		Counted for every traffic update (registerTrafficUpdate()), kept in memory until restart
+		or until cleared. Available as JSON or CSV via /getAircraftStats.
+		Targets that asked not to be tracked are left out, the statistics are meant to be exported.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	aircraftStatsMax         = 10000 // Aircraft per session, later ones aren't counted
+	aircraftStatsRSSIMin     = -48   // dB, lowest bucket starts here, everything below is counted in it
+	aircraftStatsRSSIBucket  = 3     // dB per bucket
+	aircraftStatsRSSIBuckets = 16
+)
+
+// aircraftStats is the JSON representation, also used for the CSV export.
+type aircraftStats struct {
+	Addr        string // Hex, as in the traffic list
+	Addr_type   uint8
+	Tail        string
+	Sources     []string // Receivers the target was received on
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Messages    uint32
+	MaxRange    float64 // m, 0 = no position received while we had a fix
+	RSSIMin     float64 // dB, only messages with a signal level
+	RSSIMax     float64
+	RSSIMean    float64
+	RSSICount   uint32
+	RSSIBuckets []uint32 // Counts per aircraftStatsRSSIBucket dB, starting at aircraftStatsRSSIMin
+	rssiSum     float64
+	sources     uint8
+}
+
+var aircraftStatsMap = make(map[uint32]*aircraftStats) // By trafficInfoKey()
+var aircraftStatsSessionStart = time.Now()
+var aircraftStatsMutex = &sync.Mutex{}
+
+var aircraftStatsSourceNames = map[uint8]string{
+	TRAFFIC_SOURCE_1090ES: "1090ES",
+	TRAFFIC_SOURCE_UAT:    "UAT",
+	TRAFFIC_SOURCE_OGN:    "OGN",
+}
+
+// aircraftStatsUpdate counts one received message of a target. Called with trafficMutex held.
+func aircraftStatsUpdate(ti TrafficInfo) {
+	if !privacyAllows(ti, PRIVACY_USE_LOG) {
+		return
+	}
+	aircraftStatsMutex.Lock()
+	defer aircraftStatsMutex.Unlock()
+	key := trafficInfoKey(ti)
+	s, ok := aircraftStatsMap[key]
+	if !ok {
+		if len(aircraftStatsMap) >= aircraftStatsMax {
+			return
+		}
+		s = &aircraftStats{
+			Addr:        fmt.Sprintf("%06X", ti.Icao_addr),
+			Addr_type:   ti.Addr_type,
+			FirstSeen:   time.Now().UTC(),
+			RSSIBuckets: make([]uint32, aircraftStatsRSSIBuckets),
+		}
+		aircraftStatsMap[key] = s
+	}
+	s.LastSeen = time.Now().UTC()
+	s.Messages++
+	s.sources |= ti.Last_source
+	if len(ti.Tail) > 0 {
+		s.Tail = ti.Tail
+	}
+	if ti.Position_valid && !ti.ExtrapolatedPosition && isGPSValid() {
+		dist, _ := distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+		if dist > s.MaxRange {
+			s.MaxRange = dist
+		}
+	}
+	if ti.SignalLevel > -100 && ti.SignalLevel < 20 { // -999: unknown
+		if s.RSSICount == 0 || ti.SignalLevel < s.RSSIMin {
+			s.RSSIMin = ti.SignalLevel
+		}
+		if s.RSSICount == 0 || ti.SignalLevel > s.RSSIMax {
+			s.RSSIMax = ti.SignalLevel
+		}
+		s.RSSICount++
+		s.rssiSum += ti.SignalLevel
+		b := int((ti.SignalLevel - aircraftStatsRSSIMin) / aircraftStatsRSSIBucket)
+		if b < 0 {
+			b = 0
+		} else if b >= aircraftStatsRSSIBuckets {
+			b = aircraftStatsRSSIBuckets - 1
+		}
+		s.RSSIBuckets[b]++
+	}
+}
+
+// getAircraftStats returns a copy of the statistics, most messages first.
+func getAircraftStats() []aircraftStats {
+	aircraftStatsMutex.Lock()
+	ret := make([]aircraftStats, 0, len(aircraftStatsMap))
+	for _, s := range aircraftStatsMap {
+		c := *s
+		c.RSSIBuckets = append([]uint32(nil), s.RSSIBuckets...)
+		if c.RSSICount > 0 {
+			c.RSSIMean = c.rssiSum / float64(c.RSSICount)
+		}
+		c.Sources = make([]string, 0)
+		for src, name := range aircraftStatsSourceNames {
+			if c.sources&src != 0 {
+				c.Sources = append(c.Sources, name)
+			}
+		}
+		sort.Strings(c.Sources)
+		ret = append(ret, c)
+	}
+	aircraftStatsMutex.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Messages > ret[j].Messages })
+	return ret
+}
+
+func clearAircraftStats() {
+	aircraftStatsMutex.Lock()
+	aircraftStatsMap = make(map[uint32]*aircraftStats)
+	aircraftStatsSessionStart = time.Now()
+	aircraftStatsMutex.Unlock()
+}
+
+// writeAircraftStatsCSV writes one line per aircraft, the RSSI distribution as one column per bucket.
+func writeAircraftStatsCSV(w io.Writer, stats []aircraftStats) error {
+	c := csv.NewWriter(w)
+	header := []string{"addr", "addr_type", "tail", "sources", "first_seen", "last_seen", "messages", "max_range_m", "rssi_min", "rssi_max", "rssi_mean"}
+	for b := 0; b < aircraftStatsRSSIBuckets; b++ {
+		header = append(header, fmt.Sprintf("rssi_%d", aircraftStatsRSSIMin+b*aircraftStatsRSSIBucket))
+	}
+	c.Write(header)
+	for _, s := range stats {
+		line := []string{s.Addr, strconv.Itoa(int(s.Addr_type)), s.Tail, strings.Join(s.Sources, "+"),
+			s.FirstSeen.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), strconv.FormatUint(uint64(s.Messages), 10),
+			strconv.FormatFloat(s.MaxRange, 'f', 0, 64)}
+		if s.RSSICount > 0 {
+			line = append(line, strconv.FormatFloat(s.RSSIMin, 'f', 1, 64), strconv.FormatFloat(s.RSSIMax, 'f', 1, 64), strconv.FormatFloat(s.RSSIMean, 'f', 1, 64))
+		} else {
+			line = append(line, "", "", "")
+		}
+		for _, n := range s.RSSIBuckets {
+			line = append(line, strconv.FormatUint(uint64(n), 10))
+		}
+		c.Write(line)
+	}
+	c.Flush()
+	return c.Error()
+}
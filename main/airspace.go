@@ -0,0 +1,464 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	airspace.go: Airspace warnings. Airspaces are read from the openAIP files in openAIPDir (see
+		openaip.go) and from Tim Newport-Peace files (*.sua, *.tnp) in the same directory.
+		Every second our position is checked against the airspaces of the categories in
+		AirspaceWarningCategories: inside (horizontally and vertically), or close to it - less than
+		AirspaceWarningDistance from the boundary and less than AirspaceWarningVertical from the
+		floor or ceiling. The warnings are published in mySituation (AirspaceWarnings, also on
+		the /situation websocket), logged as events and sent as $PSTXA, see makePSTXAString().
+		Flight levels are compared with our pressure altitude, MSL limits with the QNH corrected baro
+		altitude, like the pilot flies them. Limits relative to the ground need the terrain elevation
+		(terrain.go). Without it, an AGL floor is treated as the surface and an AGL ceiling as
+		unlimited, so we rather warn too much.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	airspaceUpdateInterval = 1 * time.Second
+	airspaceArcStep        = 5.0 // degrees, arcs and circles are converted to polygons
+)
+
+// Altitude references of airspace limits
+const (
+	AIRSPACE_REF_MSL = iota
+	AIRSPACE_REF_GND
+	AIRSPACE_REF_STD // Flight level, relative to 1013.25 hPa
+)
+
+type airspaceLimit struct {
+	Alt float64 // ft
+	Ref int
+}
+
+type airspace struct {
+	Name     string
+	Category string // openAIP category: A-G, CTR, TMA, CTA, RESTRICTED, DANGER, PROHIBITED, TMZ, RMZ, GLIDING, ...
+	Bottom   airspaceLimit
+	Top      airspaceLimit
+	Lat, Lon []float64 // Boundary, not closed
+	// Bounding box for the quick distance check
+	minLat, maxLat, minLon, maxLon float64
+}
+
+// airspaceWarning is an airspace we are in or close to, published in mySituation.AirspaceWarnings.
+type airspaceWarning struct {
+	Name     string
+	Category string
+	Inside   bool
+	Distance float64 // m, horizontal distance to the boundary, 0 if inside
+	Bottom   string  // As on the chart, e.g. "GND", "2500 ft", "FL65"
+	Top      string
+}
+
+var airspaceWarned = make(map[string]bool) // Warnings we already logged, by name
+
+func (l airspaceLimit) String() string {
+	switch {
+	case l.Ref == AIRSPACE_REF_STD:
+		return fmt.Sprintf("FL%d", int(l.Alt/100+0.5))
+	case l.Ref == AIRSPACE_REF_GND && l.Alt == 0:
+		return "GND"
+	case l.Ref == AIRSPACE_REF_GND:
+		return fmt.Sprintf("%d ft AGL", int(l.Alt))
+	case l.Alt >= 99999:
+		return "UNL"
+	}
+	return fmt.Sprintf("%d ft", int(l.Alt))
+}
+
+// altitude converts a limit to ft, MSL for AGL limits. ok = false if the ground elevation is needed and unknown.
+func (l airspaceLimit) altitude(s *situationSnapshot) (alt float64, ok bool) {
+	if l.Ref == AIRSPACE_REF_GND {
+		if l.Alt == 0 {
+			return math.Inf(-1), true
+		}
+		elev, ok := airspaceGroundElevation(float64(s.GPSLatitude), float64(s.GPSLongitude))
+		return elev + l.Alt, ok
+	}
+	return l.Alt, true
+}
+
+// ownAltitude is our altitude (ft) in the reference of the limit, like the altimeter setting the pilot flies it with:
+// pressure altitude for flight levels, the QNH corrected baro altitude for MSL and AGL limits. GPS altitude without baro.
+func (l airspaceLimit) ownAltitude(s *situationSnapshot) float64 {
+	if !s.BaroValid {
+		return float64(s.GPSAltitudeMSL)
+	}
+	if l.Ref == AIRSPACE_REF_STD {
+		return float64(s.BaroPressureAltitude)
+	}
+	return float64(s.BaroIndicatedAltitude)
+}
+
+// airspaceGroundElevation returns the terrain elevation (ft MSL) for AGL limits, if known.
+func airspaceGroundElevation(lat, lon float64) (float64, bool) {
+	return terrainElevation(lat, lon)
+}
+
+func newAirspace(name, category string, bottom, top airspaceLimit, lat, lon []float64) (a airspace, ok bool) {
+	if len(lat) < 3 {
+		return
+	}
+	a = airspace{Name: name, Category: strings.ToUpper(category), Bottom: bottom, Top: top, Lat: lat, Lon: lon}
+	a.minLat, a.maxLat, a.minLon, a.maxLon = lat[0], lat[0], lon[0], lon[0]
+	for i := range lat {
+		a.minLat, a.maxLat = math.Min(a.minLat, lat[i]), math.Max(a.maxLat, lat[i])
+		a.minLon, a.maxLon = math.Min(a.minLon, lon[i]), math.Max(a.maxLon, lon[i])
+	}
+	return a, true
+}
+
+// openAIPAirspaceLimit converts an ALTLIMIT_TOP/ALTLIMIT_BOTTOM element.
+func openAIPAirspaceLimit(l openAIPAltLimit) airspaceLimit {
+	alt, _ := strconv.ParseFloat(strings.TrimSpace(l.Alt.Value), 64)
+	if l.Alt.Unit == "FL" {
+		alt *= 100
+	} else if l.Alt.Unit == "M" {
+		alt /= 0.3048
+	}
+	switch l.Reference {
+	case "STD":
+		return airspaceLimit{alt, AIRSPACE_REF_STD}
+	case "GND":
+		return airspaceLimit{alt, AIRSPACE_REF_GND}
+	}
+	return airspaceLimit{alt, AIRSPACE_REF_MSL}
+}
+
+// openAIPAirspaceToAirspace converts an ASP element. The polygon is "lon lat, lon lat, ...".
+func openAIPAirspaceToAirspace(asp openAIPAirspace) (airspace, bool) {
+	var lat, lon []float64
+	for _, p := range strings.Split(asp.Polygon, ",") {
+		f := strings.Fields(p)
+		if len(f) < 2 {
+			continue
+		}
+		x, err1 := strconv.ParseFloat(f[0], 64)
+		y, err2 := strconv.ParseFloat(f[1], 64)
+		if err1 == nil && err2 == nil {
+			lat, lon = append(lat, y), append(lon, x)
+		}
+	}
+	if n := len(lat); n > 1 && lat[0] == lat[n-1] && lon[0] == lon[n-1] {
+		lat, lon = lat[:n-1], lon[:n-1]
+	}
+	return newAirspace(asp.Name, asp.Category, openAIPAirspaceLimit(asp.Bottom), openAIPAirspaceLimit(asp.Top), lat, lon)
+}
+
+// parseTNPCoordinate parses N513045 / W0011530 (degrees, minutes, seconds).
+func parseTNPCoordinate(s string) (float64, bool) {
+	if len(s) < 5 {
+		return 0, false
+	}
+	degDigits := 2
+	if s[0] == 'E' || s[0] == 'W' {
+		degDigits = 3
+	}
+	digits := s[1:]
+	if len(digits) < degDigits+4 {
+		return 0, false
+	}
+	d, err1 := strconv.Atoi(digits[:degDigits])
+	m, err2 := strconv.Atoi(digits[degDigits : degDigits+2])
+	sec, err3 := strconv.ParseFloat(digits[degDigits+2:], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	v := float64(d) + float64(m)/60 + sec/3600
+	if s[0] == 'S' || s[0] == 'W' {
+		v = -v
+	}
+	return v, s[0] == 'N' || s[0] == 'S' || s[0] == 'E' || s[0] == 'W'
+}
+
+// parseTNPPosition parses "N513045 W0011530".
+func parseTNPPosition(s string) (lat, lon float64, ok bool) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return
+	}
+	lat, ok1 := parseTNPCoordinate(f[0])
+	lon, ok2 := parseTNPCoordinate(f[1])
+	return lat, lon, ok1 && ok2
+}
+
+// parseTNPLimit parses SFC, UNLTD, FL65, 3500ALT, 3500MSL, 1500AGL or 3500.
+func parseTNPLimit(s string) airspaceLimit {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	switch {
+	case s == "SFC" || s == "GND":
+		return airspaceLimit{0, AIRSPACE_REF_GND}
+	case strings.HasPrefix(s, "UNL"):
+		return airspaceLimit{99999, AIRSPACE_REF_MSL}
+	case strings.HasPrefix(s, "FL"):
+		v, _ := strconv.ParseFloat(strings.TrimSpace(s[2:]), 64)
+		return airspaceLimit{v * 100, AIRSPACE_REF_STD}
+	case strings.HasSuffix(s, "AGL"):
+		v, _ := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "AGL")), 64)
+		return airspaceLimit{v, AIRSPACE_REF_GND}
+	}
+	v, _ := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(s, "ALT"), "MSL")), 64)
+	return airspaceLimit{v, AIRSPACE_REF_MSL}
+}
+
+// tnpCategory maps TYPE and CLASS of a Tim Newport-Peace airspace to the openAIP categories.
+func tnpCategory(typ, class, title string) string {
+	switch typ {
+	case "CTA/CTR":
+		if strings.Contains(strings.ToUpper(title), "CTR") {
+			return "CTR"
+		} else if len(class) == 1 {
+			return class
+		}
+		return "CTA"
+	case "RESTRICTED", "PROHIBITED", "DANGER", "TMZ", "RMZ", "GLIDING":
+		return typ
+	}
+	if len(class) == 1 {
+		return class
+	}
+	return typ
+}
+
+// appendArc adds an arc around the center from the last point of the boundary to lat2/lon2.
+func appendArc(lat, lon []float64, cLat, cLon, radiusNm float64, clockwise bool, lat2, lon2 float64) ([]float64, []float64) {
+	if len(lat) > 0 {
+		_, start := distance(cLat, cLon, lat[len(lat)-1], lon[len(lon)-1])
+		_, end := distance(cLat, cLon, lat2, lon2)
+		sweep := math.Mod(end-start+720, 360)
+		step := airspaceArcStep
+		if !clockwise {
+			sweep, step = sweep-360, -step
+		}
+		for a := step; math.Abs(a) < math.Abs(sweep); a += step {
+			pLat, pLon := calcLocationForBearingDistance(cLat, cLon, start+a, radiusNm)
+			lat, lon = append(lat, pLat), append(lon, pLon)
+		}
+	}
+	return append(lat, lat2), append(lon, lon2)
+}
+
+// loadTNPFile reads a Tim Newport-Peace airspace file. Only the features needed for warnings are supported.
+func loadTNPFile(fn string) ([]airspace, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []airspace
+	var typ, class, title string
+	var bottom, top airspaceLimit
+	var lat, lon []float64
+	finish := func() {
+		if a, ok := newAirspace(title, tnpCategory(typ, class, title), bottom, top, lat, lon); ok {
+			result = append(result, a)
+		}
+		lat, lon = nil, nil
+	}
+	value := func(line, key string) string {
+		i := strings.Index(line, key+"=")
+		if i < 0 {
+			return ""
+		}
+		v := line[i+len(key)+1:]
+		for _, next := range []string{" CENTRE=", " TO=", " RADIUS="} {
+			if j := strings.Index(v, next); j >= 0 {
+				v = v[:j]
+			}
+		}
+		return strings.TrimSpace(v)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == '*' {
+			continue
+		}
+		upper := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(upper, "TITLE="):
+			finish()
+			title = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(upper, "TYPE="):
+			typ, class = strings.TrimSpace(upper[5:]), ""
+		case strings.HasPrefix(upper, "CLASS="):
+			class = strings.TrimSpace(upper[6:])
+		case strings.HasPrefix(upper, "BASE="):
+			bottom = parseTNPLimit(upper[5:])
+		case strings.HasPrefix(upper, "TOPS="):
+			top = parseTNPLimit(upper[5:])
+		case strings.HasPrefix(upper, "POINT="):
+			if pLat, pLon, ok := parseTNPPosition(upper[6:]); ok {
+				lat, lon = append(lat, pLat), append(lon, pLon)
+			}
+		case strings.HasPrefix(upper, "CIRCLE"):
+			r, _ := strconv.ParseFloat(value(upper, "RADIUS"), 64)
+			if cLat, cLon, ok := parseTNPPosition(value(upper, "CENTRE")); ok && r > 0 {
+				lat, lon = nil, nil
+				for a := 0.0; a < 360; a += airspaceArcStep {
+					pLat, pLon := calcLocationForBearingDistance(cLat, cLon, a, r)
+					lat, lon = append(lat, pLat), append(lon, pLon)
+				}
+			}
+		case strings.HasPrefix(upper, "CLOCKWISE"), strings.HasPrefix(upper, "ANTI-CLOCKWISE"):
+			r, _ := strconv.ParseFloat(value(upper, "RADIUS"), 64)
+			cLat, cLon, ok1 := parseTNPPosition(value(upper, "CENTRE"))
+			toLat, toLon, ok2 := parseTNPPosition(value(upper, "TO"))
+			if ok1 && ok2 {
+				lat, lon = appendArc(lat, lon, cLat, cLon, r, strings.HasPrefix(upper, "CLOCKWISE"), toLat, toLon)
+			}
+		}
+	}
+	finish()
+	return result, scanner.Err()
+}
+
+// airspaceHorizontal returns whether we are inside the boundary and the distance to it (m).
+func airspaceHorizontal(a *airspace, lat0, lon0 float64) (inside bool, dist float64) {
+	cosLat := math.Cos(radians(lat0))
+	dist = math.MaxFloat64
+	n := len(a.Lat)
+	for i := 0; i < n; i++ {
+		j := (i + 1) % n
+		an, ae := obstacleLocal(a.Lat[i], a.Lon[i], lat0, lon0, cosLat)
+		bn, be := obstacleLocal(a.Lat[j], a.Lon[j], lat0, lon0, cosLat)
+		cn, ce := closestPointOnSegment(0, 0, an, ae, bn, be)
+		dist = math.Min(dist, math.Hypot(cn, ce))
+		// Ray casting to the east
+		if (an > 0) != (bn > 0) && ae+(0-an)*(be-ae)/(bn-an) > 0 {
+			inside = !inside
+		}
+	}
+	return
+}
+
+// airspaceWarnings returns the warnings for our position, inside first, then by distance.
+func airspaceWarnings(s *situationSnapshot) []airspaceWarning {
+	warnings := make([]airspaceWarning, 0)
+	if !s.GPSValid {
+		return warnings
+	}
+	categories := make(map[string]bool)
+	for _, c := range globalSettings.AirspaceWarningCategories {
+		categories[strings.ToUpper(c)] = true
+	}
+	lat0, lon0 := float64(s.GPSLatitude), float64(s.GPSLongitude)
+	warnDist := float64(globalSettings.AirspaceWarningDistance)
+	warnVert := float64(globalSettings.AirspaceWarningVertical)
+	dLat, dLon := warnDist/111120, warnDist/(111120*math.Cos(radians(lat0)))
+
+	openAIPMutex.Lock()
+	defer openAIPMutex.Unlock()
+	for i := range openAIPAirspaces {
+		a := &openAIPAirspaces[i]
+		if !categories[a.Category] || a.maxLat < lat0-dLat || a.minLat > lat0+dLat || a.maxLon < lon0-dLon || a.minLon > lon0+dLon {
+			continue
+		}
+		bottom, ok := a.Bottom.altitude(s)
+		if !ok {
+			bottom = math.Inf(-1)
+		}
+		top, ok := a.Top.altitude(s)
+		if !ok {
+			top = math.Inf(1)
+		}
+		vDist := math.Max(0, math.Max(bottom-a.Bottom.ownAltitude(s), a.Top.ownAltitude(s)-top))
+		if vDist > warnVert {
+			continue
+		}
+		inside, hDist := airspaceHorizontal(a, lat0, lon0)
+		if !inside && hDist > warnDist {
+			continue
+		}
+		w := airspaceWarning{Name: a.Name, Category: a.Category, Inside: inside && vDist == 0, Bottom: a.Bottom.String(), Top: a.Top.String()}
+		if !inside {
+			w.Distance = hDist
+		}
+		warnings = append(warnings, w)
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].Inside != warnings[j].Inside {
+			return warnings[i].Inside
+		}
+		return warnings[i].Distance < warnings[j].Distance
+	})
+	return warnings
+}
+
+func updateAirspaceWarnings() {
+	warnings := make([]airspaceWarning, 0)
+	if globalSettings.AirspaceWarning_Enabled {
+		warnings = airspaceWarnings(getSituation())
+	}
+
+	current := make(map[string]bool)
+	for _, w := range warnings {
+		key := fmt.Sprintf("%s/%t", w.Name, w.Inside)
+		current[key] = true
+		if !airspaceWarned[key] {
+			if w.Inside {
+				logEvent(EVENT_AIRSPACE, EVENT_WARN, "Inside airspace", "name", w.Name, "category", w.Category)
+			} else {
+				logEvent(EVENT_AIRSPACE, EVENT_INFO, "Approaching airspace", "name", w.Name, "category", w.Category, "distance", int(w.Distance))
+			}
+		}
+	}
+	airspaceWarned = current
+
+	mySituation.muAirfield.Lock()
+	mySituation.AirspaceWarnings = warnings
+	mySituation.muAirfield.Unlock()
+}
+
+func airspaceMonitor() {
+	ticker := time.NewTicker(airspaceUpdateInterval)
+	for {
+		<-ticker.C
+		updateAirspaceWarnings()
+	}
+}
+
+// makePSTXAString creates the proprietary airspace warning sentence for the most relevant airspace,
+// "" if there is no warning:
+//
+//	$PSTXA,<Inside>,<Distance>,<Category>,<Name>,<Bottom>,<Top>*cs
+//
+//	Inside      1 if inside, 0 if approaching
+//	Distance    Horizontal distance to the boundary in m, 0 if inside
+//	Category    A-G, CTR, TMA, RESTRICTED, ... (openAIP categories)
+//	Name        Name of the airspace, commas removed
+//	Bottom/Top  Limits as on the chart, e.g. GND, 2500 ft, FL65
+func makePSTXAString() string {
+	s := getSituation()
+	if len(s.AirspaceWarnings) == 0 {
+		return ""
+	}
+	w := s.AirspaceWarnings[0]
+	inside := 0
+	if w.Inside {
+		inside = 1
+	}
+	clean := func(v string) string { return strings.NewReplacer(",", " ", "*", " ", "$", " ").Replace(v) }
+	msg := fmt.Sprintf("PSTXA,%d,%d,%s,%s,%s,%s", inside, int(w.Distance), clean(w.Category), clean(w.Name), w.Bottom, w.Top)
+
+	return makeNMEASentence(msg)
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	alarm_test.go: Traffic alarm levels (collision.go, alarmprofiles.go, airborne.go) with simulated
+		ownship and traffic, see simulation_test.go.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const alarmTestAddr = 0xABCDEF
+
+// newAlarmTestHarness flies east at 3000ft and 100kts, past the start-up until the GPS position is valid.
+func newAlarmTestHarness(t *testing.T) *simHarness {
+	h := newSimHarness(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	h.GPS = &fakeGPS{Lat: 48.0, Lng: 11.0, AltMSL: 3000, Track: 90, Speed: 100}
+	h.Run(20 * time.Second)
+	if !isGPSValid() {
+		t.Fatalf("no valid GPS position after start-up")
+	}
+	return h
+}
+
+// alarmLevelOf returns the alarm level of a target as sent in $PFLAA, false if it isn't in the traffic table.
+func alarmLevelOf(h *simHarness, addr uint32) (uint8, bool) {
+	ti, ok := h.Traffic()[addr]
+	if !ok {
+		return 0, false
+	}
+	_, valid, alarmLevel := makeFlarmPFLAAString(ti)
+	return alarmLevel, valid
+}
+
+// alarmLevels runs the simulation for n seconds and returns the alarm level of a target after each second.
+func alarmLevels(t *testing.T, h *simHarness, addr uint32, n int) []uint8 {
+	levels := make([]uint8, 0, n)
+	for i := 0; i < n; i++ {
+		h.Run(time.Second)
+		level, ok := alarmLevelOf(h, addr)
+		if !ok {
+			t.Fatalf("target %06X not in the traffic table after %ds", addr, i+1)
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// Head-on at the same altitude, closing at 220kts: no alarm far out, then 1, 2 and 3 as the time to impact shrinks.
+func TestAlarmHeadOnEscalates(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.06, Alt: 3000, Track: 270, Speed: 120})
+
+	levels := alarmLevels(t, h, alarmTestAddr, 25)
+	if levels[0] != 0 {
+		t.Errorf("alarm level %d at 4.4km, want 0 (levels %v)", levels[0], levels)
+	}
+	seen := make(map[uint8]bool)
+	for i, level := range levels {
+		if i > 0 && level < levels[i-1] {
+			t.Errorf("alarm level dropped from %d to %d while closing in after %ds (levels %v)", levels[i-1], level, i+1, levels)
+		}
+		seen[level] = true
+	}
+	for level := uint8(1); level <= 3; level++ {
+		if !seen[level] {
+			t.Errorf("alarm level %d never reached (levels %v)", level, levels)
+		}
+	}
+}
+
+// The same encounter with 1500ft vertical separation is traffic information only.
+func TestAlarmVerticalSeparation(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.06, Alt: 4500, Track: 270, Speed: 120})
+
+	for i, level := range alarmLevels(t, h, alarmTestAddr, 25) {
+		if level != 0 {
+			t.Fatalf("alarm level %d after %ds, want 0 with 1500ft separation", level, i+1)
+		}
+	}
+}
+
+// A faster target close behind us, flying away: no alarm.
+func TestAlarmDiverging(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.0, Alt: 3000, Track: 270, Speed: 150})
+	h.Run(3 * time.Second) // 0.6km behind us by now
+
+	for i, level := range alarmLevels(t, h, alarmTestAddr, 10) {
+		if level != 0 {
+			t.Fatalf("alarm level %d after %ds for a diverging target, want 0", level, i+1)
+		}
+	}
+}
+
+// On the ground, alarms are suppressed with GroundAlarmSuppress (the default), and only then.
+func TestAlarmSuppressedOnGround(t *testing.T) {
+	for _, suppress := range []bool{true, false} {
+		h := newAlarmTestHarness(t)
+		globalSettings.GroundAlarmSuppress = suppress
+		airborneState = AIRBORNE_GROUND
+		h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.03, Alt: 3000, Track: 270, Speed: 120})
+		h.Run(5 * time.Second)
+
+		level, ok := alarmLevelOf(h, alarmTestAddr)
+		if !ok {
+			t.Fatalf("target not in the traffic table")
+		}
+		if suppress && level != 0 {
+			t.Errorf("alarm level %d on the ground with GroundAlarmSuppress, want 0", level)
+		} else if !suppress && level == 0 {
+			t.Errorf("no alarm on the ground without GroundAlarmSuppress")
+		}
+	}
+}
+
+// Just after takeoff, alarms are capped at LowAlarmMaxLevel for TakeoffAlarmTime.
+func TestAlarmLimitedAfterTakeoff(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	globalSettings.TakeoffAlarmTime = 60
+	globalSettings.LowAlarmMaxLevel = 1
+	airborneState = AIRBORNE_FLYING
+	airborneTakeoffAt = stratuxClock.Time
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.03, Alt: 3000, Track: 270, Speed: 120})
+
+	levels := alarmLevels(t, h, alarmTestAddr, 10) // 1.1km left, 7s to impact
+	for i, level := range levels {
+		if level > 1 {
+			t.Fatalf("alarm level %d %ds after takeoff, want at most 1 (levels %v)", level, i+1, levels)
+		}
+	}
+	if levels[len(levels)-1] != 1 {
+		t.Errorf("alarm level %d 7s before impact, want the capped 1 (levels %v)", levels[len(levels)-1], levels)
+	}
+
+	// Once TakeoffAlarmTime has passed, the full level is back
+	airborneTakeoffAt = stratuxClock.Time.Add(-61 * time.Second)
+	if level, _ := alarmLevelOf(h, alarmTestAddr); level != 3 {
+		t.Errorf("alarm level %d after the takeoff phase, want 3", level)
+	}
+}
+
+// Without velocities, the alarm level falls back to distance rings around us.
+func TestAlarmLevelWithoutVelocity(t *testing.T) {
+	newAlarmTestHarness(t)
+	p := defaultAlarmProfile
+	ti := TrafficInfo{Position_valid: true} // Speed_valid false, no prediction possible
+	tests := []struct {
+		dist float64 // m
+		vert int32   // m
+		want uint8
+	}{
+		{200, 50, 3},   // Inside the protection volume
+		{800, 120, 3},  // Inside Level3Dist/Level3Vert
+		{1500, 250, 2}, // Inside Level2Dist/Level2Vert
+		{1500, 400, 0}, // Too far above
+		{3000, 0, 0},   // Too far away
+	}
+	for _, test := range tests {
+		if got := collisionAlarmLevel(p, ti, test.dist, test.dist, 0, test.vert); got != test.want {
+			t.Errorf("collisionAlarmLevel(dist %.0fm, vert %dm) = %d, want %d", test.dist, test.vert, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	alarmprofiles.go: Alarm thresholds used by the FLARM threat evaluation (see collision.go).
+		The user picks a preset that fits the flying (globalSettings.AlarmPreset): thermalling
+		with other gliders needs tight volumes, in the traffic pattern the default rings alarm
+		on every aircraft in the circuit, en route they are too tight for the closure rates.
+		ALARM_PRESET_CUSTOM uses globalSettings.AlarmCustom.
+		A secondary, relaxed profile is applied to a single target that is bound to us,
+		e.g. the glider on tow behind a towplane. The target is either configured
+		(TowTargetId) or detected automatically as the aircraft that took off with us.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of globalSettings.AlarmPreset
+const (
+	ALARM_PRESET_STANDARD = "standard"
+	ALARM_PRESET_GLIDER   = "glider"
+	ALARM_PRESET_CRUISE   = "cruise"
+	ALARM_PRESET_PATTERN  = "pattern"
+	ALARM_PRESET_CUSTOM   = "custom"
+)
+
+type alarmProfile struct {
+	CPARadius  float64 // meters, protection volume for the collision prediction
+	CPAVert    float64 // meters
+	Lookahead  float64 // seconds, level 1 alarm if the protection volume is entered within
+	Level2Tau  float64 // seconds
+	Level3Tau  float64 // seconds
+	Level3Dist float64 // meters, distance rings for targets without velocity
+	Level3Vert float64 // meters
+	Level2Dist float64 // meters
+	Level2Vert float64 // meters
+}
+
+var defaultAlarmProfile = alarmProfile{
+	CPARadius:  300,
+	CPAVert:    100, // ~330'
+	Lookahead:  18,
+	Level2Tau:  12,
+	Level3Tau:  8,
+	Level3Dist: 926,  // 0.5 NM
+	Level3Vert: 152,  // 500'
+	Level2Dist: 1852, // 1.0 NM
+	Level2Vert: 304,  // 1000'
+}
+
+var alarmPresets = map[string]alarmProfile{
+	ALARM_PRESET_STANDARD: defaultAlarmProfile,
+	// Gliders fly close to each other in thermals and ridge lift, at low closure rates
+	ALARM_PRESET_GLIDER: {
+		CPARadius:  150,
+		CPAVert:    60,
+		Lookahead:  18,
+		Level2Tau:  12,
+		Level3Tau:  8,
+		Level3Dist: 463, // 0.25 NM
+		Level3Vert: 91,  // 300'
+		Level2Dist: 926, // 0.5 NM
+		Level2Vert: 152, // 500'
+	},
+	// En route: high closure rates, warn early
+	ALARM_PRESET_CRUISE: {
+		CPARadius:  500,
+		CPAVert:    150, // ~500'
+		Lookahead:  30,
+		Level2Tau:  20,
+		Level3Tau:  12,
+		Level3Dist: 1852, // 1.0 NM
+		Level3Vert: 213,  // 700'
+		Level2Dist: 3704, // 2.0 NM
+		Level2Vert: 335,  // 1100'
+	},
+	// Traffic pattern: everybody is close and slow, only warn about real conflicts
+	ALARM_PRESET_PATTERN: {
+		CPARadius:  150,
+		CPAVert:    60,
+		Lookahead:  15,
+		Level2Tau:  10,
+		Level3Tau:  6,
+		Level3Dist: 370, // 0.2 NM
+		Level3Vert: 91,  // 300'
+		Level2Dist: 741, // 0.4 NM
+		Level2Vert: 152, // 500'
+	},
+}
+
+// Towing: the glider is 30-60m behind us on the rope. Only warn if it gets much closer than that.
+var towAlarmProfile = alarmProfile{
+	CPARadius:  15,
+	CPAVert:    10,
+	Lookahead:  18,
+	Level2Tau:  12,
+	Level3Tau:  8,
+	Level3Dist: 20,
+	Level3Vert: 10,
+	Level2Dist: 30,
+	Level2Vert: 15,
+}
+
+// Automatically detected tow target address, 0 if none
+var towTargetAuto uint32
+
+func (p alarmProfile) alarmLevel(dist float64, relativeVertical int32) uint8 {
+	vert := math.Abs(float64(relativeVertical))
+	if dist < p.Level3Dist && vert < p.Level3Vert {
+		return 3
+	} else if dist < p.Level2Dist && vert < p.Level2Vert {
+		return 2
+	}
+	return 0
+}
+
+// towTarget returns the address of the target that gets the towing profile, if any.
+func towTarget() (uint32, bool) {
+	if len(globalSettings.TowTargetId) > 0 {
+		addr, err := strconv.ParseUint(globalSettings.TowTargetId, 16, 32)
+		if err == nil {
+			return uint32(addr), true
+		}
+	}
+	if towTargetAuto != 0 {
+		return towTargetAuto, true
+	}
+	return 0, false
+}
+
+// validAlarmProfile checks a user defined profile. The alarm times must be ordered, and the volumes not empty.
+func validAlarmProfile(p alarmProfile) bool {
+	return p.CPARadius > 0 && p.CPAVert > 0 && p.Level3Tau > 0 && p.Level3Tau <= p.Level2Tau && p.Level2Tau <= p.Lookahead &&
+		p.Lookahead <= 60 && p.Level3Dist > 0 && p.Level3Dist <= p.Level2Dist && p.Level3Vert > 0 && p.Level3Vert <= p.Level2Vert
+}
+
+// selectedAlarmProfile returns the profile of globalSettings.AlarmPreset.
+func selectedAlarmProfile() alarmProfile {
+	if globalSettings.AlarmPreset == ALARM_PRESET_CUSTOM {
+		if validAlarmProfile(globalSettings.AlarmCustom) {
+			return globalSettings.AlarmCustom
+		}
+	} else if p, ok := alarmPresets[globalSettings.AlarmPreset]; ok {
+		return p
+	}
+	return defaultAlarmProfile
+}
+
+func alarmProfileFor(ti TrafficInfo) alarmProfile {
+	if addr, ok := towTarget(); ok && (ti.Icao_addr&0xFFFFFF) == addr {
+		return towAlarmProfile
+	}
+	return selectedAlarmProfile()
+}
+
+// findTowCandidate returns the closest target that is moving along with us right after takeoff.
+func findTowCandidate() (uint32, bool) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	var best uint32
+	bestDist := 200.0 // meters
+	for _, ti := range traffic {
+		if !ti.Position_valid || !ti.Speed_valid || ti.Age > 3 {
+			continue
+		}
+		if math.Abs(float64(ti.Speed)-mySituation.GPSGroundSpeed) > 20 {
+			continue
+		}
+		dist, _, _, _ := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+		if dist < bestDist {
+			bestDist = dist
+			best = ti.Icao_addr & 0xFFFFFF
+		}
+	}
+	return best, best != 0
+}
+
+func towTargetDistance(addr uint32) (float64, bool) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	for _, ti := range traffic {
+		if (ti.Icao_addr&0xFFFFFF) == addr && ti.Position_valid && ti.Age < 30 {
+			dist, _, _, _ := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+			return dist, true
+		}
+	}
+	return 0, false
+}
+
+// towDetector binds the aircraft that departs with us as tow target and releases it once we separate.
+func towDetector() {
+	ticker := time.NewTicker(1 * time.Second)
+	onGround := true
+	var groundSince time.Time
+	for {
+		<-ticker.C
+		if !globalSettings.TowAutoDetect || !isGPSValid() {
+			towTargetAuto = 0
+			globalStatus.TowTarget = strings.ToUpper(globalSettings.TowTargetId)
+			continue
+		}
+
+		speed := mySituation.GPSGroundSpeed
+		if onGround && speed > 40 {
+			onGround = false
+			if addr, ok := findTowCandidate(); ok {
+				log.Printf("Takeoff detected, %X departed with us. Using towing alarm profile for it.\n", addr)
+				towTargetAuto = addr
+			}
+		} else if !onGround && speed < 20 {
+			onGround = true
+			groundSince = stratuxClock.Time
+		}
+
+		if towTargetAuto != 0 {
+			dist, ok := towTargetDistance(towTargetAuto)
+			landed := onGround && stratuxClock.Since(groundSince) > 60*time.Second
+			if !ok || dist > 1000 || landed {
+				log.Printf("Tow target %X released\n", towTargetAuto)
+				towTargetAuto = 0
+			}
+		}
+
+		if addr, ok := towTarget(); ok {
+			globalStatus.TowTarget = fmt.Sprintf("%06X", addr)
+		} else {
+			globalStatus.TowTarget = ""
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	altencoder.go: Serial altitude encoder output, so a transponder in an experimental aircraft can
+		use our pressure altitude instead of a separate blind encoder. Sent on
+		globalSettings.AltEncoder_Device every altEncoderInterval in one of the common formats:
+		  ALT_ENCODER_ICARUS    "ALT 01200\r"                 Icarus/Garmin, also accepted by Trig
+		  ALT_ENCODER_TRANSCAL  "#AL +01200T+25D2\r"          Trans-Cal, with temperature and checksum
+		Pressure altitude (29.92 inHg) in feet. Only a measured pressure is sent: the ADS-B based guess
+		and GPS altitude never are. Without a fresh measurement nothing is sent, so the transponder
+		reports no altitude instead of a stale one - the same as a failed encoder.
+		Whether the installation is legal to use is up to the owner, this is not a certified encoder.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	ALT_ENCODER_ICARUS   = 0
+	ALT_ENCODER_TRANSCAL = 1
+)
+
+const (
+	altEncoderInterval   = 500 * time.Millisecond
+	altEncoderMaxAge     = 2 * time.Second // Baro measurements older than this aren't sent
+	altEncoderRetryDelay = 10 * time.Second
+)
+
+var altEncoderBaudrates = []int{1200, 2400, 4800, 9600, 19200}
+
+func isValidAltEncoderBaud(baud int) bool {
+	for _, b := range altEncoderBaudrates {
+		if b == baud {
+			return true
+		}
+	}
+	return false
+}
+
+// altEncoderAltitude returns the pressure altitude in feet, ok = false if there is no fresh measured one.
+func altEncoderAltitude() (int, float32, bool) {
+	if isDegraded(DEGRADED_NO_BARO) {
+		return 0, 0, false
+	}
+	mySituation.muBaro.Lock()
+	defer mySituation.muBaro.Unlock()
+	if mySituation.BaroSourceType == BARO_TYPE_NONE || mySituation.BaroSourceType == BARO_TYPE_ADSBESTIMATE ||
+		stratuxClock.Since(mySituation.BaroLastMeasurementTime) > altEncoderMaxAge {
+		return 0, 0, false
+	}
+	return int(math.Round(float64(mySituation.BaroPressureAltitude))), mySituation.BaroTemperature, true
+}
+
+// makeAltEncoderString returns the encoder message for an altitude in feet and temperature in °C.
+func makeAltEncoderString(format int, alt int, temp float32) string {
+	switch format {
+	case ALT_ENCODER_TRANSCAL:
+		t := int(math.Round(float64(temp)))
+		if t > 99 {
+			t = 99
+		} else if t < -99 {
+			t = -99
+		}
+		msg := fmt.Sprintf("#AL %+06dT%+03d", alt, t)
+		var checksum byte
+		for i := range msg {
+			checksum += msg[i]
+		}
+		return fmt.Sprintf("%s%02X\r", msg, checksum)
+	}
+	return fmt.Sprintf("ALT %05d\r", alt)
+}
+
+// altEncoderOutput sends our altitude to the configured serial port and follows changes of the settings.
+func altEncoderOutput() {
+	var port *serial.Port
+	var device string
+	var baud int
+	ticker := time.NewTicker(altEncoderInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if port != nil && (device != globalSettings.AltEncoder_Device || baud != globalSettings.AltEncoder_Baud) {
+			port.Close()
+			port = nil
+			log.Printf("Altitude encoder output on %s closed\n", device)
+		}
+		if len(globalSettings.AltEncoder_Device) == 0 {
+			continue
+		}
+		if port == nil {
+			device, baud = globalSettings.AltEncoder_Device, globalSettings.AltEncoder_Baud
+			p, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud})
+			if err != nil {
+				addSingleSystemErrorf("alt-encoder", "Altitude encoder output: can't open %s: %s", device, err.Error())
+				time.Sleep(altEncoderRetryDelay)
+				continue
+			}
+			log.Printf("Altitude encoder output on %s, %d baud\n", device, baud)
+			port = p
+		}
+		alt, temp, ok := altEncoderAltitude()
+		if !ok {
+			continue
+		}
+		if _, err := port.Write([]byte(makeAltEncoderString(globalSettings.AltEncoder_Format, alt, temp))); err != nil {
+			log.Printf("Altitude encoder output on %s: %s\n", device, err.Error())
+			port.Close()
+			port = nil
+		}
+	}
+}
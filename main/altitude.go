@@ -0,0 +1,237 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	altitude.go: Central arbitration of the ownship altitude source.
+		All pressure altitude providers (internal baro sensor, OGN tracker, external
+		FLARM/SoftRF/encoder via $PGRMZ or LX device via $LXWP0, ADS-B based estimation)
+		report here. The arbiter picks the best healthy source (or the one forced by the
+		AltitudeSource setting) and publishes it in mySituation. Where external NMEA baro
+		ranks in automatic mode is set by NMEABaroPriority. Output paths use ownshipAltitude() to get the
+		altitude they should compare traffic against.
+*/
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Values for globalSettings.AltitudeSource
+const (
+	ALT_SOURCE_AUTO          = 0 // Best available source
+	ALT_SOURCE_INTERNAL_BARO = 1 // Only use the internal pressure sensor
+	ALT_SOURCE_EXTERNAL_BARO = 2 // Only use external pressure altitude (OGN tracker, FLARM, encoder)
+	ALT_SOURCE_GPS           = 3 // Ignore all pressure sources and use GPS altitude
+)
+
+// Values for globalSettings.NMEABaroPriority
+const (
+	NMEA_BARO_PRIORITY_LOW     = 0 // After internal sensor and OGN tracker
+	NMEA_BARO_PRIORITY_MEDIUM  = 1 // Before OGN tracker
+	NMEA_BARO_PRIORITY_HIGHEST = 2 // Before internal sensor, e.g. a calibrated LX vario
+)
+
+// baroSourcePriority returns the auto mode priority, best first
+func baroSourcePriority() []uint8 {
+	switch globalSettings.NMEABaroPriority {
+	case NMEA_BARO_PRIORITY_MEDIUM:
+		return []uint8{BARO_TYPE_BMP280, BARO_TYPE_NMEA, BARO_TYPE_OGNTRACKER, BARO_TYPE_ADSBESTIMATE}
+	case NMEA_BARO_PRIORITY_HIGHEST:
+		return []uint8{BARO_TYPE_NMEA, BARO_TYPE_BMP280, BARO_TYPE_OGNTRACKER, BARO_TYPE_ADSBESTIMATE}
+	}
+	return []uint8{BARO_TYPE_BMP280, BARO_TYPE_OGNTRACKER, BARO_TYPE_NMEA, BARO_TYPE_ADSBESTIMATE}
+}
+
+/*
+parseNMEABaro takes the pressure altitude from an external device (split sentence without $ and checksum):
+
+$PGRMZ,<Alt>,<Unit>,<Fix>                Alt in feet (f) or meters (m), SoftRF and FLARM
+$LXWP0,<Logger>,<IAS>,<Alt>,<Vario>,...  Alt in meters, vario in m/s, LX devices. IAS in km/h, for the wind estimate
+*/
+func parseNMEABaro(x []string) bool {
+	switch x[0] {
+	case "PGRMZ":
+		// $PGRMZ,1089,f,3*2B
+		if len(x) < 3 {
+			return false
+		}
+		pressureAlt, err := strconv.ParseFloat(x[1], 32)
+		if err != nil {
+			return false
+		}
+		if x[2] == "m" {
+			pressureAlt *= 3.28084
+		}
+		updateBaroSource(BARO_TYPE_NMEA, float32(pressureAlt), 0, false)
+		return true
+	case "LXWP0":
+		// $LXWP0,Y,222.3,1665.5,1.71,,,,,,239,174,10.1*
+		if len(x) < 5 {
+			return false
+		}
+		pressureAlt, err := strconv.ParseFloat(x[3], 32)
+		if err != nil {
+			return false
+		}
+		if vario, err := strconv.ParseFloat(x[4], 32); err == nil {
+			updateBaroSource(BARO_TYPE_NMEA, float32(pressureAlt*3.28084), float32(vario*196.85), true)
+		} else {
+			updateBaroSource(BARO_TYPE_NMEA, float32(pressureAlt*3.28084), 0, false)
+		}
+		if ias, err := strconv.ParseFloat(x[2], 32); err == nil && ias > 0 {
+			// TAS from IAS with the ISA density at pressure altitude, good enough without OAT
+			sigma := math.Pow(1-pressureAlt/44330.77, 4.25588)
+			updateTAS(ias / 1.852 / math.Sqrt(sigma))
+		}
+		return true
+	}
+	return false
+}
+
+type baroReading struct {
+	Alt              float32 // feet
+	VerticalSpeed    float32 // ft/min
+	HasVerticalSpeed bool
+	Last             time.Time // stratuxClock
+}
+
+var baroReadings = make(map[uint8]baroReading)
+
+// updateBaroSource is called by pressure altitude providers for each new measurement.
+// If the source doesn't provide a vertical speed, it is derived from consecutive altitudes.
+func updateBaroSource(sourceType uint8, alt float32, verticalSpeed float32, hasVerticalSpeed bool) {
+	mySituation.muBaro.Lock()
+	defer mySituation.muBaro.Unlock()
+	if !hasVerticalSpeed {
+		verticalSpeed, hasVerticalSpeed = deriveVerticalSpeed(baroReadings[sourceType], alt)
+	}
+	baroReadings[sourceType] = baroReading{alt, verticalSpeed, hasVerticalSpeed, stratuxClock.Time}
+	selectBaroSource()
+}
+
+// deriveVerticalSpeed computes ft/min from the previous reading, smoothed with the same 5 sec decay as the BMP280 VSI.
+func deriveVerticalSpeed(prev baroReading, alt float32) (float32, bool) {
+	dt := float32(stratuxClock.Since(prev.Last).Seconds())
+	if prev.Last.IsZero() || dt <= 0 || dt > 5 {
+		return 0, false
+	}
+	u := 5 / (5 + dt)
+	vs := (alt - prev.Alt) / (dt / 60)
+	if prev.HasVerticalSpeed {
+		vs = u*prev.VerticalSpeed + (1-u)*vs
+	}
+	return vs, true
+}
+
+// isBaroReadingHealthy checks age and plausibility of a reading.
+func isBaroReadingHealthy(sourceType uint8, r baroReading) bool {
+	if stratuxClock.Since(r.Last) > 15*time.Second {
+		return false
+	}
+	if r.Alt < -2000 || r.Alt > 60000 {
+		return false
+	}
+	// A real pressure altitude won't be off by more than a few thousand feet from GPS altitude.
+	if sourceType != BARO_TYPE_ADSBESTIMATE && isGPSValid() && math.Abs(float64(r.Alt-mySituation.GPSAltitudeMSL)) > 5000 {
+		return false
+	}
+	return true
+}
+
+func baroSourceAllowed(sourceType uint8) bool {
+	switch globalSettings.AltitudeSource {
+	case ALT_SOURCE_INTERNAL_BARO:
+		return sourceType == BARO_TYPE_BMP280
+	case ALT_SOURCE_EXTERNAL_BARO:
+		return sourceType == BARO_TYPE_OGNTRACKER || sourceType == BARO_TYPE_NMEA
+	case ALT_SOURCE_GPS:
+		return false
+	}
+	return true
+}
+
+// selectBaroSource publishes the best baro reading to mySituation. Must be called with muBaro held.
+func selectBaroSource() {
+	for _, sourceType := range baroSourcePriority() {
+		r, ok := baroReadings[sourceType]
+		if !ok || !baroSourceAllowed(sourceType) || !isBaroReadingHealthy(sourceType, r) {
+			continue
+		}
+		mySituation.BaroPressureAltitude = r.Alt
+		mySituation.BaroIndicatedAltitude = indicatedAltitude(r.Alt)
+		if r.HasVerticalSpeed {
+			mySituation.BaroVerticalSpeed = r.VerticalSpeed
+		} else {
+			mySituation.BaroVerticalSpeed = 0
+		}
+		mySituation.BaroLastMeasurementTime = r.Last
+		mySituation.BaroSourceType = sourceType
+		return
+	}
+	// Nothing usable (or GPS forced). Invalidate immediately so consumers fall back to GPS.
+	mySituation.BaroLastMeasurementTime = time.Time{}
+	mySituation.BaroSourceType = BARO_TYPE_NONE
+}
+
+func altitudeSourceName() string {
+	if isTempPressValid() {
+		switch mySituation.BaroSourceType {
+		case BARO_TYPE_BMP280:
+			return "Baro sensor"
+		case BARO_TYPE_OGNTRACKER:
+			return "OGN Tracker"
+		case BARO_TYPE_NMEA:
+			return "External (PGRMZ/LXWP0)"
+		case BARO_TYPE_ADSBESTIMATE:
+			return "ADS-B estimate"
+		}
+	}
+	if isGPSValid() {
+		return "GPS"
+	}
+	return "None"
+}
+
+// indicatedAltitude converts pressure altitude to what the altimeter shows with the configured QNH.
+func indicatedAltitude(pressAlt float32) float32 {
+	qnh := globalSettings.QNH
+	if qnh < 900 || qnh > 1100 {
+		return pressAlt
+	}
+	return float32(CalcIndicatedAltitude(float64(pressAlt), qnh))
+}
+
+/*
+ownshipAltitude returns the altitude traffic should be compared against.
+isBaro is true if it is pressure altitude, false if it's GPS MSL altitude.
+After losing the baro sensor (DEGRADED_NO_BARO) this is GPS altitude, not the ADS-B based estimate.
+*/
+func ownshipAltitude() (alt float32, isBaro bool, valid bool) {
+	if isTempPressValid() && !isDegraded(DEGRADED_NO_BARO) {
+		return mySituation.BaroPressureAltitude, true, true
+	}
+	if isGPSValid() {
+		return mySituation.GPSAltitudeMSL, false, true
+	}
+	return 0, false, false
+}
+
+// altitudeArbiter re-evaluates the selection periodically, so a source that stops reporting is replaced.
+func altitudeArbiter() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		mySituation.muBaro.Lock()
+		selectBaroSource()
+		mySituation.muBaro.Unlock()
+		if source := altitudeSourceName(); source != globalStatus.AltitudeSource {
+			logEvent(EVENT_BARO, EVENT_INFO, "Altitude source changed", "from", globalStatus.AltitudeSource, "to", source)
+			globalStatus.AltitudeSource = source
+		}
+	}
+}
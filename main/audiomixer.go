@@ -0,0 +1,302 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	audiomixer.go: Audio output of the Stratux itself (headset adapter on the audio jack, USB
+		sound card or a Bluetooth headset), for pilots who don't want to look at the EFB.
+		Sounds come from several channels, mixed into one stream that is piped to aplay:
+		- AUDIO_CHANNEL_ALARM:   alarm tones (traffic alarm, descent alert, low battery)
+		- AUDIO_CHANNEL_CALLOUT: spoken callouts (espeak-ng, in the selected locale)
+		- AUDIO_CHANNEL_VARIO:   vario tone from the baro climb rate
+		A channel with higher priority ducks all channels below it while it plays: the vario
+		is muted completely, callouts are attenuated to audioDuckGain. Every channel has its own
+		volume setting.
+		Bluetooth: with AudioBluetoothSink set to the MAC of a paired A2DP headset, the output
+		goes to bluealsa instead of AudioDevice.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channels, in order of priority
+const (
+	AUDIO_CHANNEL_VARIO = iota
+	AUDIO_CHANNEL_CALLOUT
+	AUDIO_CHANNEL_ALARM
+	audioChannels
+)
+
+const (
+	audioSampleRate    = 22050                // espeak-ng's native rate, so speech needs no resampling
+	audioBlockSamples  = audioSampleRate / 50 // 20ms
+	audioDuckGain      = 0.15
+	audioRestartDelay  = 5 * time.Second
+	audioCalloutRepeat = 20 * time.Second // Per target, unless the alarm level rises
+	audioVarioMinClimb = 0.2              // m/s, beeping above
+	audioVarioMaxSink  = -1.5             // m/s, continuous sink tone below
+	audioVarioMaxRate  = 5.0              // m/s, clamped
+)
+
+type audioClip struct {
+	samples []float64 // -1..1
+	pos     int
+}
+
+var audioMutex = &sync.Mutex{}
+var audioQueues [audioChannels][]*audioClip
+var audioVarioClimb float64 // m/s
+var audioVarioPhase, audioVarioBeepPhase float64
+
+type audioCalloutState struct {
+	time  time.Time
+	level uint8
+}
+
+var audioCallouts = make(map[uint32]audioCalloutState) // by traffic key, only accessed by audioTrafficAlert()
+
+func audioVolume(channel int) float64 {
+	v := 0
+	switch channel {
+	case AUDIO_CHANNEL_VARIO:
+		v = globalSettings.AudioVolumeVario
+	case AUDIO_CHANNEL_CALLOUT:
+		v = globalSettings.AudioVolumeCallout
+	case AUDIO_CHANNEL_ALARM:
+		v = globalSettings.AudioVolumeAlarm
+	}
+	return math.Max(0, math.Min(100, float64(v))) / 100
+}
+
+// audioOutputDevice returns the ALSA device for aplay.
+func audioOutputDevice() string {
+	if len(globalSettings.AudioBluetoothSink) > 0 {
+		return fmt.Sprintf("bluealsa:DEV=%s,PROFILE=a2dp", strings.ToUpper(globalSettings.AudioBluetoothSink))
+	}
+	if len(globalSettings.AudioDevice) > 0 {
+		return globalSettings.AudioDevice
+	}
+	return "default"
+}
+
+func audioQueue(channel int, samples []float64) {
+	if !globalSettings.Audio_Enabled || len(samples) == 0 {
+		return
+	}
+	audioMutex.Lock()
+	audioQueues[channel] = append(audioQueues[channel], &audioClip{samples: samples})
+	audioMutex.Unlock()
+}
+
+// audioTone returns a sine tone with short fades, so it doesn't click.
+func audioTone(freq float64, duration time.Duration) []float64 {
+	n := int(duration.Seconds() * audioSampleRate)
+	fade := audioSampleRate / 200 // 5ms
+	samples := make([]float64, n)
+	for i := range samples {
+		gain := 1.0
+		if i < fade {
+			gain = float64(i) / float64(fade)
+		} else if n-i < fade {
+			gain = float64(n-i) / float64(fade)
+		}
+		samples[i] = gain * math.Sin(2*math.Pi*freq*float64(i)/audioSampleRate)
+	}
+	return samples
+}
+
+// audioBeeps queues count beeps on a channel.
+func audioBeeps(channel int, freq float64, count int) {
+	var samples []float64
+	for i := 0; i < count; i++ {
+		samples = append(samples, audioTone(freq, 150*time.Millisecond)...)
+		samples = append(samples, make([]float64, audioSampleRate/10)...)
+	}
+	audioQueue(channel, samples)
+}
+
+// audioSpeak renders text with espeak-ng and queues it on a channel. Runs in the background.
+func audioSpeak(channel int, text string) {
+	if !globalSettings.Audio_Enabled {
+		return
+	}
+	go func() {
+		out, err := exec.Command("espeak-ng", "--stdout", "-v", globalSettings.Locale, text).Output()
+		if err != nil {
+			log.Printf("espeak-ng: %s\n", err.Error())
+			return
+		}
+		audioQueue(channel, wavSamples(out))
+	}()
+}
+
+// wavSamples returns the samples of a 16 bit mono WAV file as written by espeak-ng.
+func wavSamples(wav []byte) []float64 {
+	i := bytes.Index(wav, []byte("data"))
+	if i < 0 || len(wav) < i+8 {
+		return nil
+	}
+	data := wav[i+8:]
+	samples := make([]float64, len(data)/2)
+	for j := range samples {
+		samples[j] = float64(int16(binary.LittleEndian.Uint16(data[2*j:]))) / 32768
+	}
+	return samples
+}
+
+// audioVarioSample returns the next sample of the vario tone: beeps rising in pitch and rate when climbing, a low tone when sinking.
+func audioVarioSample() float64 {
+	climb := math.Max(-audioVarioMaxRate, math.Min(audioVarioMaxRate, audioVarioClimb))
+	var freq float64
+	on := false
+	if climb >= audioVarioMinClimb {
+		freq = 600 + 120*climb
+		beepRate := 1.5 + climb // beeps per second
+		audioVarioBeepPhase = math.Mod(audioVarioBeepPhase+beepRate/audioSampleRate, 1)
+		on = audioVarioBeepPhase < 0.5
+	} else if climb <= audioVarioMaxSink {
+		freq = 400 + 40*climb
+		on = true
+	}
+	if !on {
+		return 0
+	}
+	audioVarioPhase = math.Mod(audioVarioPhase+freq/audioSampleRate, 1)
+	return math.Sin(2 * math.Pi * audioVarioPhase)
+}
+
+// audioMixBlock renders the next block of the output. Must be called with audioMutex held.
+func audioMixBlock(block []int16) {
+	active := [audioChannels]bool{}
+	for c := 0; c < audioChannels; c++ {
+		active[c] = len(audioQueues[c]) > 0
+	}
+	active[AUDIO_CHANNEL_VARIO] = globalSettings.AudioVario_Enabled && isTempPressValid()
+	top := -1
+	for c := audioChannels - 1; c >= 0; c-- {
+		if active[c] {
+			top = c
+			break
+		}
+	}
+	var gains [audioChannels]float64
+	for c := 0; c < audioChannels; c++ {
+		gains[c] = audioVolume(c)
+		if c < top {
+			if c == AUDIO_CHANNEL_VARIO {
+				gains[c] = 0
+			} else {
+				gains[c] *= audioDuckGain
+			}
+		}
+	}
+
+	for i := range block {
+		var v float64
+		if active[AUDIO_CHANNEL_VARIO] {
+			v += gains[AUDIO_CHANNEL_VARIO] * audioVarioSample()
+		}
+		for c := AUDIO_CHANNEL_CALLOUT; c < audioChannels; c++ {
+			if len(audioQueues[c]) == 0 {
+				continue
+			}
+			clip := audioQueues[c][0]
+			v += gains[c] * clip.samples[clip.pos]
+			clip.pos++
+			if clip.pos >= len(clip.samples) {
+				audioQueues[c] = audioQueues[c][1:]
+			}
+		}
+		block[i] = int16(math.Max(-1, math.Min(1, v)) * 32767)
+	}
+}
+
+// audioPlayer runs aplay and feeds it until it fails (e.g. Bluetooth headset disconnected).
+func audioPlayer(device string) error {
+	cmd := exec.Command("aplay", "-q", "-D", device, "-t", "raw", "-f", "S16_LE", "-r", fmt.Sprint(audioSampleRate), "-c", "1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	block := make([]int16, audioBlockSamples)
+	buf := new(bytes.Buffer)
+	for globalSettings.Audio_Enabled && audioOutputDevice() == device {
+		audioMutex.Lock()
+		audioVarioClimb = float64(mySituation.BaroVerticalSpeed) * 0.3048 / 60
+		audioMixBlock(block)
+		audioMutex.Unlock()
+		buf.Reset()
+		binary.Write(buf, binary.LittleEndian, block)
+		if _, err := io.Copy(stdin, buf); err != nil {
+			return err // aplay blocks while the device plays, that paces us
+		}
+	}
+	return nil
+}
+
+func audioMixer() {
+	for {
+		if !globalSettings.Audio_Enabled {
+			audioMutex.Lock()
+			for c := range audioQueues {
+				audioQueues[c] = nil
+			}
+			audioMutex.Unlock()
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		device := audioOutputDevice()
+		if err := audioPlayer(device); err != nil {
+			log.Printf("Audio output on %s failed: %s\n", device, err.Error())
+			time.Sleep(audioRestartDelay)
+		}
+	}
+}
+
+// audioTrafficAlert is called with the most threatening target of each traffic cycle.
+func audioTrafficAlert(ti TrafficInfo, alarmLevel uint8) {
+	if !globalSettings.Audio_Enabled || alarmLevel == 0 || lowAltitudeAlarmPhase() {
+		return
+	}
+	key := trafficInfoKey(ti)
+	last, ok := audioCallouts[key]
+	if ok && alarmLevel <= last.level && stratuxClock.Since(last.time) < audioCalloutRepeat {
+		return
+	}
+	audioCallouts[key] = audioCalloutState{time: stratuxClock.Time, level: alarmLevel}
+	for k, s := range audioCallouts {
+		if stratuxClock.Since(s.time) > audioCalloutRepeat {
+			delete(audioCallouts, k)
+		}
+	}
+
+	audioBeeps(AUDIO_CHANNEL_ALARM, 1000, int(alarmLevel))
+	ownAlt, _, altValid := ownshipAltitude()
+	altValid = altValid && ti.Alt != 0
+	audioSpeak(AUDIO_CHANNEL_CALLOUT, trafficCallout(ti, alarmLevel, ti.Alt-int32(ownAlt), altValid, mySituation.GPSTrueCourse))
+}
+
+// audioAlert sounds a non-traffic alert: alarm tone, then the phrase.
+func audioAlert(phraseID string) {
+	audioBeeps(AUDIO_CHANNEL_ALARM, 800, 2)
+	audioSpeak(AUDIO_CHANNEL_CALLOUT, phrase(phraseID))
+}
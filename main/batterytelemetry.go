@@ -0,0 +1,251 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	batterytelemetry.go: Telemetry of smart battery boxes that power a portable Stratux. Sources
+		are pluggable (batteryTelemetrySources), the first one that delivers data is used:
+		- Serial: a battery box on /dev/battery0 (udev symlink) sending
+		  $PBATT,<pack V>,<temp °C>,<cell 1 V>,...,<cell n V>*CS once per second. Empty fields
+		  are allowed for values the box doesn't know.
+		- I2C: an SBS smart battery (fuel gauge at 0x0B), as used in many USB power banks with
+		  a maintenance header.
+		Values appear in globalStatus.Battery. A low pack voltage, a weak cell or an overheated
+		pack raise globalStatus.Battery.Low, which the web UI shows as an alert.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	batteryTelemetryDevice  = "/dev/battery0"
+	batteryTelemetryBaud    = 9600
+	batteryTelemetryTimeout = 10 * time.Second // Values older than this are dropped
+	batteryLowCellVoltage   = 3.4              // V
+	batteryMaxTemp          = 60.0             // °C
+	sbsBatteryAddr          = 0x0B
+	sbsRegTemperature       = 0x08 // 0.1 K
+	sbsRegVoltage           = 0x09 // mV
+	sbsRegRelativeCharge    = 0x0D // %
+	sbsRegCellVoltage1      = 0x3F // mV, cells 1-4 are 0x3F downwards (bq20z/bq40z)
+)
+
+type batteryStatus struct {
+	Source    string    // Source that delivered the values, "" = no telemetry
+	Voltage   float64   // V, pack
+	Cells     []float64 // V, per cell if known
+	Temp      float64   // °C, only if TempValid
+	TempValid bool
+	Charge    int    // %, -1 = unknown
+	Low       bool   // Low battery alert
+	Reason    string // Why Low is set
+	updated   time.Time
+}
+
+// A batteryTelemetrySource delivers battery values. poll() is called every second, and returns false if the source isn't available.
+type batteryTelemetrySource interface {
+	name() string
+	poll() (batteryStatus, bool)
+}
+
+var batteryTelemetrySources = []batteryTelemetrySource{
+	&serialBatteryTelemetry{},
+	&sbsBatteryTelemetry{},
+}
+
+// parsePBATT parses a $PBATT sentence. The checksum is optional.
+func parsePBATT(line string) (batteryStatus, error) {
+	st := batteryStatus{Charge: -1}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$PBATT,") {
+		return st, errors.New("not a $PBATT sentence")
+	}
+	if strings.Contains(line, "*") {
+		stripped, ok := validateNMEAChecksum(line)
+		if !ok {
+			return st, errors.New(stripped)
+		}
+		line = stripped
+	}
+	x := strings.Split(line, ",")
+	if len(x) < 2 {
+		return st, errors.New("too short")
+	}
+	var err error
+	if st.Voltage, err = strconv.ParseFloat(x[1], 64); err != nil {
+		return st, fmt.Errorf("pack voltage: %s", err.Error())
+	}
+	if len(x) > 2 && len(x[2]) > 0 {
+		if st.Temp, err = strconv.ParseFloat(x[2], 64); err != nil {
+			return st, fmt.Errorf("temperature: %s", err.Error())
+		}
+		st.TempValid = true
+	}
+	if len(x) > 3 {
+		for _, c := range x[3:] {
+			if len(c) == 0 {
+				continue // Cell the box doesn't know
+			}
+			v, err := strconv.ParseFloat(c, 64)
+			if err != nil {
+				return st, fmt.Errorf("cell voltage: %s", err.Error())
+			}
+			st.Cells = append(st.Cells, v)
+		}
+	}
+	return st, nil
+}
+
+// serialBatteryTelemetry reads $PBATT from batteryTelemetryDevice in its own goroutine.
+type serialBatteryTelemetry struct {
+	mu      sync.Mutex
+	running bool
+	last    batteryStatus
+}
+
+func (s *serialBatteryTelemetry) name() string {
+	return "serial"
+}
+
+func (s *serialBatteryTelemetry) poll() (batteryStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		if _, err := os.Stat(batteryTelemetryDevice); err == nil {
+			s.running = true
+			go s.reader()
+		}
+	}
+	return s.last, s.running && stratuxClock.Since(s.last.updated) < batteryTelemetryTimeout
+}
+
+func (s *serialBatteryTelemetry) reader() {
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+	port, err := serial.OpenPort(&serial.Config{Name: batteryTelemetryDevice, Baud: batteryTelemetryBaud})
+	if err != nil {
+		logEvent(EVENT_BATTERY, EVENT_WARN, "Could not open battery telemetry port", "device", batteryTelemetryDevice, "error", err.Error())
+		return
+	}
+	defer port.Close()
+	logEvent(EVENT_BATTERY, EVENT_INFO, "Battery telemetry port opened", "device", batteryTelemetryDevice)
+	scanner := bufio.NewScanner(port)
+	for scanner.Scan() {
+		st, err := parsePBATT(scanner.Text())
+		if err != nil {
+			continue
+		}
+		st.updated = stratuxClock.Time
+		s.mu.Lock()
+		s.last = st
+		s.mu.Unlock()
+	}
+}
+
+// sbsBatteryTelemetry reads a Smart Battery System fuel gauge on the sensor I2C bus.
+type sbsBatteryTelemetry struct{}
+
+func (s *sbsBatteryTelemetry) name() string {
+	return "i2c"
+}
+
+// readWord reads an SBS register. SMBus words are little endian, embd reads them big endian.
+func (s *sbsBatteryTelemetry) readWord(reg byte) (uint16, error) {
+	v, err := i2cbus.ReadWordFromReg(sbsBatteryAddr, reg)
+	return v<<8 | v>>8, err
+}
+
+func (s *sbsBatteryTelemetry) poll() (st batteryStatus, ok bool) {
+	if i2cbus == nil {
+		return st, false
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			ok = false // No I2C on this platform
+		}
+	}()
+	st = batteryStatus{Charge: -1}
+	mv, err := s.readWord(sbsRegVoltage)
+	if err != nil || mv == 0 {
+		return st, false
+	}
+	st.Voltage = float64(mv) / 1000
+	if t, err := s.readWord(sbsRegTemperature); err == nil {
+		st.Temp = float64(t)/10 - 273.15
+		st.TempValid = true
+	}
+	if c, err := s.readWord(sbsRegRelativeCharge); err == nil && c <= 100 {
+		st.Charge = int(c)
+	}
+	for i := 0; i < 4; i++ {
+		cell, err := s.readWord(byte(sbsRegCellVoltage1 - i))
+		if err != nil || cell == 0 || cell == 0xFFFF {
+			break
+		}
+		st.Cells = append(st.Cells, float64(cell)/1000)
+	}
+	return st, true
+}
+
+// checkBatteryLow sets st.Low and st.Reason.
+func checkBatteryLow(st *batteryStatus) {
+	st.Low, st.Reason = false, ""
+	if globalSettings.BatteryAlertVoltage > 0 && st.Voltage < globalSettings.BatteryAlertVoltage {
+		st.Low, st.Reason = true, fmt.Sprintf("pack %.2f V", st.Voltage)
+	}
+	for i, v := range st.Cells {
+		if v > 0 && v < batteryLowCellVoltage {
+			st.Low, st.Reason = true, fmt.Sprintf("cell %d %.2f V", i+1, v)
+		}
+	}
+	if st.TempValid && st.Temp > batteryMaxTemp {
+		st.Low, st.Reason = true, fmt.Sprintf("temperature %.0f °C", st.Temp)
+	}
+}
+
+func batteryTelemetryMonitor() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	wasLow := false
+	for range ticker.C {
+		st := batteryStatus{Charge: -1}
+		if globalSettings.BatteryTelemetry_Enabled {
+			for _, src := range batteryTelemetrySources {
+				if s, ok := src.poll(); ok {
+					st = s
+					st.Source = src.name()
+					break
+				}
+			}
+		}
+		if len(st.Source) > 0 {
+			checkBatteryLow(&st)
+		}
+		if st.Low != wasLow {
+			if st.Low {
+				logEvent(EVENT_BATTERY, EVENT_WARN, "Battery low", "reason", st.Reason, "voltage", st.Voltage)
+				audioAlert("battery_low")
+			} else {
+				logEvent(EVENT_BATTERY, EVENT_INFO, "Battery alert cleared", "voltage", st.Voltage)
+			}
+			wasLow = st.Low
+		}
+		globalStatus.Battery = st
+	}
+}
@@ -0,0 +1,145 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bluetooth.go: NMEA output over Bluetooth, for EFBs that don't join the stratux Wi-Fi.
+		The FLARM NMEA stream (same as UDP, with globalSettings.FlarmRange applied) is fed to
+		bluetoothHelperPath (image/stratux-bluetooth.py), which registers with bluetoothd as
+		an SPP serial service (classic Bluetooth, Android) and/or a BLE UART (Nordic UART
+		Service, iOS) and sends it to every connected client.
+		The helper is (re)started when the Bluetooth settings change. Needs a Bluetooth
+		adapter: the onboard one of the Pi only works with hciuart enabled, a USB dongle
+		always does.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	bluetoothHelperPath    = "/usr/bin/stratux-bluetooth.py"
+	bluetoothCheckInterval = 5 * time.Second
+	bluetoothNameMaxLen    = 20 // Has to fit into the BLE advertisement
+)
+
+var bluetoothNMEAChan = make(chan string, 1024)
+
+// sendBluetoothNMEA queues NMEA for the Bluetooth clients. Dropped if the helper doesn't keep up.
+func sendBluetoothNMEA(msg string) {
+	if !globalSettings.Bluetooth_Enabled {
+		return
+	}
+	select {
+	case bluetoothNMEAChan <- msg:
+	default:
+	}
+}
+
+func isValidBluetoothName(name string) bool {
+	if len(name) == 0 || len(name) > bluetoothNameMaxLen {
+		return false
+	}
+	for _, c := range name {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// bluetoothHelperArgs returns the helper arguments for the current settings, nil if it shouldn't run.
+func bluetoothHelperArgs() []string {
+	if !globalSettings.Bluetooth_Enabled || (!globalSettings.BluetoothSPP && !globalSettings.BluetoothBLE) {
+		return nil
+	}
+	args := []string{"--name", globalSettings.BluetoothName}
+	if globalSettings.BluetoothSPP {
+		args = append(args, "--spp")
+	}
+	if globalSettings.BluetoothBLE {
+		args = append(args, "--ble")
+	}
+	return args
+}
+
+// bluetoothOutput runs the helper while Bluetooth output is enabled and writes the queued NMEA to it.
+func bluetoothOutput() {
+	var cmd *exec.Cmd
+	var stdin io.WriteCloser
+	var exited chan bool
+	var running string // Arguments of the running helper
+
+	stop := func() {
+		if cmd != nil {
+			log.Printf("Stopping Bluetooth output\n")
+			stdin.Close()
+			cmd.Process.Kill()
+			<-exited
+			cmd, stdin, exited = nil, nil, nil
+		}
+	}
+	defer stop()
+
+	ticker := time.NewTicker(bluetoothCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-bluetoothNMEAChan:
+			if stdin == nil {
+				continue
+			}
+			if _, err := io.WriteString(stdin, msg); err != nil {
+				log.Printf("Bluetooth output: %s\n", err.Error())
+				stop()
+			}
+		case <-exited:
+			addSingleSystemErrorf("bluetooth", "Bluetooth output stopped unexpectedly, see the log for details")
+			cmd, stdin, exited = nil, nil, nil
+		case <-ticker.C:
+			args := bluetoothHelperArgs()
+			wanted := strings.Join(args, " ")
+			if cmd != nil && wanted == running {
+				continue
+			}
+			stop()
+			if args == nil {
+				continue
+			}
+
+			c := exec.Command(bluetoothHelperPath, args...)
+			in, err := c.StdinPipe()
+			if err != nil {
+				continue
+			}
+			out, err := c.StdoutPipe()
+			if err != nil {
+				continue
+			}
+			c.Stderr = c.Stdout // Both end up in our log
+			if err := c.Start(); err != nil {
+				addSingleSystemErrorf("bluetooth", "Error executing %s: %s", bluetoothHelperPath, err.Error())
+				continue
+			}
+			log.Printf("Started Bluetooth output: %s\n", wanted)
+			cmd, stdin, running = c, in, wanted
+			exited = make(chan bool, 1)
+			go func(c *exec.Cmd, out io.Reader, ch chan bool) {
+				scanner := bufio.NewScanner(out)
+				for scanner.Scan() {
+					log.Printf("Bluetooth: %s\n", scanner.Text())
+				}
+				c.Wait()
+				ch <- true
+			}(c, out, exited)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	closurerate.go: Closure rate (range rate) per target, from both velocity vectors projected on
+		the line of sight. Positive = approaching. Published in TrafficInfo together with a coarse
+		severity class (CLOSURE_*), so the web radar and apps on the traffic API can color a target
+		that is closing fast differently from co-moving traffic (formation, same thermal) long
+		before an alarm triggers:
+		- CLOSURE_STEADY: range changes by less than closureSteadyRate
+		- CLOSURE_CLOSING: approaching
+		- CLOSURE_FAST: approaching faster than closureFastRate, or less than closureFastTime away
+*/
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	CLOSURE_UNKNOWN   = 0 // No position or velocity of the target or ownship
+	CLOSURE_DIVERGING = 1
+	CLOSURE_STEADY    = 2
+	CLOSURE_CLOSING   = 3
+	CLOSURE_FAST      = 4
+)
+
+const (
+	closureSteadyRate = 10.0  // kt
+	closureFastRate   = 150.0 // kt
+	closureFastTime   = 60.0  // s, time to go at the current closure rate
+)
+
+// velocityNED returns the velocity in m/s north, east and up.
+func velocityNED(speedKts float64, track float64, vvelFpm float64) (n, e, u float64) {
+	speed := speedKts * 0.514444
+	n = speed * math.Cos(radians(track))
+	e = speed * math.Sin(radians(track))
+	u = vvelFpm * 0.3048 / 60
+	return
+}
+
+// computeClosureRate sets ClosureRate and ClosureClass. Called by sendTrafficUpdates() after the distance is updated.
+func computeClosureRate(ti *TrafficInfo) {
+	ti.ClosureRate = 0
+	ti.ClosureClass = CLOSURE_UNKNOWN
+	if !ti.BearingDist_valid || !ti.TrackKnown || !isGPSValid() {
+		return
+	}
+	dist, _, relN, relE := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	on, oe, _ := velocityNED(mySituation.GPSGroundSpeed, float64(mySituation.GPSTrueCourse), 0)
+	tn, te, _ := velocityNED(float64(ti.Speed), float64(ti.Track), 0)
+	if dist < 1 {
+		return
+	}
+	rate := -((tn-on)*relN + (te-oe)*relE) / dist // m/s
+	ti.ClosureRate = rate / 0.514444
+	ti.ClosureClass = closureClass(ti.ClosureRate, dist)
+}
+
+// closureClass maps a closure rate in kt at dist meters to CLOSURE_*.
+func closureClass(rate, dist float64) uint8 {
+	switch {
+	case math.Abs(rate) < closureSteadyRate:
+		return CLOSURE_STEADY
+	case rate < 0:
+		return CLOSURE_DIVERGING
+	case rate >= closureFastRate || dist/(rate*0.514444) < closureFastTime:
+		return CLOSURE_FAST
+	}
+	return CLOSURE_CLOSING
+}
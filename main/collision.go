@@ -0,0 +1,127 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	collision.go: Time based collision prediction for the FLARM alarm levels. Both aircraft are
+		projected over the lookahead time of the alarm profile from ground speed, track, turn rate and
+		climb rate, in collisionStep steps. A turning aircraft flies a circle, not a straight
+		line - a glider thermalling next to us stays where it is instead of being projected
+		across our path (or away from it) every half turn.
+		If a target enters the protection volume of the alarm profile, the alarm level follows
+		the time until it does, as defined for PFLAU/PFLAA:
+			1 = 13-18 seconds to impact, 2 = 9-12 seconds, 3 = 0-8 seconds
+		These are the times of the standard profile, other presets shift them (alarmprofiles.go).
+		A diverging target or one that passes well clear gets no alarm, however close it is.
+		Without velocities (no GPS track, bearingless targets), we fall back to the distance
+		rings of the profile.
+*/
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	collisionStep    = 0.5  // s
+	collisionMaxTurn = 30.0 // deg/s, turn rates above are bad data
+)
+
+type collisionPrediction struct {
+	Conflict bool    // Target enters the protection volume within the lookahead time
+	Tau      float64 // s until it enters the protection volume, if Conflict
+	CPATime  float64 // s to the closest point of approach, 0 if diverging
+	CPADist  float64 // m, horizontal distance at CPA
+	CPAVert  float64 // m, vertical separation at CPA
+}
+
+// projectedPath advances an aircraft along a circle (or a straight line without turn rate).
+type projectedPath struct {
+	n, e, u   float64 // m
+	speed     float64 // m/s, horizontal
+	track     float64 // deg
+	turnRate  float64 // deg/s, right turn positive
+	climbRate float64 // m/s
+}
+
+func newProjectedPath(n, e, u, speedKts, track, turnRate, vvelFpm float64) projectedPath {
+	if math.Abs(turnRate) > collisionMaxTurn {
+		turnRate = 0
+	}
+	return projectedPath{n: n, e: e, u: u, speed: speedKts * 0.514444, track: track, turnRate: turnRate, climbRate: vvelFpm * 0.3048 / 60}
+}
+
+// step advances the path by dt seconds, using the mid-point track of the step.
+func (p *projectedPath) step(dt float64) {
+	mid := radians(p.track + p.turnRate*dt/2)
+	p.n += p.speed * math.Cos(mid) * dt
+	p.e += p.speed * math.Sin(mid) * dt
+	p.u += p.climbRate * dt
+	p.track += p.turnRate * dt
+}
+
+// ownshipVerticalSpeed returns our climb rate in ft/min, baro if available.
+func ownshipVerticalSpeed() float64 {
+	if isTempPressValid() {
+		return float64(mySituation.BaroVerticalSpeed)
+	}
+	return float64(mySituation.GPSVerticalSpeed) * 60
+}
+
+/*
+predictCollision projects the target and us along our paths. relN, relE, relV are the current relative position
+in meters (target minus ownship), prof gives the protection volume. Returns false if the velocities needed are unknown.
+*/
+func predictCollision(ti TrafficInfo, relN, relE, relV float64, prof alarmProfile) (collisionPrediction, bool) {
+	var p collisionPrediction
+	if !ti.Position_valid || !ti.Speed_valid || !isGPSValid() {
+		return p, false
+	}
+	own := newProjectedPath(0, 0, 0, mySituation.GPSGroundSpeed, float64(mySituation.GPSTrueCourse), mySituation.GPSTurnRate, ownshipVerticalSpeed())
+	target := newProjectedPath(relN, relE, relV, float64(ti.Speed), float64(ti.Track), float64(ti.TurnRate), float64(ti.Vvel))
+
+	p.CPADist = math.Hypot(relN, relE)
+	p.CPAVert = relV
+	for t := collisionStep; t <= prof.Lookahead+collisionStep/2; t += collisionStep {
+		own.step(collisionStep)
+		target.step(collisionStep)
+		dn, de, du := target.n-own.n, target.e-own.e, target.u-own.u
+		dist := math.Hypot(dn, de)
+		if dist < p.CPADist {
+			p.CPATime, p.CPADist, p.CPAVert = t, dist, du
+		}
+		if !p.Conflict && dist < prof.CPARadius && math.Abs(du) < prof.CPAVert {
+			p.Conflict, p.Tau = true, t
+		}
+	}
+	return p, true
+}
+
+// alarmLevelForTau maps the time until the protection volume is entered to the FLARM alarm level.
+func (p alarmProfile) alarmLevelForTau(tau float64) uint8 {
+	if tau <= p.Level3Tau {
+		return 3
+	} else if tau <= p.Level2Tau {
+		return 2
+	}
+	return 1
+}
+
+// collisionAlarmLevel evaluates a target with its profile. relN, relE, relV: relative position in meters.
+func collisionAlarmLevel(p alarmProfile, ti TrafficInfo, dist, relN, relE float64, relativeVertical int32) uint8 {
+	relV := float64(relativeVertical)
+	// Inside the protection volume right now
+	if dist < p.CPARadius && math.Abs(relV) < p.CPAVert {
+		return 3
+	}
+	pred, ok := predictCollision(ti, relN, relE, relV, p)
+	if !ok {
+		return p.alarmLevel(dist, relativeVertical)
+	}
+	if !pred.Conflict {
+		return 0
+	}
+	return p.alarmLevelForTau(pred.Tau)
+}
@@ -0,0 +1,228 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	configreload.go: Live settings changes. Modules that need to act when a setting changes
+		(instead of just reading globalSettings the next time) subscribe to the keys they care
+		about and are notified after applySettingsMap changed them.
+		The settings file is watched as well, so edits of /etc/stratux.conf (or SIGHUP) are
+		applied without restarting Stratux and dropping all clients. Settings that can't be
+		changed safely at runtime are stored, but only take effect after the next restart.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type settingsSubscriber struct {
+	keys []string
+	fn   func()
+}
+
+var settingsSubscribersMutex = &sync.Mutex{}
+var settingsSubscribers []settingsSubscriber
+
+// Changing these would disconnect clients or disturb the AHRS mid-flight.
+var settingsRequireRestart = map[string]bool{
+	"WiFiSSID":            true,
+	"WiFiChannel":         true,
+	"WiFiSecurityEnabled": true,
+	"WiFiPassphrase":      true,
+	"WiFiSmartEnabled":    true,
+	"WiFiIPAddress":       true,
+	"WiFiMode":            true,
+	"WiFiDirectPin":       true,
+	"IMUMapping":          true,
+	"SensorQuaternion":    true,
+	"C":                   true,
+	"D":                   true,
+	"NetworkOutputs":      true,
+	"SerialOutputs":       true,
+	"ActiveProfile":       true,
+	"ProfileRestore":      true,
+}
+
+// Restart-only settings changed in the file. saveSettings() keeps them in the file until the restart applies them.
+var pendingRestartSettings = make(map[string]interface{})
+var pendingRestartSettingsMutex = &sync.Mutex{}
+
+// subscribeSettings calls fn whenever one of the given settings has changed.
+func subscribeSettings(fn func(), keys ...string) {
+	settingsSubscribersMutex.Lock()
+	settingsSubscribers = append(settingsSubscribers, settingsSubscriber{keys, fn})
+	settingsSubscribersMutex.Unlock()
+}
+
+// changedSettings returns the keys that differ between two currentSettingsMap() results.
+func changedSettings(before, after map[string]interface{}) map[string]bool {
+	changed := make(map[string]bool)
+	for key, val := range after {
+		if !reflect.DeepEqual(before[key], val) {
+			changed[key] = true
+		}
+	}
+	return changed
+}
+
+func notifySettingsChanged(changed map[string]bool) {
+	settingsSubscribersMutex.Lock()
+	subscribers := settingsSubscribers
+	settingsSubscribersMutex.Unlock()
+	for _, s := range subscribers {
+		for _, key := range s.keys {
+			if changed[key] {
+				s.fn()
+				break
+			}
+		}
+	}
+}
+
+func initSettingsSubscribers() {
+	subscribeSettings(configureOgnTrackerFromSettings, "OGNAddrType", "OGNAddr", "OGNAcftType", "OGNTxPower", "OGNPilot", "OGNStealth", "OGNNoTrack")
+	subscribeSettings(closeNMEACapture, "NMEACapture_Enabled")
+	subscribeSettings(func() {
+		exec.Command("killall", "-SIGUSR1", "fancontrol").Run()
+	}, "PWMDutyMin")
+	subscribeSettings(func() {
+		radarUpdate.SendJSON(globalSettings)
+	}, "RadarLimits", "RadarRange")
+	subscribeSettings(refreshMulticastOutputs, "MulticastOutputs")
+	subscribeSettings(reloadTCPNMEAOutListeners, "NMEAOutTCPPorts")
+	subscribeSettings(refreshNMEABroadcastOutput, "NMEAOutUDPBroadcast_Enabled", "NMEAOutUDPBroadcastPort", "WiFiIPAddress")
+}
+
+// settingsFileValue converts a value from the settings file to the representation /setSettings expects.
+func settingsFileValue(key string, val interface{}) interface{} {
+	switch key {
+	case "StaticIps", "LegacyDisplayIps":
+		if list, ok := val.([]interface{}); ok {
+			ips := make([]string, 0, len(list))
+			for _, ip := range list {
+				if s, ok := ip.(string); ok {
+					ips = append(ips, s)
+				}
+			}
+			return strings.Join(ips, " ")
+		}
+	}
+	return val
+}
+
+// reloadSettingsFile applies everything that was changed in the settings file since we last read/wrote it.
+func reloadSettingsFile() {
+	buf, err := ioutil.ReadFile(configLocation)
+	if err != nil {
+		log.Printf("can't reload settings %s: %s\n", configLocation, err.Error())
+		return
+	}
+	var fileSettings map[string]interface{}
+	if err := json.Unmarshal(buf, &fileSettings); err != nil {
+		// Probably caught in the middle of an edit. We'll see the next write.
+		log.Printf("can't reload settings %s: %s\n", configLocation, err.Error())
+		return
+	}
+
+	current := currentSettingsMap()
+	live := make(map[string]interface{})
+	deferred := make(map[string]interface{})
+	pendingRestartSettingsMutex.Lock()
+	for key, val := range fileSettings {
+		if _, known := current[key]; !known {
+			continue
+		}
+		if reflect.DeepEqual(current[key], val) {
+			delete(pendingRestartSettings, key) // Changed back
+			continue
+		}
+		if settingsRequireRestart[key] {
+			if !reflect.DeepEqual(pendingRestartSettings[key], val) {
+				deferred[key] = val
+			}
+			pendingRestartSettings[key] = val
+		} else {
+			live[key] = settingsFileValue(key, val)
+		}
+	}
+	pendingRestartSettingsMutex.Unlock()
+
+	if len(deferred) > 0 {
+		logEvent(EVENT_SETTINGS, EVENT_INFO, "Settings changed in file, effective after restart", "file", configLocation, "keys", strings.Join(sortedKeys(deferred), ", "))
+	}
+	if len(live) > 0 {
+		logEvent(EVENT_SETTINGS, EVENT_INFO, "Reloading settings from file", "file", configLocation, "keys", strings.Join(sortedKeys(live), ", "))
+		defer func() {
+			if err := recover(); err != nil {
+				addSingleSystemErrorf("settings-reload", "Failed to reload settings from %s: %v", configLocation, err)
+			}
+		}()
+		applySettingsMap(live)
+	}
+}
+
+// dropPendingRestartSettings forgets deferred file changes of the given keys, they were set again since.
+func dropPendingRestartSettings(msg map[string]interface{}) {
+	pendingRestartSettingsMutex.Lock()
+	for key := range msg {
+		delete(pendingRestartSettings, key)
+	}
+	pendingRestartSettingsMutex.Unlock()
+}
+
+// settingsFileJSON returns the settings as saved: globalSettings with the pending restart-only changes.
+func settingsFileJSON() []byte {
+	s := globalSettings
+	pendingRestartSettingsMutex.Lock()
+	if len(pendingRestartSettings) > 0 {
+		for key := range pendingRestartSettings {
+			// Don't decode into the slices and maps we share with globalSettings
+			field := reflect.ValueOf(&s).Elem().FieldByName(key)
+			field.Set(reflect.Zero(field.Type()))
+		}
+		j, _ := json.Marshal(pendingRestartSettings)
+		json.Unmarshal(j, &s)
+	}
+	pendingRestartSettingsMutex.Unlock()
+	j, _ := json.Marshal(&s)
+	return withPendingCredentials(j)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// settingsFileWatcher reloads the settings file when its modification time changes.
+func settingsFileWatcher() {
+	var lastModTime time.Time
+	if fi, err := os.Stat(configLocation); err == nil {
+		lastModTime = fi.ModTime()
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		<-ticker.C
+		fi, err := os.Stat(configLocation)
+		if err != nil || fi.ModTime().Equal(lastModTime) {
+			continue
+		}
+		lastModTime = fi.ModTime()
+		reloadSettingsFile() // No-op if it was our own saveSettings()
+	}
+}
@@ -0,0 +1,291 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	credentials.go: Encrypted at rest storage for secrets (Wi-Fi passwords, NTRIP/MQTT/APRS
+		credentials). Secrets are never written to /etc/stratux.conf and never returned by
+		/getSettings, so settings exports, profiles and diagnostics bundles can't leak them.
+		The store is encrypted with AES-GCM using a key derived from the device identity
+		(Raspberry Pi CPU serial and machine-id). This protects a copied SD card image or
+		settings file, not a running device someone has root on.
+		Settings fields that hold a secret are tagged `json:"-"` and registered in
+		settingsCredentials, they are loaded from and saved to the store with the settings.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const credentialsLocation = "/etc/stratux-credentials.bin"
+
+// Secret settings fields, keyed by their settings name (as used with /setSettings).
+var settingsCredentials = map[string]*string{
+	"WiFiPassphrase":     &globalSettings.WiFiPassphrase,
+	"WeGlideDateOfBirth": &globalSettings.WeGlideDateOfBirth,
+}
+
+var credentialsMutex = &sync.Mutex{}
+var credentials = make(map[string]string)
+
+// Secrets that stay in the settings file because they could not be moved to the store yet, see migrateSettingsCredentials()
+var credentialsPending = make(map[string]bool)
+
+// credentialsWritable is false if the store could not be read at all (I/O error, no device identity) - we must not overwrite it then.
+var credentialsWritable = true
+
+// deviceKey derives the store key from identifiers that stay with the hardware.
+// Images are cloned, so machine-id alone isn't unique - the Pi CPU serial is.
+func deviceKey() ([]byte, error) {
+	id := ""
+	if f, err := os.Open("/proc/cpuinfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.SplitN(scanner.Text(), ":", 2); len(fields) == 2 && strings.TrimSpace(fields[0]) == "Serial" {
+				id += strings.TrimSpace(fields[1])
+			}
+		}
+		f.Close()
+	}
+	if machineID, err := ioutil.ReadFile("/etc/machine-id"); err == nil {
+		id += strings.TrimSpace(string(machineID))
+	}
+	if len(id) == 0 {
+		return nil, errors.New("no device identity available")
+	}
+	key := sha256.Sum256([]byte("stratux-credentials:" + id))
+	return key[:], nil
+}
+
+func credentialsCipher() (cipher.AEAD, error) {
+	key, err := deviceKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readCredentials loads the store. A missing store is an empty store. A store we can't decrypt or decode
+// is moved aside to credentialsLocation.bad and replaced by an empty one, the secrets have to be entered again.
+func readCredentials() error {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	buf, err := ioutil.ReadFile(credentialsLocation)
+	if os.IsNotExist(err) {
+		credentials = make(map[string]string)
+		credentialsWritable = true
+		return nil
+	} else if err != nil {
+		credentialsWritable = false
+		return err
+	}
+	aead, err := credentialsCipher()
+	if err != nil {
+		credentialsWritable = false
+		return err
+	}
+	m, err := decodeCredentials(aead, buf)
+	if err != nil {
+		// Different device (SD card moved) or corrupted. Keep the old file for a manual rescue.
+		bad := credentialsLocation + ".bad"
+		if renameErr := os.Rename(credentialsLocation, bad); renameErr != nil {
+			credentialsWritable = false
+			return fmt.Errorf("%s, can't move it aside: %s", err.Error(), renameErr.Error())
+		}
+		credentials = make(map[string]string)
+		credentialsWritable = true
+		addSingleSystemErrorf("credentials-lost", "Stored passwords could not be read (%s) and were moved to %s. Please enter them again.", err.Error(), bad)
+		return err
+	}
+	credentials = m
+	credentialsWritable = true
+	return nil
+}
+
+func decodeCredentials(aead cipher.AEAD, buf []byte) (map[string]string, error) {
+	if len(buf) < aead.NonceSize() {
+		return nil, errors.New("credentials store truncated")
+	}
+	plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt credentials store: %s", err.Error())
+	}
+	m := make(map[string]string)
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeCredentials must be called with credentialsMutex held.
+func writeCredentials() error {
+	if !credentialsWritable {
+		return errors.New("credentials store could not be read, not overwriting it")
+	}
+	aead, err := credentialsCipher()
+	if err != nil {
+		return err
+	}
+	plain, _ := json.Marshal(credentials)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(credentialsLocation, aead.Seal(nonce, nonce, plain, nil), 0600)
+}
+
+func getCredential(name string) (string, bool) {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	val, ok := credentials[name]
+	return val, ok
+}
+
+// setCredential stores a secret. An empty value removes it.
+func setCredential(name, value string) error {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	if old, ok := credentials[name]; ok && old == value || !ok && len(value) == 0 {
+		return nil
+	}
+	if len(value) == 0 {
+		delete(credentials, name)
+	} else {
+		credentials[name] = value
+	}
+	return writeCredentials()
+}
+
+// credentialNames lists the stored secrets, without their values.
+func credentialNames() map[string]bool {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	names := make(map[string]bool)
+	for name := range credentials {
+		names[name] = true
+	}
+	return names
+}
+
+// loadSettingsCredentials fills the secret settings fields from the store.
+func loadSettingsCredentials() {
+	if err := readCredentials(); err != nil {
+		log.Printf("can't read credentials %s: %s\n", credentialsLocation, err.Error())
+	}
+	for name, field := range settingsCredentials {
+		*field, _ = getCredential(name)
+	}
+}
+
+// saveSettingsCredentials is called by saveSettings, the secrets go to the store instead of the settings file.
+func saveSettingsCredentials() {
+	for name, field := range settingsCredentials {
+		if err := setCredential(name, *field); err != nil {
+			addSingleSystemErrorf("save-credentials", "can't save credentials %s: %s", credentialsLocation, err.Error())
+			return
+		}
+		credentialsMutex.Lock()
+		delete(credentialsPending, name)
+		credentialsMutex.Unlock()
+	}
+}
+
+// withPendingCredentials adds the secrets that are not in the store yet to the settings file JSON, so they aren't lost.
+func withPendingCredentials(settingsJSON []byte) []byte {
+	credentialsMutex.Lock()
+	defer credentialsMutex.Unlock()
+	if len(credentialsPending) == 0 {
+		return settingsJSON
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(settingsJSON, &m) != nil {
+		return settingsJSON
+	}
+	for name := range credentialsPending {
+		m[name], _ = json.Marshal(*settingsCredentials[name])
+	}
+	j, _ := json.Marshal(m)
+	return j
+}
+
+// migrateSettingsCredentials moves secrets that older versions stored in plain text in the settings file to the store.
+func migrateSettingsCredentials(settingsFile []byte) {
+	var m map[string]interface{}
+	if json.Unmarshal(settingsFile, &m) != nil {
+		return
+	}
+	migrated := false
+	for name, field := range settingsCredentials {
+		if val, ok := m[name].(string); ok {
+			if len(val) > 0 {
+				*field = val
+				// Only remove it from the settings file once it is in the store, or it would be lost
+				if err := setCredential(name, val); err != nil {
+					addSingleSystemErrorf("save-credentials", "can't move secrets to %s, leaving them in %s: %s", credentialsLocation, configLocation, err.Error())
+					credentialsMutex.Lock()
+					credentialsPending[name] = true
+					credentialsMutex.Unlock()
+					continue
+				}
+			}
+			migrated = true // Rewrite the settings file without it, even if empty
+		}
+	}
+	if migrated {
+		log.Printf("moved secrets from %s to %s\n", configLocation, credentialsLocation)
+		saveSettings()
+	}
+}
+
+// AJAX call - /getCredentials. Responds with the names of the stored secrets, never their values.
+func handleCredentialsGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	namesJSON, _ := json.Marshal(credentialNames())
+	fmt.Fprintf(w, "%s\n", namesJSON)
+}
+
+// AJAX call - /setCredential. POST {"Name": "...", "Value": "..."}, an empty value removes the secret.
+func handleCredentialSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var cred struct {
+		Name  string
+		Value string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil || len(cred.Name) == 0 {
+		http.Error(w, "invalid credential", http.StatusBadRequest)
+		return
+	}
+	if _, isSetting := settingsCredentials[cred.Name]; isSetting {
+		applySettingsMap(map[string]interface{}{cred.Name: cred.Value}) // Applies the change and saves it to the store
+	} else if err := setCredential(cred.Name, cred.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logEvent(EVENT_SETTINGS, EVENT_INFO, "Credential changed", "name", cred.Name)
+}
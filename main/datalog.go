@@ -112,7 +112,7 @@ func uintMarshal(v reflect.Value) string {
 }
 
 func floatMarshal(v reflect.Value) string {
-	return strconv.FormatFloat(v.Float(), 'f', 10, 64)
+	return strconv.FormatFloat(v.Float(), 'f', dataLogDecimals(), 64)
 }
 
 func stringMarshal(v reflect.Value) string {
@@ -221,7 +221,12 @@ func makeTable(i interface{}, tbl string, db *sql.DB) {
 		Reads insertBatch and insertBatchIfs. This is called after a group of insertData() calls.
 */
 
-func bulkInsert(tbl string, db *sql.DB) (res sql.Result, err error) {
+// sqlExecer is a *sql.DB or a *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func bulkInsert(tbl string, db sqlExecer) (res sql.Result, err error) {
 	if _, ok := insertString[tbl]; !ok {
 		return nil, errors.New("no insert statement")
 	}
@@ -281,7 +286,7 @@ func bulkInsert(tbl string, db *sql.DB) (res sql.Result, err error) {
 var insertString map[string]string // INSERT INTO tbl (col1, col2, ...) VALUES(?, ?, ...). Only for one value.
 var insertBatchIfs map[string][][]interface{}
 
-func insertData(i interface{}, tbl string, db *sql.DB, ts_num int64) int64 {
+func insertData(i interface{}, tbl string, db sqlExecer, ts_num int64) int64 {
 	val := reflect.ValueOf(i)
 
 	keys := make([]string, 0)
@@ -374,6 +379,7 @@ func dataLogWriter(db *sql.DB) {
 			//				logSituation()
 			//			}
 			timeStart := stratuxClock.Time
+			workStart := time.Now()
 			nRows := len(rowsQueuedForWrite)
 			if globalSettings.DEBUG {
 				log.Printf("Writing %d rows\n", nRows)
@@ -389,14 +395,18 @@ func dataLogWriter(db *sql.DB) {
 			}
 			for _, r := range rowsQueuedForWrite {
 				tblsAffected[r.tbl] = true
-				insertData(r.data, r.tbl, db, r.ts_num)
+				insertData(r.data, r.tbl, tx, r.ts_num)
 			}
 			// Do the bulk inserts.
 			for tbl, _ := range tblsAffected {
-				bulkInsert(tbl, db)
+				bulkInsert(tbl, tx)
+			}
+			// Close the transaction. All rows of this interval go to the card in one write.
+			if err := tx.Commit(); err != nil {
+				log.Printf("tx.Commit() error: %s\n", err.Error())
 			}
-			// Close the transaction.
-			tx.Commit()
+			dataLogPruneCoalescing()
+			workDone(LOAD_LOGGING, workStart)
 			rowsQueuedForWrite = make([]DataLogRow, 0) // Zero the queue.
 			timeElapsed := stratuxClock.Since(timeStart)
 			if globalSettings.DEBUG {
@@ -533,49 +543,57 @@ func isDataLogReady() bool {
 }
 
 func logSituation() {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) &&
+		dataLogShouldWrite(DATALOG_TABLE_SITUATION, "", float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(mySituation.GPSAltitudeMSL)) {
 		dataLogChan <- DataLogRow{tbl: "mySituation", data: mySituation}
 	}
 }
 
 func logStatus() {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
 		dataLogChan <- DataLogRow{tbl: "status", data: globalStatus}
 	}
 }
 
 func logSettings() {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
 		dataLogChan <- DataLogRow{tbl: "settings", data: globalSettings}
 	}
 }
 
 func logTraffic(ti TrafficInfo) {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if !privacyAllows(ti, PRIVACY_USE_LOG) {
+		return
+	}
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) &&
+		dataLogShouldWrite(DATALOG_TABLE_TRAFFIC, trafficLogKey(ti), float64(ti.Lat), float64(ti.Lng), float64(ti.Alt)) {
 		dataLogChan <- DataLogRow{tbl: "traffic", data: ti}
 	}
 }
 
 func logMsg(m msg) {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
+		if m.uatMsg != nil && !dataLogShouldWrite(DATALOG_TABLE_WEATHER, weatherLogKey(m), 0, 0, 0) {
+			return // Unchanged weather products
+		}
 		dataLogChan <- DataLogRow{tbl: "messages", data: m}
 	}
 }
 
 func logESMsg(m esmsg) {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
 		dataLogChan <- DataLogRow{tbl: "es_messages", data: m}
 	}
 }
 
 func logGPSAttitude(gpsPerf gpsPerfStats) {
-	if globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
 		dataLogChan <- DataLogRow{tbl: "gps_attitude", data: gpsPerf}
 	}
 }
 
 func logDump1090TermMessage(m Dump1090TermMessage) {
-	if globalSettings.DEBUG && globalSettings.ReplayLog && isDataLogReady() {
+	if globalSettings.DEBUG && globalSettings.ReplayLog && isDataLogReady() && !isShedding(SHED_LOGGING) {
 		dataLogChan <- DataLogRow{tbl: "dump1090_terminal", data: m}
 	}
 }
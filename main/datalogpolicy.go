@@ -0,0 +1,128 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	datalogpolicy.go: Coalescing of replay log rows to spare the SD card. Situation updates come
+		in at the GPS/AHRS rate, traffic once per second per target and the same weather
+		uplinks over and over. Per table (globalSettings.DataLogPolicies, defaults below),
+		a row is only written if
+		- at least MinInterval passed since the last row of the same object, and
+		- it moved by PosChange / AltChange, or MaxInterval passed.
+		Weather uplinks are identified by their content, so a product that is
+		re-broadcast unchanged is logged once per MinInterval.
+		Floats are written with globalSettings.DataLogDecimals decimals (6 = ~0.1m for coordinates).
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Tables for globalSettings.DataLogPolicies
+const (
+	DATALOG_TABLE_SITUATION = "mySituation"
+	DATALOG_TABLE_TRAFFIC   = "traffic"
+	DATALOG_TABLE_WEATHER   = "weather" // UAT uplinks, in the "messages" table
+)
+
+const dataLogDefaultDecimals = 6
+
+type dataLogPolicy struct {
+	Table       string  // One of the DATALOG_TABLE_* names
+	MinInterval float64 // s, never log the same object more often
+	MaxInterval float64 // s, log at least this often even without change. 0 = only on change
+	PosChange   float64 // m, log (after MinInterval) once the position moved this far. 0 = any change
+	AltChange   float64 // ft
+}
+
+var defaultDataLogPolicies = map[string]dataLogPolicy{
+	DATALOG_TABLE_SITUATION: {Table: DATALOG_TABLE_SITUATION, MinInterval: 1, MaxInterval: 10, PosChange: 10, AltChange: 20},
+	DATALOG_TABLE_TRAFFIC:   {Table: DATALOG_TABLE_TRAFFIC, MinInterval: 2, MaxInterval: 15, PosChange: 50, AltChange: 50},
+	DATALOG_TABLE_WEATHER:   {Table: DATALOG_TABLE_WEATHER, MinInterval: 300},
+}
+
+type dataLogLastRow struct {
+	time time.Time // stratuxClock
+	lat  float64
+	lng  float64
+	alt  float64 // ft
+}
+
+var dataLogCoalesceMutex = &sync.Mutex{}
+var dataLogLastRows = make(map[string]dataLogLastRow) // by table + object key
+
+func dataLogPolicyFor(table string) dataLogPolicy {
+	for _, p := range globalSettings.DataLogPolicies {
+		if p.Table == table {
+			return p
+		}
+	}
+	return defaultDataLogPolicies[table]
+}
+
+func dataLogDecimals() int {
+	if globalSettings.DataLogDecimals <= 0 {
+		return dataLogDefaultDecimals
+	}
+	return globalSettings.DataLogDecimals
+}
+
+// dataLogShouldWrite decides if a row for the object key of table is written now. lat/lng/alt are ignored if the table has no thresholds.
+func dataLogShouldWrite(table string, key string, lat, lng, alt float64) bool {
+	p := dataLogPolicyFor(table)
+	id := table + "/" + key
+	dataLogCoalesceMutex.Lock()
+	defer dataLogCoalesceMutex.Unlock()
+	last, ok := dataLogLastRows[id]
+	if ok {
+		since := stratuxClock.Since(last.time).Seconds()
+		if since < p.MinInterval {
+			return false
+		}
+		changed := p.PosChange <= 0 && p.AltChange <= 0
+		if p.PosChange > 0 {
+			dist, _, _, _ := distRect(last.lat, last.lng, lat, lng)
+			changed = changed || dist >= p.PosChange
+		}
+		if p.AltChange > 0 {
+			changed = changed || math.Abs(alt-last.alt) >= p.AltChange
+		}
+		if !changed && (p.MaxInterval <= 0 || since < p.MaxInterval) {
+			return false
+		}
+	}
+	dataLogLastRows[id] = dataLogLastRow{time: stratuxClock.Time, lat: lat, lng: lng, alt: alt}
+	return true
+}
+
+// dataLogPruneCoalescing forgets objects that are long gone (weather products, traffic). Called by dataLogWriter().
+func dataLogPruneCoalescing() {
+	dataLogCoalesceMutex.Lock()
+	defer dataLogCoalesceMutex.Unlock()
+	for id, last := range dataLogLastRows {
+		if stratuxClock.Since(last.time) > 15*time.Minute {
+			delete(dataLogLastRows, id)
+		}
+	}
+}
+
+// weatherLogKey identifies an uplink by its tower and products. The slot/time header changes with every re-broadcast.
+func weatherLogKey(m msg) string {
+	h := sha1.New()
+	h.Write([]byte(m.ADSBTowerID))
+	for _, f := range m.uatMsg.Frames {
+		h.Write(f.Raw_data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func trafficLogKey(ti TrafficInfo) string {
+	return fmt.Sprintf("%08X", trafficInfoKey(ti))
+}
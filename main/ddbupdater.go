@@ -0,0 +1,296 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ddbupdater.go: Keeps the OGN device database (DDB) and FlarmNet up to date. The DDB that is
+		shipped with the image (/etc/ddb.json) goes stale quickly. Whenever internet is available
+		(e.g. Stratux connected to a phone hotspot), both databases are synced in the background.
+		Sync uses conditional requests (ETag/Last-Modified), so unchanged databases are not
+		transferred again. Downloads are stored gzip compressed in ddbDir and the lookup tables
+		used by getTailNumber() are swapped without restarting.
+		OGN DDB registrations take precedence over FlarmNet, the shipped DDB is the fallback.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ddbDir             = "/etc/stratux-ddb"
+	ddbShippedFile     = "/etc/ddb.json"
+	ddbOgnURL          = "http://ddb.glidernet.org/download/?j=1"
+	ddbFlarmnetURL     = "https://www.flarmnet.org/static/files/wfn/data.fln"
+	ddbSyncInterval    = 6 * time.Hour
+	ddbRetryInterval   = 5 * time.Minute // No internet - try again soon
+	ddbDownloadTimeout = 60 * time.Second
+)
+
+type ddbSource struct {
+	Name         string
+	URL          string
+	File         string // gzip compressed copy in ddbDir
+	ETag         string
+	LastModified string
+	LastSync     time.Time // UTC
+	Entries      int
+	parse        func([]byte) (map[string]string, error)
+}
+
+var ddbSources = []*ddbSource{
+	{Name: "OGN", URL: ddbOgnURL, File: "ogn-ddb.json.gz", parse: parseOgnDDB},
+	{Name: "FlarmNet", URL: ddbFlarmnetURL, File: "flarmnet.fln.gz", parse: parseFlarmnet},
+}
+
+// ID (6 hex digits, upper case) -> registration. Replaced as a whole, never modified. map[string]string
+var ddbTails atomic.Value
+
+// Per source tables, in ddbSources order. Only accessed by the updater goroutine (and init).
+var ddbTables = make([]map[string]string, len(ddbSources))
+var ddbShipped map[string]string
+
+func parseOgnDDB(data []byte) (map[string]string, error) {
+	var ddb struct {
+		Devices []struct {
+			DeviceID     string `json:"device_id"`
+			Registration string `json:"registration"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal(data, &ddb); err != nil {
+		return nil, err
+	}
+	tails := make(map[string]string, len(ddb.Devices))
+	for _, dev := range ddb.Devices {
+		if len(dev.Registration) > 0 {
+			tails[strings.ToUpper(dev.DeviceID)] = dev.Registration
+		}
+	}
+	return tails, nil
+}
+
+/*
+parseFlarmnet parses the FlarmNet .fln file: a version line followed by one hex encoded record
+per line. Record: ID (6), owner (21), airfield (21), type (21), registration (7), competition
+number (3), frequency (7). Text fields are space padded.
+*/
+func parseFlarmnet(data []byte) (map[string]string, error) {
+	tails := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	first := true
+	for scanner.Scan() {
+		if first {
+			first = false // version
+			continue
+		}
+		rec, err := hex.DecodeString(strings.TrimSpace(scanner.Text()))
+		if err != nil || len(rec) < 79 {
+			continue
+		}
+		id := strings.ToUpper(strings.TrimSpace(string(rec[0:6])))
+		reg := strings.TrimSpace(string(rec[69:76]))
+		if len(id) == 6 && len(reg) > 0 {
+			tails[id] = reg
+		}
+	}
+	if len(tails) == 0 {
+		return nil, errors.New("no records")
+	}
+	return tails, nil
+}
+
+func ddbMetaFile() string {
+	return filepath.Join(ddbDir, "meta.json")
+}
+
+func saveDDBMeta() {
+	os.MkdirAll(ddbDir, 0755)
+	meta, _ := json.Marshal(ddbSources)
+	ioutil.WriteFile(ddbMetaFile(), meta, 0644)
+}
+
+// rebuildDDBTails merges the tables and publishes the result. Earlier sources win.
+func rebuildDDBTails() {
+	tails := make(map[string]string)
+	for id, tail := range ddbShipped {
+		tails[id] = tail
+	}
+	for i := len(ddbTables) - 1; i >= 0; i-- {
+		for id, tail := range ddbTables[i] {
+			tails[id] = tail
+		}
+	}
+	ddbTails.Store(tails)
+}
+
+func lookupDDBTail(id string) (string, bool) {
+	tails, ok := ddbTails.Load().(map[string]string)
+	if !ok {
+		return "", false
+	}
+	tail, ok := tails[strings.ToUpper(id)]
+	return tail, ok
+}
+
+func readGzipFile(fn string) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	return ioutil.ReadAll(z)
+}
+
+func writeGzipFile(fn string, data []byte) error {
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	z := gzip.NewWriter(f)
+	_, err = z.Write(data)
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn) // Atomic, a power loss leaves the old copy
+}
+
+// loadDDB loads the shipped DDB and the previously downloaded copies.
+func loadDDB() {
+	if data, err := ioutil.ReadFile(ddbShippedFile); err == nil {
+		if tails, err := parseOgnDDB(data); err == nil {
+			ddbShipped = tails
+		} else {
+			log.Printf("Failed to parse OGN device db %s: %s\n", ddbShippedFile, err.Error())
+		}
+	}
+	if meta, err := ioutil.ReadFile(ddbMetaFile()); err == nil {
+		var saved []ddbSource
+		json.Unmarshal(meta, &saved)
+		for _, s := range saved {
+			for _, src := range ddbSources {
+				if src.Name == s.Name {
+					src.ETag, src.LastModified, src.LastSync, src.Entries = s.ETag, s.LastModified, s.LastSync, s.Entries
+				}
+			}
+		}
+	}
+	for i, src := range ddbSources {
+		data, err := readGzipFile(filepath.Join(ddbDir, src.File))
+		if err != nil {
+			src.ETag, src.LastModified = "", "" // Force a full download
+			continue
+		}
+		if tails, err := src.parse(data); err == nil {
+			ddbTables[i] = tails
+		}
+	}
+	rebuildDDBTails()
+}
+
+// syncDDBSource downloads a database if it changed. Returns true if the table was updated.
+func syncDDBSource(i int) (bool, error) {
+	src := ddbSources[i]
+	req, err := http.NewRequest("GET", src.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "stratux/"+stratuxVersion)
+	if len(src.ETag) > 0 {
+		req.Header.Set("If-None-Match", src.ETag)
+	}
+	if len(src.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", src.LastModified)
+	}
+	client := &http.Client{Timeout: ddbDownloadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		src.LastSync = time.Now().UTC()
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	tails, err := src.parse(data)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(ddbDir, 0755); err != nil {
+		return false, err
+	}
+	if err := writeGzipFile(filepath.Join(ddbDir, src.File), data); err != nil {
+		return false, err
+	}
+	ddbTables[i] = tails
+	src.ETag = resp.Header.Get("ETag")
+	src.LastModified = resp.Header.Get("Last-Modified")
+	src.LastSync = time.Now().UTC()
+	src.Entries = len(tails)
+	return true, nil
+}
+
+func ddbUpdater() {
+	loadDDB()
+	next := time.Now().Add(30 * time.Second) // Give the network a moment after boot
+	for {
+		time.Sleep(time.Until(next))
+		if !globalSettings.DDBUpdate_Enabled || isPowerSaveIdle() {
+			next = time.Now().Add(ddbRetryInterval)
+			continue
+		}
+		next = time.Now().Add(ddbSyncInterval)
+		updated := false
+		for i, src := range ddbSources {
+			changed, err := syncDDBSource(i)
+			if err != nil {
+				log.Printf("%s database sync failed: %s\n", src.Name, err.Error())
+				next = time.Now().Add(ddbRetryInterval)
+				continue
+			}
+			if changed {
+				logEvent(EVENT_SYSTEM, EVENT_INFO, "Aircraft database updated", "db", src.Name, "entries", src.Entries)
+				updated = true
+			}
+		}
+		saveDDBMeta()
+		if updated {
+			rebuildDDBTails()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	debugconsole.go: Traffic source debug console. Every traffic frame that updates a target is
+		published on the /debugconsole websocket with the raw frame as received (dump1090 JSON,
+		UAT hex, OGN JSON, FLARM NMEA, MLAT SBS) and the target as decoded from it, so the
+		developer page can show side by side what came in and what we made of it.
+		Nothing is encoded while nobody is watching.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Frame sources shown in the console.
+const (
+	DEBUG_SOURCE_ES    = "1090ES"
+	DEBUG_SOURCE_UAT   = "UAT"
+	DEBUG_SOURCE_OGN   = "OGN"
+	DEBUG_SOURCE_FLARM = "FLARM"
+	DEBUG_SOURCE_MLAT  = "MLAT"
+)
+
+type debugConsoleFrame struct {
+	Time    time.Time // UTC
+	Source  string    // DEBUG_SOURCE_*
+	Addr    string    // hex, for filtering
+	Raw     string
+	Decoded TrafficInfo
+}
+
+var debugConsoleUpdate *uibroadcaster
+var debugConsoleClients int32
+
+// debugConsolePublish is called by the traffic parsers after a frame was decoded into ti.
+func debugConsolePublish(source string, raw string, ti TrafficInfo) {
+	if atomic.LoadInt32(&debugConsoleClients) == 0 {
+		return
+	}
+	debugConsoleUpdate.SendJSON(debugConsoleFrame{
+		Time:    time.Now().UTC(),
+		Source:  source,
+		Addr:    fmt.Sprintf("%06X", ti.Icao_addr&0xFFFFFF),
+		Raw:     strings.TrimSpace(raw),
+		Decoded: ti,
+	})
+}
+
+// /debugconsole websocket. Pausing and filtering are done by the web UI.
+func handleDebugConsoleWS(conn *websocket.Conn) {
+	atomic.AddInt32(&debugConsoleClients, 1)
+	defer atomic.AddInt32(&debugConsoleClients, -1)
+	debugConsoleUpdate.AddSocket(conn)
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything, just keep it busy.
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	degraded.go: Supervisor for degraded operation. Instead of every output deciding on its
+		own what to do when a subsystem fails, the current set of degraded modes is determined
+		here once per second, and GDL90, FLARM NMEA and the web UI all act on the same state:
+		- No GPS:  FLARM NMEA traffic is sent bearingless with the estimated distance (flarmBearingless()),
+		           GDL90 ownship is only sent from our own ADS-B Out (buildOwnshipReport())
+		- No baro: GNSS altitude is used for vertical separation (ownshipAltitude()), no PGRMZ, vario or
+		           altitude encoder output
+		- SDR lost: we are down to the remaining band(s)
+		All modes set the maintenance flag in the GDL90 heartbeat and are listed in the status.
+		A mode is only entered if the subsystem worked before, so a Stratux that simply has
+		no baro sensor or only one SDR is not permanently shown as degraded.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEGRADED_NO_GPS  = 1 << iota // GPS fix lost
+	DEGRADED_NO_BARO             // Pressure altitude lost, GNSS altitude used instead
+	DEGRADED_NO_UAT              // 978 MHz SDR lost
+	DEGRADED_NO_ES               // 1090 MHz SDR lost
+	DEGRADED_NO_OGN              // 868 MHz SDR lost
+)
+
+var degradedModes uint32 // Current DEGRADED_* flags, written by degradedModeSupervisor only
+
+// Subsystems that worked at least once since startup
+var degradedSeen uint32
+
+func isDegraded(mode uint32) bool {
+	return atomic.LoadUint32(&degradedModes)&mode != 0
+}
+
+func isAnyDegraded() bool {
+	return atomic.LoadUint32(&degradedModes) != 0
+}
+
+func degradedModeDescription(mode uint32) string {
+	switch mode {
+	case DEGRADED_NO_GPS:
+		return "No GPS: traffic shown relative only (no position)"
+	case DEGRADED_NO_BARO:
+		return "No pressure altitude: using GPS altitude for traffic separation"
+	case DEGRADED_NO_UAT:
+		return "978 MHz receiver lost: no UAT traffic or weather"
+	case DEGRADED_NO_ES:
+		return "1090 MHz receiver lost: no 1090ES traffic"
+	case DEGRADED_NO_OGN:
+		return "868 MHz receiver lost: no FLARM/OGN traffic"
+	}
+	return ""
+}
+
+// subsystemStates returns which subsystems are currently working and which are enabled (i.e. expected to work).
+func subsystemStates() (working uint32, expected uint32) {
+	if isGPSValid() {
+		working |= DEGRADED_NO_GPS
+	}
+	if globalSettings.GPS_Enabled {
+		expected |= DEGRADED_NO_GPS
+	}
+	if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
+		working |= DEGRADED_NO_BARO
+	}
+	if globalSettings.AltitudeSource != ALT_SOURCE_GPS {
+		expected |= DEGRADED_NO_BARO
+	}
+	if UATDev != nil {
+		working |= DEGRADED_NO_UAT
+	}
+	if globalSettings.UAT_Enabled {
+		expected |= DEGRADED_NO_UAT
+	}
+	if ESDev != nil {
+		working |= DEGRADED_NO_ES
+	}
+	if globalSettings.ES_Enabled {
+		expected |= DEGRADED_NO_ES
+	}
+	if OGNDev != nil {
+		working |= DEGRADED_NO_OGN
+	}
+	if globalSettings.OGN_Enabled {
+		expected |= DEGRADED_NO_OGN
+	}
+	if isPowerSaveIdle() {
+		// SDRs are switched off on purpose, see powersave.go
+		working |= degradedSeen & (DEGRADED_NO_UAT | DEGRADED_NO_ES | DEGRADED_NO_OGN)
+	}
+	return
+}
+
+func updateDegradedModes() {
+	working, expected := subsystemStates()
+	degradedSeen = (degradedSeen | working) & expected // Forget subsystems that were disabled by the user
+	modes := degradedSeen &^ working
+
+	old := atomic.SwapUint32(&degradedModes, modes)
+	descriptions := make([]string, 0)
+	for mode := uint32(1); mode <= DEGRADED_NO_OGN; mode <<= 1 {
+		if modes&mode != 0 {
+			descriptions = append(descriptions, degradedModeDescription(mode))
+		}
+		if (old^modes)&mode == 0 {
+			continue
+		}
+		if modes&mode != 0 {
+			logEvent(EVENT_SYSTEM, EVENT_WARN, "Entering degraded mode", "mode", degradedModeDescription(mode))
+		} else {
+			logEvent(EVENT_SYSTEM, EVENT_INFO, "Leaving degraded mode", "mode", degradedModeDescription(mode))
+		}
+	}
+	if old != modes && modes != 0 {
+		log.Printf("Degraded modes active: %s\n", strings.Join(descriptions, "; "))
+	}
+	globalStatus.DegradedModes = descriptions
+}
+
+func degradedModeSupervisor() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		updateDegradedModes()
+	}
+}
@@ -0,0 +1,79 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	descentalert.go: Crude "altitude bust" warning. Once the aircraft has been holding an
+		altitude for a while, a sustained descent away from it (e.g. an autopilot that dropped
+		out of altitude hold during IFR practice) raises an alert.
+*/
+
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	descentAlertLevelVs      = 200              // ft/min, below this we consider the aircraft level
+	descentAlertLevelTime    = 20 * time.Second // level for this long = holding an altitude
+	descentAlertSustained    = 5 * time.Second  // descent must last this long before alerting
+	descentAlertMinDeviation = 200              // ft below the held altitude
+	descentAlertMinSpeed     = 50               // kts, only when flying
+)
+
+func descentAlerter() {
+	ticker := time.NewTicker(1 * time.Second)
+	var levelSince, descentSince time.Time
+	var heldAlt float32
+	holding := false
+	for {
+		<-ticker.C
+		flying := isGPSValid() && mySituation.GPSGroundSpeed > descentAlertMinSpeed
+		if !globalSettings.DescentAlert_Enabled || !isTempPressValid() || !flying {
+			holding = false
+			levelSince = time.Time{}
+			globalStatus.DescentAlert = false
+			continue
+		}
+		alt := mySituation.BaroPressureAltitude
+		vs := mySituation.BaroVerticalSpeed
+
+		if math.Abs(float64(vs)) < descentAlertLevelVs {
+			descentSince = time.Time{}
+			if globalStatus.DescentAlert {
+				log.Printf("Descent alert cleared, level at %.0f ft\n", alt)
+				globalStatus.DescentAlert = false
+			}
+			if levelSince.IsZero() {
+				levelSince = stratuxClock.Time
+			}
+			if stratuxClock.Since(levelSince) > descentAlertLevelTime {
+				holding = true
+				heldAlt = alt
+			}
+			continue
+		}
+		levelSince = time.Time{}
+
+		if vs > -float32(globalSettings.DescentAlertRate) {
+			// Climbing, or descending slower than the threshold - an intended altitude change
+			descentSince = time.Time{}
+			if vs > 0 {
+				holding = false
+			}
+			continue
+		}
+		if descentSince.IsZero() {
+			descentSince = stratuxClock.Time
+		}
+		if holding && !globalStatus.DescentAlert && alt < heldAlt-descentAlertMinDeviation && stratuxClock.Since(descentSince) > descentAlertSustained {
+			log.Printf("Descent alert: %.0f ft/min, %.0f ft below held altitude %.0f ft\n", vs, heldAlt-alt, heldAlt)
+			globalStatus.DescentAlert = true
+			audioAlert("descent_alert")
+		}
+	}
+}
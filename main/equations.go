@@ -310,27 +310,11 @@ Distance functions: Polar coordinate systems
 More accurate over longer distances
 */
 
-// distance calculates distance between two points using the law of cosines.
+// distance calculates distance between two points with the configured geodesy backend (see geodesy.go).
 // Inputs are lat / lon of both points in decimal degrees
 // Outputs are distance in meters and bearing to the target from origin in degrees (0° = north, 90° = east)
 func distance(lat1, lon1, lat2, lon2 float64) (dist, bearing float64) {
-	radius_earth := 6371008.8 // meters; mean radius
-
-	lat1 = radians(lat1)
-	lon1 = radians(lon1)
-	lat2 = radians(lat2)
-	lon2 = radians(lon2)
-
-	dist = math.Acos(math.Sin(lat1)*math.Sin(lat2)+math.Cos(lat1)*math.Cos(lat2)*math.Cos(lon2-lon1)) * radius_earth
-
-	var x, y float64
-
-	x = math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(lon2-lon1)
-	y = math.Sin(lon2-lon1) * math.Cos(lat2)
-
-	bearing = degreesHdg(math.Atan2(y, x))
-
-	return
+	return currentGeodesy().Inverse(lat1, lon1, lat2, lon2)
 }
 
 // CalcAltitude determines the pressure altitude (feet) from the atmospheric pressure (hPa)
@@ -339,6 +323,14 @@ func CalcAltitude(press float64, altoffset int) (altitude float64) {
 	return
 }
 
+// CalcIndicatedAltitude converts a pressure altitude (feet, standard pressure) to the altitude (feet) an
+// altimeter set to qnh (hPa) would indicate
+func CalcIndicatedAltitude(pressAlt float64, qnh float64) (altitude float64) {
+	press := 1013.25 * math.Pow(1.0 - pressAlt/145366.45, 1/0.190284)
+	altitude = 145366.45 * (1.0 - math.Pow(press/qnh, 0.190284))
+	return
+}
+
 // golang only defines min/max for float64. Really.
 func iMin(x, y int) int {
 	if x < y {
@@ -353,3 +345,10 @@ func iMax(x, y int) int {
 	}
 	return y
 }
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	events.go: Structured event log. Noteworthy state changes (GPS fix, SDRs, altitude source,
+		degraded modes, settings, errors) are recorded with subsystem, severity and key/value
+		fields in an in-memory ring buffer per subsystem, so the web UI can show e.g. the last
+		GPS events without grepping the log file. Every event is written to the log as well.
+		Served on /getEvents and included in the diagnostics zip (/downloadahrslogs).
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventRingSize = 200 // Events kept per subsystem
+
+// Subsystems
+const (
+	EVENT_GPS      = "gps"
+	EVENT_SDR      = "sdr"
+	EVENT_BARO     = "baro"
+	EVENT_SETTINGS = "settings"
+	EVENT_SYSTEM   = "system"
+	EVENT_BATTERY  = "battery"
+	EVENT_AIRSPACE = "airspace"
+)
+
+// Severities
+const (
+	EVENT_INFO = iota
+	EVENT_WARN
+	EVENT_ERROR
+)
+
+var eventSeverityNames = []string{"info", "warn", "error"}
+
+type stratuxEvent struct {
+	Time      time.Time // UTC
+	Subsystem string
+	Severity  string
+	Message   string
+	Fields    map[string]interface{} `json:",omitempty"`
+	severity  int
+}
+
+type eventRing struct {
+	events []stratuxEvent
+	next   int
+}
+
+var eventMutex = &sync.Mutex{}
+var eventRings = make(map[string]*eventRing)
+
+func (r *eventRing) add(e stratuxEvent) {
+	if len(r.events) < eventRingSize {
+		r.events = append(r.events, e)
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % eventRingSize
+}
+
+// ordered returns the events oldest first.
+func (r *eventRing) ordered() []stratuxEvent {
+	res := make([]stratuxEvent, 0, len(r.events))
+	res = append(res, r.events[r.next:]...)
+	return append(res, r.events[:r.next]...)
+}
+
+/*
+logEvent records an event. fields are alternating keys and values, e.g.
+logEvent(EVENT_GPS, EVENT_WARN, "Fix lost", "satellites", 3)
+*/
+func logEvent(subsystem string, severity int, message string, fields ...interface{}) {
+	e := stratuxEvent{
+		Time:      time.Now().UTC(),
+		Subsystem: subsystem,
+		Severity:  eventSeverityNames[severity],
+		Message:   message,
+		severity:  severity,
+	}
+	var fieldStr []string
+	if len(fields) > 1 {
+		e.Fields = make(map[string]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			e.Fields[key] = fields[i+1]
+			fieldStr = append(fieldStr, fmt.Sprintf("%s=%v", key, fields[i+1]))
+		}
+	}
+	log.Printf("[%s] %s: %s %s\n", subsystem, e.Severity, message, strings.Join(fieldStr, " "))
+
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	r, ok := eventRings[subsystem]
+	if !ok {
+		r = &eventRing{}
+		eventRings[subsystem] = r
+	}
+	r.add(e)
+}
+
+/*
+queryEvents returns the most recent events, oldest first.
+subsystem "" means all subsystems. limit <= 0 means no limit.
+*/
+func queryEvents(subsystem string, minSeverity int, limit int) []stratuxEvent {
+	eventMutex.Lock()
+	res := make([]stratuxEvent, 0)
+	for name, r := range eventRings {
+		if len(subsystem) > 0 && name != subsystem {
+			continue
+		}
+		for _, e := range r.ordered() {
+			if e.severity >= minSeverity {
+				res = append(res, e)
+			}
+		}
+	}
+	eventMutex.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	return res
+}
+
+func eventSeverityFromName(name string) int {
+	for i, n := range eventSeverityNames {
+		if n == name {
+			return i
+		}
+	}
+	return EVENT_INFO
+}
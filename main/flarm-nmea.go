@@ -16,13 +16,16 @@ import (
 	"encoding/hex"
 	"fmt"
 	"bufio"
+	"hash/fnv"
 	"io"
 	"log"
 	"math"
 	"net"
+	"sync"
 	"time"
 	"strconv"
 	"strings"
+	"sort"
 )
 
 /*
@@ -32,23 +35,39 @@ import (
 */
 
 func sendNetFLARM(msg string) {
-	sendMsg([]byte(msg), NETWORK_FLARM_NMEA, false) // UDP (and possibly future serial) output. Traffic messages are always non-queuable.
-	if len(msgchan) < cap(msgchan) {
-		msgchan <- msg // TCP output.
+	sendMsg([]byte(filterFlarmRange(msg, globalSettings.FlarmRange)), NETWORK_FLARM_NMEA, false) // UDP (and possibly future serial) output. Traffic messages are always non-queuable.
+	tcpNMEAServersMutex.Lock()
+	for _, s := range tcpNMEAServers {
+		if len(s.msgchan) < cap(s.msgchan) {
+			s.msgchan <- msg // TCP output.
+		}
 	}
+	tcpNMEAServersMutex.Unlock()
+	sendBluetoothNMEA(filterFlarmRange(msg, globalSettings.FlarmRange))
+}
 
+// flarmGPSStatus is the <GPS> field of $PFLAU.
+func flarmGPSStatus() int {
+	if !isGPSValid() {
+		return 0
+	}
+	if !ownshipAirborne() {
+		return 1 // 3D fix, on ground
+	}
+	return 2 // 3D fix, airborne
 }
 
 func makeFlarmPFLAUString(ti TrafficInfo) (msg string) {
 	// syntax: PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,<AlarmType>,<RelativeVertical>,<RelativeDistance>,<ID>
-	gpsStatus := 0
-	if isGPSValid() {
-		gpsStatus = 2
-	}
+	gpsStatus := flarmGPSStatus()
 
-	dist, bearing, _, _ := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	dist, bearing, distN, distE := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	bearingless := flarmBearingless(ti)
+	if bearingless {
+		dist, distN, distE = ti.DistanceEstimated, ti.DistanceEstimated, 0
+	}
 	relativeVertical := computeRelativeVertical(ti)
-	alarmLevel := computeAlarmLevel(dist, relativeVertical)
+	alarmLevel := computeAlarmLevel(ti, dist, distN, distE, relativeVertical)
 
 	// make bearing relative to ground track, with +-180deg
 	bearing = bearing - float64(mySituation.GPSTrueCourse)
@@ -64,42 +83,83 @@ func makeFlarmPFLAUString(ti TrafficInfo) (msg string) {
 		alarmType = 2
 	}
 
-	idstr := fmt.Sprintf("%.6X", ti.Icao_addr & 0xFFFFFF)
-	if len(ti.Tail) > 0 {
-		idstr += "!" + ti.Tail
-	}
-	// TODO: we are always airbourne for now
-	if alarmLevel > 0 {
+	idstr := flarmID(ti)
+	if alarmLevel > 0 && bearingless {
+		// Mode S target without position or no GPS: no <RelativeBearing>, the distance is estimated
+		msg = fmt.Sprintf("PFLAU,%d,1,%d,1,%d,,%d,%d,%d,%s", len(traffic), gpsStatus, alarmLevel, alarmType, relativeVertical, int32(math.Abs(dist)), idstr)
+	} else if alarmLevel > 0 {
 		msg = fmt.Sprintf("PFLAU,%d,1,%d,1,%d,%d,%d,%d,%d,%s", len(traffic), gpsStatus, alarmLevel, int32(bearing), alarmType, relativeVertical, int32(math.Abs(dist)), idstr)
 	} else {
 		msg = fmt.Sprintf("PFLAU,%d,1,%d,1,0,,0,,,", len(traffic), gpsStatus)
 	}
 
-	checksumPFLAU := byte(0x00)
-	for i := range msg {
-		checksumPFLAU = checksumPFLAU ^ byte(msg[i])
-	}
-	msg = (fmt.Sprintf("$%s*%02X\r\n", msg, checksumPFLAU))
+	msg = makeNMEASentence(msg)
 	return
 }
 
+/*
+	makeFlarmPFLAEString() creates the self-test result a FLARM sends after power-up and on request ($PFLAE,R):
+		$PFLAE,A,<Severity>,<ErrorCode>
+	We always report severity 0 (no error). Some glider computers (LX, Naviter) only accept a device as FLARM after seeing it.
+*/
+func makeFlarmPFLAEString() string {
+	msg := "PFLAE,A,0,0"
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeFlarmPFLAVString() creates the version sentence, sent after power-up, periodically and on request ($PFLAV,R):
+		$PFLAV,A,<HwVersion>,<SwVersion>,<ObstVersion>
+	Several EFBs enable FLARM features by the advertised software version, so it is configurable.
+*/
+func makeFlarmPFLAVString() string {
+	msg := fmt.Sprintf("PFLAV,A,%s,%s,%s", globalSettings.FlarmHwVersion, globalSettings.FlarmSwVersion, globalSettings.FlarmObstVersion)
+	return makeNMEASentence(msg)
+}
+
+// flarmVersionField removes characters that would break the $PFLAV sentence from a configured version.
+func flarmVersionField(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ',' || r == '*' || r == '$' || r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(v))
+}
+
+// handleFlarmQuery answers the $PFLAE,R and $PFLAV,R requests. Input is the sentence without $ and checksum.
+func handleFlarmQuery(x []string) (string, bool) {
+	if len(x) < 2 || x[1] != "R" {
+		return "", false
+	}
+	switch x[0] {
+	case "PFLAE":
+		return makeFlarmPFLAEString(), true
+	case "PFLAV":
+		return makeFlarmPFLAVString(), true
+	}
+	return "", false
+}
+
 // TODO: only very simplistic implementation
-func computeAlarmLevel(dist float64, relativeVertical int32) (alarmLevel uint8) {
-	if (dist < 926) && (relativeVertical < 152) && (relativeVertical > -152) { // 926 m = 0.5 NM; 152m = 500'
-		alarmLevel = 3
-	} else if (dist < 1852) && (relativeVertical < 304) && (relativeVertical > -304) { // 1852 m = 1.0 NM ; 304 m = 1000'
-		alarmLevel = 2
-	} else {
-		alarmLevel = 0
+func computeAlarmLevel(ti TrafficInfo, dist, distN, distE float64, relativeVertical int32) (alarmLevel uint8) {
+	// Taxiing: traffic is still reported, but without alarm. See airborne.go
+	if alarmsSuppressedOnGround() {
+		return 0
 	}
-	return
+	// Time to the closest point of approach, see collision.go. Thresholds depend on the target, see alarmprofiles.go
+	// Just after takeoff and low in the pattern, alarms are de-escalated
+	return limitLowAltitudeAlarm(collisionAlarmLevel(alarmProfileFor(ti), ti, dist, distN, distE, relativeVertical))
+}
+
+// flarmBearingless is true if only the estimated distance of a target is known: Mode S targets without position,
+// and all targets while our own position is lost (DEGRADED_NO_GPS, see degraded.go).
+func flarmBearingless(ti TrafficInfo) bool {
+	return !ti.Position_valid || isDegraded(DEGRADED_NO_GPS)
 }
 
 func computeRelativeVertical(ti TrafficInfo) (relativeVertical int32) {
-	altf := mySituation.BaroPressureAltitude
-	if !isTempPressValid() && isGPSValid() { // if no pressure altitude available, use GPS altitude
-		altf = mySituation.GPSAltitudeMSL
-	}
+	altf, _, _ := ownshipAltitude() // if no pressure altitude available, this is GPS altitude
 	if ti.AltIsGNSS && isGPSValid() {
 		// Altitude coming from OGN. We set the geoid separation to 0 in the OGN config, so OGN reports ellipsoid alt - we need to compare to that
 		altf = mySituation.GPSHeightAboveEllipsoid
@@ -108,6 +168,69 @@ func computeRelativeVertical(ti TrafficInfo) (relativeVertical int32) {
 	return
 }
 
+// flarmAircraftType maps a GDL90 emitter category to the FLARM aircraft type (hex digit).
+func flarmAircraftType(emitterCategory uint8) string {
+	acType := "0"
+	switch emitterCategory {
+	case 1: acType = "8" // light = piston
+	case 2, 3, 4, 5, 6: acType = "9" // heavy = jet
+	case 7: acType = "3" // helicopter = helicopter
+	case 9: acType = "1" // glider = glider
+	case 10: acType = "B" // lighter than air = balloon
+	case 11: acType = "4" // skydiver/parachute = sky diver
+	case 12: acType = "7" // paraglider, hanglider
+	}
+	return acType
+}
+
+const (
+	FLARM_SOURCE_FLARM = "FLARM"
+	FLARM_SOURCE_ADSB  = "ADS-B"
+	FLARM_SOURCE_ADSR  = "ADS-R"
+	FLARM_SOURCE_TISB  = "TIS-B"
+	FLARM_SOURCE_MODES = "Mode-S"
+)
+
+// <Source> codes of PFLAA v9
+var flarmSourceCodes = map[string]int{
+	FLARM_SOURCE_FLARM: 0,
+	FLARM_SOURCE_ADSB:  1,
+	FLARM_SOURCE_ADSR:  3,
+	FLARM_SOURCE_TISB:  4,
+	FLARM_SOURCE_MODES: 6,
+}
+
+// flarmSourceCode returns the PFLAA <Source> of a target. Targets from a FLARM device keep what it reported.
+func flarmSourceCode(ti TrafficInfo) int {
+	if code, ok := flarmSourceCodes[ti.FlarmSource]; ok {
+		return code
+	}
+	if ti.Last_source == TRAFFIC_SOURCE_OGN {
+		return flarmSourceCodes[FLARM_SOURCE_FLARM]
+	}
+	switch ti.TargetType {
+	case TARGET_TYPE_ADSR:
+		return flarmSourceCodes[FLARM_SOURCE_ADSR]
+	case TARGET_TYPE_TISB, TARGET_TYPE_TISB_S:
+		return flarmSourceCodes[FLARM_SOURCE_TISB]
+	case TARGET_TYPE_MODE_S, TARGET_TYPE_MLAT:
+		return flarmSourceCodes[FLARM_SOURCE_MODES]
+	}
+	return flarmSourceCodes[FLARM_SOURCE_ADSB]
+}
+
+const flarmStealthVerticalStep = 100 // m, resolution of <RelativeVertical> in stealth output
+
+var flarmStealthSalt = uint32(time.Now().UnixNano())
+
+// flarmStealthID returns a random ID for a target in stealth output. It is stable during this session, so
+// displays can still follow the target, but changes with every restart and can't be mapped back.
+func flarmStealthID(ti TrafficInfo) string {
+	h := fnv.New32a()
+	binary.Write(h, binary.LittleEndian, [2]uint32{flarmStealthSalt, trafficInfoKey(ti)})
+	return fmt.Sprintf("%06X", h.Sum32()&0xFFFFFF)
+}
+
 /*
 	makeFlarmPFLAAString() creates a NMEA-formatted PFLAA string (FLARM traffic format) with checksum from the referenced
 		traffic object.
@@ -152,31 +275,44 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool, alarmLevel ui
 							D = unmanned aerial vehicle (UAV)
 							E = unknown
 							F = static object
+		Protocol version 9 (globalSettings.FlarmProtocolVersion) appends:
+			<NoTrack>: 1 = the target requested no tracking
+			<Source>: 0 = FLARM, 1 = ADS-B, 3 = ADS-R, 4 = TIS-B, 6 = Mode-S
+			<RSSI>: Signal strength in dBm, empty if unknown
+		With globalSettings.FlarmOutStealth, targets without alarm are sent like a FLARM in stealth mode would:
+		anonymous ID, <RelativeVertical> rounded to flarmStealthVerticalStep, no track, speed and climb rate.
 	*/
 
-	var idType, checksum uint8
+	var idType uint8
 	var relativeNorth, relativeEast, relativeVertical, groundSpeed int32
-	var msg2 string
 
-	// Addr type "NON-ICAO" mapped to Flarm ID, rest mapped to ICAO.
+	// Addr type "NON-ICAO" mapped to Flarm ID, ICAO (ADS-B, TIS-B, ADS-R) to ICAO.
+	// TIS-B track files and other anonymous addresses change, so they are "random" IDs.
 	// Especially SkyDemon is picky and only accepts NMEA messages with 0-2, but nothing else.
 	if ti.Addr_type == 1 {
 		idType = 2
-	} else {
+	} else if isICAOAddrType(ti.Addr_type) {
 		idType = 1
+	} else {
+		idType = 0
 	}
 
 	// determine distance and bearing to target
 	dist, bearing, distN, distE := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
-	if !ti.Position_valid {
+	bearingless := flarmBearingless(ti)
+	if bearingless {
+		if ti.DistanceEstimated <= 0 {
+			return "", false, 0 // No GPS and no signal strength based estimate: nothing to show
+		}
 		dist = ti.DistanceEstimated
 		distN = ti.DistanceEstimated
+		distE = 0
 	}
 	if globalSettings.DEBUG {
 		log.Printf("FLARM - ICAO target %X (%s) is %.1f meters away at %.1f degrees\n", ti.Icao_addr, ti.Tail, dist, bearing)
 	}
 
-	// TODO: Estimate distance for bearingless / distanceless Mode S (1090) aircraft targets
+	// Bearingless Mode S targets: distance estimated from the signal strength, see estimateDistance()
 
 	//if distN > 200000 || distN < -200000 || distE > 200000 || distE < -200000 {
 	//	msg = ""
@@ -188,51 +324,115 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool, alarmLevel ui
 	//}
 
 	relativeVertical = computeRelativeVertical(ti)
-	alarmLevel = computeAlarmLevel(dist, relativeVertical)
+	alarmLevel = computeAlarmLevel(ti, dist, distN, distE, relativeVertical)
 
 	if ti.Speed_valid {
 		groundSpeed = int32(float32(ti.Speed) * 0.5144) // convert to m/s
 	}
 
-	acType := "0"
-	switch ti.Emitter_category {
-	case 1: acType = "8" // light = piston
-	case 2, 3, 4, 5, 6: acType = "9" // heavy = jet
-	case 7: acType = "3" // helicopter = helicopter
-	case 9: acType = "1" // glider = glider
-	case 10: acType = "B" // lighter than air = balloon
-	case 11: acType = "4" // skydiver/parachute = sky diver
-	case 12: acType = "7" // paraglider, hanglider
-	}
+	acType := flarmAircraftType(ti.Emitter_category)
 
 	climbRate := float32(ti.Vvel) * 0.3048 / 60 // convert to m/s
 
-	idstr := fmt.Sprintf("%.6X", ti.Icao_addr & 0xFFFFFF)
-	if len(ti.Tail) > 0 {
-		idstr += "!" + ti.Tail
-	}
+	idstr := flarmID(ti)
 
-	if ti.Position_valid {
+	if globalSettings.FlarmOutStealth && alarmLevel == 0 {
+		// FLARM stealth semantics: no movement data, coarse altitude and a random ID for targets without alarm
+		idType = flarmIDTypeAnonymous
+		idstr = flarmStealthID(ti)
+		relativeVertical = int32(math.Round(float64(relativeVertical)/flarmStealthVerticalStep) * flarmStealthVerticalStep)
+		if !bearingless {
+			msg = fmt.Sprintf("PFLAA,%d,%d,%d,%d,%d,%s,,,,,%s", alarmLevel, relativeNorth, relativeEast, relativeVertical, idType, idstr, acType)
+		} else {
+			msg = fmt.Sprintf("PFLAA,%d,%d,,%d,%d,%s,,,,,%s", alarmLevel, int32(math.Abs(dist)), relativeVertical, idType, idstr, acType)
+		}
+	} else if !bearingless {
 		msg = fmt.Sprintf("PFLAA,%d,%d,%d,%d,%d,%s,%d,%d,%d,%0.1f,%s", alarmLevel, relativeNorth, relativeEast, relativeVertical, idType, idstr, uint16(ti.Track), uint16(ti.TurnRate), groundSpeed, climbRate, acType)
 	} else {
 		msg = fmt.Sprintf("PFLAA,%d,%d,,%d,%d,%s,,,,%0.1f,%s", alarmLevel, int32(math.Abs(dist)), relativeVertical, idType, idstr, climbRate, acType) // prototype for bearingless traffic
 	}
 	//msg = fmt.Sprintf("PFLAA,%d,%d,%d,%d,%d,%X!%s,%d,,%d,%0.1f,%d", alarmLevel, relativeNorth, relativeEast, relativeVertical, idType, ti.Icao_addr, ti.Tail, ti.Track, groundSpeed, climbRate, acType)
-	
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
+	if globalSettings.FlarmProtocolVersion >= 9 {
+		noTrack := 0
+		if ti.NoTrack {
+			noTrack = 1
+		}
+		rssi := ""
+		if ti.SignalLevel > -100 && ti.SignalLevel < 20 { // -999: unknown
+			rssi = fmt.Sprintf("%d", int(math.Round(ti.SignalLevel)))
+		}
+		msg += fmt.Sprintf(",%d,%d,%s", noTrack, flarmSourceCode(ti), rssi)
 	}
-	msg = (fmt.Sprintf("$%s*%02X\r\n", msg, checksum))
 
-	checksum = 0 // reset for next message
-	for i := range msg2 {
-		checksum = checksum ^ byte(msg2[i])
-	}
-	msg = msg
+	msg = makeNMEASentence(msg)
 	valid = true
 	return
 }
 
+/*
+	PFLAA scheduling for dense traffic. With 80+ OGN targets around, a full cycle is more than a 38400 baud
+	serial consumer can take. If globalSettings.FlarmMaxSentences is set, the FlarmPriorityTargets most
+	threatening targets (highest alarm level, then closest) are sent every cycle, the remaining slots
+	go to the other targets in turn - the ones that waited longest first.
+*/
+
+type pflaaCandidate struct {
+	ti         TrafficInfo
+	msg        string
+	alarmLevel uint8
+}
+
+var pflaaLastSentCycle = make(map[uint32]uint64) // By trafficInfoKey(). Protected by trafficMutex
+var pflaaCycle uint64
+
+// schedulePFLAA returns the PFLAA sentences to send in this cycle. Called by sendTrafficUpdates() with trafficMutex held.
+func schedulePFLAA(candidates []pflaaCandidate) []pflaaCandidate {
+	pflaaCycle++
+	max := globalSettings.FlarmMaxSentences
+	if globalSettings.FlarmRange > 0 {
+		inRange := candidates[:0]
+		for _, c := range candidates {
+			if !c.ti.BearingDist_valid || c.ti.Distance <= float64(globalSettings.FlarmRange) {
+				inRange = append(inRange, c)
+			}
+		}
+		candidates = inRange
+	}
+
+	selected := candidates
+	if max > 0 && len(candidates) > max {
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].alarmLevel != candidates[j].alarmLevel {
+				return candidates[i].alarmLevel > candidates[j].alarmLevel
+			}
+			return candidates[i].ti.Distance < candidates[j].ti.Distance
+		})
+		priority := globalSettings.FlarmPriorityTargets
+		if priority > max {
+			priority = max
+		} else if priority < 0 {
+			priority = 0
+		}
+		rest := append([]pflaaCandidate(nil), candidates[priority:]...)
+		sort.SliceStable(rest, func(i, j int) bool {
+			return pflaaLastSentCycle[trafficInfoKey(rest[i].ti)] < pflaaLastSentCycle[trafficInfoKey(rest[j].ti)]
+		})
+		selected = append(candidates[:priority:priority], rest[:max-priority]...)
+	}
+
+	// Forget targets that are gone
+	lastSent := make(map[uint32]uint64, len(candidates))
+	for _, c := range candidates {
+		key := trafficInfoKey(c.ti)
+		lastSent[key] = pflaaLastSentCycle[key]
+	}
+	for _, c := range selected {
+		lastSent[trafficInfoKey(c.ti)] = pflaaCycle
+	}
+	pflaaLastSentCycle = lastSent
+	return selected
+}
+
 /*
 	makeGPRMCString() creates a NMEA-formatted GPRMC string (GPS recommended minimum data) with checksum from the current GPS position.
 		If current position is invalid, the GPRMC string will indicate no-fix.
@@ -270,18 +470,19 @@ func makeGPRMCString() string {
 		LastGroundTrackTime     time.Time
 	*/
 
-	lastFix := float64(mySituation.GPSLastFixSinceMidnightUTC)
+	s := nmeaPositionSituation() // Dead reckoned at output rates above 1 Hz
+	lastFix := float64(s.GPSLastFixSinceMidnightUTC)
 	hr := math.Floor(lastFix / 3600)
 	lastFix -= 3600 * hr
 	mins := math.Floor(lastFix / 60)
 	sec := lastFix - mins*60
 
 	status := "V"
-	if isGPSValid() && mySituation.GPSFixQuality > 0 {
+	if s.GPSValid && s.GPSFixQuality > 0 {
 		status = "A"
 	}
 
-	lat := float64(mySituation.GPSLatitude)
+	lat := float64(s.GPSLatitude)
 	ns := "N"
 	if lat < 0 {
 		lat = -lat
@@ -293,7 +494,7 @@ func makeGPRMCString() string {
 	lat = deg*100 + min
 
 	ew := "E"
-	lng := float64(mySituation.GPSLongitude)
+	lng := float64(s.GPSLongitude)
 	if lng < 0 {
 		lng = -lng
 		ew = "W"
@@ -303,32 +504,140 @@ func makeGPRMCString() string {
 	min = (lng - deg) * 60
 	lng = deg*100 + min
 
-	gs := float32(mySituation.GPSGroundSpeed)
-	trueCourse := float32(mySituation.GPSTrueCourse)
+	gs := float32(s.GPSGroundSpeed)
+	trueCourse := float32(s.GPSTrueCourse)
 	yy, mm, dd := time.Now().UTC().Date()
 	yy = yy % 100
 	var magVar, mvEW string
+	if s.GPSValid {
+		// See wmm.go
+		mv := magneticVariation(s.GPSLatitude, s.GPSLongitude)
+		magVar, mvEW = fmt.Sprintf("%.1f", math.Abs(mv)), "E"
+		if mv < 0 {
+			mvEW = "W"
+		}
+	}
 	mode := "N"
-	if mySituation.GPSFixQuality == 1 {
+	if s.GPSFixQuality == 1 {
 		mode = "A"
-	} else if mySituation.GPSFixQuality == 2 {
+	} else if s.GPSFixQuality == 2 {
 		mode = "D"
 	}
 
 	var msg string
 
-	if isGPSValid() {
-		msg = fmt.Sprintf("GPRMC,%02.f%02.f%05.2f,%s,%010.5f,%s,%011.5f,%s,%.1f,%.1f,%02d%02d%02d,%s,%s,%s", hr, mins, sec, status, lat, ns, lng, ew, gs, trueCourse, dd, mm, yy, magVar, mvEW, mode)
+	if s.GPSValid {
+		msg = fmt.Sprintf("%sRMC,%02.f%02.f%05.2f,%s,%010.5f,%s,%011.5f,%s,%.1f,%.1f,%02d%02d%02d,%s,%s,%s", nmeaTalkerID(), hr, mins, sec, status, lat, ns, lng, ew, gs, trueCourse, dd, mm, yy, magVar, mvEW, mode)
+	} else {
+		msg = fmt.Sprintf("%sRMC,,%s,,,,,,,%02d%02d%02d,%s,%s,%s", nmeaTalkerID(), status, dd, mm, yy, magVar, mvEW, mode) // return null lat-lng and velocity if invalid GPS
+	}
+
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeGPGLLString() creates the GPGLL sentence (position and time) for consumers that don't parse RMC:
+		$GPGLL,<Lat>,<N|S>,<Lon>,<E|W>,<Time>,<Status>,<Mode>
+*/
+func makeGPGLLString() string {
+	s := getSituation()
+	lastFix := float64(s.GPSLastFixSinceMidnightUTC)
+	hr := math.Floor(lastFix / 3600)
+	lastFix -= 3600 * hr
+	mins := math.Floor(lastFix / 60)
+	sec := lastFix - mins*60
+
+	mode := "N"
+	if s.GPSFixQuality == 1 {
+		mode = "A"
+	} else if s.GPSFixQuality == 2 {
+		mode = "D"
+	}
+
+	var msg string
+	if s.GPSValid && s.GPSFixQuality > 0 {
+		lat := float64(s.GPSLatitude)
+		ns := "N"
+		if lat < 0 {
+			lat = -lat
+			ns = "S"
+		}
+		deg := math.Floor(lat)
+		lat = deg*100 + (lat-deg)*60
+
+		lng := float64(s.GPSLongitude)
+		ew := "E"
+		if lng < 0 {
+			lng = -lng
+			ew = "W"
+		}
+		deg = math.Floor(lng)
+		lng = deg*100 + (lng-deg)*60
+		msg = fmt.Sprintf("%sGLL,%010.5f,%s,%011.5f,%s,%02.f%02.f%05.2f,A,%s", nmeaTalkerID(), lat, ns, lng, ew, hr, mins, sec, mode)
+	} else {
+		msg = nmeaTalkerID() + "GLL,,,,,,V,N"
+	}
+
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeGPVTGString() creates the GPVTG sentence (track and ground speed) for displays that don't read it from RMC:
+		$GPVTG,<TrueCourse>,T,<MagCourse>,M,<Speed>,N,<Speed>,K,<Mode>
+	Magnetic course from the variation in wmm.go.
+*/
+func makeGPVTGString() string {
+	s := getSituation()
+	mode := "N"
+	if s.GPSFixQuality == 1 {
+		mode = "A"
+	} else if s.GPSFixQuality == 2 {
+		mode = "D"
+	}
+
+	var msg string
+	if s.GPSValid {
+		magCourse := magneticTrack(float64(s.GPSTrueCourse), s.GPSLatitude, s.GPSLongitude)
+		msg = fmt.Sprintf("%sVTG,%.1f,T,%.1f,M,%.1f,N,%.1f,K,%s", nmeaTalkerID(), s.GPSTrueCourse, magCourse, s.GPSGroundSpeed, s.GPSGroundSpeed*1.852, mode)
 	} else {
-		msg = fmt.Sprintf("GPRMC,,%s,,,,,,,%02d%02d%02d,%s,%s,%s", status, dd, mm, yy, magVar, mvEW, mode) // return null lat-lng and velocity if invalid GPS
+		msg = nmeaTalkerID() + "VTG,,T,,M,,N,,K,N"
+	}
+
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeHeadingStrings() creates the heading sentences from the AHRS, empty without an IMU or valid heading:
+		$HEHDT,<TrueHeading>,T
+		$HCHDG,<MagHeading>,,,<Variation>,<E|W>
+	The fused AHRS heading is true (the AHRS is aided by the GPS track). Magnetic heading and variation
+	from wmm.go, so HCHDG needs a GPS position. The GPS-only fallback of the AHRS is not sent, that is
+	the track, not the heading.
+*/
+func makeHeadingStrings() string {
+	if !globalSettings.IMU_Sensor_Enabled || !globalStatus.IMUConnected || !isAHRSValid() {
+		return ""
+	}
+	s := getSituation()
+	if isAHRSInvalidValue(s.AHRSGyroHeading) {
+		return ""
+	}
+	hdg := math.Mod(s.AHRSGyroHeading+360, 360)
+	msgs := []string{fmt.Sprintf("HEHDT,%.1f,T", hdg)}
+	if s.GPSValid {
+		mv := magneticVariation(s.GPSLatitude, s.GPSLongitude)
+		mvDir := "E"
+		if mv < 0 {
+			mvDir = "W"
+		}
+		msgs = append(msgs, fmt.Sprintf("HCHDG,%.1f,,,%.1f,%s", magneticTrack(hdg, s.GPSLatitude, s.GPSLongitude), math.Abs(mv), mvDir))
 	}
 
-	var checksum byte
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
+	ret := ""
+	for _, msg := range msgs {
+		ret += makeNMEASentence(msg)
 	}
-	msg = fmt.Sprintf("$%s*%X\r\n", msg, checksum)
-	return msg
+	return ret
 }
 
 func makeGPGGAString() string {
@@ -350,14 +659,14 @@ func makeGPGGAString() string {
 	 diffStation
 	*/
 
-	thisSituation := mySituation
+	thisSituation := nmeaPositionSituation()
 	lastFix := float64(thisSituation.GPSLastFixSinceMidnightUTC)
 	hr := math.Floor(lastFix / 3600)
 	lastFix -= 3600 * hr
 	mins := math.Floor(lastFix / 60)
 	sec := lastFix - mins*60
 
-	lat := float64(mySituation.GPSLatitude)
+	lat := float64(thisSituation.GPSLatitude)
 	ns := "N"
 	if lat < 0 {
 		lat = -lat
@@ -369,7 +678,7 @@ func makeGPGGAString() string {
 	lat = deg*100 + min
 
 	ew := "E"
-	lng := float64(mySituation.GPSLongitude)
+	lng := float64(thisSituation.GPSLongitude)
 	if lng < 0 {
 		lng = -lng
 		ew = "W"
@@ -393,19 +702,172 @@ func makeGPGGAString() string {
 
 	var msg string
 
-	if isGPSValid() {
-		msg = fmt.Sprintf("GPGGA,%02.f%02.f%05.2f,%010.5f,%s,%011.5f,%s,%d,%d,%.2f,%.1f,M,%.1f,M,,", hr, mins, sec, lat, ns, lng, ew, thisSituation.GPSFixQuality, numSV, hdop, alt, geoidSep)
+	if thisSituation.GPSValid {
+		msg = fmt.Sprintf("%sGGA,%02.f%02.f%05.2f,%010.5f,%s,%011.5f,%s,%d,%d,%.2f,%.1f,M,%.1f,M,,", nmeaTalkerID(), hr, mins, sec, lat, ns, lng, ew, thisSituation.GPSFixQuality, numSV, hdop, alt, geoidSep)
+	} else {
+		msg = fmt.Sprintf("%sGGA,,,,,,0,%d,,,,,,,", nmeaTalkerID(), numSV)
+	}
+
+	return makeNMEASentence(msg)
+
+}
+
+/*
+	makePSTXString creates the proprietary Stratux status sentence, so simple displays
+	can show receiver health without talking HTTP.
+
+	$PSTX,<Targets>,<AlarmLevel>,<GPSFix>,<Sats>,<NACp>,<Towers>,<Battery>*cs
+
+	Targets     Number of traffic targets currently sent to the EFB
+	AlarmLevel  Highest FLARM alarm level of all targets, 0-3
+	GPSFix      0 = no fix, 1 = 3D fix, 2 = SBAS/DGPS fix
+	Sats        Number of satellites used in solution
+	NACp        Navigation accuracy category of the own position
+	Towers      Number of ADS-B ground stations currently received
+	Battery     Battery charge in percent. Empty if unknown.
+*/
+func makePSTXString() string {
+	var fix uint8
+	var sats uint16
+	var nacp uint8
+	if s := getSituation(); s.GPSValid {
+		fix = s.GPSFixQuality
+		sats = s.GPSSatellites
+		nacp = s.GPSNACp
+	}
+	trafficSnap := getTrafficSnapshot()
+
+	ADSBTowerMutex.Lock()
+	towers := 0
+	for _, tower := range ADSBTowers {
+		if tower.Messages_last_minute > 0 {
+			towers++
+		}
+	}
+	ADSBTowerMutex.Unlock()
+
+	battery := ""
+	if b := globalStatus.Battery; len(b.Source) > 0 && b.Charge >= 0 {
+		battery = strconv.Itoa(b.Charge)
+	}
+
+	msg := fmt.Sprintf("PSTX,%d,%d,%d,%d,%d,%d,%s", trafficSnap.Count, trafficSnap.HighestAlarmLevel, fix, sats, nacp, towers, battery)
+
+	return makeNMEASentence(msg)
+}
+
+// nmeaSatellites returns the tracked satellites that have an NMEA 0183 ID (GPS, SBAS, GLONASS), ordered by ID.
+func nmeaSatellites() []SatelliteInfo {
+	mySituation.muSatellite.Lock()
+	sats := make([]SatelliteInfo, 0, len(Satellites))
+	for _, sat := range Satellites {
+		if sat.SatelliteNMEA > 0 && sat.SatelliteNMEA <= 96 {
+			sats = append(sats, sat)
+		}
+	}
+	mySituation.muSatellite.Unlock()
+	sort.Slice(sats, func(i, j int) bool { return sats[i].SatelliteNMEA < sats[j].SatelliteNMEA })
+	return sats
+}
+
+// nmeaTalkerID returns the talker ID of our GPS sentences: "GN" if enabled (globalSettings.NMEAOut_GNTalker) and
+// the solution uses more than one constellation, "GP" otherwise. GSV stays GP, it lists all satellites with their NMEA IDs.
+func nmeaTalkerID() string {
+	if !globalSettings.NMEAOut_GNTalker {
+		return "GP"
+	}
+	constellations := make(map[uint8]bool)
+	mySituation.muSatellite.Lock()
+	for _, sat := range Satellites {
+		if sat.InSolution && sat.Type != SAT_TYPE_UNKNOWN && sat.Type != SAT_TYPE_SBAS {
+			constellations[sat.Type] = true
+		}
+	}
+	mySituation.muSatellite.Unlock()
+	if len(constellations) > 1 {
+		return "GN"
+	}
+	return "GP"
+}
+
+/*
+	makeGPGSAString() creates the GPGSA sentence (DOP and satellites in solution):
+		$GPGSA,A,<FixMode>,<PRN>*12,<PDOP>,<HDOP>,<VDOP>
+	DOPs are estimated back from our accuracy estimates, see processNMEALine().
+*/
+func makeGPGSAString() string {
+	thisSituation := getSituation()
+	var msg string
+	if thisSituation.GPSValid {
+		prns := make([]string, 12)
+		i := 0
+		for _, sat := range nmeaSatellites() {
+			if sat.InSolution && i < len(prns) {
+				prns[i] = fmt.Sprintf("%02d", sat.SatelliteNMEA)
+				i++
+			}
+		}
+		hdop := math.Max(0.5, float64(thisSituation.GPSHorizontalAccuracy)/5)
+		vdop := math.Max(0.5, float64(thisSituation.GPSVerticalAccuracy)/5)
+		msg = fmt.Sprintf("%sGSA,A,3,%s,%.1f,%.1f,%.1f", nmeaTalkerID(), strings.Join(prns, ","), math.Sqrt(hdop*hdop+vdop*vdop), hdop, vdop)
 	} else {
-		msg = fmt.Sprintf("GPGGA,,,,,,0,%d,,,,,,,", numSV)
+		msg = nmeaTalkerID() + "GSA,A,1,,,,,,,,,,,,,,,"
 	}
 
-	var checksum byte
-	for i := range msg {
-		checksum = checksum ^ byte(msg[i])
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeGPGSVString() creates the GPGSV sentences (satellites in view), four satellites per sentence:
+		$GPGSV,<NumMsg>,<MsgNum>,<NumSats>,{<PRN>,<Elevation>,<Azimuth>,<SNR>}*4
+	Returns all sentences concatenated, an empty string if no satellites are tracked.
+*/
+func makeGPGSVString() string {
+	sats := nmeaSatellites()
+	numMsg := (len(sats) + 3) / 4
+	var sentences string
+	for m := 0; m < numMsg; m++ {
+		msg := fmt.Sprintf("GPGSV,%d,%d,%02d", numMsg, m+1, len(sats))
+		for _, sat := range sats[m*4 : int(math.Min(float64(len(sats)), float64(m*4+4)))] {
+			snr := ""
+			if sat.Signal > 0 {
+				snr = fmt.Sprintf("%02d", sat.Signal)
+			}
+			elev := int(math.Max(0, math.Min(90, float64(sat.Elevation))))
+			msg += fmt.Sprintf(",%02d,%02d,%03d,%s", sat.SatelliteNMEA, elev, (int(sat.Azimuth)+360)%360, snr)
+		}
+
+		sentences += makeNMEASentence(msg)
+	}
+	return sentences
+}
+
+/*
+	makePGRMZString() creates the Garmin altitude sentence with our pressure altitude in feet.
+	Returns an empty string if no pressure altitude is available (see degraded.go).
+*/
+func makePGRMZString() string {
+	// Without our real pressure altitude, let the display use GNSS altitude instead of a guess.
+	if !isTempPressValid() || isDegraded(DEGRADED_NO_BARO) {
+		return ""
+	}
+	msg := fmt.Sprintf("PGRMZ,%d,f,3", int(mySituation.BaroPressureAltitude))
+
+	return makeNMEASentence(msg)
+}
+
+/*
+	makeNmeaOutPGRMZString() creates the $PGRMZ for the NMEA outputs. Without baro it falls back to GPS
+	altitude if the user allows it (globalSettings.PGRMZ_GPSFallback), so EFBs that need PGRMZ at all
+	keep working. Only here: other users of makePGRMZString() must get pressure altitude or nothing.
+*/
+func makeNmeaOutPGRMZString() string {
+	if msg := makePGRMZString(); len(msg) > 0 || !globalSettings.PGRMZ_GPSFallback || !isGPSValid() {
+		return msg
 	}
-	msg = fmt.Sprintf("$%s*%X\r\n", msg, checksum)
-	return msg
+	msg := fmt.Sprintf("PGRMZ,%d,f,3", int(mySituation.GPSAltitudeMSL))
 
+	return makeNMEASentence(msg)
 }
 
 /*
@@ -416,43 +878,134 @@ http://synflood.at/tmp/golang-slides/mrmcd2012.html#2
 */
 
 type tcpClient struct {
-	conn net.Conn
-	ch   chan string
+	conn       net.Conn
+	ch         chan string
+	flarmRange *flarmChannelRange // set by the client via PFLAC, see flarmrange.go
+	out        *tcpClientOutput   // nil if the client can't use the FLARM binary protocol, see flarmbinary.go
 }
 
-var msgchan chan string
+const (
+	airConnectPort            = 2000 // The passcode is only asked for on the AIR Connect port
+	airConnectPasscodeTimeout = 30 * time.Second
+)
 
-func tcpNMEAOutListener() {
-	ln, err := net.Listen("tcp", ":2000")
+// tcpNMEAServer is one TCP NMEA output port with its own clients, see globalSettings.NMEAOutTCPPorts.
+type tcpNMEAServer struct {
+	port    int
+	ln      net.Listener
+	msgchan chan string
+	addchan chan tcpClient
+	rmchan  chan tcpClient
+	quit    chan struct{}
+}
+
+var tcpNMEAServers []*tcpNMEAServer
+var tcpNMEAServersMutex = &sync.Mutex{}
+var tcpNMEAOutReload = make(chan struct{}, 1)
+
+func startTCPNMEAServer(port int) (*tcpNMEAServer, error) {
+	ln, err := listenTCP(fmt.Sprintf(":%d", port))
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
+	}
+	s := &tcpNMEAServer{
+		port:    port,
+		ln:      ln,
+		msgchan: make(chan string, 1024), // buffered channel n = 1024
+		addchan: make(chan tcpClient),
+		rmchan:  make(chan tcpClient),
+		quit:    make(chan struct{}),
 	}
+	go handleMessages(s)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-s.quit:
+					return
+				default:
+				}
+				fmt.Println(err)
+				continue
+			}
+			go handleNmeaOutConnection(conn, s)
+		}
+	}()
+	log.Printf("NMEA TCP output listening on port %d\n", port)
+	return s, nil
+}
 
-	msgchan = make(chan string, 1024) // buffered channel n = 1024
-	addchan := make(chan tcpClient)
-	rmchan := make(chan tcpClient)
+// stop closes the listener and disconnects all clients.
+func (s *tcpNMEAServer) stop() {
+	close(s.quit)
+	s.ln.Close()
+}
+
+// reloadTCPNMEAOutListeners is called when NMEAOutTCPPorts changed.
+func reloadTCPNMEAOutListeners() {
+	select {
+	case tcpNMEAOutReload <- struct{}{}:
+	default:
+	}
+}
 
-	go handleMessages(msgchan, addchan, rmchan)
+// tcpNMEAOutListener runs a server for each port in globalSettings.NMEAOutTCPPorts and follows changes of the setting.
+func tcpNMEAOutListener() {
+	servers := make(map[int]*tcpNMEAServer)
+	defer func() { // Let the supervisor listen again after a panic
+		tcpNMEAServersMutex.Lock()
+		tcpNMEAServers = nil
+		tcpNMEAServersMutex.Unlock()
+		for _, s := range servers {
+			s.stop()
+		}
+	}()
 
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			fmt.Println(err)
-			continue
+		wanted := make(map[int]bool)
+		for _, port := range globalSettings.NMEAOutTCPPorts {
+			wanted[port] = true
+		}
+		for port, s := range servers {
+			if !wanted[port] {
+				log.Printf("NMEA TCP output on port %d stopped\n", port)
+				s.stop()
+				delete(servers, port)
+			}
 		}
+		for port := range wanted {
+			if _, ok := servers[port]; ok {
+				continue
+			}
+			s, err := startTCPNMEAServer(port)
+			if err != nil {
+				addSingleSystemErrorf(fmt.Sprintf("nmea-tcp-%d", port), "NMEA TCP output: can't listen on port %d: %s", port, err.Error())
+				continue
+			}
+			servers[port] = s
+		}
+
+		list := make([]*tcpNMEAServer, 0, len(servers))
+		for _, s := range servers {
+			list = append(list, s)
+		}
+		tcpNMEAServersMutex.Lock()
+		tcpNMEAServers = list
+		tcpNMEAServersMutex.Unlock()
 
-		go handleNmeaOutConnection(conn, msgchan, addchan, rmchan)
+		<-tcpNMEAOutReload
 	}
 }
 
 /* Server that can be used to feed NMEA data to, e.g. to connect OGN Tracker wirelessly */
 func tcpNMEAInListener() {
-	ln, err := net.Listen("tcp", ":30011")
+	ln, err := listenTCP(":30011")
 	if err != nil {
 		log.Printf(err.Error())
 		return
 	}
+	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -466,22 +1019,32 @@ func tcpNMEAInListener() {
 func handleNmeaInConnection(c net.Conn) {
 	defer c.Close()
 	reader := bufio.NewReader(c)
-	// Set to fixed GPS_TYPE_NETWORK in the beginning, to override previous detected NMEA types
-	globalStatus.GPS_detected_type = GPS_TYPE_NETWORK
-	globalStatus.GPS_NetworkRemoteIp = strings.Split(c.RemoteAddr().String(), ":")[0]
+	remoteIp := strings.Split(c.RemoteAddr().String(), ":")[0]
+	key := addNMEAInFeeder(NMEA_SOURCE_TCP, c.RemoteAddr().String(), remoteIp)
+	defer removeNMEAInFeeder(key)
+	feed := &ognTrackerFeed{conn: c}
+	defer feed.unregister()
+	done := make(chan struct{})
+	defer close(done)
+	go feed.run(done)
 	for {
-		globalStatus.GPS_connected = true
-		// Keep detected protocol, only ensure type=network
-		globalStatus.GPS_detected_type = GPS_TYPE_NETWORK | (globalStatus.GPS_detected_type & 0xf0)
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			break
 		}
-		processNMEALine(line)
+		captureNMEA(NMEA_SOURCE_TCP, remoteIp, line)
+		sentence, valid := checkNMEAInput(NMEA_SOURCE_TCP, remoteIp, line)
+		if !valid {
+			continue
+		}
+		line = line[strings.Index(line, "$"):]
+		if reply, ok := handleFlarmQuery(strings.Split(sentence, ",")); ok {
+			io.WriteString(c, reply)
+			continue
+		}
+		feed.inspect(line)
+		processNMEAInLine(key, line)
 	}
-	globalStatus.GPS_connected = false
-	globalStatus.GPS_detected_type = 0
-	globalStatus.GPS_NetworkRemoteIp = ""
 }
 
 /*
@@ -497,74 +1060,178 @@ func (c tcpClient) ReadLinesInto(ch chan<- string) {
 }
 */
 
-func (c tcpClient) WriteLinesFrom(ch <-chan string) {
-	for msg := range ch {
-		_, err := io.WriteString(c.conn, msg)
-		if err != nil {
+// writeNMEA sends NMEA output to the client, nothing while it is in FLARM binary mode.
+func (c tcpClient) writeNMEA(msg string) error {
+	if c.out != nil {
+		c.out.mu.Lock()
+		defer c.out.mu.Unlock()
+		if c.out.binary {
+			return nil
+		}
+	}
+	_, err := io.WriteString(c.conn, msg)
+	return err
+}
+
+func (c tcpClient) WriteLinesFrom(ch <-chan string, quit <-chan struct{}) {
+	for {
+		select {
+		case msg := <-ch:
+			if err := c.writeNMEA(filterFlarmChannel(msg, c.flarmRange)); err != nil {
+				return
+			}
+		case <-quit:
 			return
 		}
 	}
 }
 
-func handleNmeaOutConnection(c net.Conn, msgchan chan<- string, addchan chan<- tcpClient, rmchan chan<- tcpClient) {
+// checkAirConnectPasscode waits for the AIR Connect passcode, with or without line end. Asks again after a wrong one.
+// The whole line must be the passcode, not just contain it.
+func checkAirConnectPasscode(c net.Conn) bool {
+	defer c.SetReadDeadline(time.Time{})
+	c.SetReadDeadline(time.Now().Add(airConnectPasscodeTimeout))
+	buf := make([]byte, 64)
+	var received string
+	wrong := func() {
+		log.Printf("Wrong passcode from client %s\n", c.RemoteAddr())
+		io.WriteString(c, "PASS?")
+	}
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return false
+		}
+		received += string(buf[:n])
+		for {
+			idx := strings.IndexAny(received, "\r\n")
+			if idx < 0 {
+				break
+			}
+			line := strings.TrimSpace(received[:idx])
+			received = received[idx+1:]
+			if line == globalSettings.AirConnectPasscode {
+				return true
+			} else if len(line) > 0 {
+				wrong()
+			}
+		}
+		if strings.TrimSpace(received) == globalSettings.AirConnectPasscode {
+			return true // Sent without line end
+		}
+		if len(received) > 32 {
+			wrong()
+			received = ""
+		}
+	}
+}
+
+func handleNmeaOutConnection(c net.Conn, s *tcpNMEAServer) {
 	//bufc := bufio.NewReader(c)
 	defer c.Close()
 	client := tcpClient{
-		conn: c,
-		ch:   make(chan string),
+		conn:       c,
+		ch:         make(chan string),
+		flarmRange: &flarmChannelRange{},
+		out:        &tcpClientOutput{},
 	}
 	io.WriteString(c, "PASS?")
 
-	// disabling passcode checks. RunwayHD and SkyDemon don't send CR / LF, and PIN check is something else that can go wrong.
-	//time.Sleep(100 * time.Millisecond)
-
-	//code, _, _ := bufc.ReadLine()
-	//log.Printf("Passcode entry was %v\n",code)
-
-	//passcode := ""
-	/*for passcode != "6000" {
-		io.WriteString(c, "PASS?")
-		code, _, err := bufc.ReadLine()
-		if err != nil {
-			log.Printf("Error scanning passcode from client %s: %s\n",c.RemoteAddr(), err)
-			continue
+	// The passcode check is optional: RunwayHD and SkyDemon don't send CR / LF, and PIN check is something else that can go wrong.
+	if globalSettings.AirConnectPasscode_Enabled && s.port == airConnectPort {
+		if !checkAirConnectPasscode(c) {
+			log.Printf("No correct passcode from client %s, closing.\n", c.RemoteAddr())
+			return
 		}
-		passcode = string(code)
-		log.Printf("Received passcode %s from client %s\n", passcode, c.RemoteAddr())
+		log.Printf("Correct passcode on client %s. Unlocking.\n", c.RemoteAddr())
 	}
-	*/
 	io.WriteString(c, "AOK") // correct passcode received; continue to writes
-	log.Printf("Correct passcode on client %s. Unlocking.\n", c.RemoteAddr())
+	io.WriteString(c, makeFlarmPFLAEString()) // Self-test passed, like a FLARM after power-up
+	io.WriteString(c, makeFlarmPFLAVString())
 	// Register user
-	addchan <- client
+	select {
+	case s.addchan <- client:
+	case <-s.quit:
+		return
+	}
 	defer func() {
 		log.Printf("Connection from %s closed.\n", c.RemoteAddr())
-		rmchan <- client
+		select {
+		case s.rmchan <- client:
+		case <-s.quit:
+		}
 	}()
 
 	// I/O
 	//go client.ReadLinesInto(msgchan)  //treating the port as read-only once it's opened
-	client.WriteLinesFrom(client.ch)
+	go client.ReadCommands()
+	client.WriteLinesFrom(client.ch, s.quit)
+}
+
+// ReadCommands handles configuration sentences that glide computers send to their FLARM, e.g. the flight declaration.
+func (c tcpClient) ReadCommands() {
+	bufc := bufio.NewReader(c.conn)
+	for {
+		line, err := bufc.ReadString('\n')
+		if err != nil {
+			return
+		}
+		sentence, valid := validateNMEAChecksum(strings.TrimSpace(line))
+		if !valid {
+			continue
+		}
+		x := strings.Split(sentence, ",")
+		if x[0] == "PFLAX" && c.out != nil {
+			// Flight download, see flarmbinary.go
+			c.out.setBinary(true)
+			io.WriteString(c.conn, makeFlarmPFLAXAnswer())
+			flarmBinarySession(c.conn, bufc)
+			c.out.setBinary(false)
+		} else if reply, ok := handlePflacRange(x, c.flarmRange); ok {
+			io.WriteString(c.conn, reply)
+		} else if reply, ok := handlePflacDeclaration(x); ok {
+			io.WriteString(c.conn, reply)
+		} else if reply, ok := handlePflacConfig(x); ok {
+			io.WriteString(c.conn, reply)
+		} else if reply, ok := handleFlarmQuery(x); ok {
+			io.WriteString(c.conn, reply)
+		}
+	}
 }
 
-func handleMessages(msgchan <-chan string, addchan <-chan tcpClient, rmchan <-chan tcpClient) {
+func handleMessages(s *tcpNMEAServer) {
 	clients := make(map[net.Conn]chan<- string)
 
 	for {
 		select {
-		case msg := <-msgchan:
+		case msg := <-s.msgchan:
 			if globalSettings.DEBUG {
 				log.Printf("New message: %s", msg)
 			}
-			for _, ch := range clients {
-				go func(mch chan<- string) { mch <- msg }(ch)
+			for conn, ch := range clients {
+				ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				out := filterNMEAForClient(msg, ip, s.port)
+				if len(out) == 0 {
+					continue
+				}
+				go func(mch chan<- string) {
+					select {
+					case mch <- out:
+					case <-s.quit:
+					}
+				}(ch)
 			}
-		case client := <-addchan:
-			log.Printf("New client: %v\n", client.conn.RemoteAddr().String())
+		case client := <-s.addchan:
+			log.Printf("New client on port %d: %v\n", s.port, client.conn.RemoteAddr().String())
 			clients[client.conn] = client.ch
-		case client := <-rmchan:
+		case client := <-s.rmchan:
 			log.Printf("Client disconnects: %v\n", client.conn.RemoteAddr().String())
 			delete(clients, client.conn)
+		case <-s.quit:
+			for conn := range clients {
+				conn.Close()
+			}
+			return
 		}
 	}
 }
@@ -590,10 +1257,8 @@ func parseFlarmNmeaMessage(message []string) {
 }
 
 func relativeGpsAltToBaro(relVert float32) (alt int32, altIsGnss bool) {
-	if isTempPressValid() {
-		return int32(mySituation.BaroPressureAltitude + relVert * 3.28084), false
-	} else if isGPSValid() {
-		return int32(mySituation.GPSAltitudeMSL + relVert * 3.28084), true
+	if ownAlt, isBaro, valid := ownshipAltitude(); valid {
+		return int32(ownAlt + relVert * 3.28084), !isBaro
 	}
 	return 0, false
 }
@@ -696,6 +1361,7 @@ func parseFlarmPFLAU(message []string) {
 	traffic[key] = ti
 
 	// notify
+	debugConsolePublish(DEBUG_SOURCE_FLARM, "$"+strings.Join(message, ","), ti)
 	registerTrafficUpdate(ti)
 
 	// mark traffic as seen
@@ -704,6 +1370,7 @@ func parseFlarmPFLAU(message []string) {
 
 func parseFlarmPFLAA(message []string) {
 	// $PFLAA,<AlarmLevel>,<RelativeNorth>,<RelativeEast>,<RelativeVertical>,<IDType>,<ID>,<Track>,<TurnRate>,<GroundSpeed>, <ClimbRate>,<AcftType>
+	// Protocol version 9 adds <NoTrack>,<Source>,<RSSI>
 	// Append flarm message to message log
 	if len(message) < 12 {
 		log.Printf("Discarding invalid NMEA: " + strings.Join(message, ","))
@@ -752,6 +1419,7 @@ func parseFlarmPFLAA(message []string) {
 	} else {
 		ti.Addr_type = 1
 	}
+	ti.Stealth = idType == flarmIDTypeAnonymous
 	if len(ti.Tail) <= 3 {
 		if len(tail) != 0 {
 			// Tail provided via NMEA (IDIDID!TAIL syntax)
@@ -797,10 +1465,26 @@ func parseFlarmPFLAA(message []string) {
 	case "B", "C": ti.Emitter_category = 10 // Balloon, airship = lighter than air
 	}
 
+	if len(message) >= 15 {
+		ti.NoTrack = message[12] == "1"
+		ti.FlarmSource = ""
+		if code, err := strconv.Atoi(message[13]); err == nil {
+			for name, c := range flarmSourceCodes {
+				if c == code {
+					ti.FlarmSource = name
+				}
+			}
+		}
+		if rssi, err := strconv.ParseFloat(message[14], 64); err == nil {
+			ti.SignalLevel = rssi
+		}
+	}
+
 	// update traffic database
 	traffic[key] = ti
 
 	// notify
+	debugConsolePublish(DEBUG_SOURCE_FLARM, "$"+strings.Join(message, ","), ti)
 	registerTrafficUpdate(ti)
 
 	// mark traffic as seen
@@ -0,0 +1,203 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarm-nmea_test.go: FLARM sentences ($PFLAA, $PFLAU, $PFLAE/$PFLAV) for simulated traffic,
+		see simulation_test.go.
+*/
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flarmFields checks the framing and checksum of a sentence and returns its fields.
+func flarmFields(t *testing.T, sentence string) []string {
+	t.Helper()
+	if !strings.HasSuffix(sentence, "\r\n") {
+		t.Fatalf("%q: no CR LF", sentence)
+	}
+	s, ok := validateNMEAChecksum(strings.TrimSpace(sentence))
+	if !ok {
+		t.Fatalf("%q: %s", sentence, s)
+	}
+	return strings.Split(s, ",")
+}
+
+// flarmPFLAA returns the fields of the $PFLAA of a target in the traffic table.
+func flarmPFLAA(t *testing.T, h *simHarness, addr uint32) []string {
+	t.Helper()
+	ti, ok := h.Traffic()[addr]
+	if !ok {
+		t.Fatalf("target %06X not in the traffic table", addr)
+	}
+	msg, valid, _ := makeFlarmPFLAAString(ti)
+	if !valid {
+		t.Fatalf("no $PFLAA for target %06X", addr)
+	}
+	return flarmFields(t, msg)
+}
+
+func flarmIntField(t *testing.T, fields []string, i int) int {
+	t.Helper()
+	v, err := strconv.Atoi(fields[i])
+	if err != nil {
+		t.Fatalf("field %d of %v: %s", i, fields, err)
+	}
+	return v
+}
+
+// An ADS-B target 1km north of us and 500ft above, flying south.
+func TestPFLAAFromADSB(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.GPS.(*fakeGPS).Speed = 0 // Hold the position, the distances are exact
+	lat, _ := currentGeodesy().Direct(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), 0, 1000)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: lat, Lng: float64(mySituation.GPSLongitude), Alt: 3500, Track: 180})
+	h.Run(2 * time.Second)
+
+	f := flarmPFLAA(t, h, alarmTestAddr)
+	// PFLAA,<AlarmLevel>,<RelativeNorth>,<RelativeEast>,<RelativeVertical>,<IDType>,<ID>,<Track>,<TurnRate>,<GroundSpeed>,<ClimbRate>,<AcftType>
+	if len(f) != 12 || f[0] != "PFLAA" {
+		t.Fatalf("%v: want 12 fields for protocol version 8", f)
+	}
+	if n := flarmIntField(t, f, 2); math.Abs(float64(n)-1000) > 5 {
+		t.Errorf("relative north %dm, want 1000m", n)
+	}
+	if e := flarmIntField(t, f, 3); math.Abs(float64(e)) > 5 {
+		t.Errorf("relative east %dm, want 0m", e)
+	}
+	if v := flarmIntField(t, f, 4); math.Abs(float64(v)-152) > 2 {
+		t.Errorf("relative vertical %dm, want 152m (500ft)", v)
+	}
+	if f[5] != "1" || !strings.HasPrefix(f[6], "ABCDEF") {
+		t.Errorf("ID type %s, ID %s: want the ICAO address ABCDEF with ID type 1", f[5], f[6])
+	}
+	if f[7] != "180" {
+		t.Errorf("track %s, want 180", f[7])
+	}
+}
+
+// OGN/FLARM targets have the FLARM ID type, the aircraft type and ground speed in m/s.
+func TestPFLAAFromOGN(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: 0xDD1234, Class: MSGCLASS_OGN, Lat: 48.01, Lng: 11.0, Alt: 3500, Track: 90, Speed: 60})
+	h.Run(2 * time.Second)
+
+	f := flarmPFLAA(t, h, 1<<24|0xDD1234)
+	if f[5] != "2" || f[6] != "DD1234" {
+		t.Errorf("ID type %s, ID %s: want the FLARM ID DD1234 with ID type 2", f[5], f[6])
+	}
+	if speed := flarmIntField(t, f, 9); speed != 30 {
+		t.Errorf("ground speed %dm/s, want 30m/s (60kts)", speed)
+	}
+	if f[11] != "1" {
+		t.Errorf("aircraft type %s, want 1 (glider)", f[11])
+	}
+}
+
+// Protocol version 9 appends <NoTrack>,<Source>,<RSSI>.
+func TestPFLAAProtocolVersion9(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	globalSettings.FlarmProtocolVersion = 9
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.02, Lng: 11.0, Alt: 3500, Track: 180, Speed: 100})
+	h.Run(2 * time.Second)
+
+	f := flarmPFLAA(t, h, alarmTestAddr)
+	if len(f) != 15 {
+		t.Fatalf("%v: want 15 fields for protocol version 9", f)
+	}
+	if f[12] != "0" || f[13] != "1" {
+		t.Errorf("no track %s, source %s: want 0 and 1 (ADS-B)", f[12], f[13])
+	}
+}
+
+// In stealth output, targets without alarm have an anonymous ID and no movement data.
+func TestPFLAAStealth(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	globalSettings.FlarmOutStealth = true
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.02, Lng: 11.0, Alt: 3500, Track: 180, Speed: 100})
+	h.Run(2 * time.Second)
+
+	f := flarmPFLAA(t, h, alarmTestAddr)
+	if f[5] != strconv.Itoa(flarmIDTypeAnonymous) || strings.HasPrefix(f[6], "ABCDEF") {
+		t.Errorf("ID type %s, ID %s: want an anonymous ID", f[5], f[6])
+	}
+	if f[7] != "" || f[9] != "" || f[10] != "" {
+		t.Errorf("%v: track, speed or climb rate sent in stealth mode", f)
+	}
+}
+
+// $PFLAU carries the most urgent target, or no alarm.
+func TestPFLAU(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.02, Alt: 3000, Track: 270, Speed: 120})
+	h.Run(2 * time.Second)
+
+	// PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,<AlarmType>,<RelativeVertical>,<RelativeDistance>,<ID>
+	f := flarmFields(t, makeFlarmPFLAUString(h.Traffic()[alarmTestAddr]))
+	if len(f) != 11 || f[0] != "PFLAU" {
+		t.Fatalf("%v: want 11 fields", f)
+	}
+	if f[1] != "1" || f[3] != "2" {
+		t.Errorf("RX %s, GPS %s: want 1 target and 2 (airborne)", f[1], f[3])
+	}
+	if f[5] != "3" || f[7] != "2" || !strings.HasPrefix(f[10], "ABCDEF") {
+		t.Errorf("%v: want alarm level 3, aircraft alarm type and the target ID", f)
+	}
+	if bearing := flarmIntField(t, f, 6); bearing < -2 || bearing > 2 {
+		t.Errorf("relative bearing %d, want 0 (straight ahead)", bearing)
+	}
+
+	f = flarmFields(t, makeFlarmPFLAUString(TrafficInfo{}))
+	if strings.Join(f, ",") != "PFLAU,1,1,2,1,0,,0,,," {
+		t.Errorf("%v: want the no alarm form", f)
+	}
+}
+
+// Rising alarm levels are sent right away, $PFLAU first, not only in the next 1Hz cycle.
+func TestFlarmFastPath(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.Sent(NETWORK_FLARM_NMEA)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.0, Lng: 11.06, Alt: 3000, Track: 270, Speed: 120})
+
+	var levels []string
+	for i := 0; i < 25; i++ {
+		h.Run(time.Second)
+		sent := h.Sent(NETWORK_FLARM_NMEA)
+		if len(sent) == 0 {
+			continue
+		}
+		if len(sent) != 2 || !strings.HasPrefix(sent[0], "$PFLAU,") || !strings.HasPrefix(sent[1], "$PFLAA,") {
+			t.Fatalf("sent %q, want $PFLAU and $PFLAA", sent)
+		}
+		levels = append(levels, flarmFields(t, sent[1])[1])
+	}
+	if strings.Join(levels, ",") != "1,2,3" {
+		t.Errorf("fast path sent alarm levels %v, want each of 1, 2, 3 once", levels)
+	}
+}
+
+// $PFLAE and $PFLAV requests are answered, other sentences aren't.
+func TestFlarmQuery(t *testing.T) {
+	newSimHarness(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	globalSettings.FlarmSwVersion = "7.20"
+
+	answer, ok := handleFlarmQuery([]string{"PFLAE", "R"})
+	if !ok || strings.Join(flarmFields(t, answer), ",") != "PFLAE,A,0,0" {
+		t.Errorf("$PFLAE,R answered with %q", answer)
+	}
+	answer, ok = handleFlarmQuery([]string{"PFLAV", "R"})
+	if f := flarmFields(t, answer); !ok || len(f) != 5 || f[1] != "A" || f[3] != "7.20" {
+		t.Errorf("$PFLAV,R answered with %q", answer)
+	}
+	if answer, ok = handleFlarmQuery([]string{"PFLAV", "A", "x", "y", "z"}); ok {
+		t.Errorf("$PFLAV,A answered with %q", answer)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarmbinary.go: Flight download with the FLARM binary protocol, the way XCSoar and LK8000 read the
+		IGC files of a FLARM. A glide computer connected to a TCP NMEA output sends $PFLAX, we answer
+		$PFLAX,A and that connection talks binary frames until EXIT, or until the client goes quiet.
+		NMEA output to the client is paused meanwhile.
+		Frame: start byte 0x73, then header and payload with 0x73 and 0x78 escaped as 0x78 0x31 and 0x78 0x55.
+		Header: length (header + payload), version, sequence number, message type, CRC. Numbers are little
+		endian, the CRC is CRC16-CCITT over the first 6 header bytes and the payload.
+		Answers are ACK/NACK frames whose payload starts with the sequence number of the request.
+		Records are our IGC files in the order of getIgcFiles(), newest first like on a FLARM.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	flarmBinaryStart     = 0x73
+	flarmBinaryEscape    = 0x78
+	flarmBinaryEscStart  = 0x31
+	flarmBinaryEscEscape = 0x55
+	flarmBinaryHeaderLen = 8
+	flarmBinaryMaxFrame  = 1024             // Requests are a few bytes, anything longer is garbage
+	flarmBinaryChunk     = 512              // IGC data per GETIGCDATA answer
+	flarmBinaryTimeout   = 30 * time.Second // Back to NMEA if the client neither sends requests nor EXIT
+	flarmBinaryEOF       = 0x1A             // Ends the last GETIGCDATA answer
+)
+
+const (
+	FLARM_BINARY_PING          = 0x01
+	FLARM_BINARY_SETBAUDRATE   = 0x02
+	FLARM_BINARY_EXIT          = 0x12
+	FLARM_BINARY_SELECTRECORD  = 0x20
+	FLARM_BINARY_GETRECORDINFO = 0x21
+	FLARM_BINARY_GETIGCDATA    = 0x22
+	FLARM_BINARY_ACK           = 0xA0
+	FLARM_BINARY_NACK          = 0xB7
+)
+
+// tcpClientOutput pauses the NMEA output to a client while it is in binary mode.
+type tcpClientOutput struct {
+	mu     sync.Mutex
+	binary bool
+}
+
+func (o *tcpClientOutput) setBinary(binary bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.binary = binary
+}
+
+type flarmBinaryFrame struct {
+	seq     uint16
+	msgType uint8
+	payload []byte
+}
+
+func flarmBinaryCRC(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func makeFlarmBinaryFrame(seq uint16, msgType uint8, payload []byte) []byte {
+	frame := make([]byte, flarmBinaryHeaderLen, flarmBinaryHeaderLen+len(payload))
+	binary.LittleEndian.PutUint16(frame[0:], uint16(flarmBinaryHeaderLen+len(payload)))
+	frame[2] = 0 // Protocol version
+	binary.LittleEndian.PutUint16(frame[3:], seq)
+	frame[5] = msgType
+	binary.LittleEndian.PutUint16(frame[6:], flarmBinaryCRC(flarmBinaryCRC(0, frame[:6]), payload))
+	frame = append(frame, payload...)
+
+	out := []byte{flarmBinaryStart}
+	for _, b := range frame {
+		switch b {
+		case flarmBinaryStart:
+			out = append(out, flarmBinaryEscape, flarmBinaryEscStart)
+		case flarmBinaryEscape:
+			out = append(out, flarmBinaryEscape, flarmBinaryEscEscape)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func readFlarmBinaryEscaped(r *bufio.Reader, buf []byte) error {
+	for i := range buf {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == flarmBinaryEscape {
+			if b, err = r.ReadByte(); err != nil {
+				return err
+			}
+			switch b {
+			case flarmBinaryEscStart:
+				b = flarmBinaryStart
+			case flarmBinaryEscEscape:
+				b = flarmBinaryEscape
+			}
+		}
+		buf[i] = b
+	}
+	return nil
+}
+
+// readFlarmBinaryFrame reads the next frame, skipping anything before the start byte. ok is false for a frame
+// with a bad length or CRC, err is only set if the connection failed.
+func readFlarmBinaryFrame(r *bufio.Reader) (f flarmBinaryFrame, ok bool, err error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return f, false, err
+		}
+		if b == flarmBinaryStart {
+			break
+		}
+	}
+	header := make([]byte, flarmBinaryHeaderLen)
+	if err := readFlarmBinaryEscaped(r, header); err != nil {
+		return f, false, err
+	}
+	length := int(binary.LittleEndian.Uint16(header[0:]))
+	if length < flarmBinaryHeaderLen || length > flarmBinaryMaxFrame {
+		return f, false, nil
+	}
+	payload := make([]byte, length-flarmBinaryHeaderLen)
+	if err := readFlarmBinaryEscaped(r, payload); err != nil {
+		return f, false, err
+	}
+	if flarmBinaryCRC(flarmBinaryCRC(0, header[:6]), payload) != binary.LittleEndian.Uint16(header[6:]) {
+		return f, false, nil
+	}
+	return flarmBinaryFrame{seq: binary.LittleEndian.Uint16(header[3:]), msgType: header[5], payload: payload}, true, nil
+}
+
+func makeFlarmPFLAXAnswer() string {
+	msg := "PFLAX,A"
+	return makeNMEASentence(msg)
+}
+
+// igcRecordInfo returns the GETRECORDINFO answer for an IGC file, "<file name>|<YYYY-MM-DD>|<start HH:MM:SS>|
+// <duration HH:MM:SS>|<pilot>|<copilot>|<glider type>|<glider id>|<comp id>|<comp class>".
+// Date and pilot come from the H records, start and duration from the first and last B record.
+func igcRecordInfo(name string, data []byte) string {
+	headers := make(map[string]string)
+	var first, last time.Time
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "B") && len(line) >= 7 {
+			t, err := time.Parse("150405", line[1:7])
+			if err != nil {
+				continue
+			}
+			if first.IsZero() {
+				first = t
+			}
+			last = t
+		} else if strings.HasPrefix(line, "H") && len(line) >= 5 {
+			if idx := strings.Index(line, ":"); idx > 0 {
+				headers[line[2:5]] = line[idx+1:]
+			}
+		}
+	}
+
+	date := ""
+	if d, err := time.Parse("020106", strings.Split(headers["DTE"], ",")[0]); err == nil {
+		date = d.Format("2006-01-02")
+	}
+	duration := last.Sub(first)
+	if duration < 0 {
+		duration += 24 * time.Hour // Flight over midnight UTC
+	}
+	d := int(duration.Seconds())
+	return fmt.Sprintf("%s|%s|%s|%02d:%02d:%02d|%s|%s|%s|%s|%s|%s", name, date, first.Format("15:04:05"),
+		d/3600, d/60%60, d%60, headers["PLT"], headers["CM2"], headers["GTY"], headers["GID"], headers["CID"], headers["CCL"])
+}
+
+// flarmBinarySession serves a client after $PFLAX. Returns when it sends EXIT, goes quiet or disconnects.
+func flarmBinarySession(conn net.Conn, r *bufio.Reader) {
+	log.Printf("FLARM binary mode on %s\n", conn.RemoteAddr())
+	defer conn.SetReadDeadline(time.Time{})
+
+	files := getIgcFiles()
+	var selectedName string
+	var selected []byte // Contents of the selected IGC file, nil if none
+	var sent int
+	var seq uint16
+	for {
+		conn.SetReadDeadline(time.Now().Add(flarmBinaryTimeout))
+		f, ok, err := readFlarmBinaryFrame(r)
+		if err != nil {
+			log.Printf("FLARM binary mode on %s ended: %s\n", conn.RemoteAddr(), err.Error())
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		answerType := uint8(FLARM_BINARY_ACK)
+		answer := make([]byte, 2, 2+flarmBinaryChunk+2)
+		binary.LittleEndian.PutUint16(answer, f.seq)
+		switch f.msgType {
+		case FLARM_BINARY_PING, FLARM_BINARY_EXIT:
+		case FLARM_BINARY_SELECTRECORD:
+			selectedName, selected, sent = "", nil, 0
+			if len(f.payload) > 0 && int(f.payload[0]) < len(files) {
+				if data, err := ioutil.ReadFile(filepath.Join(igcRecordDir(), files[f.payload[0]])); err == nil {
+					selectedName, selected = files[f.payload[0]], data
+				}
+			}
+			if selected == nil {
+				answerType = FLARM_BINARY_NACK
+			}
+		case FLARM_BINARY_GETRECORDINFO:
+			if selected == nil {
+				answerType = FLARM_BINARY_NACK
+				break
+			}
+			answer = append(answer, igcRecordInfo(selectedName, selected)...)
+			answer = append(answer, 0)
+		case FLARM_BINARY_GETIGCDATA:
+			if selected == nil {
+				answerType = FLARM_BINARY_NACK
+				break
+			}
+			n := iMin(flarmBinaryChunk, len(selected)-sent)
+			progress := 100
+			if len(selected) > 0 {
+				progress = 100 * (sent + n) / len(selected)
+			}
+			answer = append(answer, byte(progress))
+			answer = append(answer, selected[sent:sent+n]...)
+			sent += n
+			if sent >= len(selected) {
+				answer = append(answer, flarmBinaryEOF)
+			}
+		default:
+			answerType = FLARM_BINARY_NACK // Includes SETBAUDRATE: there is no baud rate on a TCP connection
+		}
+
+		seq++
+		if _, err := conn.Write(makeFlarmBinaryFrame(seq, answerType, answer)); err != nil {
+			return
+		}
+		if f.msgType == FLARM_BINARY_EXIT {
+			log.Printf("FLARM binary mode on %s ended\n", conn.RemoteAddr())
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarmconfig.go: The remaining FLARM configuration items ($PFLAC,R,<item> / $PFLAC,S,<item>,<value>).
+		LXNav and Oudie devices poll and set these on every connect and misbehave (endless
+		retries, "FLARM not found") if nothing answers. RANGE, VRANGE and the declaration items
+		are handled in flarmrange.go and igc.go, see ReadCommands().
+		Items that have a meaning for us are stored in globalSettings and show up in the web UI:
+		- ID:      OGNAddr, the ID of the OGN tracker. FFFFFF (use the ICAO address) clears it
+		- ACFT:    OGNAcftType (OGN uses the FLARM aircraft types)
+		- NOTRACK: OGNNoTrack
+		- PRIV:    OGNStealth
+		Other writable items are acknowledged and stored in globalSettings.FlarmConfigValues, so
+		reading them back gives the written value, but don't change anything. Unknown items get
+		PFLAC,A,ERROR like a FLARM. Like changes in the web UI, all writes are saved to the settings file.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Writable items we don't use, with the value a FLARM reports by default
+var flarmConfigDefaults = map[string]string{
+	"NMEAOUT": "1", // All sentences, current protocol version
+	"BAUD":    "2", // 19200
+	"CFLAGS":  "0",
+	"THRE":    "2", // m/s, ground speed above which we are airborne
+	"LOGINT":  "4", // s, IGC logging interval
+	"UI":      "0",
+}
+
+// flarmConfigValuesFromJSON checks FlarmConfigValues from the settings file or /setSettings: string values
+// for flarmConfigDefaults items only.
+func flarmConfigValuesFromJSON(val interface{}) (map[string]string, error) {
+	values := make(map[string]string)
+	switch v := val.(type) {
+	case map[string]string:
+		for item, value := range v {
+			values[item] = value
+		}
+	case map[string]interface{}:
+		for item, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("value of %s is not a string", item)
+			}
+			values[item] = s
+		}
+	default:
+		return nil, fmt.Errorf("wrong type %T", val)
+	}
+	for item := range values {
+		if _, ok := flarmConfigDefaults[item]; !ok {
+			return nil, fmt.Errorf("unknown item %s", item)
+		}
+	}
+	return values, nil
+}
+
+// flarmConfigId returns the ID of the OGN tracker, or the FLARM "use ICAO address" value.
+func flarmConfigId() string {
+	if len(globalSettings.OGNAddr) == 6 {
+		return strings.ToUpper(globalSettings.OGNAddr)
+	}
+	return "FFFFFF"
+}
+
+func flarmConfigBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+/*
+handlePflacConfig handles $PFLAC,<R|S>,<item>[,<value>] for all items not handled by handlePflacRange()
+and handlePflacDeclaration(). Input is the sentence without $ and checksum. Returns the answer sentence
+and true if it was a PFLAC sentence.
+*/
+func handlePflacConfig(x []string) (string, bool) {
+	if len(x) < 3 || x[0] != "PFLAC" {
+		return "", false
+	}
+	item := x[2]
+	set := x[1] == "S" && len(x) >= 4
+	if x[1] != "R" && !set {
+		return "", false
+	}
+
+	var answer string
+	var err error
+	switch item {
+	case "ID":
+		if set {
+			id := strings.TrimPrefix(strings.ToUpper(x[3]), "0X")
+			if _, err = strconv.ParseUint(id, 16, 24); err == nil && len(id) != 6 {
+				err = fmt.Errorf("invalid ID %s", x[3])
+			} else if err == nil && id == "FFFFFF" {
+				applySettingsMap(map[string]interface{}{"OGNAddr": ""}) // Use the ICAO address
+			} else if err == nil {
+				applySettingsMap(map[string]interface{}{"OGNAddr": id})
+			}
+		}
+		answer = fmt.Sprintf("PFLAC,A,ID,%s", flarmConfigId())
+	case "ACFT":
+		if set {
+			var acft int
+			if acft, err = strconv.Atoi(x[3]); err == nil && (acft < 0 || acft > 15) {
+				err = fmt.Errorf("invalid aircraft type %s", x[3])
+			} else if err == nil {
+				applySettingsMap(map[string]interface{}{"OGNAcftType": float64(acft)})
+			}
+		}
+		answer = fmt.Sprintf("PFLAC,A,ACFT,%d", globalSettings.OGNAcftType)
+	case "NOTRACK", "PRIV":
+		key := "OGNNoTrack"
+		if item == "PRIV" {
+			key = "OGNStealth"
+		}
+		if set {
+			var b bool
+			if b, err = strconv.ParseBool(x[3]); err == nil {
+				applySettingsMap(map[string]interface{}{key: b})
+			}
+		}
+		v := globalSettings.OGNNoTrack
+		if item == "PRIV" {
+			v = globalSettings.OGNStealth
+		}
+		answer = fmt.Sprintf("PFLAC,A,%s,%s", item, flarmConfigBool(v))
+	case "RADIOID":
+		answer = fmt.Sprintf("PFLAC,A,RADIOID,1,%s", flarmConfigId()) // Read only
+	case "DEVTYPE":
+		answer = "PFLAC,A,DEVTYPE,STRATUX" // Read only
+	default:
+		def, ok := flarmConfigDefaults[item]
+		if !ok {
+			break
+		}
+		if set {
+			values := make(map[string]interface{})
+			for k, v := range globalSettings.FlarmConfigValues {
+				values[k] = v
+			}
+			values[item] = strings.Join(x[3:], ",")
+			applySettingsMap(map[string]interface{}{"FlarmConfigValues": values})
+		}
+		v, written := globalSettings.FlarmConfigValues[item]
+		if !written {
+			v = def
+		}
+		answer = fmt.Sprintf("PFLAC,A,%s,%s", item, v)
+	}
+	if len(answer) == 0 || err != nil {
+		answer = "PFLAC,A,ERROR"
+	}
+
+	return makeNMEASentence(answer), true
+}
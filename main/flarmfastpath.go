@@ -0,0 +1,57 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarmfastpath.go: Event driven FLARM output for rising alarms. The FLARM NMEA stream is sent
+		once per second by sendTrafficUpdates(). A target that just became an urgent threat
+		would wait up to a second for that cycle - a lot with 8 seconds to impact. Whenever an
+		update of a target raises its alarm level above what we last sent, PFLAU and PFLAA
+		for it are pushed out immediately. Everything else stays on the periodic cycle.
+*/
+
+package main
+
+// Alarm level last sent per target, by the periodic cycle or the fast path. Protected by trafficMutex.
+var flarmSentAlarmLevels = make(map[uint32]uint8)
+
+// flarmCycleStart is called by sendTrafficUpdates() before sending the targets, with trafficMutex held.
+func flarmCycleStart() {
+	flarmSentAlarmLevels = make(map[uint32]uint8)
+}
+
+// flarmCycleSent is called by sendTrafficUpdates() for every target it sent, with trafficMutex held.
+func flarmCycleSent(ti TrafficInfo, alarmLevel uint8) {
+	flarmSentAlarmLevels[trafficInfoKey(ti)] = alarmLevel
+}
+
+// flarmFastPath is called for every traffic update with trafficMutex held (see registerTrafficUpdate()).
+func flarmFastPath(ti TrafficInfo) {
+	if !ti.Position_valid || !isGPSValid() {
+		return
+	}
+	if isOwnshipTi, shouldIgnore := isOwnshipTrafficInfo(ti); isOwnshipTi || shouldIgnore {
+		return
+	}
+	msgPFLAA, valid, alarmLevel := makeFlarmPFLAAString(ti)
+	key := trafficInfoKey(ti)
+	if !valid || alarmLevel <= flarmSentAlarmLevels[key] {
+		return
+	}
+	flarmSentAlarmLevels[key] = alarmLevel
+	// PFLAU first, displays sound the alarm on it. This target is the most urgent one only if nothing else is at least as bad.
+	if alarmLevel >= flarmHighestSentAlarmLevel() {
+		sendNetFLARM(makeFlarmPFLAUString(ti))
+	}
+	sendNetFLARM(msgPFLAA)
+}
+
+func flarmHighestSentAlarmLevel() (highest uint8) {
+	for _, level := range flarmSentAlarmLevels {
+		if level > highest {
+			highest = level
+		}
+	}
+	return
+}
@@ -0,0 +1,149 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarmrange.go: The FLARM RANGE and VRANGE configuration items. A real FLARM only reports PFLAA
+		targets within the configured range, and some glide computers and EFBs (SkyDemon) set it
+		and read it back ($PFLAC,S,RANGE,<m> / $PFLAC,R,RANGE) - they fail their FLARM setup if
+		it isn't answered.
+		globalSettings.FlarmRange is the default (web UI, UDP outputs). A TCP client can set
+		its own range with PFLAC, valid for its connection only. The same goes for VRANGE, the
+		vertical range, which is unlimited unless a client sets it.
+		Targets with an alarm are always sent, whatever the range.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	flarmRangeMin     = 2000  // m
+	flarmRangeMax     = 65535 // m
+	flarmRangeDefault = flarmRangeMax
+	flarmVRangeMin    = 100  // m
+	flarmVRangeMax    = 2000 // m, also what we report while not set: we don't limit then
+)
+
+// flarmChannelRange is the RANGE and VRANGE of one output channel. 0 = use globalSettings.FlarmRange / no vertical limit.
+type flarmChannelRange struct {
+	rangeM  int32
+	vrangeM int32
+}
+
+func (r *flarmChannelRange) get() int {
+	if v := atomic.LoadInt32(&r.rangeM); v > 0 {
+		return int(v)
+	}
+	return globalSettings.FlarmRange
+}
+
+// getVertical returns the vertical range, 0 = unlimited.
+func (r *flarmChannelRange) getVertical() int {
+	return int(atomic.LoadInt32(&r.vrangeM))
+}
+
+func clampFlarmRange(rangeM int) int {
+	if rangeM < flarmRangeMin {
+		return flarmRangeMin
+	}
+	if rangeM > flarmRangeMax {
+		return flarmRangeMax
+	}
+	return rangeM
+}
+
+/*
+handlePflacRange handles $PFLAC,<R|S>,<RANGE|VRANGE>[,<m>] for a channel. Input is the sentence without $
+and checksum. Returns the answer sentence and true if it was a RANGE or VRANGE request.
+*/
+func handlePflacRange(x []string, r *flarmChannelRange) (string, bool) {
+	if len(x) < 3 || x[0] != "PFLAC" || (x[2] != "RANGE" && x[2] != "VRANGE") {
+		return "", false
+	}
+	answer := ""
+	if x[1] == "S" && len(x) >= 4 {
+		rangeM, err := strconv.Atoi(x[3])
+		if err != nil {
+			answer = "PFLAC,A,ERROR"
+		} else if x[2] == "RANGE" {
+			atomic.StoreInt32(&r.rangeM, int32(clampFlarmRange(rangeM)))
+		} else {
+			atomic.StoreInt32(&r.vrangeM, int32(math.Max(flarmVRangeMin, math.Min(flarmVRangeMax, float64(rangeM)))))
+		}
+	}
+	if len(answer) == 0 && x[2] == "RANGE" {
+		answer = fmt.Sprintf("PFLAC,A,RANGE,%d", r.get())
+	} else if len(answer) == 0 {
+		vrange := r.getVertical()
+		if vrange == 0 {
+			vrange = flarmVRangeMax
+		}
+		answer = fmt.Sprintf("PFLAC,A,VRANGE,%d", vrange)
+	}
+	return makeNMEASentence(answer), true
+}
+
+// pflaaOutOfRange returns true for a $PFLAA sentence without alarm whose target is farther away than rangeM.
+func pflaaOutOfRange(sentence string, rangeM int) bool {
+	x := strings.Split(sentence, ",")
+	if len(x) < 4 || x[0] != "$PFLAA" || x[1] != "0" {
+		return false
+	}
+	north, err := strconv.ParseFloat(x[2], 64)
+	if err != nil {
+		return false
+	}
+	east, _ := strconv.ParseFloat(x[3], 64) // empty for bearingless targets, <RelativeNorth> is the distance then
+	return math.Hypot(north, east) > float64(rangeM)
+}
+
+// pflaaOutOfVRange returns true for a $PFLAA sentence without alarm whose target is more than vrangeM above or below us.
+func pflaaOutOfVRange(sentence string, vrangeM int) bool {
+	x := strings.Split(sentence, ",")
+	if len(x) < 5 || x[0] != "$PFLAA" || x[1] != "0" {
+		return false
+	}
+	vertical, err := strconv.ParseFloat(x[4], 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(vertical) > float64(vrangeM)
+}
+
+// filterFlarmChannel drops the PFLAA sentences outside of a channel's RANGE and VRANGE from a batch of NMEA sentences.
+func filterFlarmChannel(msg string, r *flarmChannelRange) string {
+	msg = filterFlarmRange(msg, r.get())
+	vrangeM := r.getVertical()
+	if vrangeM == 0 || !strings.Contains(msg, "$PFLAA") {
+		return msg
+	}
+	var sb strings.Builder
+	for _, sentence := range strings.SplitAfter(msg, "\n") {
+		if !pflaaOutOfVRange(sentence, vrangeM) {
+			sb.WriteString(sentence)
+		}
+	}
+	return sb.String()
+}
+
+// filterFlarmRange drops the PFLAA sentences beyond rangeM from a batch of NMEA sentences.
+func filterFlarmRange(msg string, rangeM int) string {
+	if rangeM >= flarmRangeMax || !strings.Contains(msg, "$PFLAA") {
+		return msg
+	}
+	var sb strings.Builder
+	for _, sentence := range strings.SplitAfter(msg, "\n") {
+		if !pflaaOutOfRange(sentence, rangeM) {
+			sb.WriteString(sentence)
+		}
+	}
+	return sb.String()
+}
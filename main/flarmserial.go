@@ -0,0 +1,254 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarmserial.go: Additional FLARM-speaking serial devices, next to the one initGPSSerial() picked
+		as GPS. A typical installation has an OGN Tracker (transmits, and is our GPS) and a FLARM
+		mouse or SoftRF (receives) on USB at the same time. The additional devices are only used
+		for traffic ($PFLAU/$PFLAA), merged into the traffic list like everything else - their
+		GPS sentences are ignored, there is one GPS source.
+		Each device has its own status (type, message counts, its own RX count and GPS state from
+		$PFLAU), published in globalStatus.FlarmSerialDevices. The GPS device shows up there as
+		well once it sends FLARM sentences.
+		An additional OGN Tracker is configured from the settings like the primary one.
+		Additional devices are only opened while the GPS is connected, so initGPSSerial() can
+		always choose first.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	flarmSerialScanInterval = 5 * time.Second
+	flarmSerialTimeout      = 10 * time.Second // No sentence for this long = not receiving
+)
+
+// Candidates for additional devices, see image/10-stratux.rules. serialin_<kernel name> exists for each
+// device that matches a serialin rule, so two devices of the same kind can be told apart.
+var flarmSerialPatterns = []string{"/dev/serialin*", "/dev/softrf_dongle*", "/dev/flarm*"}
+var flarmSerialBaudrates = []int{115200, 38400, 19200, 9600}
+
+const (
+	FLARM_SERIAL_TYPE_UNKNOWN    = "FLARM compatible"
+	FLARM_SERIAL_TYPE_FLARM      = "FLARM"
+	FLARM_SERIAL_TYPE_OGNTRACKER = "OGN Tracker"
+)
+
+// flarmSerialDevice is the state of one FLARM-speaking serial device, also its JSON status.
+type flarmSerialDevice struct {
+	Device            string
+	Primary           bool // Also our GPS, read by gpsSerialReader()
+	Type              string
+	Receiving         bool
+	Messages          uint32 // Sentences received. From the GPS device only FLARM and OGN sentences are counted
+	TrafficMessages   uint32
+	RX                int // Targets received, as reported by the device in $PFLAU
+	GPS               int // GPS state of the device from $PFLAU: 0 = no fix, 1 = on ground, 2 = airborne
+	lastMessage       time.Time
+	port              *serial.Port
+	trackerConfigured bool
+}
+
+var flarmSerialDevices = make(map[string]*flarmSerialDevice) // By resolved device path
+var flarmSerialMutex = &sync.Mutex{}
+
+func resolveSerialDevice(device string) string {
+	if p, err := filepath.EvalSymlinks(device); err == nil {
+		return p
+	}
+	return device
+}
+
+// flarmSerialNote updates the status of a device for a received sentence (without $ and checksum, split).
+// Returns the device, nil if the sentence doesn't show that it is a FLARM device.
+func flarmSerialNote(device string, primary bool, x []string) *flarmSerialDevice {
+	flarmSerialMutex.Lock()
+	defer flarmSerialMutex.Unlock()
+	d, ok := flarmSerialDevices[device]
+	if !ok {
+		if !primary || len(x) == 0 || !(strings.HasPrefix(x[0], "PFLA") || strings.HasPrefix(x[0], "POGN")) {
+			return nil
+		}
+		d = &flarmSerialDevice{Device: device, Primary: true, Type: FLARM_SERIAL_TYPE_UNKNOWN}
+		flarmSerialDevices[device] = d
+	}
+	d.Messages++
+	d.lastMessage = stratuxClock.Time
+	switch x[0] {
+	case "PFLAU":
+		if len(x) >= 4 {
+			d.RX, _ = strconv.Atoi(x[1])
+			d.GPS, _ = strconv.Atoi(x[3])
+		}
+		d.TrafficMessages++
+	case "PFLAA":
+		d.TrafficMessages++
+	case "PFLAV":
+		if d.Type == FLARM_SERIAL_TYPE_UNKNOWN {
+			d.Type = FLARM_SERIAL_TYPE_FLARM
+		}
+	case "POGNR", "POGNS", "POGNB":
+		d.Type = FLARM_SERIAL_TYPE_OGNTRACKER
+	}
+	return d
+}
+
+// flarmSerialPrimaryLine is called by gpsSerialReader() for every line from the GPS device.
+func flarmSerialPrimaryLine(device, line string) {
+	if !strings.HasPrefix(line, "$PFLA") && !strings.HasPrefix(line, "$POGN") {
+		return // GPS sentences, most of the traffic on this device
+	}
+	if s, ok := validateNMEAChecksum(line); ok {
+		flarmSerialNote(resolveSerialDevice(device), true, strings.Split(s, ","))
+	}
+}
+
+// openFlarmSerialPort detects the baud rate of an additional device without passing its data to the GPS.
+func openFlarmSerialPort(device string) (*serial.Port, error) {
+	for _, baud := range flarmSerialBaudrates {
+		p, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud, ReadTimeout: time.Millisecond * 2500})
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(3 * time.Second)
+		buffer := make([]byte, 10000)
+		n, _ := p.Read(buffer)
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			if idx := strings.Index(line, "$"); idx >= 0 {
+				if _, ok := validateNMEAChecksum(strings.TrimSpace(line[idx:])); ok {
+					log.Printf("Detected additional FLARM device %s with baud %d", device, baud)
+					return p, nil
+				}
+			}
+		}
+		p.Close()
+		time.Sleep(250 * time.Millisecond)
+	}
+	return nil, errors.New("no NMEA data")
+}
+
+// flarmSerialReader reads traffic from an additional device until it disconnects or the GPS does.
+func flarmSerialReader(d *flarmSerialDevice) {
+	defer func() {
+		d.port.Close()
+		flarmSerialMutex.Lock()
+		delete(flarmSerialDevices, d.Device)
+		flarmSerialMutex.Unlock()
+	}()
+	scanner := bufio.NewScanner(d.port)
+	for scanner.Scan() && globalStatus.GPS_connected && globalSettings.GPS_Enabled {
+		line := scanner.Text()
+		captureNMEA(NMEA_SOURCE_SERIAL, d.Device, line)
+		s, ok := checkNMEAInput(NMEA_SOURCE_SERIAL, d.Device, line)
+		if !ok {
+			continue
+		}
+		x := strings.Split(s, ",")
+		flarmSerialNote(d.Device, false, x)
+		switch x[0] {
+		case "PFLAU", "PFLAA":
+			if !isGroundStation() {
+				parseFlarmNmeaMessage(x)
+			}
+		case "PGRMZ", "LXWP0":
+			if !isGroundStation() {
+				parseNMEABaro(x)
+			}
+		case "POGNR":
+			flarmSerialMutex.Lock()
+			configure := !d.trackerConfigured
+			d.trackerConfigured = true
+			flarmSerialMutex.Unlock()
+			if configure {
+				d.port.Write([]byte(ognTrackerSettingsCommand()))
+			}
+		}
+	}
+	log.Printf("Additional FLARM device %s disconnected\n", d.Device)
+}
+
+// flarmSerialManager opens FLARM devices that aren't our GPS.
+func flarmSerialManager() {
+	ticker := time.NewTicker(flarmSerialScanInterval)
+	for {
+		<-ticker.C
+		if !globalStatus.GPS_connected || !globalSettings.GPS_Enabled || serialConfig == nil || isPowerSaveIdle() {
+			continue
+		}
+		primary := resolveSerialDevice(serialConfig.Name)
+		candidates := usbSerialFlarmDevices() // Autodetected, see usbserialscan.go
+		for _, pattern := range flarmSerialPatterns {
+			matches, _ := filepath.Glob(pattern)
+			candidates = append(candidates, matches...)
+		}
+		for _, m := range candidates {
+			device := resolveSerialDevice(m)
+			flarmSerialMutex.Lock()
+			_, known := flarmSerialDevices[device]
+			flarmSerialMutex.Unlock()
+			if device == primary || known {
+				continue
+			}
+			p, err := openFlarmSerialPort(device)
+			if err != nil {
+				continue
+			}
+			d := &flarmSerialDevice{Device: device, Type: FLARM_SERIAL_TYPE_UNKNOWN, port: p}
+			flarmSerialMutex.Lock()
+			flarmSerialDevices[device] = d
+			flarmSerialMutex.Unlock()
+			logEvent(EVENT_GPS, EVENT_INFO, "Additional FLARM device connected", "device", device)
+			go flarmSerialReader(d)
+		}
+	}
+}
+
+// writeOgnTrackerSettings sends the OGN configuration to additional OGN Trackers.
+func writeOgnTrackerSettings(cfg string) {
+	flarmSerialMutex.Lock()
+	defer flarmSerialMutex.Unlock()
+	for _, d := range flarmSerialDevices {
+		if !d.Primary && d.port != nil && d.Type == FLARM_SERIAL_TYPE_OGNTRACKER {
+			d.port.Write([]byte(cfg))
+			d.port.Write([]byte("$POGNS\r\n"))
+		}
+	}
+}
+
+// getFlarmSerialStatus returns the status of all FLARM devices, the GPS device first.
+func getFlarmSerialStatus() []flarmSerialDevice {
+	flarmSerialMutex.Lock()
+	defer flarmSerialMutex.Unlock()
+	ret := make([]flarmSerialDevice, 0, len(flarmSerialDevices))
+	for dev, d := range flarmSerialDevices {
+		if d.Primary && (serialConfig == nil || resolveSerialDevice(serialConfig.Name) != dev) {
+			delete(flarmSerialDevices, dev) // GPS device changed
+			continue
+		}
+		s := *d
+		s.Receiving = !d.lastMessage.IsZero() && stratuxClock.Since(d.lastMessage) < flarmSerialTimeout
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Primary != ret[j].Primary {
+			return ret[i].Primary
+		}
+		return ret[i].Device < ret[j].Device
+	})
+	return ret
+}
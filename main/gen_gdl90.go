@@ -14,7 +14,6 @@ import (
 	"bufio"
 	"compress/gzip"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -285,19 +284,33 @@ func makeLatLng(v float32) []byte {
 	return ret
 }
 
-func isDetectedOwnshipValid() bool {
-	return stratuxClock.Since(OwnshipTrafficInfo.Last_seen).Seconds() < 10
+func makeOwnshipReport() bool {
+	msg, xplaneMsg, ok := buildOwnshipReport(0, 0)
+	if !ok {
+		return false
+	}
+	sendOwnshipGDL90(msg)
+	sendXPlane(xplaneMsg, false)
+	return true
 }
 
-func makeOwnshipReport() bool {
-	gpsValid := isGPSValid()
-	selfOwnshipValid := isDetectedOwnshipValid()
+/*
+	buildOwnshipReport creates the prepared ownship report and the matching X-Plane position message.
+	nic and nacp override the reported values if not 0, see ownshipout.go.
+*/
+func buildOwnshipReport(nic, nacp uint8) (msg []byte, xplaneMsg []byte, ok bool) {
+	if isGroundStation() {
+		return nil, nil, false // No aircraft, see groundstation.go
+	}
+	s := getSituation()
+	curOwnship := getTrafficSnapshot().Ownship
+	gpsValid := s.GPSValid
+	selfOwnshipValid := stratuxClock.Since(curOwnship.Last_seen).Seconds() < 10
 	if !gpsValid && !selfOwnshipValid {
-		return false
+		return nil, nil, false
 	}
-	curOwnship := OwnshipTrafficInfo
 
-	msg := make([]byte, 28)
+	msg = make([]byte, 28)
 	// See p.16.
 	msg[0] = 0x0A // Message type "Ownship".
 
@@ -327,8 +340,8 @@ func makeOwnshipReport() bool {
 		lat = curOwnship.Lat
 		lon = curOwnship.Lng
 	} else {
-		lat = mySituation.GPSLatitude
-		lon = mySituation.GPSLongitude
+		lat = s.GPSLatitude
+		lon = s.GPSLongitude
 	}
 
 	tmp = makeLatLng(lat)
@@ -349,11 +362,8 @@ func makeOwnshipReport() bool {
 	if selfOwnshipValid {
 		altf = float64(curOwnship.Alt)
 		validAltf = true
-	} else if isTempPressValid() {
-		altf = float64(mySituation.BaroPressureAltitude)
-		validAltf = true
-	} else if isGPSValid() {
-		altf = float64(mySituation.GPSAltitudeMSL)
+	} else if ownAlt, _, valid := s.ownshipAltitude(); valid {
+		altf = float64(ownAlt)
 		validAltf = true
 	}
 
@@ -364,25 +374,35 @@ func makeOwnshipReport() bool {
 
 	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
 	msg[12] = byte((alt & 0x00F) << 4)
-	if selfOwnshipValid || isGPSGroundTrackValid() {
+	if selfOwnshipValid || s.GPSGroundTrackValid {
 		msg[12] = msg[12] | 0x09 // "Airborne" + "True Track"
 	}
 
-	msg[13] = byte(0x80 | (mySituation.GPSNACp & 0x0F)) //Set NIC = 8 and use NACp from gps.go.
+	if nic == 0 {
+		nic = 8
+	}
+	if nacp == 0 {
+		nacp = uint8(s.GPSNACp)
+	}
+	msg[13] = byte((nic & 0x0F) << 4 | (nacp & 0x0F)) // Default NIC = 8 and NACp from gps.go.
 
 	gdSpeed := uint16(0) // 1kt resolution.
 	if selfOwnshipValid && curOwnship.Speed_valid {
 		gdSpeed = curOwnship.Speed
-	} else if isGPSGroundTrackValid() {
-		gdSpeed = uint16(mySituation.GPSGroundSpeed + 0.5)
+	} else if s.GPSGroundTrackValid {
+		gdSpeed = uint16(s.GPSGroundSpeed + 0.5)
 	}
 
 	// gdSpeed should fit in 12 bits.
 	msg[14] = byte((gdSpeed & 0xFF0) >> 4)
 	msg[15] = byte((gdSpeed & 0x00F) << 4)
 
-	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution.
-	//TODO: 0x800 = no information available.
+	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution. 0x800 = no information available.
+	if s.BaroValid {
+		verticalVelocity = encodeVerticalVelocity(s.BaroVerticalSpeed)
+	} else if gpsValid {
+		verticalVelocity = encodeVerticalVelocity(s.GPSVerticalSpeed * 60) // ft/s -> ft/min
+	}
 	// verticalVelocity should fit in 12 bits.
 	msg[15] = msg[15] | byte((verticalVelocity&0x0F00)>>8)
 	msg[16] = byte(verticalVelocity & 0xFF)
@@ -391,8 +411,8 @@ func makeOwnshipReport() bool {
 	groundTrack := float32(0)
 	if selfOwnshipValid {
 		groundTrack = float32(curOwnship.Track)
-	} else if isGPSGroundTrackValid() {
-		groundTrack = mySituation.GPSTrueCourse
+	} else if s.GPSGroundTrackValid {
+		groundTrack = s.GPSTrueCourse
 	}
 
 	tempTrack := groundTrack + TRACK_RESOLUTION/2 // offset by half the 8-bit resolution to minimize binning error
@@ -435,35 +455,49 @@ func makeOwnshipReport() bool {
 		}
 	}
 
-	// Truncate registration to 8 characters.
-	if len(myReg) > 8 {
-		myReg = myReg[:8]
+	// Write the callsign. If nothing is left of it, keep the ownship tail - there is no address to fall back to.
+	if len(gdl90CallsignChars(myReg)) > 0 {
+		copy(msg[19:27], gdl90Callsign(myReg, 0))
 	}
 
-	// Write the callsign.
-	for i := 0; i < len(myReg); i++ {
-		msg[19+i] = myReg[i]
-	}
-
-	sendGDL90(prepareMessage(msg), false)
-	sendXPlane(createXPlaneGpsMsg(lat, lon, mySituation.GPSAltitudeMSL, groundTrack, float32(gdSpeed)), false)
+	xplaneMsg = createXPlaneGpsMsg(lat, lon, s.GPSAltitudeMSL, groundTrack, float32(gdSpeed))
+	return prepareMessage(msg), xplaneMsg, true
+}
 
-	return true
+// encodeVerticalVelocity converts ft/min to the 12 bit GDL90 representation (64 ft/min resolution, max +-32576 ft/min).
+func encodeVerticalVelocity(fpm float32) int16 {
+	v := int16(math.Round(float64(fpm) / 64))
+	if v > 509 {
+		v = 509
+	} else if v < -509 {
+		v = -509
+	}
+	return v
 }
 
 func makeOwnshipGeometricAltitudeReport() bool {
-	if !isGPSValid() {
+	msg, ok := buildOwnshipGeometricAltitudeReport()
+	if !ok {
 		return false
 	}
+	sendOwnshipGDL90(msg)
+	return true
+}
+
+func buildOwnshipGeometricAltitudeReport() ([]byte, bool) {
+	s := getSituation()
+	if !s.GPSValid || isGroundStation() {
+		return nil, false
+	}
 	msg := make([]byte, 5)
 	// See p.28.
 	msg[0] = 0x0B // Message type "Ownship Geo Alt".
 
 	var GPSalt float32
 	if globalSettings.GDL90MSLAlt_Enabled {
-		GPSalt = mySituation.GPSAltitudeMSL
+		GPSalt = s.GPSAltitudeMSL
 	} else {
-		GPSalt = mySituation.GPSHeightAboveEllipsoid
+		GPSalt = s.GPSHeightAboveEllipsoid
 	}
 	encodedAlt := int16(GPSalt / 5)    // GPS Altitude, encoded to 16-bit int using 5-foot resolution
 	msg[1] = byte(encodedAlt >> 8)     // Altitude.
@@ -473,8 +507,7 @@ func makeOwnshipGeometricAltitudeReport() bool {
 	msg[3] = 0x00
 	msg[4] = 0x0A
 
-	sendGDL90(prepareMessage(msg), false)
-	return true
+	return prepareMessage(msg), true
 }
 
 /*
@@ -712,8 +745,8 @@ func makeHeartbeat() []byte {
 	}
 	msg[1] = msg[1] | 0x10 //FIXME: Addr talkback.
 
-	// "Maintenance Req'd". Add flag if there are any current critical system errors.
-	if len(globalStatus.Errors) > 0 {
+	// "Maintenance Req'd". Add flag if there are any current critical system errors, or we lost a subsystem.
+	if len(globalStatus.Errors) > 0 || isAnyDegraded() {
 		msg[1] = msg[1] | 0x40
 	}
 
@@ -745,7 +778,13 @@ func relayMessage(msgtype uint16, msg []byte) {
 		ret[i+4] = msg[i]
 	}
 
-	sendGDL90(prepareMessage(ret), true)
+	prepared := prepareMessage(ret)
+	if msgtype == MSGTYPE_UPLINK {
+		sendOptionalGDL90(prepared, true)
+		uplinkArchiveAdd(prepared)
+	} else {
+		sendUATReportGDL90(prepared)
+	}
 }
 
 func blinkStatusLED() {
@@ -779,7 +818,11 @@ func heartBeatSender() {
 	timerFast := time.NewTicker(150 * time.Millisecond)
 	timer := time.NewTicker(1 * time.Second)
 	timerMessageStats := time.NewTicker(2 * time.Second)
+	timerNmeaRate := time.NewTicker(nmeaRateTickInterval)
+	nmeaRateTicks := 0
 	ledBlinking := false
+	statusSentenceCounter := 0
+	versionSentenceCounter := 0
 	for {
 		select {
 		case <-timerFast.C:
@@ -787,7 +830,12 @@ func heartBeatSender() {
 			if globalSettings.SkyDemonAndroidHack {
 				sendAllOwnshipInfo()
 			}
+		case <-timerNmeaRate.C:
+			// Position sentences in between, if the NMEA output rate is above 1 Hz. See nmearate.go
+			nmeaRateTicks++
+			nmeaRateTick(nmeaRateTicks)
 		case <-timer.C:
+			nmeaRateTicks = 0
 			// Green LED - always on during normal operation.
 			//  Blinking when there is a critical system error (and Stratux is still running).
 
@@ -802,14 +850,61 @@ func heartBeatSender() {
 				ledBlinking = true
 			}
 
-			// Normal behaviour: Send ownship info once per secopnd
-			if !globalSettings.SkyDemonAndroidHack {
-				sendAllOwnshipInfo()
-			}
+			// Nobody is listening in power save idle, see powersave.go
+			if !isPowerSaveIdle() {
+				// Normal behaviour: Send ownship info once per secopnd
+				if !globalSettings.SkyDemonAndroidHack {
+					sendAllOwnshipInfo()
+				}
 
-			sendNetFLARM(makeGPRMCString())
-			sendNetFLARM(makeGPGGAString())
-			sendNetFLARM("$GPGSA,A,3,,,,,,,,,,,,,1.0,1.0,1.0*33\r\n")
+				if !isGroundStation() {
+					sendNetFLARM(makeGPRMCString())
+					sendNetFLARM(makeGPGGAString())
+					if pgrmz := makeNmeaOutPGRMZString(); len(pgrmz) > 0 {
+						sendNetFLARM(pgrmz)
+					}
+					if globalSettings.NMEAOut_GPGLL {
+						sendNetFLARM(makeGPGLLString())
+					}
+					if globalSettings.NMEAOut_GPVTG {
+						sendNetFLARM(makeGPVTGString())
+					}
+					if globalSettings.NMEAOut_Heading {
+						if hdg := makeHeadingStrings(); len(hdg) > 0 {
+							sendNetFLARM(hdg)
+						}
+					}
+					if globalSettings.NMEAOut_WIMWV {
+						if mwv := makeWIMWVString(); len(mwv) > 0 {
+							sendNetFLARM(mwv)
+						}
+					}
+					sendNetFLARM(makeGPGSAString())
+					if gsv := makeGPGSVString(); len(gsv) > 0 {
+						sendNetFLARM(gsv)
+					}
+				}
+
+				// Stratux status sentence every 10 seconds
+				statusSentenceCounter++
+				if statusSentenceCounter >= 10 {
+					statusSentenceCounter = 0
+					sendNetFLARM(makePSTXString())
+				}
+				if msg := makePSTXAString(); len(msg) > 0 {
+					sendNetFLARM(msg)
+				}
+				if msg := makePSTXTString(); len(msg) > 0 {
+					sendNetFLARM(msg)
+				}
+
+				// FLARM version once per minute, see flarm-nmea.go
+				versionSentenceCounter++
+				if versionSentenceCounter >= 60 {
+					versionSentenceCounter = 0
+					sendNetFLARM(makeFlarmPFLAVString())
+				}
+			}
 
 			// --- debug code: traffic demo ---
 			// Uncomment and compile to display large number of artificial traffic targets
@@ -926,6 +1021,7 @@ func updateMessageStats() {
 }
 
 func updateStatus() {
+	lastSolution := globalStatus.GPS_solution
 	if mySituation.GPSFixQuality == 2 {
 		globalStatus.GPS_solution = "3D GPS + SBAS"
 	} else if mySituation.GPSFixQuality == 1 {
@@ -952,6 +1048,21 @@ func updateStatus() {
 		globalStatus.GPS_connected = false
 	}
 
+	globalStatus.GPS_validity, globalStatus.GPS_validity_changes = gpsValidityStatus()
+	globalStatus.FlarmSerialDevices = getFlarmSerialStatus()
+	globalStatus.NMEAInputs = getNMEAInStatus()
+	globalStatus.NMEAInputStats = getNMEAInputStats()
+	globalStatus.USBSerialDevices = getUSBSerialStatus()
+	globalStatus.OGNTracker_connected = ognTrackerConnected()
+
+	if globalStatus.GPS_solution != lastSolution {
+		severity := EVENT_INFO
+		if globalStatus.GPS_solution == "No Fix" || globalStatus.GPS_solution == "Disconnected" {
+			severity = EVENT_WARN
+		}
+		logEvent(EVENT_GPS, severity, "GPS solution changed", "from", lastSolution, "to", globalStatus.GPS_solution, "satellites", mySituation.GPSSatellites)
+	}
+
 	globalStatus.GPS_satellites_locked = mySituation.GPSSatellites
 	globalStatus.GPS_satellites_seen = mySituation.GPSSatellitesSeen
 	globalStatus.GPS_satellites_tracked = mySituation.GPSSatellitesTracked
@@ -976,6 +1087,8 @@ func updateStatus() {
 		}
 	}
 	globalStatus.AHRS_LogFiles_Size = ahrsLogSize
+
+	updateLatencyStatus()
 }
 
 type WeatherMessage struct {
@@ -1074,7 +1187,9 @@ func parseInput(buf string) ([]byte, uint16) {
 	}
 
 	if s[0] == '-' {
-		parseDownlinkReport(s, int(thisSignalStrength))
+		start := time.Now()
+		parseDownlinkReport(s, int(thisSignalStrength), start)
+		workDone(LOAD_UAT, start)
 	}
 
 	s = s[1:]
@@ -1118,24 +1233,37 @@ func parseInput(buf string) ([]byte, uint16) {
 	thisMsg.Products = make([]uint32, 0)
 	if msgtype == MSGTYPE_UPLINK {
 		// Parse the UAT message.
+		start := time.Now()
 		uatMsg, err := uatparse.New(buf)
 		if err == nil {
-			uatMsg.DecodeUplink()
+			// When overloaded, the raw uplink is still relayed to the EFB, but we don't decode the weather ourselves.
+			shedWeather := isShedding(SHED_WEATHER)
+			if shedWeather {
+				uatMsg.DecodeUplinkNoWeather()
+			} else {
+				uatMsg.DecodeUplink()
+			}
+			tisbUplinkReceived(uatMsg)
 			towerid := fmt.Sprintf("(%f,%f)", uatMsg.Lat, uatMsg.Lon)
 			thisMsg.ADSBTowerID = towerid
 			// Get all of the "product ids".
 			for _, f := range uatMsg.Frames {
 				thisMsg.Products = append(thisMsg.Products, f.Product_id)
 				UpdateUATStats(f.Product_id)
-				weatherRawUpdate.SendJSON(f)
+				if !shedWeather {
+					weatherRawUpdate.SendJSON(f)
+				}
 			}
-			// Get all of the text reports.
-			textReports, _ := uatMsg.GetTextReports()
-			for _, r := range textReports {
-				registerADSBTextMessageReceived(r, uatMsg)
+			if !shedWeather {
+				// Get all of the text reports.
+				textReports, _ := uatMsg.GetTextReports()
+				for _, r := range textReports {
+					registerADSBTextMessageReceived(r, uatMsg)
+				}
 			}
 			thisMsg.uatMsg = uatMsg
 		}
+		workDone(LOAD_WEATHER, start)
 	}
 
 	msgLogAppend(thisMsg)
@@ -1158,6 +1286,7 @@ func getProductNameFromId(product_id int) string {
 }
 
 type settings struct {
+	SettingsVersion      int // Schema version of the settings file, see settingsschema.go
 	DarkMode             bool
 	UAT_Enabled          bool
 	ES_Enabled           bool
@@ -1167,6 +1296,9 @@ type settings struct {
 	BMP_Sensor_Enabled   bool
 	IMU_Sensor_Enabled   bool
 	NetworkOutputs       []networkConnection
+	OwnshipOutputs       []ownshipOutputConfig // Per output ownship report rate and content, see ownshipout.go
+	UATReportOutputs     []uatReportOutputConfig // Per output forwarding of raw UAT reports, see uatreportout.go
+	MulticastOutputs     []multicastOutput       // IPv4 multicast group outputs, see multicastout.go
 	SerialOutputs        map[string]serialConnection
 	DisplayTrafficSource bool
 	DEBUG                bool
@@ -1177,15 +1309,62 @@ type settings struct {
 	C, D                 [3]float64 // IMU Accel, Gyro zero bias
 	PPM                  int
 	AltitudeOffset       int
+	AltitudeSource       int // Forced ownship altitude source, see altitude.go. 0 = automatic
+	NMEABaroPriority     int // Rank of external $PGRMZ/$LXWP0 baro in automatic mode, see altitude.go
+	QNH                  float64 // hPa, used for indicated altitude
+	Geodesy              int     // Backend for long-range distance computations, see geodesy.go
+	DescentAlert_Enabled bool    // Alert on sustained descent after holding an altitude, see descentalert.go
+	DescentAlertRate     int     // ft/min
+	GroundStation_Enabled bool    // Fixed installation, position from the surveyed location below, see groundstation.go
+	GroundStationLat     float64 // deg
+	GroundStationLng     float64 // deg
+	GroundStationAlt     int     // ft MSL
+	PowerSave_Enabled    bool    // Wake-on-traffic power saving, see powersave.go
+	PowerSaveWakeRadius  int     // nm
+	GlideRatio           int     // Own glide ratio for the relative energy of glider targets, 0 = off. See glideband.go
+	GlideTailSuffix      bool    // Append the glide band to the PFLAA ID
+	OGNDashboard_Enabled bool    // UDP JSON feed of OGN/FLARM targets for club dashboards, see ogndashboard.go
+	OGNDashboardAddr     string  // host:port, may be a broadcast address
+	NMEACapture_Enabled  bool    // Record raw inbound NMEA per source, see nmeacapture.go
+	Locale               string  // Phrase set for alerts and callouts, see phrases.go
+	DDBUpdate_Enabled    bool    // Sync OGN DDB and FlarmNet when internet is available, see ddbupdater.go
+	RunwayHeading        int     // degrees, runway for the wind components in the situation. 0 = none. See wind.go
+	OGNTrackerFeed_Enabled bool  // Send our baro altitude and GPS to an OGN Tracker on the NMEA-in port, see ogntrackerfeed.go
+	FlarmRange           int     // m, FLARM RANGE: max distance of PFLAA targets. Clients can override it with PFLAC, see flarmrange.go
+	FlarmMaxSentences    int     // PFLAA sentences per second, 0 = all targets. See schedulePFLAA()
+	FlarmProtocolVersion int     // 9: PFLAA with <NoTrack>,<Source>,<RSSI>. 8: classic fields only
+	FlarmOutStealth      bool    // PFLAA of targets without alarm degraded like FLARM stealth mode (competitions)
+	ObstacleAlarm_Enabled bool   // Obstacle warnings and alert zones from obstacleDir, see obstacles.go
+	AirspaceWarning_Enabled   bool     // See airspace.go
+	AirspaceWarningDistance   int      // m, warn if closer to the boundary
+	AirspaceWarningVertical   int      // ft, warn if closer to the floor or ceiling
+	AirspaceWarningCategories []string // openAIP categories to warn for
+	TerrainAlert_Enabled      bool     // See terrain.go
+	TerrainClearance          int      // ft, caution if the predicted height above terrain is lower
+	AntennaGainOffset    int     // dB, 1090 antenna installation vs. typical, for the distance estimate of Mode S targets. See estimateDistance()
+	FlarmPriorityTargets int     // Most threatening targets that are sent every second if FlarmMaxSentences is exceeded
+	WiFiLinkAdapt_Enabled bool   // Only essential traffic to clients with a poor Wi-Fi link, see wifilinkquality.go
+	BatteryTelemetry_Enabled bool // Read smart battery box telemetry (serial/I2C), see batterytelemetry.go
+	BatteryAlertVoltage  float64 // V, low battery alert below this pack voltage. 0 = cell voltages only
+	DataLogDecimals      int     // Decimals of floats in the replay log, see datalogpolicy.go
+	DataLogPolicies      []dataLogPolicy // Replay log rate and change thresholds per table, see datalogpolicy.go
+	Audio_Enabled        bool    // Audio output of alarms, callouts and vario, see audiomixer.go
+	AudioDevice          string  // ALSA device, "" = default
+	AudioBluetoothSink   string  // MAC of a paired Bluetooth headset, overrides AudioDevice
+	AudioVolumeAlarm     int     // %
+	AudioVolumeCallout   int     // %
+	AudioVolumeVario     int     // %
+	AudioVario_Enabled   bool    // Vario tone from the baro climb rate
 	OwnshipModeS         string
 	WatchList            string
 	DeveloperMode        bool
 	GLimits              string
 	StaticIps            []string
+	LegacyDisplayIps     []string // Legacy FLARM displays behind WiFi serial bridges, see legacydisplay.go
 	WiFiSSID             string
 	WiFiChannel          int
 	WiFiSecurityEnabled  bool
-	WiFiPassphrase       string
+	WiFiPassphrase       string `json:"-"` // Kept in the credentials store, see credentials.go
 	WiFiSmartEnabled     bool // "Smart WiFi" - disables the default gateway for iOS.
 	NoSleep              bool
 
@@ -1201,9 +1380,73 @@ type settings struct {
 	OGNAddr              string
 	OGNAddrType          int
 	OGNAcftType          int
+	OGNTxPower           int  // dBm, see ognTrackerTxPowerMin/Max
 	OGNPilot             string
+	OGNStealth           bool // Hide track details from other FLARM/OGN devices
+	OGNNoTrack           bool // Don't show in public tracking (OGN) at all
+	OGNAprsReport_Enabled bool // Report own position to OGN via internet
+	SharedFeedPolicies   []sharedFeedPolicy // Position precision/delay for feeds to third parties, see sharedfeeds.go
 
 	PWMDutyMin           int
+
+	MLAT_Enabled         bool
+	MLAT_Server          string // host:port of the MLAT server
+	MLAT_User            string // user name shown on the MLAT server
+
+	UplinkArchive_Enabled bool // Serve received FIS-B uplinks with catch-up on TCP port 4001
+
+	Heatmap_Enabled      bool // Accumulate traffic density, see heatmap.go
+
+	OverloadShedding_Enabled bool // Shed weather decoding and logging when overloaded, see overload.go
+
+	TowTargetId          string       // Hex address of the target that gets the relaxed towing alarm profile
+	TowAutoDetect        bool         // Automatically use the towing alarm profile for the aircraft that takes off with us
+	AlarmPreset          string       // ALARM_PRESET_*: traffic alarm thresholds, see alarmprofiles.go
+	AlarmCustom          alarmProfile // Thresholds for ALARM_PRESET_CUSTOM
+	GroundAlarmSuppress  bool         // No traffic alarms while we are on the ground, see airborne.go
+	IGCUpload_Enabled    bool         // Upload IGC files after landing, see igcupload.go
+	WeGlideUserId        int
+	WeGlideDateOfBirth   string `json:"-"` // YYYY-MM-DD, WeGlide's upload credential. Kept in the credentials store, see credentials.go
+	WeGlideAircraftId    int
+	FlarmHwVersion       string       // Advertised in $PFLAV
+	FlarmSwVersion       string
+	FlarmObstVersion     string
+	FlarmConfigValues    map[string]string // PFLAC items without a meaning for us, as written by a glide computer. See flarmconfig.go
+	WeatherUplinkRegion  string       // Region pack for the emulated weather uplink, "" = off, see weatheruplink.go
+	PGRMZ_GPSFallback    bool         // $PGRMZ output with GPS altitude if there is no baro
+	RemoteSDR1090        string       // Remote receiver URL instead of a local dongle, see remotesdr.go
+	RemoteSDR978         string
+	RemoteSDR868         string
+	NMEAOut_GPVTG        bool         // Also send $GPVTG (track and speed) on the NMEA outputs
+	NMEAOut_GPGLL        bool         // Also send $GPGLL (position) on the NMEA outputs
+	NMEAOut_Vario        bool         // Also send $POV and $LXWP0 with the baro climb rate, see vario.go
+	NMEAOut_WIMWV        bool         // Also send $WIMWV with the wind estimate, see wind.go
+	NMEAOut_Heading      bool         // Also send $HEHDT/$HCHDG with the AHRS heading, at NMEAOutRate
+	NMEAOutRate          int          // Hz, GPRMC/GPGGA output rate (1, 2, 5, 10), see nmearate.go
+	NMEAOut_GNTalker     bool         // GN instead of GP talker ID if the GPS uses several constellations, see nmeaTalkerID()
+	NMEAOutTCPPorts      []int        // TCP NMEA output servers, e.g. 2000 (AIR Connect) and 10110 (NMEA standard port)
+	NMEAOutUDPBroadcast_Enabled bool  // UDP broadcast of the NMEA stream on the Wi-Fi, see nmeabroadcast.go
+	NMEAOutUDPBroadcastPort int       // 10110 = NMEA standard port
+	AirConnectPasscode_Enabled bool   // Require the passcode on port 2000 like a real AIR Connect
+	AirConnectPasscode   string
+	NMEAInUDPPort        int          // NMEA input over UDP, e.g. 10110 for SoftRF. 0 = off, see nmeaudpin.go
+	NMEAClientFilters    []nmeaClientFilter // Sentence masks per NMEA client, see nmeafilter.go
+	NMEASerialOut_Device string       // FLARM NMEA output on a serial port, e.g. /dev/ttyAMA0 for a panel display. "" = off
+	NMEASerialOut_Baud   int
+	AltEncoder_Device    string       // Serial altitude encoder output for a transponder, "" = off. See altencoder.go
+	AltEncoder_Baud      int
+	AltEncoder_Format    int          // ALT_ENCODER_*
+	Bluetooth_Enabled    bool         // NMEA output over Bluetooth, see bluetooth.go
+	BluetoothName        string       // Name the stratux is visible as
+	BluetoothSPP         bool         // Serial Port Profile (Android EFBs)
+	BluetoothBLE         bool         // BLE UART (iOS)
+	LowAlarmAGL          int          // ft above the ground reference, alarms de-escalated below, 0 = off. See airborne.go
+	TakeoffAlarmTime     int          // s after takeoff with de-escalated alarms, 0 = off
+	LowAlarmMaxLevel     int          // Highest alarm level while de-escalated, 0 = no alarms
+
+	Profiles             []settingsProfile      // Geofenced settings profiles, see profiles.go
+	ActiveProfile        string                 // Name of the profile we are currently in
+	ProfileRestore       map[string]interface{} // Settings to restore when leaving the active profile
 }
 
 type status struct {
@@ -1230,6 +1473,13 @@ type status struct {
 	GPS_position_accuracy                      float32
 	GPS_connected                              bool
 	GPS_solution                               string
+	GPS_validity                               string // See gpsvalidity.go
+	GPS_validity_changes                       uint32 // Since startup. Counts up quickly with a marginal fix
+	FlarmSerialDevices                         []flarmSerialDevice // FLARM/OGN Tracker serial devices, see flarmserial.go
+	NMEAInputs                                 []nmeaInFeeder      // Network NMEA inputs, see nmeainput.go
+	NMEAInputStats                             map[string]nmeaInputStats // Inbound sentences and checksum errors per source, see nmeachecksum.go
+	USBSerialDevices                           []usbSerialDevice         // Autodetected USB serial devices, see usbserialscan.go
+	OGNTracker_connected                       bool                      // An OGN Tracker that can be configured is connected, see ognTrackerConnected()
 	GPS_detected_type                          uint
 	GPS_NetworkRemoteIp                        string // for NMEA via TCP from OGN tracker: display remote IP to configure the OGN tracker
 	Uptime                                     int64
@@ -1260,12 +1510,28 @@ type status struct {
 	NightMode                                  bool // For turning off LEDs.
 	OGN_noise_db                               float32
 	OGN_gain_db                                float32
+	MLAT_connected                             bool
+	TowTarget                                  string                   // Hex address of the target the towing alarm profile is applied to
+	AltitudeSource                             string                   // Currently selected ownship altitude source
+	TISB_service                               string                   // TIS-B service volume status, see tisbstatus.go
+	TISB_sites                                 int                      // Number of TIS-B sites we currently receive targets from
+	DescentAlert                               bool                     // Unexpected sustained descent, see descentalert.go
+	DegradedModes                              []string                 // Descriptions of the active degraded modes, see degraded.go
+	Latency                                    map[string]sourceLatency // Traffic pipeline latency per source, see latency.go
+	Load                                       loadStatus               // CPU/memory usage and overload shedding, see overload.go
+	PowerSave                                  string                   // Power save state, see powersave.go
+	SubsystemRestarts                          map[string]int           // Restarts per supervised subsystem, see supervisor.go
+	Battery                                    batteryStatus            // Battery box telemetry, see batterytelemetry.go
+	Airborne                                   bool                     // Ownship airborne (or unknown), see airborne.go
+	GroundAlarmSuppressed                      bool                     // Traffic alarms currently suppressed because we are on the ground
+	LowAltitudeAlarmLimit                      bool                     // Traffic alarms currently de-escalated after takeoff or low in the pattern
 }
 
 var globalSettings settings
 var globalStatus status
 
 func defaultSettings() {
+	globalSettings.SettingsVersion = settingsSchemaVersion
 	globalSettings.DarkMode = false
 	globalSettings.UAT_Enabled = false
 	globalSettings.ES_Enabled = true
@@ -1279,6 +1545,9 @@ func defaultSettings() {
 		{Conn: nil, Ip: "", Port: 2000, Capability: NETWORK_FLARM_NMEA},
 		{Conn: nil, Ip: "", Port: 49002, Capability: NETWORK_POSITION_FFSIM | NETWORK_AHRS_FFSIM},
 	}
+	globalSettings.OwnshipOutputs = make([]ownshipOutputConfig, 0)
+	globalSettings.UATReportOutputs = make([]uatReportOutputConfig, 0)
+	globalSettings.MulticastOutputs = make([]multicastOutput, 0)
 	globalSettings.DEBUG = false
 	globalSettings.DisplayTrafficSource = false
 	globalSettings.ReplayLog = false //TODO: 'true' for debug builds.
@@ -1287,6 +1556,8 @@ func defaultSettings() {
 	globalSettings.OwnshipModeS = "F00000"
 	globalSettings.DeveloperMode = true
 	globalSettings.StaticIps = make([]string, 0)
+	globalSettings.LegacyDisplayIps = make([]string, 0)
+	globalSettings.SharedFeedPolicies = make([]sharedFeedPolicy, 0)
 	globalSettings.NoSleep = false
 	globalSettings.GDL90MSLAlt_Enabled = true
 	globalSettings.SkyDemonAndroidHack = false
@@ -1301,8 +1572,93 @@ func defaultSettings() {
 	globalSettings.RadarLimits = 2000
 	globalSettings.RadarRange = 10
 	globalSettings.AltitudeOffset = 0
+	globalSettings.AltitudeSource = ALT_SOURCE_AUTO
+	globalSettings.NMEABaroPriority = NMEA_BARO_PRIORITY_LOW
+	globalSettings.QNH = 1013.25
+	globalSettings.DescentAlert_Enabled = false
+	globalSettings.DescentAlertRate = 500
+	globalSettings.OverloadShedding_Enabled = true
+	globalSettings.PowerSave_Enabled = false
+	globalSettings.PowerSaveWakeRadius = 10
+	globalSettings.OGNDashboard_Enabled = false
+	globalSettings.OGNDashboardAddr = "192.168.10.255:8888"
+	globalSettings.NMEACapture_Enabled = false
+	globalSettings.Locale = defaultLocale
+	globalSettings.DDBUpdate_Enabled = true
+	globalSettings.FlarmRange = flarmRangeDefault
+	globalSettings.FlarmMaxSentences = 0
+	globalSettings.FlarmPriorityTargets = 10
+	globalSettings.FlarmProtocolVersion = 8
+	globalSettings.FlarmOutStealth = false
+	globalSettings.AntennaGainOffset = 0
+	globalSettings.ObstacleAlarm_Enabled = true
+	globalSettings.AirspaceWarning_Enabled = true
+	globalSettings.AirspaceWarningDistance = 2000
+	globalSettings.AirspaceWarningVertical = 500
+	globalSettings.TerrainAlert_Enabled = true
+	globalSettings.TerrainClearance = 500
+	globalSettings.AirspaceWarningCategories = []string{"A", "B", "C", "D", "CTR", "TMA", "CTA", "RESTRICTED", "PROHIBITED", "DANGER"}
+	globalSettings.OGNTrackerFeed_Enabled = true
+	globalSettings.OGNTxPower = 14 // OGN Tracker default
+	globalSettings.WiFiLinkAdapt_Enabled = true
+	globalSettings.BatteryTelemetry_Enabled = false
+	globalSettings.BatteryAlertVoltage = 0
+	globalSettings.DataLogDecimals = dataLogDefaultDecimals
+	globalSettings.DataLogPolicies = make([]dataLogPolicy, 0)
+	globalSettings.Audio_Enabled = false
+	globalSettings.AudioVolumeAlarm = 100
+	globalSettings.AudioVolumeCallout = 80
+	globalSettings.AudioVolumeVario = 60
+	globalSettings.AudioVario_Enabled = false
+	globalSettings.AlarmPreset = ALARM_PRESET_STANDARD
+	globalSettings.AlarmCustom = defaultAlarmProfile
+	globalSettings.GroundAlarmSuppress = true
+	globalSettings.IGCUpload_Enabled = false
+	globalSettings.FlarmHwVersion = "1.00"
+	globalSettings.FlarmSwVersion = "7.24"
+	globalSettings.FlarmObstVersion = ""
+	globalSettings.FlarmConfigValues = make(map[string]string)
+	globalSettings.WeatherUplinkRegion = ""
+	globalSettings.PGRMZ_GPSFallback = false
+	globalSettings.RemoteSDR1090 = ""
+	globalSettings.RemoteSDR978 = ""
+	globalSettings.RemoteSDR868 = ""
+	globalSettings.NMEAOut_GPVTG = false
+	globalSettings.NMEAOut_GPGLL = false
+	globalSettings.NMEAOut_Vario = false
+	globalSettings.NMEAOut_WIMWV = false
+	globalSettings.NMEAOut_Heading = false
+	globalSettings.NMEAOutRate = 1
+	globalSettings.NMEAOut_GNTalker = false
+	globalSettings.NMEAOutTCPPorts = []int{2000}
+	globalSettings.NMEAOutUDPBroadcast_Enabled = false
+	globalSettings.NMEAOutUDPBroadcastPort = 10110
+	globalSettings.AirConnectPasscode_Enabled = false
+	globalSettings.AirConnectPasscode = "6000"
+	globalSettings.NMEAInUDPPort = 0
+	globalSettings.NMEAClientFilters = make([]nmeaClientFilter, 0)
+	globalSettings.NMEASerialOut_Device = ""
+	globalSettings.NMEASerialOut_Baud = 19200 // FLARM default
+	globalSettings.AltEncoder_Device = ""
+	globalSettings.AltEncoder_Baud = 9600
+	globalSettings.AltEncoder_Format = ALT_ENCODER_ICARUS
+	globalSettings.Bluetooth_Enabled = false
+	globalSettings.BluetoothName = "Stratux"
+	globalSettings.BluetoothSPP = true
+	globalSettings.BluetoothBLE = true
+	globalSettings.LowAlarmAGL = 0
+	globalSettings.TakeoffAlarmTime = 0
+	globalSettings.LowAlarmMaxLevel = 1
 
 	globalSettings.PWMDutyMin = 0
+
+	globalSettings.MLAT_Enabled = false
+	globalSettings.MLAT_Server = ""
+	globalSettings.MLAT_User = ""
+
+	globalSettings.UplinkArchive_Enabled = false
+
+	globalSettings.Profiles = make([]settingsProfile, 0)
 }
 
 func readSettings() {
@@ -1310,25 +1666,30 @@ func readSettings() {
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
+		loadSettingsCredentials()
 		return
 	}
 	defer fd.Close()
-	buf := make([]byte, 4096)
-	count, err := fd.Read(buf)
+	buf, err := ioutil.ReadAll(fd)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
+		loadSettingsCredentials()
 		return
 	}
-	var newSettings settings
-	err = json.Unmarshal(buf[0:count], &newSettings)
+	migrated, err := loadSettingsJSON(buf)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
+		loadSettingsCredentials()
 		return
 	}
-	globalSettings = newSettings
 	log.Printf("read in settings.\n")
+	loadSettingsCredentials()
+	migrateSettingsCredentials(buf)
+	if migrated {
+		saveSettings()
+	}
 }
 
 func addSystemError(err error) {
@@ -1344,21 +1705,21 @@ func addSingleSystemErrorf(ident string, format string, a ...interface{}) {
 		// Error hasn't been thrown yet.
 		systemErrs[ident] = fmt.Sprintf(format, a...)
 		globalStatus.Errors = append(globalStatus.Errors, systemErrs[ident])
-		log.Printf("Added critical system error: %s\n", systemErrs[ident])
+		logEvent(EVENT_SYSTEM, EVENT_ERROR, "Added critical system error", "id", ident, "error", systemErrs[ident])
 	}
 	// Do nothing on this call if the error has already been thrown.
 	systemErrsMutex.Unlock()
 }
 
 func saveSettings() {
+	saveSettingsCredentials() // First, secrets only leave the settings file once they are in the store
 	fd, err := os.OpenFile(configLocation, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
 	if err != nil {
 		addSingleSystemErrorf("save-settings", "can't save settings %s: %s", configLocation, err.Error())
 		return
 	}
 	defer fd.Close()
-	jsonSettings, _ := json.Marshal(&globalSettings)
-	fd.Write(jsonSettings)
+	fd.Write(settingsFileJSON())
 	fd.Sync()
 	log.Printf("wrote settings.\n")
 }
@@ -1516,6 +1877,10 @@ func gracefulShutdown() {
 
 	pprof.StopCPUProfile()
 
+	saveHeatmap()
+	stopIgcFlight()
+	saveHandoverState()
+
 	//TODO: Any other graceful shutdown functions.
 
 	// Turn off green ACT LED on the Pi.
@@ -1534,6 +1899,7 @@ func handleSIGHUP() {
 		mfp := io.MultiWriter(fp, os.Stdout)
 		log.SetOutput(mfp)
 	}
+	reloadSettingsFile()
 	log.Printf("signal caught: SIGHUP, handled.\n")
 }
 
@@ -1583,6 +1949,9 @@ func main() {
 	mySituation.muGPSPerformance = &sync.Mutex{}
 	mySituation.muAttitude = &sync.Mutex{}
 	mySituation.muBaro = &sync.Mutex{}
+	mySituation.muWind = &sync.Mutex{}
+	mySituation.muAirfield = &sync.Mutex{}
+	mySituation.muTerrain = &sync.Mutex{}
 	mySituation.muSatellite = &sync.Mutex{}
 
 	// Set up system error tracking.
@@ -1684,6 +2053,7 @@ func main() {
 
 	// Read settings.
 	readSettings()
+	initSettingsSubscribers()
 
 	// Disable replay logs when replaying - so that messages replay data isn't copied into the logs.
 	// Override after reading in the settings.
@@ -1699,6 +2069,12 @@ func main() {
 	//FIXME: Only do this if data logging is enabled.
 	initDataLog()
 
+	// Flight declaration and IGC recording.
+	initIgc()
+
+	// Traffic density heatmap.
+	initHeatmap()
+
 	// Start the AHRS sensor monitoring.
 	initI2CSensors()
 
@@ -1706,10 +2082,20 @@ func main() {
 	initGPS()
 
 	// Start the heartbeat message loop in the background, once per second.
-	go heartBeatSender()
+	supervise("heartBeatSender", heartBeatSender)
 
 	// Initialize the (out) network handler.
 	initNetwork()
+	loadHandoverState()
+
+	// Ownship reports for outputs with their own rate/content configuration.
+	go ownshipOutputSender()
+
+	// Fixed rate NMEA stream for legacy FLARM displays.
+	go legacyDisplaySender()
+
+	// Vario sentences from the baro altitude.
+	supervise("varioSender", varioSender)
 
 	// Start printing stats periodically to the logfiles.
 	go printStats()
@@ -1720,6 +2106,39 @@ func main() {
 	// Guesses barometric altitude if we don't have our own baro source by using GnssBaroDiff from other traffic at similar altitude
 	go baroAltGuesser()
 
+	// Select the ownship altitude source.
+	go altitudeArbiter()
+
+	// Keep track of the TIS-B service volume status.
+	go tisbStatusUpdater()
+
+	// Warn on unexpected descents.
+	go descentAlerter()
+	go degradedModeSupervisor()
+	go sharedFeedRecorder()
+	go situationPublisher()
+	go settingsFileWatcher()
+	go overloadSupervisor()
+	go groundStationSupervisor()
+	go powerSaveSupervisor()
+	go ognDashboardSender()
+	go ddbUpdater()
+	go windEstimator()
+	go batteryTelemetryMonitor()
+	go audioMixer()
+	go airborneDetector()
+	go openAIPMonitor()
+	go obstacleLoader()
+	go airspaceMonitor()
+	go terrainMonitor()
+	go weatherUplinkEmulator()
+
+	// Apply geofenced settings profiles.
+	go profileEvaluator()
+
+	// Bind the glider on tow to the towing alarm profile.
+	go towDetector()
+
 	// Monitor RPi CPU temp.
 	globalStatus.CPUTempMin = invalidCpuTemp
 	globalStatus.CPUTempMax = invalidCpuTemp
@@ -0,0 +1,172 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	geodesy.go: Selectable geodesy backend for long-range computations (distance/bearing to
+		traffic, OGN ground stations, geofences, position projection). The default spherical
+		backend is fast, but off by up to ~0.5% since the earth is not a sphere. The WGS84 backend
+		uses Vincenty's formulae on the ellipsoid and is accurate to well below a meter.
+		Close-in FLARM math keeps using the flat-earth distRect() in equations.go.
+*/
+
+package main
+
+import (
+	"math"
+)
+
+// Values for globalSettings.Geodesy
+const (
+	GEODESY_SPHERICAL = 0
+	GEODESY_WGS84     = 1
+)
+
+type geodesyBackend interface {
+	// Inverse returns the distance in meters and the initial bearing in degrees from point 1 to point 2.
+	Inverse(lat1, lon1, lat2, lon2 float64) (dist, bearing float64)
+	// Direct returns the point reached from point 1 after distMeters on the given initial bearing.
+	Direct(lat1, lon1, bearingDeg, distMeters float64) (lat2, lon2 float64)
+}
+
+func currentGeodesy() geodesyBackend {
+	if globalSettings.Geodesy == GEODESY_WGS84 {
+		return vincentyGeodesy{}
+	}
+	return sphericalGeodesy{}
+}
+
+type sphericalGeodesy struct{}
+
+const sphericalEarthRadius = 6371008.8 // meters; mean radius
+
+// Inverse uses the law of cosines.
+func (sphericalGeodesy) Inverse(lat1, lon1, lat2, lon2 float64) (dist, bearing float64) {
+	lat1 = radians(lat1)
+	lon1 = radians(lon1)
+	lat2 = radians(lat2)
+	lon2 = radians(lon2)
+
+	dist = math.Acos(math.Sin(lat1)*math.Sin(lat2)+math.Cos(lat1)*math.Cos(lat2)*math.Cos(lon2-lon1)) * sphericalEarthRadius
+
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(lon2-lon1)
+	y := math.Sin(lon2-lon1) * math.Cos(lat2)
+	bearing = degreesHdg(math.Atan2(y, x))
+	return
+}
+
+func (sphericalGeodesy) Direct(lat1, lon1, bearingDeg, distMeters float64) (lat2, lon2 float64) {
+	lat1Rad := radians(lat1)
+	lon1Rad := radians(lon1)
+	bearingRad := radians(bearingDeg)
+	distanceRad := distMeters / 1852.0 / (180 * 60 / math.Pi)
+
+	lat2Rad := math.Asin(math.Sin(lat1Rad)*math.Cos(distanceRad) + math.Cos(lat1Rad)*math.Sin(distanceRad)*math.Cos(bearingRad))
+	distanceLon := -math.Atan2(math.Sin(bearingRad)*math.Sin(distanceRad)*math.Cos(lat1Rad), math.Cos(distanceRad)-math.Sin(lat1Rad)*math.Sin(lat2Rad))
+	lon2Rad := math.Mod(lon1Rad-distanceLon+math.Pi, 2.0*math.Pi) - math.Pi
+
+	return degrees(lat2Rad), degrees(lon2Rad)
+}
+
+type vincentyGeodesy struct{}
+
+// WGS84 ellipsoid
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+const vincentyMaxIterations = 100
+
+// Inverse uses Vincenty's inverse formula. Falls back to the sphere for nearly antipodal points, where it doesn't converge.
+func (vincentyGeodesy) Inverse(lat1, lon1, lat2, lon2 float64) (dist, bearing float64) {
+	if lat1 == lat2 && lon1 == lon2 {
+		return 0, 0
+	}
+	L := radians(lon2 - lon1)
+	U1 := math.Atan((1 - wgs84F) * math.Tan(radians(lat1)))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(radians(lat2)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	var sinSigma, cosSigma, sigma, cos2Alpha, cos2SigmaM, sinLambda, cosLambda float64
+	converged := false
+	for i := 0; i < vincentyMaxIterations; i++ {
+		sinLambda, cosLambda = math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0, 0 // Coincident points
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cos2Alpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cos2Alpha != 0 { // Not on the equator
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cos2Alpha
+		}
+		C := wgs84F / 16 * cos2Alpha * (4 + wgs84F*(4-3*cos2Alpha))
+		lambdaPrev := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-lambdaPrev) < 1e-12 {
+			converged = true
+			break
+		}
+	}
+	if !converged {
+		return sphericalGeodesy{}.Inverse(lat1, lon1, lat2, lon2)
+	}
+
+	uSq := cos2Alpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+
+	dist = wgs84B * A * (sigma - deltaSigma)
+	bearing = degreesHdg(math.Atan2(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda))
+	return
+}
+
+// Direct uses Vincenty's direct formula.
+func (vincentyGeodesy) Direct(lat1, lon1, bearingDeg, distMeters float64) (lat2, lon2 float64) {
+	alpha1 := radians(bearingDeg)
+	sinAlpha1, cosAlpha1 := math.Sincos(alpha1)
+	tanU1 := (1 - wgs84F) * math.Tan(radians(lat1))
+	cosU1 := 1 / math.Sqrt(1+tanU1*tanU1)
+	sinU1 := tanU1 * cosU1
+	sigma1 := math.Atan2(tanU1, cosAlpha1)
+	sinAlpha := cosU1 * sinAlpha1
+	cos2Alpha := 1 - sinAlpha*sinAlpha
+	uSq := cos2Alpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+
+	sigma := distMeters / (wgs84B * A)
+	var sinSigma, cosSigma, cos2SigmaM float64
+	for i := 0; i < vincentyMaxIterations; i++ {
+		cos2SigmaM = math.Cos(2*sigma1 + sigma)
+		sinSigma, cosSigma = math.Sincos(sigma)
+		deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+			B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+		sigmaPrev := sigma
+		sigma = distMeters/(wgs84B*A) + deltaSigma
+		if math.Abs(sigma-sigmaPrev) < 1e-12 {
+			break
+		}
+	}
+	sinSigma, cosSigma = math.Sincos(sigma)
+	cos2SigmaM = math.Cos(2*sigma1 + sigma)
+
+	x := sinU1*sinSigma - cosU1*cosSigma*cosAlpha1
+	lat2Rad := math.Atan2(sinU1*cosSigma+cosU1*sinSigma*cosAlpha1, (1-wgs84F)*math.Hypot(sinAlpha, x))
+	lambda := math.Atan2(sinSigma*sinAlpha1, cosU1*cosSigma-sinU1*sinSigma*cosAlpha1)
+	C := wgs84F / 16 * cos2Alpha * (4 + wgs84F*(4-3*cos2Alpha))
+	L := lambda - (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+	lon2Rad := math.Mod(radians(lon1)+L+3*math.Pi, 2*math.Pi) - math.Pi
+
+	return degrees(lat2Rad), degrees(lon2Rad)
+}
@@ -0,0 +1,59 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	glideband.go: Relative energy of glider targets for glider pilots. With the configured
+		glide ratio we estimate the altitude we would arrive at the target's position, and
+		compare it with the target's altitude. A thermalling gaggle we arrive above is
+		reachable, one slightly above our glide path can still be joined at its base, the
+		rest is out of reach. No wind and no sink between here and there, so it's a hint only.
+		Published as TrafficInfo.GlideBand and optionally as suffix of the PFLAA ID.
+*/
+
+package main
+
+const (
+	GLIDE_UNKNOWN   = 0 // Not a glider, disabled, or no position/altitude
+	GLIDE_REACHABLE = 1 // We arrive at or above the target's altitude
+	GLIDE_ABOVE     = 2 // Target is above our glide path, we arrive less than glideBandMargin below it
+	GLIDE_BELOW     = 3 // We arrive more than glideBandMargin below the target
+)
+
+const glideBandMargin = 1000.0 // ft
+
+func isGliderTarget(ti TrafficInfo) bool {
+	return ti.Emitter_category == 9 || ti.Emitter_category == 12 // glider, hang glider/paraglider
+}
+
+// computeGlideBand classifies a target relative to our glide performance. ownAlt must be comparable to ti.Alt.
+func computeGlideBand(ti TrafficInfo, ownAlt float32, ownAltValid bool) uint8 {
+	if globalSettings.GlideRatio <= 0 || !ownAltValid || !ti.BearingDist_valid || ti.Alt == 0 || !isGliderTarget(ti) {
+		return GLIDE_UNKNOWN
+	}
+	arrivalAlt := float64(ownAlt) - ti.Distance*3.28084/float64(globalSettings.GlideRatio)
+	switch {
+	case arrivalAlt >= float64(ti.Alt):
+		return GLIDE_REACHABLE
+	case arrivalAlt >= float64(ti.Alt)-glideBandMargin:
+		return GLIDE_ABOVE
+	}
+	return GLIDE_BELOW
+}
+
+// glideBandTailSuffix is appended to the PFLAA ID if enabled, so displays without Stratux support can show it.
+func glideBandTailSuffix(band uint8) string {
+	if !globalSettings.GlideTailSuffix {
+		return ""
+	}
+	switch band {
+	case GLIDE_REACHABLE:
+		return "+"
+	case GLIDE_ABOVE:
+		return "="
+	case GLIDE_BELOW:
+		return "-"
+	}
+	return ""
+}
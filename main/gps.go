@@ -41,7 +41,7 @@ const (
 	BARO_TYPE_NONE         = 0 // No baro present
 	BARO_TYPE_BMP280       = 1 // Stratux AHRS module or similar internal baro
 	BARO_TYPE_OGNTRACKER   = 2 // OGN Tracker with baro pressure
-	BARO_TYPE_NMEA         = 3 // Other NMEA provider that reports $PGRMZ (SoftRF)
+	BARO_TYPE_NMEA         = 3 // Other NMEA provider that reports $PGRMZ (SoftRF) or $LXWP0 (LX)
 	BARO_TYPE_ADSBESTIMATE = 4 // If we have no baro, we will try to estimate baro pressure from ADS-B targets reporting GnssDiffFromBaroAlt (HAE<->Baro difference)
 )
 
@@ -92,6 +92,7 @@ type SituationData struct {
 	muBaro                  *sync.Mutex
 	BaroTemperature         float32
 	BaroPressureAltitude    float32
+	BaroIndicatedAltitude   float32 // Pressure altitude corrected for globalSettings.QNH
 	BaroVerticalSpeed       float32
 	BaroLastMeasurementTime time.Time
 	BaroSourceType          uint8
@@ -109,6 +110,37 @@ type SituationData struct {
 	AHRSGLoadMax         float64
 	AHRSLastAttitudeTime time.Time
 	AHRSStatus           uint8
+
+	// From wind estimator (wind.go).
+	muWind               *sync.Mutex
+	WindValid            bool
+	WindDirection        float32 // degrees true, direction the wind is coming from
+	WindSpeed            float32 // knots
+	WindLastEstimateTime time.Time
+	WindHeadwind         float32 // knots, along the current track. Negative = tailwind
+	WindCrosswind        float32 // knots, across the current track. Positive = from the right
+	WindRunwayHeadwind   float32 // knots, as above for globalSettings.RunwayHeading
+	WindRunwayCrosswind  float32
+
+	// From airfield database (openaip.go).
+	muAirfield            *sync.Mutex
+	AirfieldValid         bool
+	AirfieldName          string
+	AirfieldICAO          string
+	AirfieldFrequency     string  // MHz, as in the database, e.g. "122.875"
+	AirfieldFrequencyType string  // TOWER, CTAF, INFO, ...
+	AirfieldDistance      float32 // NM
+	AirfieldBearing       float32 // degrees true
+	AirspaceWarnings      []airspaceWarning // Also protected by muAirfield, see airspace.go
+
+	// From the terrain elevation tiles (terrain.go).
+	muTerrain               *sync.Mutex
+	TerrainValid            bool
+	TerrainElevation        float32 // ft MSL, below us
+	TerrainHeightAbove      float32 // ft, from the GPS altitude
+	TerrainMinClearance     float32 // ft, lowest predicted height above terrain along our path
+	TerrainMinClearanceTime int     // s until then
+	TerrainAlert            int     // TERRAIN_ALERT_*
 }
 
 /*
@@ -196,11 +228,7 @@ func makeUBXCFG(class, id byte, msglen uint16, msg []byte) []byte {
 }
 
 func makeNMEACmd(cmd string) []byte {
-	chk_sum := byte(0)
-	for i := range cmd {
-		chk_sum = chk_sum ^ byte(cmd[i])
-	}
-	return []byte(fmt.Sprintf("$%s*%02x\x0d\x0a", cmd, chk_sum))
+	return []byte(makeNMEASentence(cmd))
 }
 
 
@@ -243,6 +271,10 @@ func initGPSSerial() bool {
 		device = "/dev/softrf_dongle"
 		globalStatus.GPS_detected_type = GPS_TYPE_SOFTRF_DONGLE
 		baudrates[0] = 115200
+	} else if d, ok := usbSerialGPSDevice(); ok { // No udev rule, found by usbSerialScanner()
+		device = d.Device
+		globalStatus.GPS_detected_type = usbSerialGPSType(d)
+		baudrates[0] = d.Baud
  	} else if _, err := os.Stat("/dev/ttyAMA0"); err == nil { // ttyAMA0 is PL011 UART (GPIO pins 8 and 10) on all RPi.
 		device = "/dev/ttyAMA0"
 		globalStatus.GPS_detected_type = GPS_TYPE_UART
@@ -564,6 +596,23 @@ func configureOgnTracker() {
 	globalStatus.GPS_detected_type = GPS_TYPE_OGNTRACKER
 }
 
+// gpsSetsSystemTime is false in the tests, they must not set the clock of the machine they run on.
+var gpsSetsSystemTime = true
+
+// setSystemTimeFromGPS sets the system clock to the GPS time, if it's more than 200ms off.
+func setSystemTimeFromGPS(gpsTime time.Time) {
+	if !gpsSetsSystemTime || (time.Since(gpsTime) <= 200*time.Millisecond && time.Since(gpsTime) >= -200*time.Millisecond) {
+		return
+	}
+	setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
+	log.Printf("setting system time from %s to: '%s'\n", time.Now().Format("20060102 15:04:05.000"), setStr)
+	if err := exec.Command("date", "-s", setStr).Run(); err != nil {
+		log.Printf("Set Date failure: %s error\n", err)
+	} else {
+		log.Printf("Time set from GPS. Current time is %v\n", time.Now())
+	}
+}
+
 // func validateNMEAChecksum determines if a string is a properly formatted NMEA sentence with a valid checksum.
 //
 // If the input string is valid, output is the input stripped of the "$" token and checksum, along with a boolean 'true'
@@ -592,10 +641,7 @@ func validateNMEAChecksum(s string) (string, bool) {
 		return "Invalid checksum", false
 	}
 
-	cs_calc := byte(0)
-	for i := range s_out {
-		cs_calc = cs_calc ^ byte(s_out[i])
-	}
+	cs_calc := nmeaChecksum(s_out)
 
 	if cs_calc != byte(cs) {
 		return fmt.Sprintf("Checksum failed. Calculated %#X; expected %#X", cs_calc, cs), false
@@ -1045,8 +1091,20 @@ func calculateNavRate() float64 {
  	return halfwidth
  }
 
+// Sentences that set our own position. In ground station mode they are ignored, see groundstation.go.
+var nmeaOwnPositionSentences = []string{"RMC", "GGA", "VTG", "GSA", "PUBX"}
+
+// processNMEALine handles a sentence from any connected GPS. A ground station uses its fixed position,
+// but still takes the traffic (PFLAA, PFLAU, POGNB, ...) from a FLARM or OGN Tracker.
+func processNMEALine(l string) (sentenceUsed bool) {
+	if isGroundStation() && nmeaSentenceMatches(nmeaOwnPositionSentences, nmeaSentenceID(l)) {
+		return false
+	}
+	return parseNMEALine(l)
+}
+
 /*
-processNMEALine parses NMEA-0183 formatted strings against several message types.
+parseNMEALine parses NMEA-0183 formatted strings against several message types.
 
 Standard messages supported: RMC GGA VTG GSA
 U-blox proprietary messages: PUBX,00 PUBX,03 PUBX,04
@@ -1056,7 +1114,7 @@ return is true if parse occurs correctly and position is valid.
 
 */
 
-func processNMEALine(l string) (sentenceUsed bool) {
+func parseNMEALine(l string) (sentenceUsed bool) {
 	mySituation.muGPS.Lock()
 
 	defer func() {
@@ -1455,15 +1513,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 					stratuxClock.SetRealTimeReference(gpsTime)
 					mySituation.GPSLastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
 					// log.Printf("GPS time is: %s\n", gpsTime) //debug
-					if time.Since(gpsTime) > 200*time.Millisecond || time.Since(gpsTime) < -200*time.Millisecond {
-						setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-						log.Printf("setting system time from %s to: '%s'\n", time.Now().Format("20060102 15:04:05.000"), setStr)
-						if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-							log.Printf("Set Date failure: %s error\n", err)
-						} else {
-							log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-						}
-					}
+					setSystemTimeFromGPS(gpsTime)
 					setDataLogTimeWithGPS(mySituation)
 					return true // All possible successes lead here.
 				}
@@ -1668,15 +1718,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				tmpSituation.GPSLastGPSTimeStratuxTime = stratuxClock.Time
 				tmpSituation.GPSTime = gpsTime
 				stratuxClock.SetRealTimeReference(gpsTime)
-				if time.Since(gpsTime) > 200*time.Millisecond || time.Since(gpsTime) < -200*time.Millisecond {
-					setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-					log.Printf("setting system time from %s to: '%s'\n", time.Now().Format("20060102 15:04:05.000"), setStr)
-					if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-						log.Printf("Set Date failure: %s error\n", err)
-					} else {
-						log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-					}
-				}
+				setSystemTimeFromGPS(gpsTime)
 			}
 		}
 
@@ -2054,14 +2096,8 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			return false
 		}
 
-		if !isTempPressValid() || mySituation.BaroSourceType != BARO_TYPE_BMP280 {
-			mySituation.muBaro.Lock()
-			mySituation.BaroPressureAltitude = float32(pressureAlt * 3.28084) // meters to feet
-			mySituation.BaroVerticalSpeed = float32(vspeed * 196.85) // m/s in ft/min
-			mySituation.BaroLastMeasurementTime = stratuxClock.Time
-			mySituation.BaroSourceType = BARO_TYPE_OGNTRACKER
-			mySituation.muBaro.Unlock()
-		}
+		// meters to feet, m/s in ft/min
+		updateBaroSource(BARO_TYPE_OGNTRACKER, float32(pressureAlt * 3.28084), float32(vspeed * 196.85), true)
 		return true
 	}
 
@@ -2101,37 +2137,24 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			} else if kv[0] == "AcftType" {
 				acfttype, _ :=  strconv.ParseInt(kv[1], 0, 8)
 				globalSettings.OGNAcftType = int(acfttype)
+			} else if kv[0] == "TxPower" {
+				if txpower, err := strconv.ParseInt(kv[1], 0, 8); err == nil && txpower >= ognTrackerTxPowerMin && txpower <= ognTrackerTxPowerMax {
+					globalSettings.OGNTxPower = int(txpower)
+				}
 			} else if kv[0] == "Pilot" {
 				globalSettings.OGNPilot = kv[1]
+			} else if kv[0] == "Stealth" {
+				globalSettings.OGNStealth = kv[1] == "1"
+			} else if kv[0] == "NoTrack" {
+				globalSettings.OGNNoTrack = kv[1] == "1"
 			}
 		}
 	}
 
-	// Only evaluate PGRMZ for SoftRF/Flarm, where we know that it is standard barometric pressure.
+	// Only evaluate PGRMZ/LXWP0 for SoftRF/Flarm/LX devices (serial or pushing to 30011), where we know that it is standard barometric pressure.
 	// might want to add more types if applicable.
-	// $PGRMZ,1089,f,3*2B
-	if x[0] == "PGRMZ" && ((globalStatus.GPS_detected_type & 0x0f) ==  GPS_TYPE_SERIAL || (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_SOFTRF_DONGLE) {
-		if len(x) < 3 {
-			return false
-		}
-		// Assume pressure altitude in PGRMZ if we don't have any other baro (SoftRF style)
-		pressureAlt, err := strconv.ParseFloat(x[1], 32)
-		if err != nil {
-			return false
-		}
-		unit := x[2]
-		if unit == "m" {
-			pressureAlt *= 3.28084
-		}
-		// Prefer internal sensor and OGN tracker over this...
-		if !isTempPressValid() || (mySituation.BaroSourceType != BARO_TYPE_BMP280 && mySituation.BaroSourceType != BARO_TYPE_OGNTRACKER) {
-			mySituation.muBaro.Lock()
-			mySituation.BaroPressureAltitude = float32(pressureAlt) // meters to feet
-			mySituation.BaroLastMeasurementTime = stratuxClock.Time
-			mySituation.BaroSourceType = BARO_TYPE_NMEA
-			mySituation.muBaro.Unlock()
-			return true
-		}
+	if (x[0] == "PGRMZ" || x[0] == "LXWP0") && ((globalStatus.GPS_detected_type & 0x0f) ==  GPS_TYPE_SERIAL || (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_SOFTRF_DONGLE || (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_NETWORK) {
+		return parseNMEABaro(x)
 	}
 
 	// Flarm NMEA traffic data
@@ -2144,12 +2167,25 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	return false
 }
 
+// TX power range accepted by the OGN Tracker firmware (RFM95 and SX1262 modules)
+const (
+	ognTrackerTxPowerMin = -10
+	ognTrackerTxPowerMax = 20
+)
+
+func ognTrackerSettingsCommand() string {
+	return fmt.Sprintf("$POGNS,Address=0x%s,AddrType=%d,AcftType=%d,TxPower=%d,Pilot=%s,Stealth=%d,NoTrack=%d\r\n", globalSettings.OGNAddr, globalSettings.OGNAddrType, globalSettings.OGNAcftType, globalSettings.OGNTxPower,
+		globalSettings.OGNPilot, boolToInt(globalSettings.OGNStealth), boolToInt(globalSettings.OGNNoTrack))
+}
+
 func configureOgnTrackerFromSettings() {
+	cfg := ognTrackerSettingsCommand()
+	writeOgnTrackerSettings(cfg) // Additional trackers, see flarmserial.go
+	writeOgnTrackerFeedSettings(cfg) // Trackers on the NMEA-in port, see ogntrackerfeed.go
 	if serialPort == nil {
 		return
 	}
 
-	cfg := fmt.Sprintf("$POGNS,Address=0x%s,AddrType=%d,AcftType=%d,Pilot=%s\r\n", globalSettings.OGNAddr, globalSettings.OGNAddrType, globalSettings.OGNAcftType, globalSettings.OGNPilot)
 	log.Printf("Configuring OGN Tracker: " + cfg)
 
 	serialPort.Write([]byte(cfg))
@@ -2222,11 +2258,7 @@ func baroAltGuesser() {
 				slope, intercept, valid := linRegWeighted(alts, diffs, weights)
 				if valid {
 					gnssBaroDiff := float64(myAlt) * slope + intercept
-					mySituation.muBaro.Lock()
-					mySituation.BaroLastMeasurementTime = stratuxClock.Time
-					mySituation.BaroPressureAltitude = mySituation.GPSHeightAboveEllipsoid - float32(gnssBaroDiff)
-					mySituation.BaroSourceType = BARO_TYPE_ADSBESTIMATE
-					mySituation.muBaro.Unlock()
+					updateBaroSource(BARO_TYPE_ADSBESTIMATE, mySituation.GPSHeightAboveEllipsoid - float32(gnssBaroDiff), 0, false)
 				}
 			}
 		}
@@ -2237,6 +2269,11 @@ func baroAltGuesser() {
 func gpsSerialReader() {
 	defer serialPort.Close()
 	readyToInitGPS = false //TODO: replace with channel control to terminate goroutine when complete
+	defer func() {
+		// Also after a panic, so pollGPS reconnects.
+		globalStatus.GPS_connected = false
+		readyToInitGPS = true
+	}()
 
 	i := 0 //debug monitor
 	scanner := bufio.NewScanner(serialPort)
@@ -2247,11 +2284,16 @@ func gpsSerialReader() {
 		}
 
 		s := scanner.Text()
+		captureNMEA(NMEA_SOURCE_SERIAL, "", s)
 		startIdx := strings.Index(s, "$")
 		if startIdx < 0 {
 			continue
 		}
 		s = s[startIdx:]
+		if _, ok := checkNMEAInput(NMEA_SOURCE_SERIAL, "", s); !ok {
+			continue
+		}
+		flarmSerialPrimaryLine(serialConfig.Name, s)
 
 		if !processNMEALine(s) {
 			if globalSettings.DEBUG {
@@ -2266,9 +2308,6 @@ func gpsSerialReader() {
 	if globalSettings.DEBUG {
 		log.Printf("Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
 	}
-	globalStatus.GPS_connected = false
-	readyToInitGPS = true //TODO: replace with channel control to terminate goroutine when complete
-	return
 }
 
 func makeAHRSSimReport() {
@@ -2500,16 +2539,14 @@ func isGPSConnected() bool {
 
 /*
 isGPSValid returns true only if a valid position fix has been seen in the last 3 seconds,
-and if the GPS subsystem has recently detected a GPS device.
+and if the GPS subsystem has recently detected a GPS device. With hysteresis, see gpsvalidity.go.
 
-If false, 'GPSFixQuality` is set to 0 ("No fix"), as is the number of satellites in solution.
+If there is no fix at all, 'GPSFixQuality` is set to 0 ("No fix"), as is the number of satellites in solution.
 */
 
 func isGPSValid() bool {
-	isValid := false
-	if (stratuxClock.Since(mySituation.GPSLastFixLocalTime) < 3*time.Second) && globalStatus.GPS_connected && mySituation.GPSFixQuality > 0 {
-		isValid = true
-	} else {
+	isValid := updateGPSValidity()
+	if !isValid && !gpsFixPresent() {
 		mySituation.GPSFixQuality = 0
 		mySituation.GPSSatellites = 0
 		mySituation.GPSHorizontalAccuracy = 999999
@@ -2546,15 +2583,18 @@ func isTempPressValid() bool {
 func pollGPS() {
 	readyToInitGPS = true //TODO: Implement more robust method (channel control) to kill zombie serial readers
 	timer := time.NewTicker(4 * time.Second)
-	go gpsAttitudeSender()
-	go ffAttitudeSender()
 	for {
 		<-timer.C
 		// GPS enabled, was not connected previously?
 		if globalSettings.GPS_Enabled && !globalStatus.GPS_connected && readyToInitGPS { //TODO: Implement more robust method (channel control) to kill zombie serial readers
 			globalStatus.GPS_connected = initGPSSerial()
 			if globalStatus.GPS_connected && (globalStatus.GPS_detected_type & 0x0f) != GPS_TYPE_NETWORK {
-				go gpsSerialReader()
+				go func() {
+					if err := runSupervised("gpsSerialReader", gpsSerialReader); err != nil {
+						recordSubsystemRestart("gpsSerialReader")
+						logEvent(EVENT_GPS, EVENT_ERROR, "GPS reader crashed, reconnecting", "reason", err.Error())
+					}
+				}()
 			}
 		}
 	}
@@ -2563,5 +2603,9 @@ func pollGPS() {
 func initGPS() {
 	Satellites = make(map[string]SatelliteInfo)
 
-	go pollGPS()
+	go gpsAttitudeSender()
+	go ffAttitudeSender()
+	superviseNoRecover("pollGPS", pollGPS) // The NMEA parser doesn't unlock with defer
+	supervise("flarmSerialManager", flarmSerialManager)
+	supervise("usbSerialScanner", usbSerialScanner)
 }
@@ -0,0 +1,120 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpsvalidity.go: Validity of our GPS position with hysteresis. A marginal fix (few satellites,
+		under the wing, in the hangar door) used to toggle isGPSValid() every few seconds, so
+		NMEA outputs flapped between fix and no fix and the GDL90 ownship report came and went.
+		EFBs handle that badly (ownship jumps to the last known position, traffic is cleared).
+		- Acquisition: the fix must be good (gpsAcquireMinSatellites, gpsAcquireMaxAccuracy) for
+		  gpsAcquireDwell before it is used.
+		- Loss: once valid, a missing or bad fix is bridged for gpsLossHold (GPS_VALIDITY_HOLDOVER)
+		  before we report no fix.
+		Transitions are recorded in the event log (EVENT_GPS), see /getEvents?subsystem=gps.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	GPS_VALIDITY_NOFIX     = 0
+	GPS_VALIDITY_ACQUIRING = 1 // Good fix, waiting for gpsAcquireDwell
+	GPS_VALIDITY_VALID     = 2
+	GPS_VALIDITY_HOLDOVER  = 3 // Fix lost or stale, still reported valid for gpsLossHold
+)
+
+var gpsValidityNames = []string{"No Fix", "Acquiring", "Valid", "Holdover"}
+
+const (
+	gpsFixTimeout           = 3 * time.Second // No fix message for this long = no fix
+	gpsAcquireDwell         = 3 * time.Second
+	gpsAcquireMinSatellites = 4
+	gpsAcquireMaxAccuracy   = 100 // m, 95% horizontal
+	gpsLossHold             = 2 * time.Second
+)
+
+var gpsValidityMutex = &sync.Mutex{}
+var gpsValidity = GPS_VALIDITY_NOFIX
+var gpsValiditySince time.Time // Entered the current state
+var gpsValidityTransitions uint32
+
+// gpsFixPresent is the raw condition: a fix was received recently from a connected GPS.
+func gpsFixPresent() bool {
+	return stratuxClock.Since(mySituation.GPSLastFixLocalTime) < gpsFixTimeout && globalStatus.GPS_connected && mySituation.GPSFixQuality > 0
+}
+
+// gpsFixGood returns true if the fix is good enough to start using the GPS. Not all sources report
+// satellites and accuracy (ground station mode, some NMEA devices), unknown values don't block.
+func gpsFixGood() bool {
+	if !gpsFixPresent() {
+		return false
+	}
+	sats, acc := mySituation.GPSSatellites, mySituation.GPSHorizontalAccuracy
+	return (sats == 0 || sats >= gpsAcquireMinSatellites) && (acc <= 0 || acc >= 999999 || acc < gpsAcquireMaxAccuracy)
+}
+
+// setGPSValidity must be called with gpsValidityMutex held.
+func setGPSValidity(state int) {
+	prev := gpsValidity
+	gpsValidity = state
+	gpsValiditySince = stratuxClock.Time
+	if (prev == GPS_VALIDITY_NOFIX && state == GPS_VALIDITY_ACQUIRING) || (prev == GPS_VALIDITY_ACQUIRING && state == GPS_VALIDITY_NOFIX) {
+		return // Not a change of the reported validity
+	}
+	gpsValidityTransitions++
+	severity := EVENT_INFO
+	if state == GPS_VALIDITY_NOFIX {
+		severity = EVENT_WARN
+	}
+	logEvent(EVENT_GPS, severity, "GPS validity changed", "from", gpsValidityNames[prev], "to", gpsValidityNames[state],
+		"satellites", mySituation.GPSSatellites, "accuracy", mySituation.GPSHorizontalAccuracy)
+}
+
+// updateGPSValidity runs the state machine and returns true if the position may be used.
+func updateGPSValidity() bool {
+	gpsValidityMutex.Lock()
+	defer gpsValidityMutex.Unlock()
+	switch gpsValidity {
+	case GPS_VALIDITY_NOFIX:
+		if gpsFixGood() {
+			setGPSValidity(GPS_VALIDITY_ACQUIRING)
+		}
+	case GPS_VALIDITY_ACQUIRING:
+		if !gpsFixGood() {
+			setGPSValidity(GPS_VALIDITY_NOFIX)
+		} else if stratuxClock.Since(gpsValiditySince) >= gpsAcquireDwell {
+			setGPSValidity(GPS_VALIDITY_VALID)
+		}
+	case GPS_VALIDITY_VALID:
+		if !gpsFixPresent() {
+			setGPSValidity(GPS_VALIDITY_HOLDOVER)
+		}
+	case GPS_VALIDITY_HOLDOVER:
+		if gpsFixPresent() {
+			setGPSValidity(GPS_VALIDITY_VALID)
+		} else if stratuxClock.Since(gpsValiditySince) >= gpsLossHold {
+			setGPSValidity(GPS_VALIDITY_NOFIX)
+		}
+	}
+	return gpsValidity == GPS_VALIDITY_VALID || gpsValidity == GPS_VALIDITY_HOLDOVER
+}
+
+// gpsValidityCurrent returns the validity as of the last updateGPSValidity(), without updating it.
+func gpsValidityCurrent() bool {
+	gpsValidityMutex.Lock()
+	defer gpsValidityMutex.Unlock()
+	return gpsValidity == GPS_VALIDITY_VALID || gpsValidity == GPS_VALIDITY_HOLDOVER
+}
+
+// gpsValidityStatus returns the current state name and the number of valid/invalid transitions since startup.
+func gpsValidityStatus() (string, uint32) {
+	gpsValidityMutex.Lock()
+	defer gpsValidityMutex.Unlock()
+	return gpsValidityNames[gpsValidity], gpsValidityTransitions
+}
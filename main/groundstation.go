@@ -0,0 +1,89 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	groundstation.go: Ground station mode for fixed installations (club webcams, tow office
+		displays). The position comes from the surveyed location in the settings instead of
+		GPS, so traffic bearing/distance and OGN reception work without a GPS antenna.
+		A connected GPS is ignored. There is no aircraft, so no ownship is sent to the outputs
+		and our position is not reported to OGN.
+		Without GPS, the real time is taken from the system clock (NTP).
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	groundStationHorizontalAccuracy = 3.0 // m, a surveyed position is better than any GPS fix
+	groundStationVerticalAccuracy   = 5.0 // m
+)
+
+func isGroundStation() bool {
+	return globalSettings.GroundStation_Enabled && isGroundStationSurveyed()
+}
+
+func isGroundStationSurveyed() bool {
+	lat, lng := globalSettings.GroundStationLat, globalSettings.GroundStationLng
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 && (lat != 0 || lng != 0)
+}
+
+// updateGroundStationSituation publishes the surveyed position as a valid fix.
+func updateGroundStationSituation() {
+	mySituation.muGPS.Lock()
+	mySituation.GPSLatitude = float32(globalSettings.GroundStationLat)
+	mySituation.GPSLongitude = float32(globalSettings.GroundStationLng)
+	mySituation.GPSAltitudeMSL = float32(globalSettings.GroundStationAlt)
+	mySituation.GPSHeightAboveEllipsoid = mySituation.GPSAltitudeMSL + mySituation.GPSGeoidSep
+	mySituation.GPSFixQuality = 1
+	mySituation.GPSHorizontalAccuracy = groundStationHorizontalAccuracy
+	mySituation.GPSVerticalAccuracy = groundStationVerticalAccuracy
+	mySituation.GPSNACp = calculateNACp(groundStationHorizontalAccuracy)
+	mySituation.GPSGroundSpeed = 0
+	mySituation.GPSVerticalSpeed = 0
+	mySituation.GPSTurnRate = 0
+	mySituation.GPSLastFixLocalTime = stratuxClock.Time
+	mySituation.GPSLastGroundTrackTime = stratuxClock.Time
+	mySituation.GPSLastValidNMEAMessageTime = stratuxClock.Time
+	mySituation.muGPS.Unlock()
+	globalStatus.GPS_connected = true
+}
+
+// groundStationSupervisor keeps the surveyed position valid while ground station mode is enabled.
+func groundStationSupervisor() {
+	ticker := time.NewTicker(1 * time.Second)
+	wasEnabled := false
+	for {
+		<-ticker.C
+		enabled := isGroundStation()
+		if enabled != wasEnabled {
+			if enabled {
+				logEvent(EVENT_GPS, EVENT_INFO, "Ground station mode, using surveyed position",
+					"lat", globalSettings.GroundStationLat, "lng", globalSettings.GroundStationLng, "alt", globalSettings.GroundStationAlt)
+			} else {
+				logEvent(EVENT_GPS, EVENT_INFO, "Ground station mode disabled")
+				globalStatus.GPS_connected = false // Let pollGPS look for a real GPS again
+			}
+			wasEnabled = enabled
+		}
+		if !enabled {
+			continue
+		}
+		if !stratuxClock.HasRealTimeReference() {
+			stratuxClock.SetRealTimeReference(time.Now())
+		}
+		updateGroundStationSituation()
+
+		// ogn-rx-eu needs to know where it is, it usually gets that from the GPS NMEA stream.
+		for _, nmea := range []string{makeGPRMCString(), makeGPGGAString()} {
+			if nmea = strings.TrimSpace(nmea); len(nmea) > 0 {
+				ognPublishNmea(nmea)
+			}
+		}
+	}
+}
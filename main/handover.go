@@ -0,0 +1,207 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	handover.go: Restarts without losing clients and state (e.g. for an update).
+		- systemd socket activation: if stratux.socket is installed, systemd owns the listening
+		  sockets (NMEA out, NMEA in, uplink archive, web interface) and passes them to us
+		  (LISTEN_FDS). They stay open while we restart, so clients can reconnect right away
+		  and connection attempts during the restart are queued instead of refused.
+		- State handover: on shutdown, the traffic map and the uplink archive (weather) are saved
+		  to stateHandoverFile on tmpfs. If we come back within stateHandoverMaxAge, they are
+		  restored, so EFBs get traffic and weather right away instead of starting cold.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	systemdListenFdsStart = 3 // SD_LISTEN_FDS_START
+	stateHandoverFile     = "/run/stratux-state.json"
+	stateHandoverMaxAge   = 60 * time.Second
+)
+
+// systemdListener is a socket passed by systemd. It is never closed and never accepted on itself: each
+// listenTCP() gets a duplicate of it, and only one at a time, like a port can only be bound once.
+type systemdListener struct {
+	ln    net.Listener
+	inUse bool
+}
+
+var systemdListeners map[string]*systemdListener // by local port
+var systemdListenersOnce sync.Once
+var systemdListenersMutex = &sync.Mutex{}
+
+// inheritedListener is a duplicate of a socket that belongs to systemd. Closing it ends Accept() like for
+// any listener and hands the socket back, systemd's one stays open for the next listenTCP() of the port.
+type inheritedListener struct {
+	net.Listener
+	port string
+	once sync.Once
+}
+
+func (l *inheritedListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.Listener.Close()
+		systemdListenersMutex.Lock()
+		systemdListeners[l.port].inUse = false
+		systemdListenersMutex.Unlock()
+	})
+	return err
+}
+
+func loadSystemdListeners() {
+	systemdListeners = make(map[string]*systemdListener)
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID") // Not for our child processes
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return
+	}
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener made a copy
+		if err != nil {
+			log.Printf("Socket activation: fd %d is not a listening socket: %s\n", fd, err.Error())
+			continue
+		}
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			systemdListeners[strconv.Itoa(addr.Port)] = &systemdListener{ln: ln}
+			log.Printf("Socket activation: listening on %s\n", addr.String())
+		} else {
+			ln.Close()
+		}
+	}
+}
+
+// listenTCP returns a listener on the socket passed by systemd for the port of addr, or a new one.
+func listenTCP(addr string) (net.Listener, error) {
+	systemdListenersOnce.Do(loadSystemdListeners)
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.Listen("tcp", addr)
+	}
+	systemdListenersMutex.Lock()
+	defer systemdListenersMutex.Unlock()
+	sl, ok := systemdListeners[port]
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if sl.inUse {
+		return nil, fmt.Errorf("socket for port %s passed by systemd is in use", port)
+	}
+	f, err := sl.ln.(*net.TCPListener).File()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.FileListener(f)
+	f.Close() // FileListener made a copy
+	if err != nil {
+		return nil, err
+	}
+	sl.inUse = true
+	return &inheritedListener{Listener: ln, port: port}, nil
+}
+
+type handoverUplink struct {
+	Age float64 // seconds
+	Msg []byte
+}
+
+type handoverState struct {
+	Saved   time.Time              // wall clock
+	Traffic map[uint32]TrafficInfo // stratuxClock times converted to wall clock, see stratuxClockTimes()
+	Uplinks []handoverUplink
+}
+
+// saveHandoverState is called by gracefulShutdown().
+func saveHandoverState() {
+	state := handoverState{Saved: time.Now()}
+	toWall := state.Saved.Sub(stratuxClock.Time)
+	trafficMutex.Lock()
+	state.Traffic = make(map[uint32]TrafficInfo, len(traffic))
+	for key, ti := range traffic {
+		for _, t := range ti.stratuxClockTimes() {
+			if !t.IsZero() {
+				*t = t.Add(toWall)
+			}
+		}
+		state.Traffic[key] = ti
+	}
+	trafficMutex.Unlock()
+	if uplinkArchiveMutex != nil {
+		uplinkArchiveMutex.Lock()
+		for _, e := range uplinkArchive {
+			state.Uplinks = append(state.Uplinks, handoverUplink{Age: stratuxClock.Since(e.received).Seconds(), Msg: e.msg})
+		}
+		uplinkArchiveMutex.Unlock()
+	}
+	buf, err := json.Marshal(&state)
+	if err == nil {
+		err = ioutil.WriteFile(stateHandoverFile, buf, 0600)
+	}
+	if err != nil {
+		log.Printf("Could not save state for handover: %s\n", err.Error())
+	}
+}
+
+// loadHandoverState restores the state saved by the previous instance. The file is used only once.
+func loadHandoverState() {
+	buf, err := ioutil.ReadFile(stateHandoverFile)
+	if err != nil {
+		return
+	}
+	os.Remove(stateHandoverFile)
+	var state handoverState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		log.Printf("Invalid handover state: %s\n", err.Error())
+		return
+	}
+	elapsed := time.Since(state.Saved)
+	if elapsed < 0 || elapsed > stateHandoverMaxAge {
+		return
+	}
+	// stratuxClock restarted at zero. The saved times are wall clock, so their age includes the restart time.
+	fromWall := stratuxClock.Time.Sub(time.Now())
+
+	trafficMutex.Lock()
+	for key, ti := range state.Traffic {
+		if _, ok := traffic[key]; ok {
+			continue // Already received fresh data
+		}
+		for _, t := range ti.stratuxClockTimes() {
+			if !t.IsZero() {
+				*t = t.Add(fromWall)
+			}
+		}
+		traffic[key] = ti
+	}
+	trafficMutex.Unlock()
+
+	uplinkArchiveMutex.Lock()
+	for _, u := range state.Uplinks {
+		received := stratuxClock.Time.Add(-time.Duration(u.Age*float64(time.Second)) - elapsed)
+		uplinkArchive[string(u.Msg)] = &uplinkArchiveEntry{received: received, msg: u.Msg}
+	}
+	uplinkArchiveMutex.Unlock()
+	log.Printf("Restored %d targets and %d uplink frames from the previous instance (%.1fs ago)\n", len(state.Traffic), len(state.Uplinks), elapsed.Seconds())
+}
@@ -0,0 +1,194 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	heatmap.go: Accumulates received traffic positions into a persistent geographic grid,
+		split into altitude bands, for traffic density analysis around a site.
+		Each cell counts "target seconds", i.e. it is incremented once per second for each
+		target that is currently inside the cell.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	heatmapFile         = "heatmap.json"
+	heatmapCellSize     = 0.01 // degrees, about 1km in latitude
+	heatmapBandSize     = 1000 // feet
+	heatmapMaxBand      = 18   // everything above 18000ft is counted in the top band
+	heatmapSaveInterval = 5 * time.Minute
+)
+
+type heatmapKey struct {
+	LatIdx int32
+	LonIdx int32
+	Band   int8
+}
+
+type heatmapCell struct {
+	LatIdx int32
+	LonIdx int32
+	Band   int8
+	Count  uint32
+}
+
+var heatmap map[heatmapKey]uint32
+var heatmapMutex *sync.Mutex
+var heatmapDirty bool
+
+func heatmapLocation() string {
+	return filepath.Join(logDirf, heatmapFile)
+}
+
+func heatmapBand(alt int32) int8 {
+	band := alt / heatmapBandSize
+	if band < 0 {
+		band = 0
+	}
+	if band > heatmapMaxBand {
+		band = heatmapMaxBand
+	}
+	return int8(band)
+}
+
+// heatmapAdd counts a target in its current cell. Called once per second per current target.
+func heatmapAdd(ti TrafficInfo) {
+	if !globalSettings.Heatmap_Enabled || !ti.Position_valid || ti.ExtrapolatedPosition || !privacyAllows(ti, PRIVACY_USE_HEATMAP) {
+		return
+	}
+	key := heatmapKey{
+		LatIdx: int32(math.Floor(float64(ti.Lat) / heatmapCellSize)),
+		LonIdx: int32(math.Floor(float64(ti.Lng) / heatmapCellSize)),
+		Band:   heatmapBand(ti.Alt),
+	}
+	heatmapMutex.Lock()
+	heatmap[key]++
+	heatmapDirty = true
+	heatmapMutex.Unlock()
+}
+
+func loadHeatmap() {
+	data, err := ioutil.ReadFile(heatmapLocation())
+	if err != nil {
+		return
+	}
+	var cells []heatmapCell
+	if err := json.Unmarshal(data, &cells); err != nil {
+		log.Printf("can't read heatmap %s: %s\n", heatmapLocation(), err.Error())
+		return
+	}
+	heatmapMutex.Lock()
+	for _, c := range cells {
+		heatmap[heatmapKey{c.LatIdx, c.LonIdx, c.Band}] = c.Count
+	}
+	heatmapMutex.Unlock()
+}
+
+func saveHeatmap() {
+	heatmapMutex.Lock()
+	if !heatmapDirty {
+		heatmapMutex.Unlock()
+		return
+	}
+	cells := make([]heatmapCell, 0, len(heatmap))
+	for k, v := range heatmap {
+		cells = append(cells, heatmapCell{k.LatIdx, k.LonIdx, k.Band, v})
+	}
+	heatmapDirty = false
+	heatmapMutex.Unlock()
+
+	data, _ := json.Marshal(cells)
+	tmp := heatmapLocation() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		addSingleSystemErrorf("heatmap-save", "can't save heatmap %s: %s", heatmapLocation(), err.Error())
+		return
+	}
+	os.Rename(tmp, heatmapLocation())
+}
+
+func clearHeatmap() {
+	heatmapMutex.Lock()
+	heatmap = make(map[heatmapKey]uint32)
+	heatmapDirty = false
+	heatmapMutex.Unlock()
+	os.Remove(heatmapLocation())
+}
+
+/*
+makeHeatmapGeoJSON returns the heatmap as GeoJSON FeatureCollection. Each cell is a Polygon
+feature with the properties "count", "band" (altitude band index) and "alt_min"/"alt_max" in feet.
+band < 0 returns all altitude bands.
+*/
+func makeHeatmapGeoJSON(band int) ([]byte, error) {
+	type geometry struct {
+		Type        string         `json:"type"`
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	type feature struct {
+		Type       string                 `json:"type"`
+		Geometry   geometry               `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	type featureCollection struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}
+
+	fc := featureCollection{Type: "FeatureCollection", Features: make([]feature, 0)}
+	heatmapMutex.Lock()
+	for k, v := range heatmap {
+		if band >= 0 && int(k.Band) != band {
+			continue
+		}
+		lat0 := float64(k.LatIdx) * heatmapCellSize
+		lon0 := float64(k.LonIdx) * heatmapCellSize
+		lat1 := lat0 + heatmapCellSize
+		lon1 := lon0 + heatmapCellSize
+		altMax := interface{}((int(k.Band) + 1) * heatmapBandSize)
+		if k.Band == heatmapMaxBand {
+			altMax = nil
+		}
+		fc.Features = append(fc.Features, feature{
+			Type: "Feature",
+			Geometry: geometry{
+				Type:        "Polygon",
+				Coordinates: [][][2]float64{{{lon0, lat0}, {lon1, lat0}, {lon1, lat1}, {lon0, lat1}, {lon0, lat0}}},
+			},
+			Properties: map[string]interface{}{
+				"count":   v,
+				"band":    k.Band,
+				"alt_min": int(k.Band) * heatmapBandSize,
+				"alt_max": altMax,
+			},
+		})
+	}
+	heatmapMutex.Unlock()
+	return json.Marshal(&fc)
+}
+
+func heatmapSaver() {
+	ticker := time.NewTicker(heatmapSaveInterval)
+	for {
+		<-ticker.C
+		saveHeatmap()
+	}
+}
+
+func initHeatmap() {
+	heatmap = make(map[heatmapKey]uint32)
+	heatmapMutex = &sync.Mutex{}
+	loadHeatmap()
+	go heatmapSaver()
+}
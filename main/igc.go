@@ -0,0 +1,370 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	igc.go: FLARM-like flight declaration and IGC flight recording.
+		Glide computers declare the pilot, glider and task via $PFLAC,S,<item> like they
+		would with a real FLARM. The declaration is stored and written into the header of
+		the IGC files recorded for each flight. Recorded files can be downloaded via the web API
+		and by glide computers with the FLARM binary protocol (flarmbinary.go), and uploaded to a
+		scoring platform after landing (igcupload.go).
+		Note that we can't produce a valid IGC security (G) record, so the files are not
+		accepted for badge/record claims.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	taskLocation    = "/etc/stratux-task.json"
+	igcDir          = "igc"
+	igcManufacturer = "XSX" // X = manufacturer without official IGC code
+)
+
+type flarmTaskWaypoint struct {
+	Lat  float64
+	Lon  float64
+	Name string
+}
+
+type flarmDeclaration struct {
+	Pilot      string
+	CoPilot    string
+	GliderType string
+	GliderId   string
+	CompId     string
+	CompClass  string
+	TaskName   string
+	Waypoints  []flarmTaskWaypoint
+}
+
+var flarmTask flarmDeclaration
+var flarmTaskMutex *sync.Mutex
+
+type igcFlight struct {
+	file       *os.File
+	started    time.Time
+	lastMoving time.Time // stratuxClock
+}
+
+var currentIgcFlight *igcFlight // Guarded by igcFlightMutex
+var igcFlightMutex = &sync.Mutex{}
+
+func readFlarmTask() {
+	data, err := ioutil.ReadFile(taskLocation)
+	if err != nil {
+		return
+	}
+	flarmTaskMutex.Lock()
+	defer flarmTaskMutex.Unlock()
+	if err := json.Unmarshal(data, &flarmTask); err != nil {
+		log.Printf("can't read task declaration %s: %s\n", taskLocation, err.Error())
+	}
+}
+
+// saveFlarmTask must be called with flarmTaskMutex held.
+func saveFlarmTask() {
+	data, _ := json.MarshalIndent(&flarmTask, "", "  ")
+	if err := ioutil.WriteFile(taskLocation, data, 0644); err != nil {
+		addSingleSystemErrorf("task-write", "can't save task declaration to %s: %s", taskLocation, err.Error())
+	}
+}
+
+// parseFlarmCoord parses FLARM/IGC style coordinates DDMMmmmN / DDDMMmmmE.
+func parseFlarmCoord(s string, degDigits int) (float64, bool) {
+	if len(s) != degDigits+6 {
+		return 0, false
+	}
+	deg, err1 := strconv.Atoi(s[:degDigits])
+	mmm, err2 := strconv.Atoi(s[degDigits : degDigits+5])
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	val := float64(deg) + float64(mmm)/1000.0/60.0
+	switch s[degDigits+5] {
+	case 'S', 'W':
+		val = -val
+	case 'N', 'E':
+	default:
+		return 0, false
+	}
+	return val, true
+}
+
+// formatFlarmCoord is the inverse of parseFlarmCoord.
+func formatFlarmCoord(val float64, degDigits int, pos, neg string) string {
+	hemi := pos
+	if val < 0 {
+		hemi = neg
+		val = -val
+	}
+	deg := math.Floor(val)
+	mmm := math.Round((val - deg) * 60 * 1000)
+	if mmm >= 60000 {
+		deg++
+		mmm -= 60000
+	}
+	return fmt.Sprintf("%0*d%05d%s", degDigits, int(deg), int(mmm), hemi)
+}
+
+// declarationItem returns a pointer to the string field of the declaration for the given PFLAC item.
+func declarationItem(item string) *string {
+	switch item {
+	case "PILOT":
+		return &flarmTask.Pilot
+	case "COPIL":
+		return &flarmTask.CoPilot
+	case "GLIDERTYPE":
+		return &flarmTask.GliderType
+	case "GLIDERID":
+		return &flarmTask.GliderId
+	case "COMPID":
+		return &flarmTask.CompId
+	case "COMPCLASS":
+		return &flarmTask.CompClass
+	}
+	return nil
+}
+
+/*
+handlePflacDeclaration handles the declaration related PFLAC items:
+$PFLAC,<R|S>,<PILOT|COPIL|GLIDERTYPE|GLIDERID|COMPID|COMPCLASS>[,<value>]
+$PFLAC,S,NEWTASK,<name>
+$PFLAC,S,ADDWP,<DDMMmmmN>,<DDDMMmmmE>,<name>
+Input is the sentence without $ and checksum. Returns the answer sentence and true if the item was handled.
+*/
+func handlePflacDeclaration(x []string) (string, bool) {
+	if len(x) < 3 || x[0] != "PFLAC" {
+		return "", false
+	}
+	flarmTaskMutex.Lock()
+	defer flarmTaskMutex.Unlock()
+
+	item := x[2]
+	var answer string
+	if field := declarationItem(item); field != nil {
+		if x[1] == "S" && len(x) >= 4 {
+			*field = strings.Join(x[3:], ",")
+			saveFlarmTask()
+		}
+		answer = fmt.Sprintf("PFLAC,A,%s,%s", item, *field)
+	} else if item == "NEWTASK" && x[1] == "S" {
+		flarmTask.TaskName = ""
+		if len(x) >= 4 {
+			flarmTask.TaskName = x[3]
+		}
+		flarmTask.Waypoints = make([]flarmTaskWaypoint, 0)
+		saveFlarmTask()
+		answer = fmt.Sprintf("PFLAC,A,NEWTASK,%s", flarmTask.TaskName)
+	} else if item == "ADDWP" && x[1] == "S" && len(x) >= 5 {
+		lat, ok1 := parseFlarmCoord(x[3], 2)
+		lon, ok2 := parseFlarmCoord(x[4], 3)
+		if !ok1 || !ok2 {
+			answer = "PFLAC,A,ERROR"
+		} else {
+			wp := flarmTaskWaypoint{Lat: lat, Lon: lon}
+			if len(x) >= 6 {
+				wp.Name = x[5]
+			}
+			flarmTask.Waypoints = append(flarmTask.Waypoints, wp)
+			saveFlarmTask()
+			answer = fmt.Sprintf("PFLAC,A,ADDWP,%s,%s,%s", x[3], x[4], wp.Name)
+		}
+	} else {
+		return "", false
+	}
+
+	return makeNMEASentence(answer), true
+}
+
+func igcRecordDir() string {
+	return filepath.Join(logDirf, igcDir)
+}
+
+func igcHeader(t time.Time) string {
+	flarmTaskMutex.Lock()
+	defer flarmTaskMutex.Unlock()
+
+	serial := strings.ToUpper(globalSettings.OwnshipModeS)
+	if len(serial) > 3 {
+		serial = serial[len(serial)-3:]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "A%s%s\r\n", igcManufacturer, serial)
+	fmt.Fprintf(&b, "HFDTEDATE:%s,01\r\n", t.Format("020106"))
+	fmt.Fprintf(&b, "HFPLTPILOTINCHARGE:%s\r\n", flarmTask.Pilot)
+	fmt.Fprintf(&b, "HFCM2CREW2:%s\r\n", flarmTask.CoPilot)
+	fmt.Fprintf(&b, "HFGTYGLIDERTYPE:%s\r\n", flarmTask.GliderType)
+	fmt.Fprintf(&b, "HFGIDGLIDERID:%s\r\n", flarmTask.GliderId)
+	fmt.Fprintf(&b, "HFDTMGPSDATUM:WGS84\r\n")
+	fmt.Fprintf(&b, "HFFTYFRTYPE:Stratux,%s\r\n", stratuxVersion)
+	fmt.Fprintf(&b, "HFCIDCOMPETITIONID:%s\r\n", flarmTask.CompId)
+	fmt.Fprintf(&b, "HFCCLCOMPETITIONCLASS:%s\r\n", flarmTask.CompClass)
+	fmt.Fprintf(&b, "HFALGALTGPS:GEO\r\n")
+	fmt.Fprintf(&b, "HFALPALTPRESSURE:ISA\r\n")
+
+	// Task declaration. Takeoff and landing are not known in advance and are left empty.
+	if len(flarmTask.Waypoints) > 0 {
+		fmt.Fprintf(&b, "C%s000000000001%02d%s\r\n", t.Format("020106150405"), iMax(0, len(flarmTask.Waypoints)-2), flarmTask.TaskName)
+		fmt.Fprintf(&b, "C0000000N00000000ETAKEOFF\r\n")
+		for _, wp := range flarmTask.Waypoints {
+			fmt.Fprintf(&b, "C%s%s%s\r\n", formatFlarmCoord(wp.Lat, 2, "N", "S"), formatFlarmCoord(wp.Lon, 3, "E", "W"), wp.Name)
+		}
+		fmt.Fprintf(&b, "C0000000N00000000ELANDING\r\n")
+	}
+	return b.String()
+}
+
+// igcAltitude formats an altitude in m for a B record. Below sea level the first digit is a minus sign.
+func igcAltitude(alt int) string {
+	if alt < 0 {
+		return fmt.Sprintf("-%04d", iMin(-alt, 9999))
+	}
+	return fmt.Sprintf("%05d", iMin(alt, 99999))
+}
+
+func igcBRecord(t time.Time) string {
+	mySituation.muGPS.Lock()
+	lat := float64(mySituation.GPSLatitude)
+	lon := float64(mySituation.GPSLongitude)
+	gpsAlt := int(mySituation.GPSAltitudeMSL / 3.28084)
+	mySituation.muGPS.Unlock()
+
+	pressAlt := 0
+	if isTempPressValid() {
+		pressAlt = int(mySituation.BaroPressureAltitude / 3.28084)
+	}
+	return fmt.Sprintf("B%s%s%sA%s%s\r\n", t.Format("150405"),
+		formatFlarmCoord(lat, 2, "N", "S"), formatFlarmCoord(lon, 3, "E", "W"), igcAltitude(pressAlt), igcAltitude(gpsAlt))
+}
+
+// startIgcFlight opens the file for a new flight. Caller holds igcFlightMutex.
+func startIgcFlight(t time.Time) {
+	dir := igcRecordDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		addSingleSystemErrorf("igc-dir", "can't create IGC directory %s: %s", dir, err.Error())
+		return
+	}
+	// Flight number of the day. The IGC long file name has two digits, more than 99 flights a day get more.
+	var fn string
+	var f *os.File
+	var err error
+	for i := 1; ; i++ {
+		fn = filepath.Join(dir, fmt.Sprintf("%s-%s-%02d.igc", t.Format("2006-01-02"), igcManufacturer, i))
+		f, err = os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		addSingleSystemErrorf("igc-create", "can't create IGC file %s: %s", fn, err.Error())
+		return
+	}
+	log.Printf("Starting IGC recording %s\n", fn)
+	f.WriteString(igcHeader(t))
+	currentIgcFlight = &igcFlight{file: f, started: t, lastMoving: stratuxClock.Time}
+}
+
+// stopIgcFlight closes the current flight, if any, and queues it for upload.
+func stopIgcFlight() {
+	igcFlightMutex.Lock()
+	defer igcFlightMutex.Unlock()
+	stopIgcFlightLocked()
+}
+
+// isIgcRecording is true while a flight is recorded.
+func isIgcRecording() bool {
+	igcFlightMutex.Lock()
+	defer igcFlightMutex.Unlock()
+	return currentIgcFlight != nil
+}
+
+// stopIgcFlightLocked is stopIgcFlight for callers that hold igcFlightMutex.
+func stopIgcFlightLocked() {
+	if currentIgcFlight == nil {
+		return
+	}
+	name := currentIgcFlight.file.Name()
+	log.Printf("Stopping IGC recording %s\n", name)
+	currentIgcFlight.file.Close()
+	currentIgcFlight = nil
+	if globalSettings.IGCUpload_Enabled {
+		if err := queueIgcUpload(filepath.Base(name)); err != nil {
+			log.Printf("can't queue IGC upload of %s: %s\n", name, err.Error())
+		}
+	}
+}
+
+// igcRecorder writes one B record per second while we are moving.
+func igcRecorder() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		if !isGPSValid() || !isGPSClockValid() {
+			continue
+		}
+		igcRecordSecond(time.Now().UTC())
+	}
+}
+
+func igcRecordSecond(now time.Time) {
+	igcFlightMutex.Lock()
+	defer igcFlightMutex.Unlock()
+	moving := mySituation.GPSGroundSpeed > 20
+	if currentIgcFlight == nil {
+		if !moving {
+			return
+		}
+		startIgcFlight(now)
+		if currentIgcFlight == nil {
+			return
+		}
+	}
+	if mySituation.GPSGroundSpeed > 5 {
+		currentIgcFlight.lastMoving = stratuxClock.Time
+	}
+	currentIgcFlight.file.WriteString(igcBRecord(now))
+	if stratuxClock.Since(currentIgcFlight.lastMoving) > 60*time.Second {
+		stopIgcFlightLocked()
+	}
+}
+
+// getIgcFiles returns the names of all recorded IGC files, newest first.
+func getIgcFiles() []string {
+	files, err := ioutil.ReadDir(igcRecordDir())
+	names := make([]string, 0)
+	if err != nil {
+		return names
+	}
+	for _, f := range files {
+		if strings.HasSuffix(strings.ToLower(f.Name()), ".igc") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names
+}
+
+func initIgc() {
+	flarmTaskMutex = &sync.Mutex{}
+	flarmTask.Waypoints = make([]flarmTaskWaypoint, 0)
+	readFlarmTask()
+	go igcRecorder()
+	go igcUploader()
+}
@@ -0,0 +1,264 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	igcupload.go: Automatic upload of the recorded IGC files (see igc.go) to a scoring platform.
+		When a flight ends, its file is queued. Uploads are retried while Stratux has no
+		internet (usually until the phone hotspot is back in range after landing), for up
+		to igcUploadGiveUp. The state per file is kept in igcUploadStateFile next to the
+		files and shown on the logs page.
+		Services are pluggable (igcUploadServices). WeGlide identifies the pilot by user ID
+		and date of birth, the aircraft by its WeGlide aircraft ID. OLC has no public upload
+		API, files for OLC still have to be submitted by hand.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	igcUploadStateFile     = "uploads.json"
+	igcUploadRetryInterval = 2 * time.Minute
+	igcUploadGiveUp        = 72 * time.Hour
+	igcUploadTimeout       = 60 * time.Second
+	weglideUploadURL       = "https://api.weglide.org/v1/igcfile"
+	weglideFlightURL       = "https://www.weglide.org/flight/"
+)
+
+const (
+	IGC_UPLOAD_PENDING  = "pending"
+	IGC_UPLOAD_DONE     = "uploaded"
+	IGC_UPLOAD_FAILED   = "failed"   // Retried until igcUploadGiveUp
+	IGC_UPLOAD_REJECTED = "rejected" // The service refused the file, not retried
+)
+
+type igcUploadStatus struct {
+	Service   string
+	State     string    // IGC_UPLOAD_*
+	Error     string    // Last error
+	Queued    time.Time // UTC
+	Attempted time.Time // UTC, last attempt
+	FlightURL string    // Flight on the service, once uploaded
+}
+
+// An igcUploadService uploads one file. A permanent error (the service rejected the file) is returned as igcUploadRejected.
+type igcUploadService interface {
+	name() string
+	configured() bool
+	upload(fn string) (flightURL string, err error)
+}
+
+type igcUploadRejected struct {
+	msg string
+}
+
+func (e igcUploadRejected) Error() string {
+	return e.msg
+}
+
+var igcUploadServices = []igcUploadService{
+	&weglideUpload{},
+}
+
+var igcUploads = make(map[string]igcUploadStatus) // By file name
+var igcUploadMutex = &sync.Mutex{}
+var igcUploadWake = make(chan struct{}, 1)
+
+func igcUploadStatePath() string {
+	return filepath.Join(igcRecordDir(), igcUploadStateFile)
+}
+
+func loadIgcUploads() {
+	data, err := ioutil.ReadFile(igcUploadStatePath())
+	if err != nil {
+		return
+	}
+	igcUploadMutex.Lock()
+	defer igcUploadMutex.Unlock()
+	if err := json.Unmarshal(data, &igcUploads); err != nil {
+		log.Printf("can't read IGC upload state: %s\n", err.Error())
+	}
+	for name := range igcUploads {
+		if !isIgcFileName(name) {
+			delete(igcUploads, name) // The state file is untrusted input, never upload what isn't an IGC file name
+		}
+	}
+}
+
+// saveIgcUploads must be called with igcUploadMutex held.
+func saveIgcUploads() {
+	data, _ := json.MarshalIndent(igcUploads, "", "  ")
+	if err := ioutil.WriteFile(igcUploadStatePath(), data, 0644); err != nil {
+		log.Printf("can't write IGC upload state: %s\n", err.Error())
+	}
+}
+
+// activeIgcUploadService returns the first configured service, nil if none.
+func activeIgcUploadService() igcUploadService {
+	for _, s := range igcUploadServices {
+		if s.configured() {
+			return s
+		}
+	}
+	return nil
+}
+
+// isIgcFileName is true for a plain file name (no path) of an IGC file.
+func isIgcFileName(name string) bool {
+	return len(name) > len(".igc") && name == filepath.Base(name) && !strings.HasPrefix(name, ".") &&
+		strings.HasSuffix(strings.ToLower(name), ".igc")
+}
+
+// queueIgcUpload is called when a flight has ended, and for a manual (re-)upload from the web UI.
+func queueIgcUpload(name string) error {
+	if !isIgcFileName(name) {
+		return fmt.Errorf("invalid IGC file name '%s'", name)
+	}
+	svc := activeIgcUploadService()
+	if !globalSettings.IGCUpload_Enabled || svc == nil {
+		return errors.New("IGC upload is not configured")
+	}
+	if _, err := os.Stat(filepath.Join(igcRecordDir(), name)); err != nil {
+		return err
+	}
+	igcUploadMutex.Lock()
+	igcUploads[name] = igcUploadStatus{Service: svc.name(), State: IGC_UPLOAD_PENDING, Queued: time.Now().UTC()}
+	saveIgcUploads()
+	igcUploadMutex.Unlock()
+	select {
+	case igcUploadWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// getIgcUploads returns a copy of the upload state for the web UI.
+func getIgcUploads() map[string]igcUploadStatus {
+	igcUploadMutex.Lock()
+	defer igcUploadMutex.Unlock()
+	uploads := make(map[string]igcUploadStatus, len(igcUploads))
+	for name, st := range igcUploads {
+		uploads[name] = st
+	}
+	return uploads
+}
+
+// uploadPendingIgcFiles tries all files that are due.
+func uploadPendingIgcFiles() {
+	svc := activeIgcUploadService()
+	if !globalSettings.IGCUpload_Enabled || svc == nil || isIgcRecording() {
+		return // Don't upload in flight, the link is needed for traffic
+	}
+	for name, st := range getIgcUploads() {
+		if st.State != IGC_UPLOAD_PENDING && st.State != IGC_UPLOAD_FAILED {
+			continue
+		}
+		if time.Since(st.Queued) > igcUploadGiveUp {
+			continue
+		}
+		st.Attempted = time.Now().UTC()
+		url, err := svc.upload(filepath.Join(igcRecordDir(), name))
+		if err == nil {
+			st.State, st.Error, st.FlightURL = IGC_UPLOAD_DONE, "", url
+			logEvent(EVENT_SYSTEM, EVENT_INFO, "IGC file uploaded", "file", name, "service", svc.name())
+		} else if _, ok := err.(igcUploadRejected); ok {
+			st.State, st.Error = IGC_UPLOAD_REJECTED, err.Error()
+			logEvent(EVENT_SYSTEM, EVENT_WARN, "IGC upload rejected", "file", name, "service", svc.name(), "error", err.Error())
+		} else {
+			st.State, st.Error = IGC_UPLOAD_FAILED, err.Error()
+		}
+		igcUploadMutex.Lock()
+		igcUploads[name] = st
+		saveIgcUploads()
+		igcUploadMutex.Unlock()
+	}
+}
+
+func igcUploader() {
+	loadIgcUploads()
+	ticker := time.NewTicker(igcUploadRetryInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-igcUploadWake:
+		}
+		uploadPendingIgcFiles()
+	}
+}
+
+type weglideUpload struct{}
+
+func (w *weglideUpload) name() string {
+	return "WeGlide"
+}
+
+func (w *weglideUpload) configured() bool {
+	return globalSettings.WeGlideUserId > 0 && len(globalSettings.WeGlideDateOfBirth) > 0 && globalSettings.WeGlideAircraftId > 0
+}
+
+func (w *weglideUpload) upload(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", igcUploadRejected{err.Error()}
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("user_id", strconv.Itoa(globalSettings.WeGlideUserId))
+	mw.WriteField("date_of_birth", globalSettings.WeGlideDateOfBirth)
+	mw.WriteField("aircraft_id", strconv.Itoa(globalSettings.WeGlideAircraftId))
+	part, err := mw.CreateFormFile("file", filepath.Base(fn))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return "", err
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", weglideUploadURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("User-Agent", "stratux/"+stratuxVersion)
+	client := &http.Client{Timeout: igcUploadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return "", igcUploadRejected{fmt.Sprintf("HTTP %s: %s", resp.Status, string(data))}
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("HTTP %s", resp.Status)
+	}
+	// Response is the list of flights created from the file
+	var flights []struct {
+		Id int `json:"id"`
+	}
+	if err := json.Unmarshal(data, &flights); err == nil && len(flights) > 0 {
+		return weglideFlightURL + strconv.Itoa(flights[0].Id), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,145 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	latency.go: Latency instrumentation of the traffic pipeline. Every traffic position is
+		tagged with its capture time and tracked through decoding/fusion into the traffic table
+		and to the first GDL90/FLARM output that carries it. p50/p95 per source and stage are
+		published in globalStatus.Latency.
+
+		Capture time is the time the receiver saw the frame where we know it (dump1090 reports
+		it), otherwise the time the demodulated frame arrived at Stratux (UAT, OGN). Decode and
+		fusion happen synchronously under trafficMutex, so they are reported as one stage.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const latencySamples = 256 // Per source and stage, i.e. roughly the last few minutes with moderate traffic
+
+const (
+	LATENCY_DECODE = iota // Capture -> traffic table
+	LATENCY_OUTPUT        // Capture -> first traffic output (GDL90/FLARM NMEA)
+	LATENCY_ALARM         // Same as output, only for targets with a FLARM alarm level > 0
+	latencyStages
+)
+
+type latencyStats struct {
+	Samples int
+	P50_ms  float64
+	P95_ms  float64
+}
+
+type sourceLatency struct {
+	Decode latencyStats
+	Output latencyStats
+	Alarm  latencyStats
+}
+
+type latencyRing struct {
+	samples [latencySamples]float64 // milliseconds
+	next    int
+	count   int
+}
+
+func (r *latencyRing) add(ms float64) {
+	r.samples[r.next] = ms
+	r.next = (r.next + 1) % latencySamples
+	if r.count < latencySamples {
+		r.count++
+	}
+}
+
+func (r *latencyRing) stats() latencyStats {
+	if r.count == 0 {
+		return latencyStats{}
+	}
+	sorted := make([]float64, r.count)
+	copy(sorted, r.samples[:r.count])
+	sort.Float64s(sorted)
+	return latencyStats{
+		Samples: r.count,
+		P50_ms:  sorted[r.count*50/100],
+		P95_ms:  sorted[r.count*95/100],
+	}
+}
+
+var latencyMutex = &sync.Mutex{}
+var latencyRings = make(map[uint8]*[latencyStages]latencyRing)
+
+func recordLatency(source uint8, stage int, captured time.Time) {
+	ms := float64(time.Since(captured)) / float64(time.Millisecond)
+	if ms < 0 || ms > 60000 {
+		return // Clock step or stale data, would only spoil the statistics
+	}
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	rings, ok := latencyRings[source]
+	if !ok {
+		rings = new([latencyStages]latencyRing)
+		latencyRings[source] = rings
+	}
+	rings[stage].add(ms)
+}
+
+/*
+latencyDecoded is called when a new traffic position is about to be written to the traffic table.
+captured is the receiver's capture time or the arrival time of the frame. Zero if unknown: the
+position is left out of the statistics then.
+*/
+func latencyDecoded(ti *TrafficInfo, source uint8, captured time.Time) {
+	if captured.IsZero() {
+		ti.latencyOutputPending = false
+		return
+	}
+	ti.captureTime = captured
+	ti.latencySource = source
+	ti.latencyOutputPending = true
+	recordLatency(source, LATENCY_DECODE, captured)
+}
+
+// latencyOutput is called when a traffic target is sent. Returns true if ti was modified.
+func latencyOutput(ti *TrafficInfo, alarmLevel uint8) bool {
+	if !ti.latencyOutputPending {
+		return false
+	}
+	recordLatency(ti.latencySource, LATENCY_OUTPUT, ti.captureTime)
+	if alarmLevel > 0 {
+		recordLatency(ti.latencySource, LATENCY_ALARM, ti.captureTime)
+	}
+	ti.latencyOutputPending = false
+	return true
+}
+
+func latencySourceName(source uint8) string {
+	switch source {
+	case TRAFFIC_SOURCE_UAT:
+		return "UAT"
+	case TRAFFIC_SOURCE_1090ES:
+		return "1090ES"
+	case TRAFFIC_SOURCE_OGN:
+		return "OGN"
+	}
+	return "Other"
+}
+
+func updateLatencyStatus() {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	result := make(map[string]sourceLatency)
+	for source, rings := range latencyRings {
+		result[latencySourceName(source)] = sourceLatency{
+			Decode: rings[LATENCY_DECODE].stats(),
+			Output: rings[LATENCY_OUTPUT].stats(),
+			Alarm:  rings[LATENCY_ALARM].stats(),
+		}
+	}
+	globalStatus.Latency = result
+}
@@ -0,0 +1,134 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	legacydisplay.go: NMEA output for legacy FLARM displays (Butterfly, AIR, ...) that are
+		connected through serial-to-WiFi bridges (e.g. ESP32). These bridges have tiny buffers
+		and forward to a slow serial line, so instead of the bursty regular output they get a
+		fixed rate stream: one sentence per time slot, always in the same order
+		(GPRMC, GPGGA, PGRMZ, PFLAU, PFLAA...), once per second.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	legacyDisplayPort       = 2000
+	legacyDisplaySlots      = 10 // sentences per second, i.e. one every 100ms
+	legacyDisplayMaxTargets = legacyDisplaySlots - 4
+)
+
+type legacyDisplayTarget struct {
+	msg        string
+	alarmLevel uint8
+	dist       float64
+}
+
+var legacyDisplayMutex = &sync.Mutex{}
+var legacyDisplayPFLAU string
+var legacyDisplayPFLAA []legacyDisplayTarget
+
+// setLegacyDisplayTraffic is called after each traffic update with the current FLARM sentences.
+func setLegacyDisplayTraffic(pflau string, pflaa []legacyDisplayTarget) {
+	// Most important first: highest alarm level, then closest
+	sort.Slice(pflaa, func(i, j int) bool {
+		if pflaa[i].alarmLevel != pflaa[j].alarmLevel {
+			return pflaa[i].alarmLevel > pflaa[j].alarmLevel
+		}
+		return pflaa[i].dist < pflaa[j].dist
+	})
+	legacyDisplayMutex.Lock()
+	legacyDisplayPFLAU = pflau
+	legacyDisplayPFLAA = pflaa
+	legacyDisplayMutex.Unlock()
+}
+
+// isLegacyDisplay returns true if the given IP is configured as legacy display. It won't get the regular NMEA output then.
+func isLegacyDisplay(ip string) bool {
+	for _, legacyIp := range globalSettings.LegacyDisplayIps {
+		if legacyIp == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyDisplaySchedule returns the sentences for the next one second cycle, in their fixed order.
+func legacyDisplaySchedule() []string {
+	sentences := make([]string, 0)
+	if !isGroundStation() { // No own position/altitude in ground station mode, see groundstation.go
+		sentences = append(sentences, makeGPRMCString(), makeGPGGAString())
+		if pgrmz := makePGRMZString(); pgrmz != "" {
+			sentences = append(sentences, pgrmz)
+		}
+	}
+	legacyDisplayMutex.Lock()
+	if legacyDisplayPFLAU != "" {
+		sentences = append(sentences, legacyDisplayPFLAU)
+	}
+	for i := 0; i < len(legacyDisplayPFLAA) && i < legacyDisplayMaxTargets; i++ {
+		sentences = append(sentences, legacyDisplayPFLAA[i].msg)
+	}
+	legacyDisplayMutex.Unlock()
+	return sentences
+}
+
+func legacyDisplayConnections(conns map[string]*net.UDPConn) {
+	valid := make(map[string]bool)
+	for _, ip := range globalSettings.LegacyDisplayIps {
+		valid[ip] = true
+		if _, ok := conns[ip]; ok {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", ip+":"+strconv.Itoa(legacyDisplayPort))
+		if err != nil {
+			log.Printf("legacy display %s: %s\n", ip, err.Error())
+			continue
+		}
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			log.Printf("legacy display %s: %s\n", ip, err.Error())
+			continue
+		}
+		conns[ip] = conn
+	}
+	for ip, conn := range conns {
+		if !valid[ip] {
+			conn.Close()
+			delete(conns, ip)
+		}
+	}
+}
+
+func legacyDisplaySender() {
+	conns := make(map[string]*net.UDPConn)
+	slot := time.NewTicker(time.Second / legacyDisplaySlots)
+	var sentences []string
+	for i := 0; ; i = (i + 1) % legacyDisplaySlots {
+		<-slot.C
+		if i == 0 {
+			legacyDisplayConnections(conns)
+			sentences = nil
+			if len(conns) > 0 {
+				sentences = legacyDisplaySchedule()
+			}
+		}
+		// Empty slots at the end of a cycle are left empty, so the cycle timing stays fixed
+		if i >= len(sentences) {
+			continue
+		}
+		for _, conn := range conns {
+			conn.Write([]byte(sentences[i]))
+		}
+	}
+}
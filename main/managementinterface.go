@@ -23,6 +23,7 @@ import (
 	"os/user" 
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
@@ -269,6 +270,752 @@ func handleSettingsGetRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n", settingsJSON)
 }
 
+// AJAX call - /getTask. Responds with the flight declaration and task as set by the glide computer.
+func handleTaskGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	flarmTaskMutex.Lock()
+	taskJSON, _ := json.Marshal(&flarmTask)
+	flarmTaskMutex.Unlock()
+	fmt.Fprintf(w, "%s\n", taskJSON)
+}
+
+// AJAX call - /setTask. Replaces the flight declaration and task via POST.
+func handleTaskSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method == "POST" {
+		var task flarmDeclaration
+		if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+			log.Printf("handleTaskSetRequest:error: %s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if task.Waypoints == nil {
+			task.Waypoints = make([]flarmTaskWaypoint, 0)
+		}
+		flarmTaskMutex.Lock()
+		flarmTask = task
+		saveFlarmTask()
+		flarmTaskMutex.Unlock()
+	}
+	handleTaskGetRequest(w, r)
+}
+
+// AJAX call - /getHeatmap[?band=n]. Responds with the traffic density heatmap as GeoJSON.
+// POST /getHeatmap?clear=1 deletes the accumulated data.
+// AJAX call - /getEvents. Structured event log, optionally filtered: ?subsystem=gps&severity=warn&limit=50
+func handleEventsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	events := queryEvents(r.URL.Query().Get("subsystem"), eventSeverityFromName(r.URL.Query().Get("severity")), limit)
+	eventsJSON, _ := json.Marshal(events)
+	fmt.Fprintf(w, "%s\n", eventsJSON)
+}
+
+func handleHeatmapRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method == "POST" && r.URL.Query().Get("clear") == "1" {
+		clearHeatmap()
+	}
+	band := -1
+	if b, err := strconv.Atoi(r.URL.Query().Get("band")); err == nil {
+		band = b
+	}
+	heatmapJSON, err := makeHeatmapGeoJSON(band)
+	if err != nil {
+		log.Printf("Error sending heatmap JSON data: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", heatmapJSON)
+}
+
+// AJAX call - /getIGCFiles. Responds with the list of recorded IGC files, downloadable under /igc/.
+func handleIGCFilesRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	filesJSON, _ := json.Marshal(getIgcFiles())
+	fmt.Fprintf(w, "%s\n", filesJSON)
+}
+
+// AJAX call - /getIGCUploads. Responds with the upload state per IGC file, see igcupload.go.
+func handleIGCUploadsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	uploadsJSON, _ := json.Marshal(getIgcUploads())
+	fmt.Fprintf(w, "%s\n", uploadsJSON)
+}
+
+// AJAX call - /getTransponder. Responds with what our own transponder broadcasts, see transponder.go.
+func handleTransponderRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	transponderJSON, _ := json.Marshal(getTransponderStatus())
+	fmt.Fprintf(w, "%s\n", transponderJSON)
+}
+
+// AJAX call - /getAircraftStats[?format=csv]. Responds with the reception statistics per aircraft, see aircraftstats.go.
+// POST /getAircraftStats?clear=1 starts a new session.
+func handleAircraftStatsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	if r.Method == "POST" && r.URL.Query().Get("clear") == "1" {
+		clearAircraftStats()
+	}
+	stats := getAircraftStats()
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=aircraft_stats.csv")
+		if err := writeAircraftStatsCSV(w, stats); err != nil {
+			log.Printf("Error sending aircraft statistics: %s\n", err.Error())
+		}
+		return
+	}
+	setJSONHeaders(w)
+	aircraftStatsMutex.Lock()
+	sessionStart := aircraftStatsSessionStart
+	aircraftStatsMutex.Unlock()
+	statsJSON, _ := json.Marshal(struct {
+		SessionStart time.Time
+		Aircraft     []aircraftStats
+	}{sessionStart.UTC(), stats})
+	fmt.Fprintf(w, "%s\n", statsJSON)
+}
+
+// AJAX call - /uploadIGC?file=<name>. Queues an IGC file for (re-)upload.
+func handleIGCUploadRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := queueIgcUpload(r.URL.Query().Get("file")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "{}\n")
+}
+
+// parseIpList parses a space-delimited list of IPv4 addresses. err is non-empty if any of them is invalid.
+func parseIpList(ipsStr string) (ips []string, err string) {
+	ips = strings.Split(ipsStr, " ")
+	if ipsStr == "" {
+		ips = make([]string, 0)
+	}
+
+	re, _ := regexp.Compile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
+	for _, ip := range ips {
+		// Verify IP format
+		if !re.MatchString(ip) {
+			err = err + "Invalid IP: " + ip + ". "
+		}
+	}
+	return
+}
+
+// applySettingsMap applies the given settings (as sent to /setSettings), saves them and
+// notifies the subsystems subscribed to the changed settings (see configreload.go).
+func applySettingsMap(msg map[string]interface{}) {
+	before := currentSettingsMap()
+	dropPendingRestartSettings(msg)
+	for key, val := range msg {
+		// log.Printf("handleSettingsSetRequest:json: testing for key:%s of type %s\n", key, reflect.TypeOf(val))
+		if !checkSettingType(key, val) {
+			continue
+		}
+		switch key {
+		case "SettingsVersion":
+			// Managed by loadSettingsJSON()
+		case "DarkMode":
+			globalSettings.DarkMode = val.(bool)
+		case "UAT_Enabled":
+			globalSettings.UAT_Enabled = val.(bool)
+		case "ES_Enabled":
+			globalSettings.ES_Enabled = val.(bool)
+		case "OGN_Enabled":
+			globalSettings.OGN_Enabled = val.(bool)
+		case "Ping_Enabled":
+			globalSettings.Ping_Enabled = val.(bool)
+		case "GPS_Enabled":
+			globalSettings.GPS_Enabled = val.(bool)
+		case "IMU_Sensor_Enabled":
+			globalSettings.IMU_Sensor_Enabled = val.(bool)
+			if !globalSettings.IMU_Sensor_Enabled && globalStatus.IMUConnected {
+				myIMUReader.Close()
+				globalStatus.IMUConnected = false
+			}
+		case "BMP_Sensor_Enabled":
+			globalSettings.BMP_Sensor_Enabled = val.(bool)
+			if !globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
+				myPressureReader.Close()
+				globalStatus.BMPConnected = false
+			}
+		case "DEBUG":
+			globalSettings.DEBUG = val.(bool)
+		case "DisplayTrafficSource":
+			globalSettings.DisplayTrafficSource = val.(bool)
+		case "ReplayLog":
+			v := val.(bool)
+			if v != globalSettings.ReplayLog { // Don't mark the files unless there is a change.
+				globalSettings.ReplayLog = v
+			}
+		case "AHRSLog":
+			globalSettings.AHRSLog = val.(bool)
+		case "IMUMapping":
+			// A list of numbers from JSON (/setSettings, profiles)
+			list, ok := val.([]interface{})
+			if !ok || len(list) != 2 {
+				settingsValidationError(key, "wrong type %T, expected a list of 2 axes", val)
+				break
+			}
+			var mapping [2]int
+			for i, f := range list {
+				v, _ := f.(float64)
+				mapping[i] = int(v)
+			}
+			if globalSettings.IMUMapping != mapping {
+				globalSettings.IMUMapping = mapping
+				if globalStatus.IMUConnected {
+					myIMUReader.Close()
+				}
+				globalStatus.IMUConnected = false // Force a restart of the IMU reader
+			}
+		case "PPM":
+			globalSettings.PPM = int(val.(float64))
+		case "AltitudeOffset":
+			globalSettings.AltitudeOffset = int(val.(float64))
+		case "AltitudeSource":
+			globalSettings.AltitudeSource = int(val.(float64))
+		case "NMEABaroPriority":
+			if v := int(val.(float64)); v >= NMEA_BARO_PRIORITY_LOW && v <= NMEA_BARO_PRIORITY_HIGHEST {
+				globalSettings.NMEABaroPriority = v
+			} else {
+				settingsValidationError(key, "invalid priority %d", v)
+			}
+		case "DescentAlert_Enabled":
+			globalSettings.DescentAlert_Enabled = val.(bool)
+		case "DescentAlertRate":
+			globalSettings.DescentAlertRate = int(val.(float64))
+		case "OverloadShedding_Enabled":
+			globalSettings.OverloadShedding_Enabled = val.(bool)
+		case "QNH":
+			qnh := val.(float64)
+			if qnh >= 900 && qnh <= 1100 {
+				globalSettings.QNH = qnh
+			} else {
+				log.Printf("Ignoring invalid QNH %f\n", qnh)
+			}
+		case "GroundStation_Enabled":
+			globalSettings.GroundStation_Enabled = val.(bool)
+		case "GroundStationLat":
+			globalSettings.GroundStationLat = val.(float64)
+		case "GroundStationLng":
+			globalSettings.GroundStationLng = val.(float64)
+		case "GroundStationAlt":
+			globalSettings.GroundStationAlt = int(val.(float64))
+		case "PowerSave_Enabled":
+			globalSettings.PowerSave_Enabled = val.(bool)
+		case "PowerSaveWakeRadius":
+			globalSettings.PowerSaveWakeRadius = int(val.(float64))
+		case "GlideRatio":
+			globalSettings.GlideRatio = int(val.(float64))
+		case "GlideTailSuffix":
+			globalSettings.GlideTailSuffix = val.(bool)
+		case "OGNDashboard_Enabled":
+			globalSettings.OGNDashboard_Enabled = val.(bool)
+		case "Locale":
+			if locale := val.(string); isKnownLocale(locale) {
+				globalSettings.Locale = locale
+			} else {
+				settingsValidationError(key, "unknown locale %s", locale)
+			}
+		case "Audio_Enabled":
+			globalSettings.Audio_Enabled = val.(bool)
+		case "AudioDevice":
+			globalSettings.AudioDevice = strings.TrimSpace(val.(string))
+		case "AudioBluetoothSink":
+			globalSettings.AudioBluetoothSink = strings.TrimSpace(val.(string))
+		case "AudioVolumeAlarm":
+			globalSettings.AudioVolumeAlarm = int(val.(float64))
+		case "AudioVolumeCallout":
+			globalSettings.AudioVolumeCallout = int(val.(float64))
+		case "AudioVolumeVario":
+			globalSettings.AudioVolumeVario = int(val.(float64))
+		case "AudioVario_Enabled":
+			globalSettings.AudioVario_Enabled = val.(bool)
+		case "DataLogDecimals":
+			globalSettings.DataLogDecimals = int(val.(float64))
+		case "BatteryTelemetry_Enabled":
+			globalSettings.BatteryTelemetry_Enabled = val.(bool)
+		case "BatteryAlertVoltage":
+			globalSettings.BatteryAlertVoltage = val.(float64)
+		case "WiFiLinkAdapt_Enabled":
+			globalSettings.WiFiLinkAdapt_Enabled = val.(bool)
+		case "OGNTrackerFeed_Enabled":
+			globalSettings.OGNTrackerFeed_Enabled = val.(bool)
+		case "FlarmRange":
+			globalSettings.FlarmRange = clampFlarmRange(int(val.(float64)))
+		case "FlarmMaxSentences":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.FlarmMaxSentences = v
+			} else {
+				settingsValidationError(key, "negative sentence rate %d", v)
+			}
+		case "AntennaGainOffset":
+			if v := int(val.(float64)); v >= -20 && v <= 20 {
+				globalSettings.AntennaGainOffset = v
+			} else {
+				settingsValidationError(key, "gain offset %d dB out of range (-20 to 20)", v)
+			}
+		case "TerrainAlert_Enabled":
+			globalSettings.TerrainAlert_Enabled = val.(bool)
+		case "TerrainClearance":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.TerrainClearance = v
+			} else {
+				settingsValidationError(key, "negative height %d", v)
+			}
+		case "AirspaceWarning_Enabled":
+			globalSettings.AirspaceWarning_Enabled = val.(bool)
+		case "AirspaceWarningDistance":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.AirspaceWarningDistance = v
+			} else {
+				settingsValidationError(key, "negative distance %d", v)
+			}
+		case "AirspaceWarningVertical":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.AirspaceWarningVertical = v
+			} else {
+				settingsValidationError(key, "negative height %d", v)
+			}
+		case "AirspaceWarningCategories":
+			globalSettings.AirspaceWarningCategories = strings.Fields(strings.ToUpper(val.(string)))
+		case "ObstacleAlarm_Enabled":
+			globalSettings.ObstacleAlarm_Enabled = val.(bool)
+		case "FlarmOutStealth":
+			globalSettings.FlarmOutStealth = val.(bool)
+		case "FlarmProtocolVersion":
+			if v := int(val.(float64)); v == 8 || v == 9 {
+				globalSettings.FlarmProtocolVersion = v
+			} else {
+				settingsValidationError(key, "unsupported FLARM protocol version %d", v)
+			}
+		case "FlarmPriorityTargets":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.FlarmPriorityTargets = v
+			} else {
+				settingsValidationError(key, "negative target count %d", v)
+			}
+		case "RunwayHeading":
+			hdg := int(val.(float64))
+			if hdg >= 0 && hdg <= 360 {
+				globalSettings.RunwayHeading = hdg
+			}
+		case "DDBUpdate_Enabled":
+			globalSettings.DDBUpdate_Enabled = val.(bool)
+		case "NMEACapture_Enabled":
+			globalSettings.NMEACapture_Enabled = val.(bool)
+		case "OGNDashboardAddr":
+			globalSettings.OGNDashboardAddr = strings.TrimSpace(val.(string))
+		case "Geodesy":
+			globalSettings.Geodesy = int(val.(float64))
+		case "RadarLimits":
+			globalSettings.RadarLimits = int(val.(float64))
+		case "RadarRange":
+			globalSettings.RadarRange = int(val.(float64))
+		case "Baud":
+			if globalSettings.SerialOutputs != nil {
+				for dev, serialOut := range globalSettings.SerialOutputs {
+					newBaud := int(val.(float64))
+					if newBaud == serialOut.Baud { // Same baud rate. No change.
+						continue
+					}
+					log.Printf("changing %s baud rate from %d to %d.\n", dev, serialOut.Baud, newBaud)
+					serialOut.Baud = newBaud
+					// Close the port if it is open.
+					if serialOut.serialPort != nil {
+						log.Printf("closing %s for baud rate change.\n", dev)
+						serialOut.serialPort.Close()
+						serialOut.serialPort = nil
+					}
+					globalSettings.SerialOutputs[dev] = serialOut
+				}
+			}
+		case "WatchList":
+			globalSettings.WatchList = val.(string)
+		case "GLimits":
+			globalSettings.GLimits = val.(string)
+		case "OwnshipModeS":
+			codes := strings.Split(val.(string), ",")
+			codesFinal :=  make([]string, 0)
+			for _, code := range codes {
+				code = strings.Trim(code, " ")
+				// Expecting a hex string less than 6 characters (24 bits) long.
+				if len(code) > 6 { // Too long.
+					continue
+				}
+				// Pad string, must be 6 characters long.
+				vals := strings.ToUpper(code)
+				for len(vals) < 6 {
+					vals = "0" + vals
+				}
+				hexn, err := hex.DecodeString(vals)
+				if err != nil { // Number not valid.
+					settingsValidationError(key, "%s", err.Error())
+					continue
+				}
+				codesFinal = append(codesFinal, fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2]))
+			}
+			globalSettings.OwnshipModeS = strings.Join(codesFinal, ",")
+		case "StaticIps":
+			ips, err := parseIpList(val.(string))
+			if err != "" {
+				settingsValidationError(key, "%s", err)
+				continue
+			}
+			globalSettings.StaticIps = ips
+		case "LegacyDisplayIps":
+			ips, err := parseIpList(val.(string))
+			if err != "" {
+				settingsValidationError(key, "%s", err)
+				continue
+			}
+			globalSettings.LegacyDisplayIps = ips
+		case "WiFiSSID":
+			setWifiSSID(val.(string))
+		case "WiFiChannel":
+			setWifiChannel(int(val.(float64)))
+		case "WiFiSecurityEnabled":
+			setWifiSecurityEnabled(val.(bool))
+		case "WiFiPassphrase":
+			setWifiPassphrase(val.(string))
+		case "WiFiSmartEnabled":
+			setWifiSmartEnabled(val.(bool))
+		case "WiFiIPAddress":
+			setWifiIPAddress(val.(string))
+		case "WiFiMode":
+			setWiFiMode(int(val.(float64)))
+		case "WiFiDirectPin":
+			setWifiDirectPin(val.(string))
+		case "GDL90MSLAlt_Enabled":
+			globalSettings.GDL90MSLAlt_Enabled = val.(bool)
+		case "SkyDemonAndroidHack":
+			globalSettings.SkyDemonAndroidHack = val.(bool)
+		case "EstimateBearinglessDist":
+			globalSettings.EstimateBearinglessDist = val.(bool)
+
+		case "OGNAddrType":
+			globalSettings.OGNAddrType = int(val.(float64))
+		case "OGNAddr":
+			globalSettings.OGNAddr = val.(string)
+		case "OGNAcftType":
+			globalSettings.OGNAcftType = int(val.(float64))
+		case "OGNTxPower":
+			if v := int(val.(float64)); v >= ognTrackerTxPowerMin && v <= ognTrackerTxPowerMax {
+				globalSettings.OGNTxPower = v
+			} else {
+				settingsValidationError(key, "invalid TX power %d dBm", v)
+			}
+		case "OGNPilot":
+			globalSettings.OGNPilot = val.(string)
+		case "OGNStealth":
+			globalSettings.OGNStealth = val.(bool)
+		case "OGNNoTrack":
+			globalSettings.OGNNoTrack = val.(bool)
+		case "OGNAprsReport_Enabled":
+			globalSettings.OGNAprsReport_Enabled = val.(bool)
+		
+		case "PWMDutyMin":
+			globalSettings.PWMDutyMin = int(val.(float64))
+
+		case "MLAT_Enabled":
+			globalSettings.MLAT_Enabled = val.(bool)
+		case "MLAT_Server":
+			globalSettings.MLAT_Server = val.(string)
+		case "MLAT_User":
+			globalSettings.MLAT_User = val.(string)
+		case "UplinkArchive_Enabled":
+			globalSettings.UplinkArchive_Enabled = val.(bool)
+		case "Heatmap_Enabled":
+			globalSettings.Heatmap_Enabled = val.(bool)
+		case "TowTargetId":
+			globalSettings.TowTargetId = strings.ToUpper(strings.TrimSpace(val.(string)))
+		case "TowAutoDetect":
+			globalSettings.TowAutoDetect = val.(bool)
+		case "AlarmPreset":
+			preset := strings.ToLower(val.(string))
+			if _, ok := alarmPresets[preset]; ok || preset == ALARM_PRESET_CUSTOM {
+				globalSettings.AlarmPreset = preset
+			} else {
+				settingsValidationError(key, "unknown alarm preset %s", preset)
+			}
+		case "IGCUpload_Enabled":
+			globalSettings.IGCUpload_Enabled = val.(bool)
+		case "WeGlideUserId":
+			globalSettings.WeGlideUserId = int(val.(float64))
+		case "WeGlideDateOfBirth":
+			globalSettings.WeGlideDateOfBirth = strings.TrimSpace(val.(string))
+		case "WeGlideAircraftId":
+			globalSettings.WeGlideAircraftId = int(val.(float64))
+		case "FlarmHwVersion":
+			globalSettings.FlarmHwVersion = flarmVersionField(val.(string))
+		case "FlarmSwVersion":
+			globalSettings.FlarmSwVersion = flarmVersionField(val.(string))
+		case "FlarmObstVersion":
+			globalSettings.FlarmObstVersion = flarmVersionField(val.(string))
+		case "FlarmConfigValues":
+			if values, err := flarmConfigValuesFromJSON(val); err != nil {
+				settingsValidationError(key, "%s", err.Error())
+			} else {
+				globalSettings.FlarmConfigValues = values
+			}
+		case "RemoteSDR1090", "RemoteSDR978", "RemoteSDR868":
+			remote := strings.TrimSpace(val.(string))
+			if _, _, err := parseRemoteSDR(remote); err != nil && len(remote) > 0 {
+				settingsValidationError(key, "%s", err.Error())
+			} else if key == "RemoteSDR1090" {
+				globalSettings.RemoteSDR1090 = remote
+			} else if key == "RemoteSDR978" {
+				globalSettings.RemoteSDR978 = remote
+			} else {
+				globalSettings.RemoteSDR868 = remote
+			}
+		case "LowAlarmAGL":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.LowAlarmAGL = v
+			} else {
+				settingsValidationError(key, "negative height %d", v)
+			}
+		case "TakeoffAlarmTime":
+			if v := int(val.(float64)); v >= 0 {
+				globalSettings.TakeoffAlarmTime = v
+			} else {
+				settingsValidationError(key, "negative time %d", v)
+			}
+		case "LowAlarmMaxLevel":
+			if v := int(val.(float64)); v >= 0 && v <= 3 {
+				globalSettings.LowAlarmMaxLevel = v
+			} else {
+				settingsValidationError(key, "invalid alarm level %d", v)
+			}
+		case "NMEAOut_GPVTG":
+			globalSettings.NMEAOut_GPVTG = val.(bool)
+		case "NMEAOut_GPGLL":
+			globalSettings.NMEAOut_GPGLL = val.(bool)
+		case "NMEAOutRate":
+			if rate := int(val.(float64)); isValidNMEAOutRate(rate) {
+				globalSettings.NMEAOutRate = rate
+			} else {
+				settingsValidationError(key, "invalid NMEA output rate %d", rate)
+			}
+		case "NMEAOut_Vario":
+			globalSettings.NMEAOut_Vario = val.(bool)
+		case "NMEAOut_WIMWV":
+			globalSettings.NMEAOut_WIMWV = val.(bool)
+		case "NMEAOut_Heading":
+			globalSettings.NMEAOut_Heading = val.(bool)
+		case "NMEAOut_GNTalker":
+			globalSettings.NMEAOut_GNTalker = val.(bool)
+		case "NMEAOutUDPBroadcast_Enabled":
+			globalSettings.NMEAOutUDPBroadcast_Enabled = val.(bool)
+		case "NMEAOutUDPBroadcastPort":
+			if v := int(val.(float64)); v >= 1 && v <= 65535 {
+				globalSettings.NMEAOutUDPBroadcastPort = v
+			} else {
+				settingsValidationError(key, "invalid port %d", v)
+			}
+		case "NMEAInUDPPort":
+			if v := int(val.(float64)); v >= 0 && v <= 65535 {
+				globalSettings.NMEAInUDPPort = v
+			} else {
+				settingsValidationError(key, "invalid port %d", v)
+			}
+		case "AirConnectPasscode_Enabled":
+			globalSettings.AirConnectPasscode_Enabled = val.(bool)
+		case "AirConnectPasscode":
+			if v := strings.TrimSpace(val.(string)); len(v) > 0 && len(v) <= 16 {
+				globalSettings.AirConnectPasscode = v
+			} else {
+				settingsValidationError(key, "passcode must have 1 to 16 characters")
+			}
+		case "NMEAOutTCPPorts":
+			list, ok := val.([]interface{})
+			if !ok {
+				settingsValidationError(key, "wrong type %T, expected a list of ports", val)
+				break
+			}
+			ports := make([]int, 0)
+			valid := true
+			for _, f := range list {
+				v, ok := f.(float64)
+				port := int(v)
+				if !ok || float64(port) != v || port < 1 || port > 65535 {
+					settingsValidationError(key, "invalid port %v", f)
+					valid = false
+					break
+				}
+				duplicate := false
+				for _, p := range ports {
+					duplicate = duplicate || p == port
+				}
+				if !duplicate {
+					ports = append(ports, port)
+				}
+			}
+			if valid {
+				globalSettings.NMEAOutTCPPorts = ports
+			}
+		case "PGRMZ_GPSFallback":
+			globalSettings.PGRMZ_GPSFallback = val.(bool)
+		case "WeatherUplinkRegion":
+			region := strings.ToLower(val.(string))
+			if _, ok := weatherRegionPacks[region]; ok || len(region) == 0 {
+				globalSettings.WeatherUplinkRegion = region
+			} else {
+				settingsValidationError(key, "unknown weather uplink region %s", region)
+			}
+		case "GroundAlarmSuppress":
+			globalSettings.GroundAlarmSuppress = val.(bool)
+		case "AlarmCustom":
+			var profile alarmProfile
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &profile); err != nil {
+				settingsValidationError(key, "invalid alarm thresholds: %s", err.Error())
+			} else if !validAlarmProfile(profile) {
+				settingsValidationError(key, "inconsistent alarm thresholds ignored")
+			} else {
+				globalSettings.AlarmCustom = profile
+			}
+		case "OwnshipOutputs":
+			var outputs []ownshipOutputConfig
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &outputs); err != nil {
+				settingsValidationError(key, "invalid ownship outputs: %s", err.Error())
+			} else {
+				globalSettings.OwnshipOutputs = outputs
+			}
+		case "UATReportOutputs":
+			var outputs []uatReportOutputConfig
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &outputs); err != nil {
+				settingsValidationError(key, "invalid UAT report outputs: %s", err.Error())
+			} else {
+				globalSettings.UATReportOutputs = outputs
+			}
+		case "NMEASerialOut_Device":
+			dev := strings.TrimSpace(val.(string))
+			if !isValidDevicePath(dev) {
+				settingsValidationError(key, "not a device: %s", dev)
+				continue
+			}
+			closeNMEASerialOut(globalSettings.NMEASerialOut_Device)
+			globalSettings.NMEASerialOut_Device = dev
+		case "NMEASerialOut_Baud":
+			if v := int(val.(float64)); isValidNMEASerialBaud(v) {
+				globalSettings.NMEASerialOut_Baud = v
+				closeNMEASerialOut(globalSettings.NMEASerialOut_Device)
+			} else {
+				settingsValidationError(key, "unsupported baud rate %d", v)
+			}
+		case "AltEncoder_Device":
+			dev := strings.TrimSpace(val.(string))
+			if !isValidDevicePath(dev) {
+				settingsValidationError(key, "not a device: %s", dev)
+				continue
+			}
+			globalSettings.AltEncoder_Device = dev
+		case "AltEncoder_Baud":
+			if v := int(val.(float64)); isValidAltEncoderBaud(v) {
+				globalSettings.AltEncoder_Baud = v
+			} else {
+				settingsValidationError(key, "unsupported baud rate %d", v)
+			}
+		case "AltEncoder_Format":
+			if v := int(val.(float64)); v == ALT_ENCODER_ICARUS || v == ALT_ENCODER_TRANSCAL {
+				globalSettings.AltEncoder_Format = v
+			} else {
+				settingsValidationError(key, "unknown format %d", v)
+			}
+		case "Bluetooth_Enabled":
+			globalSettings.Bluetooth_Enabled = val.(bool)
+		case "BluetoothSPP":
+			globalSettings.BluetoothSPP = val.(bool)
+		case "BluetoothBLE":
+			globalSettings.BluetoothBLE = val.(bool)
+		case "BluetoothName":
+			if v := strings.TrimSpace(val.(string)); isValidBluetoothName(v) {
+				globalSettings.BluetoothName = v
+			} else {
+				settingsValidationError(key, "name must have 1 to %d printable ASCII characters", bluetoothNameMaxLen)
+			}
+		case "NMEAClientFilters":
+			var filters []nmeaClientFilter
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &filters); err != nil {
+				settingsValidationError(key, "invalid NMEA client filters: %s", err.Error())
+				continue
+			}
+			valid := true
+			for i, f := range filters {
+				if err := validNMEAClientFilter(f); err != nil {
+					settingsValidationError(key, "filter %s: %s", f.Client, err.Error())
+					valid = false
+					break
+				}
+				for k := range f.Only {
+					filters[i].Only[k] = strings.ToUpper(strings.TrimSpace(f.Only[k]))
+				}
+				for k := range f.Drop {
+					filters[i].Drop[k] = strings.ToUpper(strings.TrimSpace(f.Drop[k]))
+				}
+			}
+			if valid {
+				globalSettings.NMEAClientFilters = filters
+			}
+		case "MulticastOutputs":
+			var outputs []multicastOutput
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &outputs); err != nil {
+				settingsValidationError(key, "invalid multicast outputs: %s", err.Error())
+			} else {
+				globalSettings.MulticastOutputs = outputs
+			}
+		case "SharedFeedPolicies":
+			var policies []sharedFeedPolicy
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &policies); err != nil {
+				settingsValidationError(key, "invalid shared feed policies: %s", err.Error())
+			} else {
+				globalSettings.SharedFeedPolicies = policies
+			}
+		case "DataLogPolicies":
+			var policies []dataLogPolicy
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &policies); err != nil {
+				settingsValidationError(key, "invalid datalog policies: %s", err.Error())
+			} else {
+				globalSettings.DataLogPolicies = policies
+			}
+		case "Profiles":
+			var profiles []settingsProfile
+			j, _ := json.Marshal(val)
+			if err := json.Unmarshal(j, &profiles); err != nil {
+				settingsValidationError(key, "invalid profiles: %s", err.Error())
+			} else {
+				globalSettings.Profiles = profiles
+			}
+
+		default:
+			log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
+		}
+	}
+	saveSettings()
+	applyNetworkSettings(false)
+	notifySettingsChanged(changedSettings(before, currentSettingsMap()))
+}
+
 // AJAX call - /setSettings. receives via POST command, any/all stratux.conf data.
 func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 	// define header in support of cross-domain AJAX
@@ -293,178 +1040,7 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 			} else if err != nil {
 				log.Printf("handleSettingsSetRequest:error: %s\n", err.Error())
 			} else {
-				reconfigureOgnTracker := false
-				reconfigureFancontrol := false
-				for key, val := range msg {
-					// log.Printf("handleSettingsSetRequest:json: testing for key:%s of type %s\n", key, reflect.TypeOf(val))
-					switch key {
-					case "DarkMode":
-						globalSettings.DarkMode = val.(bool)
-					case "UAT_Enabled":
-						globalSettings.UAT_Enabled = val.(bool)
-					case "ES_Enabled":
-						globalSettings.ES_Enabled = val.(bool)
-					case "OGN_Enabled":
-						globalSettings.OGN_Enabled = val.(bool)
-					case "Ping_Enabled":
-						globalSettings.Ping_Enabled = val.(bool)
-					case "GPS_Enabled":
-						globalSettings.GPS_Enabled = val.(bool)
-					case "IMU_Sensor_Enabled":
-						globalSettings.IMU_Sensor_Enabled = val.(bool)
-						if !globalSettings.IMU_Sensor_Enabled && globalStatus.IMUConnected {
-							myIMUReader.Close()
-							globalStatus.IMUConnected = false
-						}
-					case "BMP_Sensor_Enabled":
-						globalSettings.BMP_Sensor_Enabled = val.(bool)
-						if !globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
-							myPressureReader.Close()
-							globalStatus.BMPConnected = false
-						}
-					case "DEBUG":
-						globalSettings.DEBUG = val.(bool)
-					case "DisplayTrafficSource":
-						globalSettings.DisplayTrafficSource = val.(bool)
-					case "ReplayLog":
-						v := val.(bool)
-						if v != globalSettings.ReplayLog { // Don't mark the files unless there is a change.
-							globalSettings.ReplayLog = v
-						}
-					case "AHRSLog":
-						globalSettings.AHRSLog = val.(bool)
-					case "IMUMapping":
-						if globalSettings.IMUMapping != val.([2]int) {
-							globalSettings.IMUMapping = val.([2]int)
-							myIMUReader.Close()
-							globalStatus.IMUConnected = false // Force a restart of the IMU reader
-						}
-					case "PPM":
-						globalSettings.PPM = int(val.(float64))
-					case "AltitudeOffset":
-						globalSettings.AltitudeOffset = int(val.(float64))
-					case "RadarLimits":
-						globalSettings.RadarLimits = int(val.(float64))
-						radarUpdate.SendJSON(globalSettings)
-					case "RadarRange":
-						globalSettings.RadarRange = int(val.(float64))
-						radarUpdate.SendJSON(globalSettings)
-					case "Baud":
-						if globalSettings.SerialOutputs != nil {
-							for dev, serialOut := range globalSettings.SerialOutputs {
-								newBaud := int(val.(float64))
-								if newBaud == serialOut.Baud { // Same baud rate. No change.
-									continue
-								}
-								log.Printf("changing %s baud rate from %d to %d.\n", dev, serialOut.Baud, newBaud)
-								serialOut.Baud = newBaud
-								// Close the port if it is open.
-								if serialOut.serialPort != nil {
-									log.Printf("closing %s for baud rate change.\n", dev)
-									serialOut.serialPort.Close()
-									serialOut.serialPort = nil
-								}
-								globalSettings.SerialOutputs[dev] = serialOut
-							}
-						}
-					case "WatchList":
-						globalSettings.WatchList = val.(string)
-					case "GLimits":
-						globalSettings.GLimits = val.(string)
-					case "OwnshipModeS":
-						codes := strings.Split(val.(string), ",")
-						codesFinal :=  make([]string, 0)
-						for _, code := range codes {
-							code = strings.Trim(code, " ")
-							// Expecting a hex string less than 6 characters (24 bits) long.
-							if len(code) > 6 { // Too long.
-								continue
-							}
-							// Pad string, must be 6 characters long.
-							vals := strings.ToUpper(code)
-							for len(vals) < 6 {
-								vals = "0" + vals
-							}
-							hexn, err := hex.DecodeString(vals)
-							if err != nil { // Number not valid.
-								log.Printf("handleSettingsSetRequest:OwnshipModeS: %s\n", err.Error())
-								continue
-							}
-							codesFinal = append(codesFinal, fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2]))
-						}
-						globalSettings.OwnshipModeS = strings.Join(codesFinal, ",")
-					case "StaticIps":
-						ipsStr := val.(string)
-						ips := strings.Split(ipsStr, " ")
-						if ipsStr == "" {
-							ips = make([]string, 0)
-						}
-
-						re, _ := regexp.Compile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
-						err := ""
-						for _, ip := range ips {
-							// Verify IP format
-							if !re.MatchString(ip) {
-								err = err + "Invalid IP: " + ip + ". "
-							}
-						}
-						if err != "" {
-							log.Printf("handleSettingsSetRequest:StaticIps: %s\n", err)
-							continue
-						}
-						globalSettings.StaticIps = ips
-					case "WiFiSSID":
-						setWifiSSID(val.(string))
-					case "WiFiChannel":
-						setWifiChannel(int(val.(float64)))
-					case "WiFiSecurityEnabled":
-						setWifiSecurityEnabled(val.(bool))
-					case "WiFiPassphrase":
-						setWifiPassphrase(val.(string))
-					case "WiFiSmartEnabled":
-						setWifiSmartEnabled(val.(bool))
-					case "WiFiIPAddress":
-						setWifiIPAddress(val.(string))
-					case "WiFiMode":
-						setWiFiMode(int(val.(float64)))
-					case "WiFiDirectPin":
-						setWifiDirectPin(val.(string))
-					case "GDL90MSLAlt_Enabled":
-						globalSettings.GDL90MSLAlt_Enabled = val.(bool)
-					case "SkyDemonAndroidHack":
-						globalSettings.SkyDemonAndroidHack = val.(bool)
-					case "EstimateBearinglessDist":
-						globalSettings.EstimateBearinglessDist = val.(bool)
-
-					case "OGNAddrType":
-						globalSettings.OGNAddrType = int(val.(float64))
-						reconfigureOgnTracker = true
-					case "OGNAddr":
-						globalSettings.OGNAddr = val.(string)
-						reconfigureOgnTracker = true
-					case "OGNAcftType":
-						globalSettings.OGNAcftType = int(val.(float64))
-						reconfigureOgnTracker = true
-					case "OGNPilot":
-						globalSettings.OGNPilot = val.(string)
-						reconfigureOgnTracker = true
-					
-					case "PWMDutyMin":
-						globalSettings.PWMDutyMin = int(val.(float64))
-						reconfigureFancontrol = true
-
-					default:
-						log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
-					}
-				}
-				saveSettings()
-				applyNetworkSettings(false)
-				if reconfigureOgnTracker {
-					configureOgnTrackerFromSettings()
-				}
-				if reconfigureFancontrol {
-					exec.Command("killall", "-SIGUSR1", "fancontrol").Run();
-				}
+				applySettingsMap(msg)
 			}
 		}
 
@@ -693,6 +1269,16 @@ func handleDownloadAHRSLogsRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+
+	// Include the structured event log for diagnostics.
+	eventsFile, err := z.Create("events.json")
+	if err != nil {
+		httpErr(w, err)
+		return
+	}
+	eventsJSON, _ := json.MarshalIndent(queryEvents("", EVENT_INFO, 0), "", "  ")
+	eventsFile.Write(eventsJSON)
+
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment; filename=ahrs_logs.zip")
 }
@@ -854,6 +1440,7 @@ func managementInterface() {
 	situationUpdate = NewUIBroadcaster()
 	weatherRawUpdate = NewUIBroadcaster()
 	gdl90Update = NewUIBroadcaster()
+	debugConsoleUpdate = NewUIBroadcaster()
 
 	http.HandleFunc("/", defaultServer)
 	http.Handle("/logs/", http.StripPrefix("/logs/", http.FileServer(http.Dir("/var/log"))))
@@ -877,6 +1464,12 @@ func managementInterface() {
 				Handler: websocket.Handler(handleSituationWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/debugconsole",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleDebugConsoleWS)}
+			s.ServeHTTP(w, req)
+		})
 	http.HandleFunc("/weather",
 		func(w http.ResponseWriter, req *http.Request) {
 			s := websocket.Server{
@@ -895,6 +1488,18 @@ func managementInterface() {
 				Handler: websocket.Handler(handleRadarWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/radarview",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleRadarViewWS)}
+			s.ServeHTTP(w, req)
+		})
+	http.HandleFunc("/nmea",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleNMEAWS)}
+			s.ServeHTTP(w, req)
+		})
 
 
 	http.HandleFunc("/jsonio",
@@ -909,6 +1514,20 @@ func managementInterface() {
 	http.HandleFunc("/getTowers", handleTowersRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
+	http.HandleFunc("/getSettingsErrors", handleSettingsErrorsRequest)
+	http.HandleFunc("/getCredentials", handleCredentialsGetRequest)
+	http.HandleFunc("/getPhrases", handlePhrasesGetRequest)
+	http.HandleFunc("/setCredential", handleCredentialSetRequest)
+	http.HandleFunc("/getTask", handleTaskGetRequest)
+	http.HandleFunc("/setTask", handleTaskSetRequest)
+	http.HandleFunc("/getIGCFiles", handleIGCFilesRequest)
+	http.HandleFunc("/getIGCUploads", handleIGCUploadsRequest)
+	http.HandleFunc("/uploadIGC", handleIGCUploadRequest)
+	http.HandleFunc("/getTransponder", handleTransponderRequest)
+	http.HandleFunc("/getHeatmap", handleHeatmapRequest)
+	http.HandleFunc("/getAircraftStats", handleAircraftStatsRequest)
+	http.HandleFunc("/getEvents", handleEventsRequest)
+	http.Handle("/igc/", http.StripPrefix("/igc/", http.FileServer(http.Dir(igcRecordDir()))))
 	http.HandleFunc("/setSettings", handleSettingsSetRequest)
 	http.HandleFunc("/restart", handleRestartRequest)
 	http.HandleFunc("/shutdown", handleShutdownRequest)
@@ -926,13 +1545,18 @@ func managementInterface() {
 	http.HandleFunc("/deleteahrslogfiles", handleDeleteAHRSLogFiles)
 	http.HandleFunc("/downloadahrslogs", handleDownloadAHRSLogsRequest)
 	http.HandleFunc("/downloaddb", handleDownloadDBRequest)
+	http.HandleFunc("/downloadnmeacapture", handleDownloadNMEACaptureRequest)
+	http.HandleFunc("/deletenmeacapture", handleDeleteNMEACaptureRequest)
 
 	usr, _ := user.Current()
 	addr := managementAddr
 	if usr.Username != "root" {
 		addr = ":8000" // Make sure we can run without root priviledges on different port
 	}
-	err := http.ListenAndServe(addr, nil)
+	ln, err := listenTCP(addr)
+	if err == nil {
+		err = http.Serve(ln, nil)
+	}
 
 	if err != nil {
 		log.Printf("managementInterface ListenAndServe: %s\n", err.Error())
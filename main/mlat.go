@@ -0,0 +1,214 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mlat.go: Multilateration support. Runs mlat-client to feed timestamped Mode S frames
+		from dump1090 (beast output, port 30005) to a network MLAT server and imports the
+		computed positions of Mode S only targets back into the traffic map.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mlatResultsPort = "30105" // mlat-client basestation results, listen mode
+	mlatResultsAddr = "127.0.0.1:" + mlatResultsPort
+	mlatClientPath  = "/usr/bin/mlat-client"
+
+	// MLAT positions are typically accurate to a few hundred meters, i.e. NACp 6 (< 0.3 NM)
+	mlatNACp = 6
+	mlatNIC  = 6
+)
+
+// Restart mlat-client if we moved further than this from the position we reported to the server (meters).
+const mlatMaxReceiverDrift = 2000.0
+
+// mlatClient starts and stops mlat-client depending on settings and GPS state.
+// MLAT servers need a precise receiver location, so we only run with a valid GPS fix.
+func mlatClient() {
+	var cmd *exec.Cmd
+	var exited chan bool
+	var rxLat, rxLon float64
+
+	stop := func() {
+		if cmd != nil {
+			log.Printf("Stopping mlat-client\n")
+			cmd.Process.Kill()
+			<-exited
+			cmd = nil
+		}
+	}
+
+	for {
+		time.Sleep(5 * time.Second)
+
+		if cmd != nil {
+			select {
+			case <-exited:
+				log.Printf("mlat-client exited\n")
+				cmd = nil
+			default:
+			}
+		}
+
+		if !globalSettings.MLAT_Enabled || !globalSettings.ES_Enabled || len(globalSettings.MLAT_Server) == 0 || !isGPSValid() {
+			stop()
+			continue
+		}
+
+		if cmd != nil {
+			dist, _, _, _ := distRect(rxLat, rxLon, float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude))
+			if dist < mlatMaxReceiverDrift {
+				continue
+			}
+			stop()
+		}
+
+		rxLat = float64(mySituation.GPSLatitude)
+		rxLon = float64(mySituation.GPSLongitude)
+		altM := float64(mySituation.GPSHeightAboveEllipsoid) * 0.3048
+		user := globalSettings.MLAT_User
+		if len(user) == 0 {
+			user = "stratux-" + globalSettings.OwnshipModeS
+		}
+
+		cmd = exec.Command(mlatClientPath,
+			"--input-type", "dump1090",
+			"--input-connect", "127.0.0.1:30005",
+			"--server", globalSettings.MLAT_Server,
+			"--user", user,
+			"--lat", strconv.FormatFloat(rxLat, 'f', 6, 64),
+			"--lon", strconv.FormatFloat(rxLon, 'f', 6, 64),
+			"--alt", fmt.Sprintf("%.0fm", altM),
+			"--results", "basestation,listen,"+mlatResultsPort)
+		if err := cmd.Start(); err != nil {
+			addSingleSystemErrorf("mlat-client", "Error executing %s: %s", mlatClientPath, err.Error())
+			cmd = nil
+			continue
+		}
+		log.Printf("Started mlat-client, server %s, receiver position %f,%f\n", globalSettings.MLAT_Server, rxLat, rxLon)
+		exited = make(chan bool, 1)
+		go func(c *exec.Cmd, ch chan bool) {
+			c.Wait()
+			ch <- true
+		}(cmd, exited)
+	}
+}
+
+// mlatListen reads computed positions from mlat-client in SBS/BaseStation format.
+func mlatListen() {
+	for {
+		if !globalSettings.MLAT_Enabled {
+			globalStatus.MLAT_connected = false
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		conn, err := net.Dial("tcp", mlatResultsAddr)
+		if err != nil {
+			globalStatus.MLAT_connected = false
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		globalStatus.MLAT_connected = true
+		rdr := bufio.NewReader(conn)
+		for globalSettings.MLAT_Enabled {
+			conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+			line, err := rdr.ReadString('\n')
+			if err != nil {
+				break
+			}
+			parseMlatSbsLine(strings.TrimSpace(line))
+		}
+		globalStatus.MLAT_connected = false
+		conn.Close()
+	}
+}
+
+// parseMlatSbsLine parses a line like
+// MSG,3,1,1,4CA2D6,1,2020/10/01,12:00:00.000,2020/10/01,12:00:00.000,,35000,450,270,52.1,-1.2,0,,,,,0
+func parseMlatSbsLine(line string) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 22 || fields[0] != "MSG" || fields[1] != "3" {
+		return
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(fields[4], "~"), 16, 32)
+	if err != nil || strings.HasPrefix(fields[4], "~") {
+		return // non-ICAO addresses can't be matched with our Mode S targets
+	}
+	lat, err1 := strconv.ParseFloat(fields[14], 32)
+	lng, err2 := strconv.ParseFloat(fields[15], 32)
+	if err1 != nil || err2 != nil {
+		return
+	}
+
+	icao := uint32(addr)
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	ti, known := traffic[icao]
+	if known && ti.Position_valid && ti.TargetType != TARGET_TYPE_MLAT && stratuxClock.Since(ti.Last_seen) < 10*time.Second {
+		return // target reports its own position, which is always better
+	}
+	if !known {
+		ti.Icao_addr = icao
+		ti.ExtrapolatedPosition = false
+		if reg, ok := icao2reg(icao); ok {
+			ti.Reg = reg
+			ti.Tail = reg
+		}
+	}
+
+	// Prefer transponder altitude if we have a recent one, MLAT altitude is only the reported one anyway
+	if alt, err := strconv.Atoi(fields[11]); err == nil && stratuxClock.Since(ti.Last_alt) > 10*time.Second {
+		ti.Alt = int32(alt)
+		ti.AltIsGNSS = false
+		ti.Last_alt = stratuxClock.Time
+	}
+	if gs, err := strconv.ParseFloat(fields[12], 32); err == nil {
+		if trk, err := strconv.ParseFloat(fields[13], 32); err == nil {
+			ti.Speed = uint16(gs)
+			ti.Track = float32(trk)
+			ti.Speed_valid = true
+			ti.Last_speed = stratuxClock.Time
+		}
+	}
+	if vr, err := strconv.Atoi(fields[16]); err == nil {
+		ti.Vvel = int16(vr)
+	}
+	if len(fields[10]) > 0 {
+		ti.Tail = strings.TrimSpace(fields[10])
+	}
+
+	ti.Lat = float32(lat)
+	ti.Lng = float32(lng)
+	ti.Position_valid = true
+	ti.ExtrapolatedPosition = false
+	if isGPSValid() {
+		ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+		ti.BearingDist_valid = true
+	}
+	ti.NACp = mlatNACp
+	ti.NIC = mlatNIC
+	ti.TargetType = TARGET_TYPE_MLAT
+	ti.Last_source = TRAFFIC_SOURCE_1090ES
+	ti.Last_seen = stratuxClock.Time
+	ti.Timestamp = time.Now().UTC()
+
+	postProcessTraffic(&ti)
+	traffic[icao] = ti
+	debugConsolePublish(DEBUG_SOURCE_MLAT, line, ti)
+	registerTrafficUpdate(ti)
+	seenTraffic[icao] = true
+}
@@ -0,0 +1,90 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	multicastout.go: IPv4 multicast outputs (globalSettings.MulticastOutputs), for panel networks
+		and lab setups where displays join a group instead of getting DHCP leases from us.
+		Each output is an entry in outSockets like a unicast client, so it gets the same
+		messages (GDL90, FLARM NMEA, ... by Capability) through the same queues. It never
+		sleeps: nobody answers our pings on a group address.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/ipv4"
+)
+
+type multicastOutput struct {
+	Group      string // IPv4 multicast group, e.g. 239.255.40.11
+	Port       uint32
+	Capability uint8  // NETWORK_* message types sent to the group
+	TTL        int    // Router hops, 1 = local network only
+	Interface  string // Outgoing interface, "" = default route
+}
+
+// openMulticastOutput connects a UDP socket to the group with the configured TTL and interface.
+func openMulticastOutput(o multicastOutput) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(o.Group, strconv.Itoa(int(o.Port))))
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, &net.AddrError{Err: "not a multicast group", Addr: o.Group}
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	p := ipv4.NewPacketConn(conn)
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	if err := p.SetMulticastTTL(ttl); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(o.Interface) > 0 {
+		ifi, err := net.InterfaceByName(o.Interface)
+		if err == nil {
+			err = p.SetMulticastInterface(ifi)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// refreshMulticastOutputs replaces the multicast entries in outSockets with the configured ones.
+func refreshMulticastOutputs() {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	for k, netconn := range outSockets {
+		if netconn.Multicast {
+			netconn.Conn.Close()
+			delete(outSockets, k)
+		}
+	}
+	for _, o := range globalSettings.MulticastOutputs {
+		conn, err := openMulticastOutput(o)
+		if err != nil {
+			log.Printf("multicast output %s:%d: %s\n", o.Group, o.Port, err.Error())
+			continue
+		}
+		k := net.JoinHostPort(o.Group, strconv.Itoa(int(o.Port)))
+		log.Printf("multicast output to %s\n", k)
+		outSockets[k] = networkConnection{Conn: conn, Ip: o.Group, Port: o.Port, Capability: o.Capability, messageQueue: make([][]byte, 0), Multicast: true}
+		if (o.Capability & NETWORK_FLARM_NMEA) != 0 {
+			conn.Write([]byte(makeFlarmPFLAEString() + makeFlarmPFLAVString()))
+		}
+	}
+}
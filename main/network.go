@@ -31,6 +31,10 @@ type networkMessage struct {
 	msgType   uint8
 	queueable bool
 	ts        time.Time
+	ownship   bool   // Ownship report. Not sent to outputs with their own ownship configuration, see ownshipout.go.
+	port      uint32 // If set, only send to network clients on this port.
+	uatReport bool   // Raw UAT basic/long report, subject to per output forwarding, see uatreportout.go.
+	optional  bool   // Not sent to clients with a poor Wi-Fi link, see wifilinkquality.go.
 }
 
 type networkConnection struct {
@@ -49,6 +53,12 @@ type networkConnection struct {
 	numOverflows    uint32    // Number of times the queue has overflowed - for calculating the amount to chop off from the queue.
 	SleepFlag       bool      // Whether or not this client has been marked as sleeping - only used for debugging (relies on messages being sent to update this flag in sendToAllConnectedClients()).
 	FFCrippled      bool
+	LinkSignal      int     // Wi-Fi signal in dBm as seen by the AP, 0 = unknown. See wifilinkquality.go.
+	LinkRetryRatio  float64 // Wi-Fi tx retries per packet.
+	PoorLink        bool    // Optional traffic is not sent to this client.
+	Multicast       bool    // Multicast group output, not a client. See multicastout.go.
+	Broadcast       bool    // NMEA broadcast output, not a client. See nmeabroadcast.go.
+	flarmRange      *flarmChannelRange // Set by the client via PFLAC, see readUDPFlarmCommands()
 }
 
 type serialConnection struct {
@@ -153,6 +163,9 @@ func isSleeping(k string) bool {
 	if isX86DebugMode() || globalSettings.NoSleep == true {
 		return false
 	}
+	if outSockets[k].Multicast || outSockets[k].Broadcast {
+		return false
+	}
 	ipAndPort := strings.Split(k, ":")
 	// No ping response. Assume disconnected/sleeping device.
 	if lastPing, ok := pingResponse[ipAndPort[0]]; !ok || stratuxClock.Since(lastPing) > (10*time.Second) {
@@ -176,10 +189,12 @@ func isThrottled(k string) bool {
 }
 
 func sendToAllConnectedClients(msg networkMessage) {
-	serialOutputChan <- msg
-	if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
-		// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen).
-		networkGDL90Chan <- msg.msg
+	if msg.port == 0 {
+		serialOutputChan <- msg
+		if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
+			// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen).
+			networkGDL90Chan <- msg.msg
+		}
 	}
 
 	netMutex.Lock()
@@ -194,6 +209,33 @@ func sendToAllConnectedClients(msg networkMessage) {
 		if (netconn.Capability & msg.msgType) == 0 {
 			continue
 		}
+		if msg.port != 0 && msg.port != netconn.Port {
+			continue
+		}
+		if msg.ownship && msg.port == 0 && hasOwnshipOutputConfig(netconn.Port) {
+			continue
+		}
+		if msg.uatReport && !uatReportAllowed(k, netconn.Port) {
+			continue
+		}
+		if (msg.msgType & NETWORK_FLARM_NMEA) != 0 && isLegacyDisplay(netconn.Ip) {
+			continue // Gets its own fixed rate stream, see legacydisplay.go
+		}
+		if msg.optional && isPoorLink(netconn) {
+			continue
+		}
+		out := msg.msg
+		if (msg.msgType&NETWORK_FLARM_NMEA) != 0 && isPoorLink(netconn) {
+			out = []byte(filterFlarmRange(string(msg.msg), wifiPoorLinkTrafficRange))
+		}
+		if (msg.msgType&NETWORK_FLARM_NMEA) != 0 && netconn.flarmRange != nil {
+			out = []byte(filterFlarmChannel(string(out), netconn.flarmRange))
+		}
+		if (msg.msgType & NETWORK_FLARM_NMEA) != 0 {
+			if out = []byte(filterNMEAForClient(string(out), netconn.Ip, int(netconn.Port))); len(out) == 0 {
+				continue
+			}
+		}
 		// Send non-queueable messages immediately, or discard if the client is in sleep mode.
 
 		if !sleepFlag {
@@ -204,12 +246,12 @@ func sendToAllConnectedClients(msg networkMessage) {
 			if sleepFlag {
 				continue
 			}
-			netconn.Conn.Write(msg.msg) // Write immediately.
+			netconn.Conn.Write(out) // Write immediately.
 			totalNetworkMessagesSent++
 			globalStatus.NetworkDataMessagesSent++
 			globalStatus.NetworkDataMessagesSentNonqueueable++
-			globalStatus.NetworkDataBytesSent += uint64(len(msg.msg))
-			globalStatus.NetworkDataBytesSentNonqueueable += uint64(len(msg.msg))
+			globalStatus.NetworkDataBytesSent += uint64(len(out))
+			globalStatus.NetworkDataBytesSentNonqueueable += uint64(len(out))
 		} else {
 			// Queue the message if the message is "queueable".
 			if len(netconn.messageQueue) >= maxUserMsgQueueSize { // Too many messages queued? Drop the oldest.
@@ -222,7 +264,7 @@ func sendToAllConnectedClients(msg networkMessage) {
 					netconn.messageQueue = netconn.messageQueue[s:]
 				}
 			}
-			netconn.messageQueue = append(netconn.messageQueue, msg.msg) // each netconn.messageQueue is therefore an array (well, a slice) of formatted GDL90 messages
+			netconn.messageQueue = append(netconn.messageQueue, out) // each netconn.messageQueue is therefore an array (well, a slice) of formatted GDL90 messages
 			outSockets[k] = netconn
 		}
 	}
@@ -238,6 +280,37 @@ func networkOutWatcher() {
 	}
 }
 
+// Below this baud rate, NMEA serial outputs only get nmeaSerialLowBaudFilter. The full stream needs about 1000 bytes/s.
+const nmeaSerialFullBaud = 19200
+
+var nmeaSerialLowBaudFilter = nmeaClientFilter{Only: []string{"RMC", "GGA", "PGRMZ", "PFLAU", "PFLAA"}}
+
+var nmeaSerialBaudrates = []int{4800, 9600, 19200, 38400, 57600, 115200}
+
+func isValidNMEASerialBaud(baud int) bool {
+	for _, b := range nmeaSerialBaudrates {
+		if b == baud {
+			return true
+		}
+	}
+	return false
+}
+
+// Devices to close, only serialOutWatcher() touches globalSettings.SerialOutputs.
+var serialOutCloseChan = make(chan string, 4)
+
+// closeNMEASerialOut asks serialOutWatcher() to close the configured NMEA serial output, it is opened again with the new settings.
+func closeNMEASerialOut(dev string) {
+	if len(dev) == 0 {
+		return
+	}
+	select {
+	case serialOutCloseChan <- dev:
+	default:
+		log.Printf("serialout (%s): close request dropped\n", dev)
+	}
+}
+
 // Monitor serial output channel, send to serial port.
 func serialOutWatcher() {
 	// Check every 30 seconds for a serial output device.
@@ -249,17 +322,25 @@ func serialOutWatcher() {
 	for {
 		select {
 		case <-serialTicker.C:
-			for _, serialDev := range serialDevs {
+			devs := serialDevs
+			if len(globalSettings.NMEASerialOut_Device) > 0 {
+				devs = append(devs, globalSettings.NMEASerialOut_Device) // Panel FLARM display wired to a UART, e.g. /dev/ttyAMA0
+			}
+			for _, serialDev := range devs {
 				if _, err := os.Stat(serialDev); !os.IsNotExist(err) { // Check if the device file exists.
 					var thisSerialConn serialConnection
 					// Check if we need to start handling a new device.
 					if val, ok := globalSettings.SerialOutputs[serialDev]; !ok {
 						proto := uint8(NETWORK_GDL90_STANDARD)
+						baud := 38400
 						if strings.Contains(serialDev, "_nmea") {
 							proto = NETWORK_FLARM_NMEA
 						}
-						newSerialOut := serialConnection{DeviceString: serialDev, Baud: 38400, Protocol: proto}
-						log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", serialDev)
+						if serialDev == globalSettings.NMEASerialOut_Device {
+							proto, baud = NETWORK_FLARM_NMEA, globalSettings.NMEASerialOut_Baud
+						}
+						newSerialOut := serialConnection{DeviceString: serialDev, Baud: baud, Protocol: proto}
+						log.Printf("detected new serial output, setting up now: %s. Default baudrate %d.\n", serialDev, baud)
 						if globalSettings.SerialOutputs == nil {
 							globalSettings.SerialOutputs = make(map[string]serialConnection)
 						}
@@ -289,6 +370,14 @@ func serialOutWatcher() {
 				}
 			}
 
+		case dev := <-serialOutCloseChan:
+			if val, ok := globalSettings.SerialOutputs[dev]; ok {
+				if val.serialPort != nil {
+					val.serialPort.Close()
+				}
+				delete(globalSettings.SerialOutputs, dev)
+			}
+
 		case b := <-serialOutputChan:
 			if globalSettings.SerialOutputs != nil {
 				for dev, val := range globalSettings.SerialOutputs {
@@ -296,7 +385,14 @@ func serialOutWatcher() {
 					if val.serialPort == nil || val.Protocol & b.msgType == 0 {
 						continue
 					}
-					_, err := val.serialPort.Write(b.msg)
+					out := b.msg
+					if (b.msgType&NETWORK_FLARM_NMEA) != 0 && val.Baud < nmeaSerialFullBaud {
+						// Not enough bandwidth for everything: position and traffic only
+						if out = []byte(nmeaSerialLowBaudFilter.apply(string(out))); len(out) == 0 {
+							continue
+						}
+					}
+					_, err := val.serialPort.Write(out)
 					if err != nil { // Encountered an error in writing to the serial port. Close it and set Serial_out_enabled.
 						log.Printf("serialout (%s) port err: %s. Closing port.\n", val.DeviceString, err.Error())
 						val.serialPort.Close()
@@ -370,17 +466,60 @@ func refreshConnectedClients() {
 					continue
 				}
 				newq := make([][]byte, 0)
-				outSockets[ipAndPort] = networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, messageQueue: newq}
+				newConn := networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, messageQueue: newq}
+				if (networkOutput.Capability & NETWORK_FLARM_NMEA) != 0 {
+					outConn.Write([]byte(makeFlarmPFLAEString() + makeFlarmPFLAVString())) // FLARM self-test result and version, see flarm-nmea.go
+					newConn.flarmRange = &flarmChannelRange{}
+					go readUDPFlarmCommands(outConn, newConn.flarmRange)
+				}
+				outSockets[ipAndPort] = newConn
 			}
 			validConnections[ipAndPort] = true
 		}
 	}
 	// Client that was connected before that isn't.
 	for ipAndPort, conn := range outSockets {
+		if conn.Multicast || conn.Broadcast {
+			continue
+		}
 		if _, ok := validConnections[ipAndPort]; !ok {
 			log.Printf("removed connection %s.\n", ipAndPort)
 			conn.Conn.Close()
 			delete(outSockets, ipAndPort)
+			delete(uatReportBuckets, ipAndPort)
+		}
+	}
+}
+
+/*
+	readUDPFlarmCommands answers the FLARM configuration sentences (e.g. $PFLAC,S,RANGE) a UDP NMEA client sends
+	back to us, like ReadCommands() does for TCP clients. A RANGE set here can only narrow globalSettings.FlarmRange,
+	sendNetFLARM() already applied it. Returns when the connection is closed.
+*/
+func readUDPFlarmCommands(conn *net.UDPConn, flarmRange *flarmChannelRange) {
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			time.Sleep(1 * time.Second) // ICMP unreachable while the client app isn't running
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			sentence, valid := validateNMEAChecksum(strings.TrimSpace(line))
+			if !valid {
+				continue
+			}
+			x := strings.Split(sentence, ",")
+			if reply, ok := handlePflacRange(x, flarmRange); ok {
+				conn.Write([]byte(reply))
+			} else if reply, ok := handlePflacConfig(x); ok {
+				conn.Write([]byte(reply))
+			} else if reply, ok := handleFlarmQuery(x); ok {
+				conn.Write([]byte(reply))
+			}
 		}
 	}
 }
@@ -395,79 +534,81 @@ func messageQueueSender() {
 		case msg := <-messageQueue:
 			sendToAllConnectedClients(msg)
 		case <-queueTimer.C:
-			netMutex.Lock()
+			func() {
+				netMutex.Lock()
+				defer netMutex.Unlock() // messageQueueSender is supervised, see supervisor.go
 
-			averageSendableQueueSize := float64(0.0)
-			for k, netconn := range outSockets {
-				if len(netconn.messageQueue) > 0 && !isSleeping(k) && !isThrottled(k) {
-					averageSendableQueueSize += float64(len(netconn.messageQueue)) // Add num sendable messages.
+				averageSendableQueueSize := float64(0.0)
+				for k, netconn := range outSockets {
+					if len(netconn.messageQueue) > 0 && !isSleeping(k) && !isThrottled(k) {
+						averageSendableQueueSize += float64(len(netconn.messageQueue)) // Add num sendable messages.
 
-					var queuedMsg []byte
+						var queuedMsg []byte
 
-					// Combine the first 256 entries in netconn.messageQueue to avoid flooding wlan0 with too many IOPS.
-					// Need to play nice with non-queued messages, so this limits the number of entries to combine.
-					// UAT uplink block is 432 bytes, so transmit block size shouldn't be larger than 108 KiB. 10 Mbps per device would therefore be needed to send within a 100 ms window.
+						// Combine the first 256 entries in netconn.messageQueue to avoid flooding wlan0 with too many IOPS.
+						// Need to play nice with non-queued messages, so this limits the number of entries to combine.
+						// UAT uplink block is 432 bytes, so transmit block size shouldn't be larger than 108 KiB. 10 Mbps per device would therefore be needed to send within a 100 ms window.
 
-					mqDepth := len(netconn.messageQueue)
-					if mqDepth > 256 {
-						mqDepth = 256
-					}
-
-					for j := 0; j < mqDepth; j++ {
-						queuedMsg = append(queuedMsg, netconn.messageQueue[j]...)
-					}
+						mqDepth := len(netconn.messageQueue)
+						if mqDepth > 256 {
+							mqDepth = 256
+						}
 
-					/*
-						for j, _ := range netconn.messageQueue {
+						for j := 0; j < mqDepth; j++ {
 							queuedMsg = append(queuedMsg, netconn.messageQueue[j]...)
 						}
-					*/
 
-					netconn.Conn.Write(queuedMsg)
-					totalNetworkMessagesSent++
-					globalStatus.NetworkDataMessagesSent++
-					globalStatus.NetworkDataBytesSent += uint64(len(queuedMsg))
+						/*
+							for j, _ := range netconn.messageQueue {
+								queuedMsg = append(queuedMsg, netconn.messageQueue[j]...)
+							}
+						*/
 
-					//netconn.messageQueue = [][]byte{}
-					if mqDepth < len(netconn.messageQueue) {
-						netconn.messageQueue = netconn.messageQueue[mqDepth:]
-					} else {
-						netconn.messageQueue = [][]byte{}
-					}
-					outSockets[k] = netconn
-
-					/*
-						tmpConn := netconn
-						tmpConn.Conn.Write(tmpConn.messageQueue[0])
+						netconn.Conn.Write(queuedMsg)
 						totalNetworkMessagesSent++
 						globalStatus.NetworkDataMessagesSent++
-						globalStatus.NetworkDataBytesSent += uint64(len(tmpConn.messageQueue[0]))
-						tmpConn.messageQueue = tmpConn.messageQueue[1:]
-						outSockets[k] = tmpConn
-					*/
-				}
-				netconn.MessageQueueLen = len(netconn.messageQueue)
-				outSockets[k] = netconn
-			}
+						globalStatus.NetworkDataBytesSent += uint64(len(queuedMsg))
 
-			if stratuxClock.Since(lastQueueTimeChange) >= 5*time.Second {
-				var pd float64
-				if averageSendableQueueSize > 0.0 && len(outSockets) > 0 {
-					averageSendableQueueSize = averageSendableQueueSize / float64(len(outSockets)) // It's a total, not an average, up until this point.
-					pd = math.Max(float64(1.0/750.0), float64(1.0/(4.0*averageSendableQueueSize))) // Say 250ms is enough to get through the whole queue.
-				} else {
-					pd = float64(0.1) // 100ms.
+						//netconn.messageQueue = [][]byte{}
+						if mqDepth < len(netconn.messageQueue) {
+							netconn.messageQueue = netconn.messageQueue[mqDepth:]
+						} else {
+							netconn.messageQueue = [][]byte{}
+						}
+						outSockets[k] = netconn
+
+						/*
+							tmpConn := netconn
+							tmpConn.Conn.Write(tmpConn.messageQueue[0])
+							totalNetworkMessagesSent++
+							globalStatus.NetworkDataMessagesSent++
+							globalStatus.NetworkDataBytesSent += uint64(len(tmpConn.messageQueue[0]))
+							tmpConn.messageQueue = tmpConn.messageQueue[1:]
+							outSockets[k] = tmpConn
+						*/
+					}
+					netconn.MessageQueueLen = len(netconn.messageQueue)
+					outSockets[k] = netconn
 				}
 
-				if globalSettings.DEBUG {
-					log.Printf("Average sendable queue is %v messages. Changing queue timer to %f seconds\n", averageSendableQueueSize, pd)
-				}
+				if stratuxClock.Since(lastQueueTimeChange) >= 5*time.Second {
+					var pd float64
+					if averageSendableQueueSize > 0.0 && len(outSockets) > 0 {
+						averageSendableQueueSize = averageSendableQueueSize / float64(len(outSockets)) // It's a total, not an average, up until this point.
+						pd = math.Max(float64(1.0/750.0), float64(1.0/(4.0*averageSendableQueueSize))) // Say 250ms is enough to get through the whole queue.
+					} else {
+						pd = float64(0.1) // 100ms.
+					}
 
-				queueTimer.Stop()
-				queueTimer = time.NewTicker(time.Duration(pd*1000000000.0) * time.Nanosecond)
-				lastQueueTimeChange = stratuxClock.Time
-			}
-			netMutex.Unlock()
+					if globalSettings.DEBUG {
+						log.Printf("Average sendable queue is %v messages. Changing queue timer to %f seconds\n", averageSendableQueueSize, pd)
+					}
+
+					queueTimer.Stop()
+					queueTimer = time.NewTicker(time.Duration(pd*1000000000.0) * time.Nanosecond)
+					lastQueueTimeChange = stratuxClock.Time
+				}
+			}()
 		case <-secondTimer.C:
 			getNetworkStats()
 		}
@@ -482,6 +623,26 @@ func sendGDL90(msg []byte, queueable bool) {
 	sendMsg(msg, NETWORK_GDL90_STANDARD, queueable)
 }
 
+// sendOwnshipGDL90 sends the default ownship report to all outputs that don't have their own ownship configuration.
+func sendOwnshipGDL90(msg []byte) {
+	messageQueue <- networkMessage{msg: msg, msgType: NETWORK_GDL90_STANDARD, queueable: false, ts: stratuxClock.Time, ownship: true}
+}
+
+// sendUATReportGDL90 sends a relayed raw UAT basic/long report, see uatreportout.go.
+func sendUATReportGDL90(msg []byte) {
+	messageQueue <- networkMessage{msg: msg, msgType: NETWORK_GDL90_STANDARD, queueable: true, ts: stratuxClock.Time, uatReport: true, optional: true}
+}
+
+// sendOptionalGDL90 sends a GDL90 message that is dropped for clients with a poor Wi-Fi link (weather, distant traffic).
+func sendOptionalGDL90(msg []byte, queueable bool) {
+	messageQueue <- networkMessage{msg: msg, msgType: NETWORK_GDL90_STANDARD, queueable: queueable, ts: stratuxClock.Time, optional: true}
+}
+
+// sendGDL90ToPort sends a GDL90 message only to network clients on the given port.
+func sendGDL90ToPort(msg []byte, port uint32) {
+	messageQueue <- networkMessage{msg: msg, msgType: NETWORK_GDL90_STANDARD, queueable: false, ts: stratuxClock.Time, port: port}
+}
+
 func sendXPlane(msg []byte, queueable bool) {
 	sendMsg(msg, NETWORK_POSITION_FFSIM, queueable)
 }
@@ -503,7 +664,10 @@ func icmpEchoSender(c *icmp.PacketConn) {
 		netMutex.Lock()
 		// Collect IPs.
 		ips := make(map[string]bool)
-		for k, _ := range outSockets {
+		for k, netconn := range outSockets {
+			if netconn.Multicast || netconn.Broadcast {
+				continue
+			}
 			ipAndPort := strings.Split(k, ":")
 			ips[ipAndPort[0]] = true
 		}
@@ -671,12 +835,19 @@ func initNetwork() {
 	pingResponse = make(map[string]time.Time)
 	netMutex = &sync.Mutex{}
 	refreshConnectedClients()
+	refreshMulticastOutputs()
+	refreshNMEABroadcastOutput()
 	go monitorDHCPLeases()
-	go messageQueueSender()
+	supervise("messageQueueSender", messageQueueSender)
 	go sleepMonitor()
+	go wifiLinkMonitor()
 	go networkStatsCounter()
 	go serialOutWatcher()
 	go networkOutWatcher()
-	go tcpNMEAOutListener()
-	go tcpNMEAInListener()
+	supervise("tcpNMEAOutListener", tcpNMEAOutListener)
+	supervise("tcpNMEAInListener", tcpNMEAInListener)
+	superviseNoRecover("udpNMEAInListener", udpNMEAInListener) // Runs the NMEA parser
+	supervise("bluetoothOutput", bluetoothOutput)
+	supervise("altEncoderOutput", altEncoderOutput)
+	initUplinkArchive()
 }
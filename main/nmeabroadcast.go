@@ -0,0 +1,63 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeabroadcast.go: UDP broadcast of the FLARM NMEA stream on the stratux Wi-Fi, by default on
+		10110, the conventional NMEA port OpenCPN style apps listen on. Like a multicast output
+		it is an entry in outSockets that never sleeps, so it gets the same NMEA as the UDP
+		clients on port 2000, and client filters for ":<port>" apply.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// nmeaBroadcastIP is the broadcast address of our Wi-Fi network, which is always a /24 (see applyNetworkSettings()).
+func nmeaBroadcastIP() string {
+	ipAddr := globalSettings.WiFiIPAddress
+	if ipAddr == "" {
+		ipAddr = "192.168.10.1"
+	}
+	ipParts := strings.Split(ipAddr, ".")
+	if len(ipParts) != 4 {
+		return ""
+	}
+	return ipParts[0] + "." + ipParts[1] + "." + ipParts[2] + ".255"
+}
+
+// refreshNMEABroadcastOutput replaces the broadcast entry in outSockets after a settings change.
+func refreshNMEABroadcastOutput() {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	for k, netconn := range outSockets {
+		if netconn.Broadcast {
+			netconn.Conn.Close()
+			delete(outSockets, k)
+		}
+	}
+	if !globalSettings.NMEAOutUDPBroadcast_Enabled {
+		return
+	}
+	ip := nmeaBroadcastIP()
+	k := net.JoinHostPort(ip, strconv.Itoa(globalSettings.NMEAOutUDPBroadcastPort))
+	addr, err := net.ResolveUDPAddr("udp4", k)
+	if err != nil {
+		log.Printf("NMEA broadcast output %s: %s\n", k, err.Error())
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		log.Printf("NMEA broadcast output %s: %s\n", k, err.Error())
+		return
+	}
+	log.Printf("NMEA broadcast output to %s\n", k)
+	outSockets[k] = networkConnection{Conn: conn, Ip: ip, Port: uint32(globalSettings.NMEAOutUDPBroadcastPort), Capability: NETWORK_FLARM_NMEA, messageQueue: make([][]byte, 0), Broadcast: true}
+	conn.Write([]byte(makeFlarmPFLAEString() + makeFlarmPFLAVString()))
+}
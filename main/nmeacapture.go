@@ -0,0 +1,217 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeacapture.go: Raw capture of the inbound NMEA of each input source (serial GPS, TCP 30011
+		clients, ...) with receive timestamps, to debug sources that sometimes send garbage.
+		Lines are recorded as received, before any checksum validation or parsing. Non printable
+		bytes are escaped so broken baud rates and binary junk stay visible.
+		One file per source in /var/log/nmea-capture, rotated at nmeaCaptureMaxSize.
+		Download as zip via /downloadnmeacapture.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nmeaCaptureDir      = "/var/log/nmea-capture"
+	nmeaCaptureMaxSize  = 4 * 1024 * 1024 // bytes per file before rotating
+	nmeaCaptureKeep     = 3               // rotated files kept per source (<source>.nmea.1 .. .3)
+	nmeaCaptureMaxFiles = 16              // Don't let a reconnecting TCP client with changing IPs fill the disk
+)
+
+// Input sources. TCP and UDP clients are captured per remote IP.
+const (
+	NMEA_SOURCE_SERIAL = "serial"
+	NMEA_SOURCE_TCP    = "tcp"
+	NMEA_SOURCE_UDP    = "udp"
+)
+
+type nmeaCaptureFile struct {
+	f    *os.File
+	size int64
+}
+
+var nmeaCaptureMutex = &sync.Mutex{}
+var nmeaCaptureFiles = make(map[string]*nmeaCaptureFile)
+
+func isNMEACaptureEnabled() bool {
+	return globalSettings.NMEACapture_Enabled && !isShedding(SHED_LOGGING)
+}
+
+// nmeaCaptureSourceName makes a source identifier safe to use as file name, e.g. "tcp" + "192.168.10.12".
+func nmeaCaptureSourceName(source, detail string) string {
+	if len(detail) == 0 {
+		return source
+	}
+	return source + "-" + strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '.' {
+			return r
+		}
+		return '_'
+	}, detail)
+}
+
+// escapeNMEACapture escapes control characters and non-ASCII bytes as \xNN.
+func escapeNMEACapture(line string) string {
+	var sb strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c < 0x20 || c >= 0x7f || c == '\\' {
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func openNMEACaptureFile(source string) (*nmeaCaptureFile, error) {
+	if err := os.MkdirAll(nmeaCaptureDir, 0755); err != nil {
+		return nil, err
+	}
+	fn := filepath.Join(nmeaCaptureDir, source+".nmea")
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cf := &nmeaCaptureFile{f: f}
+	if fi, err := f.Stat(); err == nil {
+		cf.size = fi.Size()
+	}
+	return cf, nil
+}
+
+// rotateNMEACaptureFile renames <source>.nmea -> .1 -> .2 ... and drops the oldest.
+func rotateNMEACaptureFile(source string, cf *nmeaCaptureFile) (*nmeaCaptureFile, error) {
+	cf.f.Close()
+	base := filepath.Join(nmeaCaptureDir, source+".nmea")
+	os.Remove(fmt.Sprintf("%s.%d", base, nmeaCaptureKeep))
+	for i := nmeaCaptureKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+	os.Rename(base, base+".1")
+	return openNMEACaptureFile(source)
+}
+
+/*
+captureNMEA records one raw inbound line. source is one of the NMEA_SOURCE_* constants, detail
+distinguishes several inputs of the same kind (e.g. the client IP). Cheap no-op if disabled.
+*/
+func captureNMEA(source, detail, line string) {
+	if !isNMEACaptureEnabled() {
+		return
+	}
+	received := time.Now().UTC()
+	name := nmeaCaptureSourceName(source, detail)
+
+	nmeaCaptureMutex.Lock()
+	defer nmeaCaptureMutex.Unlock()
+	cf, ok := nmeaCaptureFiles[name]
+	if !ok {
+		if len(nmeaCaptureFiles) >= nmeaCaptureMaxFiles {
+			return
+		}
+		var err error
+		if cf, err = openNMEACaptureFile(name); err != nil {
+			addSingleSystemErrorf("nmea-capture", "Can't write NMEA capture: %s", err.Error())
+			return
+		}
+		nmeaCaptureFiles[name] = cf
+	}
+	if cf.size >= nmeaCaptureMaxSize {
+		var err error
+		if cf, err = rotateNMEACaptureFile(name, cf); err != nil {
+			delete(nmeaCaptureFiles, name)
+			log.Printf("NMEA capture: can't rotate %s: %s\n", name, err.Error())
+			return
+		}
+		nmeaCaptureFiles[name] = cf
+	}
+	// Stratux monotonic time as well, to correlate with replay logs and the event log.
+	entry := fmt.Sprintf("%s %d %s\n", received.Format("2006-01-02T15:04:05.000000Z"), stratuxClock.Milliseconds,
+		escapeNMEACapture(strings.TrimRight(line, "\r\n")))
+	n, _ := cf.f.WriteString(entry)
+	cf.size += int64(n)
+}
+
+// closeNMEACapture closes all capture files, e.g. when capturing was disabled. They are reopened on the next line.
+func closeNMEACapture() {
+	nmeaCaptureMutex.Lock()
+	defer nmeaCaptureMutex.Unlock()
+	for name, cf := range nmeaCaptureFiles {
+		cf.f.Close()
+		delete(nmeaCaptureFiles, name)
+	}
+}
+
+// /downloadnmeacapture: all capture files as zip.
+func handleDownloadNMEACaptureRequest(w http.ResponseWriter, r *http.Request) {
+	files, err := ioutil.ReadDir(nmeaCaptureDir)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error zipping NMEA capture: %s", err), http.StatusNotFound)
+		return
+	}
+	// Open all files and take their sizes without writes in between, then zip without blocking the inputs.
+	// The open files survive a rotation while zipping, the size limit cuts lines written since.
+	type captureSnapshot struct {
+		f  *os.File
+		fi os.FileInfo
+	}
+	snapshot := make([]captureSnapshot, 0, len(files))
+	nmeaCaptureMutex.Lock()
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(nmeaCaptureDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		if fi, err = f.Stat(); err != nil {
+			f.Close()
+			continue
+		}
+		snapshot = append(snapshot, captureSnapshot{f, fi})
+	}
+	nmeaCaptureMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=nmea_capture.zip")
+	z := zip.NewWriter(w)
+	defer z.Close()
+	for _, c := range snapshot {
+		fh, _ := zip.FileInfoHeader(c.fi)
+		fh.Method = zip.Deflate
+		if zf, err := z.CreateHeader(fh); err == nil {
+			io.Copy(zf, io.LimitReader(c.f, c.fi.Size()))
+		}
+		c.f.Close()
+	}
+}
+
+// /deletenmeacapture
+func handleDeleteNMEACaptureRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	closeNMEACapture()
+	nmeaCaptureMutex.Lock()
+	defer nmeaCaptureMutex.Unlock()
+	if err := os.RemoveAll(nmeaCaptureDir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
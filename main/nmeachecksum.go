@@ -0,0 +1,108 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeachecksum.go: Checksum check for all inbound NMEA (GPS, additional FLARM devices, network
+		inputs) before anything is parsed. Radio link serial bridges deliver garbled lines,
+		a bad $PFLAA must not become a phantom target. Bad sentences are dropped and counted
+		per source (named like the NMEA capture files, e.g. "tcp-192.168.10.21"), published in
+		globalStatus.NMEAInputStats.
+		Lines without "$" aren't NMEA (debug output of trackers etc.) and aren't counted.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const nmeaInputStatsMax = 32 // Sources, don't let changing client IPs grow the map forever. The least recently seen is dropped.
+
+type nmeaInputStats struct {
+	Sentences      uint64
+	ChecksumErrors uint64
+	lastSeen       time.Time // stratuxClock
+}
+
+// nmeaChecksum is the XOR of all characters of a sentence between "$" and "*".
+func nmeaChecksum(sentence string) byte {
+	var checksum byte
+	for i := 0; i < len(sentence); i++ {
+		checksum ^= sentence[i]
+	}
+	return checksum
+}
+
+// appendNMEAChecksum adds "$" and the checksum to a sentence, the counterpart of validateNMEAChecksum().
+func appendNMEAChecksum(sentence string) string {
+	return fmt.Sprintf("$%s*%02X", sentence, nmeaChecksum(sentence))
+}
+
+// makeNMEASentence returns the complete line for a sentence without "$" and checksum, as sent to clients.
+func makeNMEASentence(sentence string) string {
+	return appendNMEAChecksum(sentence) + "\r\n"
+}
+
+var nmeaInputStatsMap = make(map[string]*nmeaInputStats)
+var nmeaInputStatsMutex = &sync.Mutex{}
+
+// checkNMEAInput validates an inbound line, starting at its "$". Returns the sentence without "$" and
+// checksum, see validateNMEAChecksum(). ok = false for lines that aren't NMEA or have a bad checksum.
+func checkNMEAInput(source, detail, line string) (string, bool) {
+	idx := strings.Index(line, "$")
+	if idx < 0 {
+		return "", false
+	}
+	sentence, ok := validateNMEAChecksum(strings.TrimSpace(line[idx:]))
+
+	name := nmeaCaptureSourceName(source, detail)
+	nmeaInputStatsMutex.Lock()
+	defer nmeaInputStatsMutex.Unlock()
+	stats, known := nmeaInputStatsMap[name]
+	if !known {
+		if len(nmeaInputStatsMap) >= nmeaInputStatsMax {
+			evictOldestNMEAInputStats()
+		}
+		stats = &nmeaInputStats{}
+		nmeaInputStatsMap[name] = stats
+	}
+	stats.lastSeen = stratuxClock.Time
+	stats.Sentences++
+	if !ok {
+		stats.ChecksumErrors++
+		if globalSettings.DEBUG {
+			log.Printf("NMEA %s: dropped %q: %s\n", name, line, sentence)
+		}
+		return "", false
+	}
+	return sentence, true
+}
+
+// evictOldestNMEAInputStats removes the source that was seen least recently, live sources keep their counters.
+// The caller holds nmeaInputStatsMutex.
+func evictOldestNMEAInputStats() {
+	var oldest string
+	for name, stats := range nmeaInputStatsMap {
+		if len(oldest) == 0 || stats.lastSeen.Before(nmeaInputStatsMap[oldest].lastSeen) {
+			oldest = name
+		}
+	}
+	delete(nmeaInputStatsMap, oldest)
+}
+
+// getNMEAInputStats returns a copy of the counters for globalStatus.
+func getNMEAInputStats() map[string]nmeaInputStats {
+	nmeaInputStatsMutex.Lock()
+	defer nmeaInputStatsMutex.Unlock()
+	ret := make(map[string]nmeaInputStats, len(nmeaInputStatsMap))
+	for name, stats := range nmeaInputStatsMap {
+		ret[name] = *stats
+	}
+	return ret
+}
@@ -0,0 +1,120 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeafilter.go: Per-client NMEA sentence filters (globalSettings.NMEAClientFilters), for consumers
+		that only want part of the stream - e.g. a glide computer with its own GPS that only
+		wants the traffic, and gets confused by a second position source.
+		A filter applies to TCP clients (by their IP and our server port) and UDP clients (by
+		their IP and destination port). The most specific filter wins: "ip:port", then "ip",
+		then ":port".
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type nmeaClientFilter struct {
+	Client string   // "192.168.10.21", ":10110" or "192.168.10.21:4353"
+	Only   []string // If set, only these sentences are sent. "RMC" matches any talker, "GPRMC" only GP
+	Drop   []string // These sentences are never sent
+}
+
+// validNMEAClientFilter checks the client of a filter.
+func validNMEAClientFilter(f nmeaClientFilter) error {
+	ip, port := f.Client, ""
+	if strings.Contains(f.Client, ":") {
+		var err error
+		if ip, port, err = net.SplitHostPort(f.Client); err != nil {
+			return err
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %s", port)
+		}
+	}
+	if len(ip) > 0 && net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP %s", ip)
+	}
+	if len(ip) == 0 && len(port) == 0 {
+		return fmt.Errorf("no client")
+	}
+	return nil
+}
+
+// nmeaFilterFor returns the filter for a client, nil if it gets everything.
+func nmeaFilterFor(ip string, port int) *nmeaClientFilter {
+	var best *nmeaClientFilter
+	bestRank := 0
+	for i := range globalSettings.NMEAClientFilters {
+		f := &globalSettings.NMEAClientFilters[i]
+		rank := 0
+		switch f.Client {
+		case net.JoinHostPort(ip, strconv.Itoa(port)):
+			rank = 3
+		case ip:
+			rank = 2
+		case fmt.Sprintf(":%d", port):
+			rank = 1
+		}
+		if rank > bestRank {
+			best, bestRank = f, rank
+		}
+	}
+	return best
+}
+
+// nmeaSentenceID returns the talker and sentence type of a sentence, e.g. GPRMC or PFLAA.
+func nmeaSentenceID(sentence string) string {
+	s := strings.TrimLeft(sentence, "$!")
+	if idx := strings.IndexAny(s, ",*\r\n"); idx >= 0 {
+		s = s[:idx]
+	}
+	return s
+}
+
+func nmeaSentenceMatches(list []string, id string) bool {
+	for _, entry := range list {
+		if entry == id {
+			return true
+		}
+		// Without talker: RMC matches GPRMC and GNRMC. Proprietary sentences (P...) have no talker.
+		if len(entry) == 3 && len(id) == 5 && id[0] != 'P' && id[2:] == entry {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *nmeaClientFilter) allows(sentence string) bool {
+	id := nmeaSentenceID(sentence)
+	if len(f.Only) > 0 && !nmeaSentenceMatches(f.Only, id) {
+		return false
+	}
+	return !nmeaSentenceMatches(f.Drop, id)
+}
+
+// filterNMEAForClient removes the sentences a client doesn't want from msg (one or more sentences).
+func filterNMEAForClient(msg string, ip string, port int) string {
+	if f := nmeaFilterFor(ip, port); f != nil {
+		return f.apply(msg)
+	}
+	return msg
+}
+
+// apply removes the sentences the filter doesn't allow from msg.
+func (f *nmeaClientFilter) apply(msg string) string {
+	var sb strings.Builder
+	for _, sentence := range strings.SplitAfter(msg, "\n") {
+		if len(sentence) > 0 && (!strings.HasPrefix(sentence, "$") || f.allows(sentence)) {
+			sb.WriteString(sentence)
+		}
+	}
+	return sb.String()
+}
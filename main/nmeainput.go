@@ -0,0 +1,130 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeainput.go: Devices pushing NMEA to us over the network - TCP 30011 (tcpNMEAInListener()) and
+		UDP (nmeaudpin.go). Several can feed at the same time, e.g. a SoftRF for traffic and a
+		phone for GPS. Traffic and everything else from all of them is used and merged like
+		always, but there is one GPS source: the first feeder that delivers a valid position,
+		until it stops doing so for nmeaInGPSTimeout. Position sentences of the others are
+		dropped instead of the last writer winning.
+		Each feeder has its own status, published in globalStatus.NMEAInputs.
+*/
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const nmeaInGPSTimeout = 3 * time.Second
+
+// nmeaInFeeder is the state of one network NMEA input, also its JSON status.
+type nmeaInFeeder struct {
+	Source       string // NMEA_SOURCE_TCP or NMEA_SOURCE_UDP
+	Addr         string // ip:port for TCP, ip for UDP
+	GPS          bool   // Our GPS source
+	Messages     uint32
+	Connected    time.Time
+	ip           string
+	lastPosition time.Time // Last valid position
+}
+
+var nmeaInFeeders = make(map[string]*nmeaInFeeder) // By Source + " " + Addr
+var nmeaInFeedersMutex = &sync.Mutex{}
+var nmeaInGPSFeeder string // Key of the feeder that is our GPS, "" = none yet
+
+// nmeaPositionSentences are dropped from feeders that aren't our GPS. Without talker, see nmeaSentenceMatches().
+var nmeaPositionSentences = []string{"RMC", "GGA", "VTG", "GSA", "GSV", "GLL", "GNS", "PUBX"}
+
+// addNMEAInFeeder registers a new feeder and returns its key.
+func addNMEAInFeeder(source, addr, ip string) string {
+	key := source + " " + addr
+	nmeaInFeedersMutex.Lock()
+	defer nmeaInFeedersMutex.Unlock()
+	if len(nmeaInFeeders) == 0 {
+		// Set to fixed GPS_TYPE_NETWORK in the beginning, to override previous detected NMEA types
+		globalStatus.GPS_detected_type = GPS_TYPE_NETWORK
+		globalStatus.GPS_NetworkRemoteIp = ip
+	}
+	nmeaInFeeders[key] = &nmeaInFeeder{Source: source, Addr: addr, Connected: stratuxClock.Time, ip: ip}
+	log.Printf("NMEA input from %s, %d feeders\n", key, len(nmeaInFeeders))
+	return key
+}
+
+func removeNMEAInFeeder(key string) {
+	nmeaInFeedersMutex.Lock()
+	defer nmeaInFeedersMutex.Unlock()
+	delete(nmeaInFeeders, key)
+	log.Printf("NMEA input from %s closed, %d feeders\n", key, len(nmeaInFeeders))
+	if len(nmeaInFeeders) == 0 {
+		nmeaInGPSFeeder = ""
+		globalStatus.GPS_connected = false
+		globalStatus.GPS_detected_type = 0
+		globalStatus.GPS_NetworkRemoteIp = ""
+		return
+	}
+	if key == nmeaInGPSFeeder {
+		nmeaInGPSFeeder = "" // The next one with a valid position takes over
+	}
+}
+
+// processNMEAInLine processes a line from a feeder, see processNMEALine().
+func processNMEAInLine(key, line string) bool {
+	nmeaInFeedersMutex.Lock()
+	f, ok := nmeaInFeeders[key]
+	if !ok {
+		nmeaInFeedersMutex.Unlock()
+		return false
+	}
+	f.Messages++
+	position := nmeaSentenceMatches(nmeaPositionSentences, nmeaSentenceID(line))
+	if position && len(nmeaInGPSFeeder) > 0 && nmeaInGPSFeeder != key {
+		if gps, ok := nmeaInFeeders[nmeaInGPSFeeder]; ok && stratuxClock.Since(gps.lastPosition) < nmeaInGPSTimeout {
+			nmeaInFeedersMutex.Unlock()
+			return false // Another feeder is our GPS
+		}
+	}
+	nmeaInFeedersMutex.Unlock()
+
+	globalStatus.GPS_connected = true
+	// Keep detected protocol, only ensure type=network
+	globalStatus.GPS_detected_type = GPS_TYPE_NETWORK | (globalStatus.GPS_detected_type & 0xf0)
+	used := processNMEALine(line)
+
+	if position && used {
+		nmeaInFeedersMutex.Lock()
+		if nmeaInGPSFeeder != key {
+			log.Printf("NMEA input: GPS from %s\n", key)
+			nmeaInGPSFeeder = key
+			globalStatus.GPS_NetworkRemoteIp = f.ip
+		}
+		f.lastPosition = stratuxClock.Time
+		nmeaInFeedersMutex.Unlock()
+	}
+	return used
+}
+
+// getNMEAInStatus returns the status of all network NMEA inputs, the GPS source first.
+func getNMEAInStatus() []nmeaInFeeder {
+	nmeaInFeedersMutex.Lock()
+	defer nmeaInFeedersMutex.Unlock()
+	ret := make([]nmeaInFeeder, 0, len(nmeaInFeeders))
+	for key, f := range nmeaInFeeders {
+		s := *f
+		s.GPS = key == nmeaInGPSFeeder && stratuxClock.Since(f.lastPosition) < nmeaInGPSTimeout
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].GPS != ret[j].GPS {
+			return ret[i].GPS
+		}
+		return ret[i].Addr < ret[j].Addr
+	})
+	return ret
+}
@@ -0,0 +1,78 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmearate.go: Rate of the GPRMC/GPGGA position output (globalSettings.NMEAOutRate, 1/2/5/10 Hz),
+		also used for the AHRS heading sentences.
+		Varios and AHRS-style displays draw a smoother track and react faster with more than one
+		position per second. heartBeatSender() sends the usual sentences once per second, the
+		additional ones in between are sent from its fast timer.
+		Many GPS chips only deliver 1-5 fixes per second. Between fixes, the position is dead
+		reckoned from the last fix with ground speed, track and vertical speed, for at most
+		nmeaExtrapolateMax. At 1 Hz, positions are sent as received.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	nmeaRateTickInterval = 100 * time.Millisecond // Resolution of the output rate, must divide 1s by all valid rates
+	nmeaExtrapolateMax   = 1 * time.Second
+)
+
+var nmeaValidRates = []int{1, 2, 5, 10}
+
+func isValidNMEAOutRate(rate int) bool {
+	for _, r := range nmeaValidRates {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
+
+// nmeaPositionSituation returns the situation for the position sentences, dead reckoned to now if the output rate is above 1 Hz.
+func nmeaPositionSituation() *situationSnapshot {
+	s := getSituation()
+	if globalSettings.NMEAOutRate <= 1 || !s.GPSValid || s.GPSGroundSpeed < 1 {
+		return s
+	}
+	dt := stratuxClock.Since(s.GPSLastFixLocalTime)
+	if dt <= 0 || dt > nmeaExtrapolateMax {
+		return s
+	}
+	p := *s // Published snapshots must not be modified
+	lat, lon := calcLocationForBearingDistance(float64(s.GPSLatitude), float64(s.GPSLongitude), float64(s.GPSTrueCourse), s.GPSGroundSpeed*dt.Hours())
+	p.GPSLatitude, p.GPSLongitude = float32(lat), float32(lon)
+	p.GPSAltitudeMSL += s.GPSVerticalSpeed * float32(dt.Seconds())
+	p.GPSHeightAboveEllipsoid += s.GPSVerticalSpeed * float32(dt.Seconds())
+	p.GPSLastFixSinceMidnightUTC += float32(dt.Seconds())
+	if p.GPSLastFixSinceMidnightUTC >= 86400 {
+		p.GPSLastFixSinceMidnightUTC -= 86400
+	}
+	return &p
+}
+
+// nmeaRateTick is called every nmeaRateTickInterval with the number of ticks since the last 1 Hz output.
+func nmeaRateTick(tick int) {
+	rate := globalSettings.NMEAOutRate
+	ticksPerSecond := int(time.Second / nmeaRateTickInterval)
+	if rate <= 1 || !isValidNMEAOutRate(rate) || tick <= 0 || tick >= ticksPerSecond || tick%(ticksPerSecond/rate) != 0 {
+		return
+	}
+	if isPowerSaveIdle() || isGroundStation() {
+		return
+	}
+	sendNetFLARM(makeGPRMCString())
+	sendNetFLARM(makeGPGGAString())
+	if globalSettings.NMEAOut_Heading {
+		if hdg := makeHeadingStrings(); len(hdg) > 0 {
+			sendNetFLARM(hdg)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeaudpin.go: NMEA input over UDP on globalSettings.NMEAInUDPPort, in addition to TCP 30011
+		(see tcpNMEAInListener()). SoftRF and OGN Tracker in UDP broadcast mode can be our
+		GPS and traffic source without firmware changes. Each sender is a feeder like a TCP
+		NMEA input (see nmeainput.go), until nothing was received for nmeaUDPInTimeout.
+		Datagrams from our own addresses are ignored, we might be broadcasting on the same port
+		(see nmeabroadcast.go).
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const nmeaUDPInTimeout = 5 * time.Second
+
+// localIPs returns our own IPv4 addresses.
+func localIPs() map[string]bool {
+	ips := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips[ipnet.IP.String()] = true
+		}
+	}
+	return ips
+}
+
+// udpNMEAInListener receives NMEA datagrams while NMEAInUDPPort is set and follows changes of the port.
+func udpNMEAInListener() {
+	for {
+		port := globalSettings.NMEAInUDPPort
+		if port == 0 {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			addSingleSystemErrorf(fmt.Sprintf("nmea-udp-in-%d", port), "NMEA UDP input: can't listen on port %d: %s", port, err.Error())
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		log.Printf("NMEA UDP input listening on port %d\n", port)
+		readUDPNMEAIn(conn, port)
+		conn.Close()
+		log.Printf("NMEA UDP input on port %d stopped\n", port)
+	}
+}
+
+func readUDPNMEAIn(conn *net.UDPConn, port int) {
+	own := localIPs()
+	ownRefresh := stratuxClock.Time
+	senders := make(map[string]time.Time) // Feeder key -> last datagram
+	defer func() {
+		for key := range senders {
+			removeNMEAInFeeder(key)
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for globalSettings.NMEAInUDPPort == port {
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buf)
+		for key, last := range senders {
+			if stratuxClock.Since(last) > nmeaUDPInTimeout {
+				removeNMEAInFeeder(key)
+				delete(senders, key)
+			}
+		}
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			log.Printf("NMEA UDP input: %s\n", err.Error())
+			return
+		}
+		if stratuxClock.Since(ownRefresh) > 30*time.Second { // Wi-Fi settings might have changed
+			own, ownRefresh = localIPs(), stratuxClock.Time
+		}
+		remoteIp := addr.IP.String()
+		if own[remoteIp] {
+			continue
+		}
+
+		key := NMEA_SOURCE_UDP + " " + remoteIp
+		if _, ok := senders[key]; !ok {
+			key = addNMEAInFeeder(NMEA_SOURCE_UDP, remoteIp, remoteIp)
+		}
+		senders[key] = stratuxClock.Time
+
+		for _, line := range strings.SplitAfter(string(buf[:n]), "\n") {
+			if len(strings.TrimSpace(line)) == 0 {
+				continue
+			}
+			captureNMEA(NMEA_SOURCE_UDP, remoteIp, line)
+			if _, valid := checkNMEAInput(NMEA_SOURCE_UDP, remoteIp, line); !valid {
+				continue
+			}
+			processNMEAInLine(key, line[strings.Index(line, "$"):])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeaws.go: /nmea websocket, the live NMEA stream for browser based tools and for debugging
+		FLARM parsers without a raw socket. The websocket joins the TCP NMEA server on port
+		airConnectPort (or ?port=) as a client, so it gets exactly what the TCP clients there get:
+		the same client filter (by the browser's IP) and FLARM range, which can be changed with
+		$PFLAC sent over the websocket. No passcode.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+)
+
+// nmeaWSConn reports the browser's address instead of the websocket origin, for the client filters.
+type nmeaWSConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c nmeaWSConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// tcpNMEAServerFor returns the running TCP NMEA server on a port, nil if there is none.
+func tcpNMEAServerFor(port int) *tcpNMEAServer {
+	tcpNMEAServersMutex.Lock()
+	defer tcpNMEAServersMutex.Unlock()
+	for _, s := range tcpNMEAServers {
+		if s.port == port {
+			return s
+		}
+	}
+	return nil
+}
+
+func handleNMEAWS(conn *websocket.Conn) {
+	defer conn.Close()
+	port := airConnectPort
+	if p, err := strconv.Atoi(conn.Request().URL.Query().Get("port")); err == nil {
+		port = p
+	}
+	s := tcpNMEAServerFor(port)
+	if s == nil {
+		log.Printf("/nmea: no NMEA TCP output on port %d\n", port)
+		return
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", conn.Request().RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	wsConn := nmeaWSConn{Conn: conn, remote: remote}
+	client := tcpClient{
+		conn:       wsConn,
+		ch:         make(chan string),
+		flarmRange: &flarmChannelRange{},
+	}
+	io.WriteString(wsConn, makeFlarmPFLAEString())
+	io.WriteString(wsConn, makeFlarmPFLAVString())
+	select {
+	case s.addchan <- client:
+	case <-s.quit:
+		return
+	}
+	defer func() {
+		select {
+		case s.rmchan <- client:
+		case <-s.quit:
+		}
+	}()
+
+	go func() {
+		client.ReadCommands()
+		conn.Close() // Browser went away: ends WriteLinesFrom()
+	}()
+	client.WriteLinesFrom(client.ch, s.quit)
+}
@@ -0,0 +1,349 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	obstacles.go: Obstacle warnings (masts, cables) and alert zones on the FLARM NMEA output, like a
+		FLARM with obstacle database: $PFLAU with <AlarmType> 3 for obstacles, $PFLAO for zones.
+		FLARM's own .obs files are encrypted and can't be read, the database is a simple CSV
+		format instead. All *.csv files in obstacleDir are loaded and reloaded when they change.
+		One object per line, heights in meters MSL, # starts a comment:
+			mast,<id>,<lat>,<lon>,<top>                        (also tower, chimney, windturbine, building)
+			cable,<id>,<lat>,<lon>,<top>,<lat2>,<lon2>          (also line: a span between two pylons)
+			zone,<id>,<lat>,<lon>,<top>,<radius m>,<bottom>,<zone type hex, see $PFLAO>
+		Our path is projected along the current track for obstacleLookahead. An obstacle alarms
+		if we pass it closer than obstacleHorizontalMargin and lower than its top plus
+		obstacleVerticalMargin. The alarm level follows the time until then, as for traffic.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	obstacleDir              = "/etc/stratux-obstacles"
+	obstacleReloadInterval   = 1 * time.Minute
+	obstacleLookahead        = 18    // s, level 1 at most this far ahead
+	obstacleHorizontalMargin = 150   // m
+	obstacleVerticalMargin   = 100   // m above the top
+	obstacleZoneRange        = 10000 // m, zones closer than this are sent as $PFLAO
+	obstacleAudioRepeat      = 20 * time.Second
+)
+
+const (
+	OBSTACLE_POINT = iota
+	OBSTACLE_CABLE
+	OBSTACLE_ZONE
+)
+
+type obstacle struct {
+	Kind     int
+	ID       string
+	Lat, Lon float64
+	Top      float64 // m MSL
+	Lat2     float64 // Cables: other end
+	Lon2     float64
+	Radius   float64 // Zones: m
+	Bottom   float64 // Zones: m MSL
+	ZoneType int
+	// Bounding box for the quick distance check
+	minLat, maxLat, minLon, maxLon float64
+}
+
+// obstacleAlert is an obstacle or zone with its alarm state, see obstacleAlerts().
+type obstacleAlert struct {
+	obstacle
+	AlarmLevel       uint8
+	Distance         float64 // m, to the closest point now
+	Bearing          float64 // degrees true
+	RelativeVertical float64 // m, obstacle top relative to us
+}
+
+var obstacles []obstacle
+var obstaclesMutex = &sync.Mutex{}
+var obstaclesLoadedState string
+
+var obstacleAudioLevel uint8
+var obstacleAudioTime time.Time
+
+func parseObstacleLine(rec []string) (o obstacle, ok bool) {
+	if len(rec) < 5 {
+		return
+	}
+	f := func(i int) float64 {
+		if i >= len(rec) {
+			return math.NaN()
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec[i]), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return v
+	}
+	o.ID = strings.TrimSpace(rec[1])
+	o.Lat, o.Lon, o.Top = f(2), f(3), f(4)
+	switch strings.ToLower(strings.TrimSpace(rec[0])) {
+	case "mast", "tower", "chimney", "windturbine", "building":
+		o.Kind = OBSTACLE_POINT
+		o.Lat2, o.Lon2 = o.Lat, o.Lon
+	case "cable", "line":
+		o.Kind = OBSTACLE_CABLE
+		o.Lat2, o.Lon2 = f(5), f(6)
+	case "zone":
+		o.Kind = OBSTACLE_ZONE
+		o.Lat2, o.Lon2 = o.Lat, o.Lon
+		o.Radius, o.Bottom = f(5), f(6)
+		if len(rec) > 7 {
+			zt, _ := strconv.ParseInt(strings.TrimSpace(rec[7]), 16, 32)
+			o.ZoneType = int(zt)
+		}
+		if math.IsNaN(o.Radius) || math.IsNaN(o.Bottom) {
+			return
+		}
+	default:
+		return
+	}
+	if math.IsNaN(o.Lat) || math.IsNaN(o.Lon) || math.IsNaN(o.Top) || math.IsNaN(o.Lat2) || math.IsNaN(o.Lon2) {
+		return
+	}
+	o.minLat, o.maxLat = math.Min(o.Lat, o.Lat2), math.Max(o.Lat, o.Lat2)
+	o.minLon, o.maxLon = math.Min(o.Lon, o.Lon2), math.Max(o.Lon, o.Lon2)
+	return o, true
+}
+
+func obstacleDirState() string {
+	files, _ := ioutil.ReadDir(obstacleDir)
+	var state []string
+	for _, f := range files {
+		if strings.HasSuffix(strings.ToLower(f.Name()), ".csv") {
+			state = append(state, f.Name(), f.ModTime().String(), strconv.FormatInt(f.Size(), 10))
+		}
+	}
+	return strings.Join(state, "|")
+}
+
+// loadObstacles (re)loads all files in obstacleDir, if they changed.
+func loadObstacles() {
+	state := obstacleDirState()
+	obstaclesMutex.Lock()
+	unchanged := state == obstaclesLoadedState
+	obstaclesMutex.Unlock()
+	if unchanged {
+		return
+	}
+
+	var loaded []obstacle
+	files, _ := filepath.Glob(filepath.Join(obstacleDir, "*.[cC][sS][vV]"))
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+		r := csv.NewReader(f)
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		invalid := 0
+		for {
+			rec, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				invalid++
+				continue
+			}
+			if o, ok := parseObstacleLine(rec); ok {
+				loaded = append(loaded, o)
+			} else {
+				invalid++
+			}
+		}
+		f.Close()
+		if invalid > 0 {
+			log.Printf("obstacles: %d invalid lines in %s\n", invalid, fn)
+		}
+	}
+	if len(files) > 0 {
+		log.Printf("obstacles: loaded %d obstacles and zones from %d files\n", len(loaded), len(files))
+	}
+
+	obstaclesMutex.Lock()
+	obstacles = loaded
+	obstaclesLoadedState = state
+	obstaclesMutex.Unlock()
+}
+
+// obstacleLocal converts a position to meters north/east of lat0/lon0. Flat earth is fine at these distances.
+func obstacleLocal(lat, lon, lat0, lon0, cosLat float64) (n, e float64) {
+	return (lat - lat0) * 111120, (lon - lon0) * 111120 * cosLat
+}
+
+// closestPointOnSegment returns the point of the segment a-b that is closest to p.
+func closestPointOnSegment(pn, pe, an, ae, bn, be float64) (cn, ce float64) {
+	dn, de := bn-an, be-ae
+	l2 := dn*dn + de*de
+	if l2 == 0 {
+		return an, ae
+	}
+	t := math.Max(0, math.Min(1, ((pn-an)*dn+(pe-ae)*de)/l2))
+	return an + t*dn, ae + t*de
+}
+
+func obstacleAlarmLevelForTime(t float64) uint8 {
+	if t <= 8 {
+		return 3
+	} else if t <= 12 {
+		return 2
+	}
+	return 1
+}
+
+// obstacleAlerts returns the most urgent obstacle (nil if none alarms) and the alert zones in range.
+func obstacleAlerts(s *situationSnapshot) (threat *obstacleAlert, zones []obstacleAlert) {
+	if !s.GPSValid {
+		return
+	}
+	lat0, lon0 := float64(s.GPSLatitude), float64(s.GPSLongitude)
+	cosLat := math.Cos(radians(lat0))
+	alt := float64(s.GPSAltitudeMSL) * 0.3048
+	vs := float64(s.GPSVerticalSpeed) * 0.3048
+	gs := s.GPSGroundSpeed * 0.514444
+	vn, ve := gs*math.Cos(radians(float64(s.GPSTrueCourse))), gs*math.Sin(radians(float64(s.GPSTrueCourse)))
+	obstacleRange := gs*obstacleLookahead + obstacleHorizontalMargin
+
+	obstaclesMutex.Lock()
+	defer obstaclesMutex.Unlock()
+	for i := range obstacles {
+		o := &obstacles[i]
+		rng := obstacleRange
+		if o.Kind == OBSTACLE_ZONE {
+			rng = obstacleZoneRange + o.Radius
+		}
+		dLat, dLon := rng/111120, rng/(111120*cosLat)
+		if o.maxLat < lat0-dLat || o.minLat > lat0+dLat || o.maxLon < lon0-dLon || o.minLon > lon0+dLon {
+			continue
+		}
+		an, ae := obstacleLocal(o.Lat, o.Lon, lat0, lon0, cosLat)
+		bn, be := obstacleLocal(o.Lat2, o.Lon2, lat0, lon0, cosLat)
+		cn, ce := closestPointOnSegment(0, 0, an, ae, bn, be)
+		a := obstacleAlert{obstacle: *o, Distance: math.Hypot(cn, ce), Bearing: math.Mod(degrees(math.Atan2(ce, cn))+360, 360), RelativeVertical: o.Top - alt}
+
+		// Where are we in t seconds?
+		entered := -1.0
+		for t := 0.0; t <= obstacleLookahead; t++ {
+			pn, pe, palt := vn*t, ve*t, alt+vs*t
+			cn, ce := closestPointOnSegment(pn, pe, an, ae, bn, be)
+			d := math.Hypot(cn-pn, ce-pe)
+			if o.Kind == OBSTACLE_ZONE && d < o.Radius && palt >= o.Bottom && palt <= o.Top {
+				entered = t
+				break
+			} else if o.Kind != OBSTACLE_ZONE && d < obstacleHorizontalMargin && palt < o.Top+obstacleVerticalMargin {
+				entered = t
+				break
+			}
+		}
+
+		if o.Kind == OBSTACLE_ZONE {
+			if a.Distance-o.Radius > obstacleZoneRange {
+				continue
+			}
+			if entered >= 0 {
+				a.AlarmLevel = 1 // Zones are information, not collision threats
+			}
+			zones = append(zones, a)
+		} else if entered >= 0 {
+			a.AlarmLevel = obstacleAlarmLevelForTime(entered)
+			if threat == nil || a.AlarmLevel > threat.AlarmLevel || (a.AlarmLevel == threat.AlarmLevel && a.Distance < threat.Distance) {
+				t := a
+				threat = &t
+			}
+		}
+	}
+	return
+}
+
+// obstacleHexID maps an obstacle ID from the database to the 6 hex digits FLARM uses.
+func obstacleHexID(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%06X", h.Sum32()&0xFFFFFF)
+}
+
+// makeFlarmObstaclePFLAUString: $PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,3,<RelativeVertical>,<RelativeDistance>,<ID>
+func makeFlarmObstaclePFLAUString(a obstacleAlert, track float32) string {
+	bearing := a.Bearing - float64(track)
+	if bearing > 180 {
+		bearing -= 360
+	} else if bearing < -180 {
+		bearing += 360
+	}
+	msg := fmt.Sprintf("PFLAU,%d,1,%d,1,%d,%d,3,%d,%d,%s", len(traffic), flarmGPSStatus(), a.AlarmLevel, int32(bearing), int32(a.RelativeVertical), int32(a.Distance), obstacleHexID(a.ID))
+	return makeNMEASentence(msg)
+}
+
+// makeFlarmPFLAOString: $PFLAO,<AlarmLevel>,<Inside>,<Latitude>,<Longitude>,<Radius>,<Bottom>,<Top>,<ActivityLimit>,<ID>,<IDType>,<ZoneType>
+// Latitude/longitude in 1e-7 degrees, heights in m MSL, no activity limit, our hashed ID (type 2).
+func makeFlarmPFLAOString(a obstacleAlert) string {
+	inside := 0
+	if alt := a.Top - a.RelativeVertical; a.Distance < a.Radius && alt >= a.Bottom && alt <= a.Top {
+		inside = 1
+	}
+	msg := fmt.Sprintf("PFLAO,%d,%d,%d,%d,%d,%d,%d,0,%s,2,%02X", a.AlarmLevel, inside, int64(math.Round(a.Lat*1e7)), int64(math.Round(a.Lon*1e7)),
+		int32(a.Radius), int32(a.Bottom), int32(a.Top), obstacleHexID(a.ID), a.ZoneType)
+	return makeNMEASentence(msg)
+}
+
+// flarmObstacleOutput is called by sendTrafficUpdates() with trafficMutex held and the PFLAU of the most urgent traffic.
+// Sends the alert zones and returns the PFLAU to send: the obstacle one if it is more urgent than the traffic.
+func flarmObstacleOutput(pflau string, trafficAlarmLevel uint8) string {
+	if !globalSettings.ObstacleAlarm_Enabled || isGroundStation() {
+		return pflau
+	}
+	// Taxiing past hangars and masts: no obstacle alarms either, see airborne.go
+	if alarmsSuppressedOnGround() {
+		obstacleAudioLevel = 0
+		return pflau
+	}
+	s := getSituation()
+	threat, zones := obstacleAlerts(s)
+	for _, z := range zones {
+		sendNetFLARM(makeFlarmPFLAOString(z))
+	}
+
+	var level uint8
+	if threat != nil {
+		level = threat.AlarmLevel
+	}
+	if level > 0 && (level > obstacleAudioLevel || stratuxClock.Since(obstacleAudioTime) > obstacleAudioRepeat) {
+		obstacleAudioTime = stratuxClock.Time
+		audioAlert("obstacle")
+	}
+	obstacleAudioLevel = level
+
+	if threat != nil && threat.AlarmLevel > trafficAlarmLevel {
+		return makeFlarmObstaclePFLAUString(*threat, s.GPSTrueCourse)
+	}
+	return pflau
+}
+
+func obstacleLoader() {
+	ticker := time.NewTicker(obstacleReloadInterval)
+	for {
+		loadObstacles()
+		<-ticker.C
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"strings"
 	"time"
 	"log"
-	"io/ioutil"
 )
 
 // {"sys":"OGN","addr":"395F39","addr_type":3,"acft_type":"1","lat_deg":51.7657533,"lon_deg":-1.1918533,"alt_msl_m":124,"alt_std_m":63,"track_deg":0.0,"speed_mps":0.3,"climb_mps":-0.5,"turn_dps":0.0,"DOP":1.5}
@@ -43,6 +42,8 @@ type OgnMessage struct {
 	DOP float64
 	SNR_dB float64
 	Rx_err int32
+	Stealth ognFlag // See privacy.go
+	No_track ognFlag
 
 	// Status message (Sys=status):
 	Bkg_noise_db float32
@@ -68,13 +69,17 @@ func ognPublishNmea(nmea string) {
 func ognListen() {
 	//go predTest()
 	for {
-		if !globalSettings.OGN_Enabled || OGNDev == nil {
+		remote := remoteDecoderAddr("868")
+		if !globalSettings.OGN_Enabled || (OGNDev == nil && len(remote) == 0) {
 			// wait until OGN is enabled
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		log.Printf("ogn-rx-eu connecting...")
 		ognAddr := "127.0.0.1:30010"
+		if len(remote) > 0 {
+			ognAddr = remote // ogn-rx-eu on another machine, see remotesdr.go
+		}
 		conn, err := net.Dial("tcp", ognAddr)
 		if err != nil { // Local connection failed.
 			time.Sleep(3 * time.Second)
@@ -83,12 +88,17 @@ func ognListen() {
 		log.Printf("ogn-rx-eu successfully connected")
 		globalStatus.OGN_connected = true
 		ognReadWriter = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		var busySince time.Time
 		for globalSettings.OGN_Enabled {
+			if !busySince.IsZero() {
+				workDone(LOAD_OGN, busySince) // Everything between two reads is decoding work
+			}
 			buf, err := ognReadWriter.ReadBytes('\n')
 			if err != nil {
 				log.Printf("ogn-rx-eu connection lost.")
 				break
 			}
+			busySince = time.Now()
 
 			var thisMsg msg
 			thisMsg.MessageClass = MSGCLASS_OGN
@@ -106,8 +116,10 @@ func ognListen() {
 				importOgnStatusMessage(msg)
 			} else {
 				msgLogAppend(thisMsg)
-				logMsg(thisMsg) // writes to replay logs
-				importOgnTrafficMessage(msg, buf)
+				if privacyAllowsOgnMessage(msg, PRIVACY_USE_LOG) {
+					logMsg(thisMsg) // writes to replay logs
+				}
+				importOgnTrafficMessage(msg, buf, busySince)
 			}
 		}
 		globalStatus.OGN_connected = false
@@ -122,7 +134,8 @@ func importOgnStatusMessage(msg OgnMessage) {
 	globalStatus.OGN_gain_db = msg.Gain_db
 }
 
-func importOgnTrafficMessage(msg OgnMessage, buf []byte) {
+// importOgnTrafficMessage decodes a traffic message from ogn-rx-eu that arrived at received.
+func importOgnTrafficMessage(msg OgnMessage, buf []byte, received time.Time) {
 	var ti TrafficInfo
 	addressBytes, _ := hex.DecodeString(msg.Addr)
 	addressBytes = append([]byte{0}, addressBytes...)
@@ -162,6 +175,8 @@ func importOgnTrafficMessage(msg OgnMessage, buf []byte) {
 		ti.Tail = getTailNumber(msg.Addr, msg.Sys)
 	}
 	ti.Last_source = TRAFFIC_SOURCE_OGN
+	ti.Stealth = bool(msg.Stealth)
+	ti.NoTrack = bool(msg.No_track)
 	if msg.Time > 0 {
 		ti.Timestamp = time.Unix(msg.Time, 0)
 	} else {
@@ -246,7 +261,9 @@ func importOgnTrafficMessage(msg OgnMessage, buf []byte) {
 		}
 	}
 
+	latencyDecoded(&ti, TRAFFIC_SOURCE_OGN, received)
 	traffic[key] = ti
+	debugConsolePublish(DEBUG_SOURCE_OGN, string(buf), ti)
 	registerTrafficUpdate(ti)
 	seenTraffic[key] = true
 
@@ -256,31 +273,9 @@ func importOgnTrafficMessage(msg OgnMessage, buf []byte) {
 	}
 }
 
-var ognTailNumberCache = make(map[string]string)
+// lookupOgnTailNumber looks up the registration in OGN DDB and FlarmNet, see ddbupdater.go.
 func lookupOgnTailNumber(ognid string) string {
-	if len(ognTailNumberCache) == 0 {
-		log.Printf("Parsing OGN device db")
-		ddb, err := ioutil.ReadFile("/etc/ddb.json")
-		if err != nil {
-			log.Printf("Failed to read OGN device db")
-			return ognid
-		}
-		var data map[string]interface{}
-		err = json.Unmarshal(ddb, &data)
-		if err != nil {
-			log.Printf("Failed to parse OGN device db")
-			return ognid
-		}
-		devlist := data["devices"].([]interface{})
-		for i := 0; i < len(devlist); i++ {
-			dev := devlist[i].(map[string]interface{})
-			ognid := dev["device_id"].(string)
-			tail := dev["registration"].(string)
-			ognTailNumberCache[ognid] = tail
-		}
-		log.Printf("Successfully parsed OGN device db")
-	}
-	if tail, ok := ognTailNumberCache[ognid]; ok {
+	if tail, ok := lookupDDBTail(ognid); ok {
 		return tail
 	}
 	return ""
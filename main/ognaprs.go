@@ -0,0 +1,160 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ognaprs.go: Reports the ownship position to the OGN APRS network, so Stratux acts like
+		an OGN tracker when internet is available. Uses the tracker ID configured for the
+		OGN tracker (OGNAddr, OGNAddrType, OGNAcftType) and honors the privacy flags
+		and the precision/delay policy for this feed (see sharedfeeds.go).
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	ognAprsServer = "aprs.glidernet.org:14580"
+	ognAprsTocall = "OGNSTX"
+)
+
+// ognAddrPrefix returns the APRS callsign prefix for the given OGN address type.
+func ognAddrPrefix(addrType int) string {
+	switch addrType {
+	case 1:
+		return "ICA"
+	case 2:
+		return "FLR"
+	case 3:
+		return "OGN"
+	}
+	return "RND"
+}
+
+// aprsPasscode computes the APRS-IS passcode for a callsign (well known public hash).
+func aprsPasscode(call string) int {
+	call = strings.ToUpper(strings.Split(call, "-")[0])
+	hash := 0x73e2
+	for i := 0; i < len(call); i += 2 {
+		hash ^= int(call[i]) << 8
+		if i+1 < len(call) {
+			hash ^= int(call[i+1])
+		}
+	}
+	return hash & 0x7fff
+}
+
+// aprsCoord formats a coordinate as APRS DDMM.mm plus the extra precision digit for the !Wxy! extension.
+func aprsCoord(val float64, degDigits int, pos, neg string) (string, byte) {
+	hemi := pos
+	if val < 0 {
+		hemi = neg
+		val = -val
+	}
+	deg := math.Floor(val)
+	min := (val - deg) * 60
+	minThousandths := int(math.Round(min * 1000))
+	if minThousandths >= 60000 {
+		deg++
+		minThousandths -= 60000
+	}
+	return fmt.Sprintf("%0*d%02d.%02d%s", degDigits, int(deg), minThousandths/1000, (minThousandths%1000)/10, hemi), byte('0' + minThousandths%10)
+}
+
+// ognIdFlags encodes the OGN tracker id byte: stealth, no-track, aircraft type and address type.
+func ognIdFlags() byte {
+	var flags byte
+	if globalSettings.OGNStealth {
+		flags |= 0x80
+	}
+	if globalSettings.OGNNoTrack {
+		flags |= 0x40
+	}
+	flags |= byte(globalSettings.OGNAcftType&0x0F) << 2
+	flags |= byte(globalSettings.OGNAddrType & 0x03)
+	return flags
+}
+
+func makeOgnAprsPosition(callsign string, pos sharedFeedPosition) string {
+	latStr, latExt := aprsCoord(pos.Lat, 2, "N", "S")
+	lonStr, lonExt := aprsCoord(pos.Lon, 3, "E", "W")
+	now := time.Now().UTC().Add(-stratuxClock.Since(pos.Time)) // Time of the position, not of sending it
+
+	return fmt.Sprintf("%s>%s,TCPIP*:/%sh%s/%s'%03d/%03d/A=%06d !W%c%c! id%02X%s %+04.0ffpm %+.1frot\r\n",
+		callsign, ognAprsTocall, now.Format("150405"), latStr, lonStr,
+		int(pos.Track)%360, int(pos.Speed), int(pos.AltFt), latExt, lonExt,
+		ognIdFlags(), strings.ToUpper(globalSettings.OGNAddr), pos.VSpeed, pos.TurnRate/3) // rot = 3 deg/s
+}
+
+func ognAprsReportingEnabled() bool {
+	return globalSettings.OGNAprsReport_Enabled && !globalSettings.OGNNoTrack && len(globalSettings.OGNAddr) == 6 && !isGroundStation()
+}
+
+// ognAprsReporter connects to the OGN APRS servers and periodically sends our own position.
+func ognAprsReporter() {
+	for {
+		if !ognAprsReportingEnabled() || !isGPSValid() {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		conn, err := net.DialTimeout("tcp", ognAprsServer, 10*time.Second)
+		if err != nil {
+			// Probably no internet. Try again later.
+			time.Sleep(60 * time.Second)
+			continue
+		}
+		callsign := ognAddrPrefix(globalSettings.OGNAddrType) + strings.ToUpper(globalSettings.OGNAddr)
+		login := fmt.Sprintf("user %s pass %d vers stratux %s\r\n", callsign, aprsPasscode(callsign), stratuxVersion)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte(login)); err != nil {
+			conn.Close()
+			continue
+		}
+		log.Printf("Connected to OGN APRS server %s as %s\n", ognAprsServer, callsign)
+
+		// Drain whatever the server sends, so it doesn't consider us dead. Closes the connection on errors.
+		go func(c net.Conn) {
+			rdr := bufio.NewReader(c)
+			for {
+				if _, err := rdr.ReadString('\n'); err != nil {
+					c.Close()
+					return
+				}
+			}
+		}(conn)
+
+		var lastSent time.Time
+		for ognAprsReportingEnabled() {
+			time.Sleep(1 * time.Second)
+			pos, ok := sharedFeedPositionFor(FEED_OGN_APRS)
+			if !ok {
+				continue
+			}
+			// Like a real tracker: frequent updates while moving, low rate on the ground.
+			interval := 60 * time.Second
+			if pos.Speed > 10 {
+				interval = 5 * time.Second
+			}
+			if stratuxClock.Since(lastSent) < interval {
+				continue
+			}
+			lastSent = stratuxClock.Time
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write([]byte(makeOgnAprsPosition(callsign, pos))); err != nil {
+				log.Printf("OGN APRS connection lost: %s\n", err.Error())
+				break
+			}
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,145 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ogndashboard.go: UDP JSON feed of all OGN/FLARM targets for club live tracking pages, so they
+		can run directly off a field deployed Stratux without APRS infrastructure. Every
+		few seconds one datagram with all current targets is sent to the configured address
+		(unicast or broadcast). Field names and units follow the decoded OGN beacons as used
+		by the common OGN dashboards (ogn-python):
+		{"timestamp": "2020-06-01T12:00:00Z", "receiver": {"name": "Stratux", "latitude": .., "longitude": .., "altitude": ..},
+		 "aircraft": [{"address": "DD1234", "address_type": "flarm", "aircraft_type": 1, "name": "D-1234",
+		               "latitude": 48.1, "longitude": 11.2, "altitude": 1200, "ground_speed": 85, "track": 270,
+		               "climb_rate": 1.5, "turn_rate": -12}]}
+		Altitudes are meters MSL, ground speed km/h, climb rate m/s, turn rate deg/s.
+		The receiver position is subject to the shared feed policy (see sharedfeeds.go) and
+		omitted without GPS.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const ognDashboardInterval = 2 * time.Second
+
+type ognDashboardReceiver struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+type ognDashboardAircraft struct {
+	Address      string  `json:"address"`
+	AddressType  string  `json:"address_type"`
+	AircraftType int     `json:"aircraft_type"`
+	Name         string  `json:"name,omitempty"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Altitude     float64 `json:"altitude"`
+	GroundSpeed  float64 `json:"ground_speed"`
+	Track        float64 `json:"track"`
+	ClimbRate    float64 `json:"climb_rate"`
+	TurnRate     float64 `json:"turn_rate"`
+}
+
+type ognDashboardMessage struct {
+	Timestamp string                 `json:"timestamp"`
+	Receiver  *ognDashboardReceiver  `json:"receiver,omitempty"`
+	Aircraft  []ognDashboardAircraft `json:"aircraft"`
+}
+
+// trafficAltitudeMSL converts the altitude of a target back to meters MSL, which is what OGN reports.
+func trafficAltitudeMSL(ti TrafficInfo, s *situationSnapshot) float64 {
+	alt := float64(ti.Alt)
+	if ti.AltIsGNSS {
+		alt -= float64(s.GPSGeoidSep) // HAE -> MSL
+	} else if s.GPSValid && s.BaroValid {
+		alt = alt - float64(s.BaroPressureAltitude) + float64(s.GPSAltitudeMSL)
+	}
+	return alt / 3.28084
+}
+
+func makeOgnDashboardMessage() ognDashboardMessage {
+	msg := ognDashboardMessage{Aircraft: make([]ognDashboardAircraft, 0)}
+	if stratuxClock.HasRealTimeReference() {
+		msg.Timestamp = stratuxClock.RealTime.UTC().Format(time.RFC3339)
+	}
+	if pos, ok := sharedFeedPositionFor(FEED_OGN_DASHBOARD); ok {
+		msg.Receiver = &ognDashboardReceiver{"Stratux", pos.Lat, pos.Lon, float64(pos.AltFt) / 3.28084}
+	}
+
+	s := getSituation()
+	for _, ti := range getTrafficSnapshot().Targets {
+		if ti.Last_source != TRAFFIC_SOURCE_OGN || !ti.Position_valid || ti.Age > 10 || !privacyAllows(ti, PRIVACY_USE_FEED) {
+			continue
+		}
+		addrType := "flarm"
+		if isICAOAddrType(ti.Addr_type) {
+			addrType = "icao"
+		}
+		acType, _ := strconv.ParseInt(flarmAircraftType(ti.Emitter_category), 16, 8)
+		msg.Aircraft = append(msg.Aircraft, ognDashboardAircraft{
+			Address:      fmt.Sprintf("%06X", ti.Icao_addr&0xFFFFFF),
+			AddressType:  addrType,
+			AircraftType: int(acType),
+			Name:         ti.Tail,
+			Latitude:     float64(ti.Lat),
+			Longitude:    float64(ti.Lng),
+			Altitude:     trafficAltitudeMSL(ti, s),
+			GroundSpeed:  float64(ti.Speed) * 1.852,
+			Track:        float64(ti.Track),
+			ClimbRate:    float64(ti.Vvel) * 0.3048 / 60,
+			TurnRate:     float64(ti.TurnRate),
+		})
+	}
+	return msg
+}
+
+func ognDashboardSender() {
+	ticker := time.NewTicker(ognDashboardInterval)
+	var conn *net.UDPConn
+	var connAddr string
+	for {
+		<-ticker.C
+		if !globalSettings.OGNDashboard_Enabled || len(globalSettings.OGNDashboardAddr) == 0 {
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+		if conn == nil || connAddr != globalSettings.OGNDashboardAddr {
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			connAddr = globalSettings.OGNDashboardAddr
+			addr, err := net.ResolveUDPAddr("udp", connAddr)
+			if err != nil {
+				addSingleSystemErrorf("ogn-dashboard", "OGN dashboard feed: invalid address %s: %s", connAddr, err.Error())
+				continue
+			}
+			conn, err = net.DialUDP("udp", nil, addr)
+			if err != nil {
+				log.Printf("OGN dashboard feed: %s\n", err.Error())
+				conn = nil
+				continue
+			}
+		}
+		data, err := json.Marshal(makeOgnDashboardMessage())
+		if err != nil {
+			continue
+		}
+		conn.Write(data) // UDP, errors (e.g. nobody listening) don't matter
+	}
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ogntrackerfeed.go: Return channel of the NMEA-in bridge (TCP 30011) to an OGN Tracker. Once the
+		client identified itself as OGN Tracker ($POGN* sentences), it is fed our pressure
+		altitude ($PGRMZ) and, if Stratux has a GPS of its own, our fixes ($GPGGA/$GPRMC), so
+		the beacons it transmits use the better sensors. Data that came from the tracker in the
+		first place is never sent back.
+		The tracker's configuration ($POGNS) is read when it identifies itself and written on
+		OGN settings changes over the same connection, like for a tracker on serial.
+*/
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ognTrackerFeedInterval = 1 * time.Second
+
+type ognTrackerFeed struct {
+	conn       net.Conn
+	identified int32 // atomic, 1 once we have seen $POGN* from this client
+}
+
+var ognTrackerFeeds = make(map[*ognTrackerFeed]bool) // Identified trackers
+var ognTrackerFeedsMutex = &sync.Mutex{}
+
+// inspect is called for every line received from the client.
+func (f *ognTrackerFeed) inspect(line string) {
+	if strings.HasPrefix(line, "$POGN") && atomic.CompareAndSwapInt32(&f.identified, 0, 1) {
+		ognTrackerFeedsMutex.Lock()
+		ognTrackerFeeds[f] = true
+		ognTrackerFeedsMutex.Unlock()
+		io.WriteString(f.conn, "$POGNS\r\n") // Query its configuration, see processNMEALine()
+	}
+}
+
+// unregister is called when the client disconnected.
+func (f *ognTrackerFeed) unregister() {
+	ognTrackerFeedsMutex.Lock()
+	delete(ognTrackerFeeds, f)
+	ognTrackerFeedsMutex.Unlock()
+}
+
+// writeOgnTrackerFeedSettings sends the OGN configuration to all trackers on the NMEA-in port.
+func writeOgnTrackerFeedSettings(cfg string) {
+	ognTrackerFeedsMutex.Lock()
+	defer ognTrackerFeedsMutex.Unlock()
+	for f := range ognTrackerFeeds {
+		log.Printf("Configuring OGN Tracker %s: %s", f.conn.RemoteAddr().String(), cfg)
+		f.conn.SetWriteDeadline(time.Now().Add(ognTrackerFeedInterval))
+		io.WriteString(f.conn, cfg)
+		io.WriteString(f.conn, "$POGNS\r\n") // re-read settings from tracker
+	}
+}
+
+// ognTrackerConnected is true if any OGN Tracker can be configured: our GPS, an additional serial device or one on the NMEA-in port.
+func ognTrackerConnected() bool {
+	if (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_OGNTRACKER {
+		return true
+	}
+	for _, d := range getFlarmSerialStatus() {
+		if d.Type == FLARM_SERIAL_TYPE_OGNTRACKER {
+			return true
+		}
+	}
+	ognTrackerFeedsMutex.Lock()
+	defer ognTrackerFeedsMutex.Unlock()
+	return len(ognTrackerFeeds) > 0
+}
+
+// makeOgnTrackerFeed returns the sentences for the tracker, empty if there is nothing better than what it has.
+func makeOgnTrackerFeed() string {
+	feed := ""
+	if mySituation.BaroSourceType != BARO_TYPE_OGNTRACKER {
+		feed += makePGRMZString()
+	}
+	// The bridge makes the tracker our GPS (GPS_TYPE_NETWORK). Only a serial GPS still running in parallel is our own.
+	if serialPort != nil && isGPSValid() {
+		feed += makeGPGGAString() + makeGPRMCString()
+	}
+	return feed
+}
+
+// run feeds the tracker until done is closed or a write fails.
+func (f *ognTrackerFeed) run(done <-chan struct{}) {
+	ticker := time.NewTicker(ognTrackerFeedInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !globalSettings.OGNTrackerFeed_Enabled || atomic.LoadInt32(&f.identified) == 0 {
+			continue
+		}
+		if feed := makeOgnTrackerFeed(); len(feed) > 0 {
+			f.conn.SetWriteDeadline(time.Now().Add(ognTrackerFeedInterval))
+			if _, err := io.WriteString(f.conn, feed); err != nil {
+				return
+			}
+		}
+	}
+}
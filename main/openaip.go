@@ -0,0 +1,227 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	openaip.go: Onboard aeronautical data from openAIP files (openaip.net, legacy XML format, one file
+		per country and type, e.g. de_apt.aip). Copy them to openAIPDir, they are reloaded when they
+		change.
+		Airports: the nearest airfield and its frequency are published in mySituation (Airfield*)
+		and updated as the flight progresses, so the pilot doesn't have to look them up. The
+		preferred frequency is the tower, else CTAF/info/unicom style frequencies.
+		Airspaces: used for the airspace warnings, see airspace.go. Tim Newport-Peace files
+		(*.sua, *.tnp) in openAIPDir are loaded as well.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	openAIPDir             = "/etc/stratux-openaip"
+	openAIPReloadInterval  = 1 * time.Minute
+	airfieldUpdateInterval = 10 * time.Second
+	airfieldMaxDistance    = 50.0 // NM, nothing published if the nearest airfield is farther
+)
+
+// Preferred frequency types, best first. Other COMMUNICATION frequencies come after these.
+var airfieldFrequencyPreference = []string{"TOWER", "CTAF", "INFO", "AFIS", "UNICOM", "RADIO", "MULTICOM", "GLIDING", "APPROACH"}
+
+type openAIPRadio struct {
+	Category  string `xml:"CATEGORY,attr"`
+	Frequency string `xml:"FREQUENCY"`
+	Type      string `xml:"TYPE"`
+}
+
+type openAIPAirport struct {
+	Type   string         `xml:"TYPE,attr"`
+	Name   string         `xml:"NAME"`
+	ICAO   string         `xml:"ICAO"`
+	Lat    float64        `xml:"GEOLOCATION>LAT"`
+	Lon    float64        `xml:"GEOLOCATION>LON"`
+	Radios []openAIPRadio `xml:"RADIO"`
+}
+
+type openAIPAltLimit struct {
+	Reference string `xml:"REFERENCE,attr"` // STD (flight level), MSL or GND
+	Alt       struct {
+		Unit  string `xml:"UNIT,attr"` // F, FL or M
+		Value string `xml:",chardata"`
+	} `xml:"ALT"`
+}
+
+type openAIPAirspace struct {
+	Category string          `xml:"CATEGORY,attr"`
+	Name     string          `xml:"NAME"`
+	Top      openAIPAltLimit `xml:"ALTLIMIT_TOP"`
+	Bottom   openAIPAltLimit `xml:"ALTLIMIT_BOTTOM"`
+	Polygon  string          `xml:"GEOMETRY>POLYGON"`
+}
+
+type openAIPFile struct {
+	Airports  []openAIPAirport  `xml:"WAYPOINTS>AIRPORT"`
+	Airspaces []openAIPAirspace `xml:"AIRSPACES>ASP"`
+}
+
+var openAIPAirports []openAIPAirport
+var openAIPAirspaces []airspace
+var openAIPMutex = &sync.Mutex{}
+var openAIPLoadedState string // File names, sizes and modification times of the loaded files
+
+// openAIPDirState returns a string that changes whenever a file in openAIPDir changes.
+func openAIPDirState() string {
+	files, _ := ioutil.ReadDir(openAIPDir)
+	var state []string
+	for _, f := range files {
+		if ext := strings.ToLower(filepath.Ext(f.Name())); ext == ".aip" || ext == ".sua" || ext == ".tnp" {
+			state = append(state, f.Name(), f.ModTime().String(), strconv.FormatInt(f.Size(), 10))
+		}
+	}
+	return strings.Join(state, "|")
+}
+
+// loadOpenAIP (re)loads all files in openAIPDir, if they changed.
+func loadOpenAIP() {
+	state := openAIPDirState()
+	openAIPMutex.Lock()
+	unchanged := state == openAIPLoadedState
+	openAIPMutex.Unlock()
+	if unchanged {
+		return
+	}
+
+	var airports []openAIPAirport
+	var airspaces []airspace
+	files, _ := filepath.Glob(filepath.Join(openAIPDir, "*.[aA][iI][pP]"))
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+		var data openAIPFile
+		err = xml.NewDecoder(f).Decode(&data)
+		f.Close()
+		if err != nil {
+			log.Printf("openAIP: error reading %s: %s\n", fn, err.Error())
+			continue
+		}
+		for _, a := range data.Airports {
+			if a.Type != "AD_CLOSED" && (a.Lat != 0 || a.Lon != 0) {
+				airports = append(airports, a)
+			}
+		}
+		for _, asp := range data.Airspaces {
+			if a, ok := openAIPAirspaceToAirspace(asp); ok {
+				airspaces = append(airspaces, a)
+			}
+		}
+	}
+	tnpFiles, _ := filepath.Glob(filepath.Join(openAIPDir, "*.[sStT][uUnN][aApP]"))
+	for _, fn := range tnpFiles {
+		if ext := strings.ToLower(filepath.Ext(fn)); ext != ".sua" && ext != ".tnp" {
+			continue
+		}
+		a, err := loadTNPFile(fn)
+		if err != nil {
+			log.Printf("openAIP: error reading %s: %s\n", fn, err.Error())
+		}
+		airspaces = append(airspaces, a...)
+		files = append(files, fn)
+	}
+	if len(files) > 0 {
+		log.Printf("openAIP: loaded %d airports and %d airspaces from %d files\n", len(airports), len(airspaces), len(files))
+	}
+
+	openAIPMutex.Lock()
+	openAIPAirports = airports
+	openAIPAirspaces = airspaces
+	openAIPLoadedState = state
+	openAIPMutex.Unlock()
+}
+
+// airfieldFrequency returns the preferred frequency of an airport and its type, "" if it has none.
+func airfieldFrequency(a openAIPAirport) (string, string) {
+	best, bestType, bestRank := "", "", len(airfieldFrequencyPreference)+1
+	for _, r := range a.Radios {
+		if r.Category != "COMMUNICATION" || len(r.Frequency) == 0 {
+			continue
+		}
+		rank := len(airfieldFrequencyPreference)
+		for i, t := range airfieldFrequencyPreference {
+			if r.Type == t {
+				rank = i
+				break
+			}
+		}
+		if rank < bestRank {
+			best, bestType, bestRank = r.Frequency, r.Type, rank
+		}
+	}
+	return best, bestType
+}
+
+// nearestAirfield returns the closest airport, its distance (NM) and bearing.
+func nearestAirfield(lat, lon float64) (nearest openAIPAirport, dist, bearing float64, ok bool) {
+	openAIPMutex.Lock()
+	defer openAIPMutex.Unlock()
+	best := math.MaxFloat64
+	cosLat := math.Cos(radians(lat))
+	for _, a := range openAIPAirports {
+		// Flat earth is fine to find the closest one
+		dN, dE := a.Lat-lat, (a.Lon-lon)*cosLat
+		if d := dN*dN + dE*dE; d < best {
+			best, nearest, ok = d, a, true
+		}
+	}
+	if ok {
+		dist, bearing = distance(lat, lon, nearest.Lat, nearest.Lon)
+		dist /= 1852
+	}
+	return
+}
+
+func updateNearestAirfield() {
+	var a openAIPAirport
+	var dist, bearing float64
+	ok := false
+	if isGPSValid() {
+		a, dist, bearing, ok = nearestAirfield(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude))
+		ok = ok && dist < airfieldMaxDistance
+	}
+	freq, freqType := airfieldFrequency(a)
+
+	mySituation.muAirfield.Lock()
+	defer mySituation.muAirfield.Unlock()
+	mySituation.AirfieldValid = ok
+	mySituation.AirfieldName = a.Name
+	mySituation.AirfieldICAO = a.ICAO
+	mySituation.AirfieldFrequency = freq
+	mySituation.AirfieldFrequencyType = freqType
+	mySituation.AirfieldDistance = float32(dist)
+	mySituation.AirfieldBearing = float32(bearing)
+}
+
+func openAIPMonitor() {
+	ticker := time.NewTicker(airfieldUpdateInterval)
+	var lastLoad time.Time
+	for {
+		if time.Since(lastLoad) > openAIPReloadInterval {
+			loadOpenAIP()
+			lastLoad = time.Now()
+		}
+		updateNearestAirfield()
+		<-ticker.C
+	}
+}
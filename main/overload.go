@@ -0,0 +1,196 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	overload.go: Runtime accounting per subsystem and overload shedding. On a Pi Zero with a
+		lot of traffic around, decoding can starve the output goroutines so alarms arrive late.
+		The busy time of the main processing loops is accounted here, and if the process runs
+		out of CPU or memory, or the alarm latency from latency.go exceeds its budget, low
+		priority work is shed step by step:
+		- Level 1: no weather decoding (uplinks are still relayed raw to the EFB)
+		- Level 2: additionally no replay/SQLite logging
+		Traffic decoding and alerting are never shed. Levels are left one at a time after the
+		load has been low for a while.
+*/
+
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Subsystems with runtime accounting
+const (
+	LOAD_UAT     = iota // UAT downlink (traffic) decoding
+	LOAD_ES             // 1090ES decoding
+	LOAD_OGN            // OGN decoding
+	LOAD_WEATHER        // UAT uplink (FIS-B) decoding and distribution
+	LOAD_TRAFFIC        // Traffic table maintenance and output
+	LOAD_LOGGING        // SQLite replay log writes
+	loadSubsystems
+)
+
+var loadSubsystemNames = [loadSubsystems]string{"UAT", "1090ES", "OGN", "Weather", "Traffic", "Logging"}
+
+// Shedding levels, in the order they are entered
+const (
+	SHED_NONE    = 0
+	SHED_WEATHER = 1
+	SHED_LOGGING = 2
+	shedMaxLevel = SHED_LOGGING
+)
+
+const (
+	overloadInterval     = 5 * time.Second
+	overloadRecoverAfter = 30 * time.Second // Load must stay low this long before a level is left
+	overloadCPUHigh      = 90.0             // % of all cores
+	overloadCPULow       = 70.0
+	overloadMemHigh      = 80.0 // % of total RAM used by stratux
+	overloadMemLow       = 65.0
+	overloadAlarmLatency = 1500.0 // ms, p95 capture -> output for targets with an alarm
+)
+
+type loadStatus struct {
+	CPU_percent  float64            // Process CPU usage, % of all cores
+	Mem_MB       float64            // Memory obtained from the OS by the Go runtime
+	Mem_percent  float64            // Mem_MB relative to total RAM
+	Busy_percent map[string]float64 // Busy time of each subsystem's processing, % of one core
+	ShedLevel    int
+	Shed         []string // Work that is currently skipped
+	ShedCount    uint32   // Number of times shedding was entered since startup
+}
+
+var shedLevel int32                // Current SHED_* level, written by overloadSupervisor only
+var loadBusy [loadSubsystems]int64 // Accumulated busy time in ns since the last evaluation
+
+func isShedding(level int) bool {
+	return globalSettings.OverloadShedding_Enabled && int(atomic.LoadInt32(&shedLevel)) >= level
+}
+
+// workDone accounts the time since start as busy time of the subsystem. Use as defer workDone(LOAD_X, time.Now()).
+func workDone(subsystem int, start time.Time) {
+	atomic.AddInt64(&loadBusy[subsystem], int64(time.Since(start)))
+}
+
+func shedDescription(level int) string {
+	switch level {
+	case SHED_WEATHER:
+		return "Weather decoding"
+	case SHED_LOGGING:
+		return "Replay logging"
+	}
+	return ""
+}
+
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func totalMemory() uint64 {
+	var si syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&si); err != nil {
+		return 0
+	}
+	return uint64(si.Totalram) * uint64(si.Unit)
+}
+
+// maxAlarmLatency returns the worst p95 alarm latency of all sources, 0 if unknown.
+func maxAlarmLatency() float64 {
+	var worst float64
+	for _, l := range globalStatus.Latency {
+		if l.Alarm.Samples > 0 && l.Alarm.P95_ms > worst {
+			worst = l.Alarm.P95_ms
+		}
+	}
+	return worst
+}
+
+func updateLoadStatus(elapsed time.Duration, cpu time.Duration) loadStatus {
+	var st loadStatus
+	st.Busy_percent = make(map[string]float64)
+	for i := 0; i < loadSubsystems; i++ {
+		busy := atomic.SwapInt64(&loadBusy[i], 0)
+		st.Busy_percent[loadSubsystemNames[i]] = 100 * float64(busy) / float64(elapsed)
+	}
+	st.CPU_percent = 100 * float64(cpu) / float64(elapsed) / float64(runtime.NumCPU())
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	st.Mem_MB = float64(m.Sys) / (1024 * 1024)
+	if total := totalMemory(); total > 0 {
+		st.Mem_percent = 100 * float64(m.Sys) / float64(total)
+	}
+	return st
+}
+
+func overloadSupervisor() {
+	ticker := time.NewTicker(overloadInterval)
+	lastTime := time.Now()
+	lastCPU := processCPUTime()
+	var lowSince time.Time
+	var shedCount uint32
+	for {
+		<-ticker.C
+		now := time.Now()
+		cpu := processCPUTime()
+		st := updateLoadStatus(now.Sub(lastTime), cpu-lastCPU)
+		lastTime, lastCPU = now, cpu
+
+		level := int(atomic.LoadInt32(&shedLevel))
+		alarmLatency := maxAlarmLatency()
+		// Late alarms only count if we are busy as well, shedding won't help if the latency comes from elsewhere.
+		// The latency statistics also follow slowly, so they are not used to decide on recovery.
+		lateAlarms := alarmLatency > overloadAlarmLatency && st.CPU_percent > overloadCPULow
+		overloaded := st.CPU_percent > overloadCPUHigh || st.Mem_percent > overloadMemHigh || lateAlarms
+		relaxed := st.CPU_percent < overloadCPULow && st.Mem_percent < overloadMemLow
+
+		newLevel := level
+		if !globalSettings.OverloadShedding_Enabled {
+			newLevel = SHED_NONE
+		} else if overloaded {
+			lowSince = time.Time{}
+			if level < shedMaxLevel {
+				newLevel = level + 1 // One step per evaluation, so the effect can be seen before shedding more
+			}
+		} else if relaxed && level > SHED_NONE {
+			if lowSince.IsZero() {
+				lowSince = now
+			} else if now.Sub(lowSince) >= overloadRecoverAfter {
+				newLevel = level - 1
+				lowSince = now
+			}
+		} else {
+			lowSince = time.Time{}
+		}
+
+		if newLevel != level {
+			atomic.StoreInt32(&shedLevel, int32(newLevel))
+			if newLevel > level {
+				if level == SHED_NONE {
+					shedCount++
+				}
+				logEvent(EVENT_SYSTEM, EVENT_WARN, "Overload, shedding work", "shed", shedDescription(newLevel),
+					"cpu", int(st.CPU_percent), "mem", int(st.Mem_percent), "alarmLatency", int(alarmLatency))
+			} else {
+				logEvent(EVENT_SYSTEM, EVENT_INFO, "Load recovered, resuming work", "resumed", shedDescription(level))
+			}
+		}
+
+		st.ShedLevel = newLevel
+		st.ShedCount = shedCount
+		st.Shed = make([]string, 0)
+		for l := SHED_WEATHER; l <= newLevel; l++ {
+			st.Shed = append(st.Shed, shedDescription(l))
+		}
+		globalStatus.Load = st
+	}
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ownshipout.go: Per output GDL90 ownship report configuration. Some displays want
+		ownship at 5 Hz with geometric altitude, others break with anything above 1 Hz.
+		Outputs (identified by their UDP port) listed in globalSettings.OwnshipOutputs don't
+		receive the default 1 Hz ownship report, but their own variant at their own rate.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+type ownshipOutputConfig struct {
+	Port     uint32  // UDP port of the network output, see globalSettings.NetworkOutputs
+	Rate     float64 // Ownship reports per second. 0 = 1 Hz
+	NoGeoAlt bool    // Don't send the ownship geometric altitude message
+	NIC      uint8   // Reported NIC. 0 = default (8)
+	NACp     uint8   // Reported NACp. 0 = as computed from GPS accuracy
+}
+
+const maxOwnshipOutputRate = 10.0
+
+func hasOwnshipOutputConfig(port uint32) bool {
+	_, ok := ownshipOutputConfigFor(port)
+	return ok
+}
+
+func ownshipOutputConfigFor(port uint32) (ownshipOutputConfig, bool) {
+	for _, cfg := range globalSettings.OwnshipOutputs {
+		if cfg.Port == port {
+			return cfg, true
+		}
+	}
+	return ownshipOutputConfig{}, false
+}
+
+func (cfg ownshipOutputConfig) interval() time.Duration {
+	rate := cfg.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+	if rate > maxOwnshipOutputRate {
+		rate = maxOwnshipOutputRate
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func sendOwnshipToOutput(cfg ownshipOutputConfig) {
+	if msg, _, ok := buildOwnshipReport(cfg.NIC, cfg.NACp); ok {
+		sendGDL90ToPort(msg, cfg.Port)
+	}
+	if !cfg.NoGeoAlt {
+		if msg, ok := buildOwnshipGeometricAltitudeReport(); ok {
+			sendGDL90ToPort(msg, cfg.Port)
+		}
+	}
+}
+
+// ownshipOutputSender sends ownship reports to all outputs with their own configuration.
+func ownshipOutputSender() {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / maxOwnshipOutputRate))
+	lastSent := make(map[uint32]time.Time)
+	for {
+		<-ticker.C
+		for _, cfg := range globalSettings.OwnshipOutputs {
+			// Allow for a bit of timer jitter, otherwise 10 Hz would end up as 5 Hz.
+			if stratuxClock.Since(lastSent[cfg.Port]) < cfg.interval()-20*time.Millisecond {
+				continue
+			}
+			lastSent[cfg.Port] = stratuxClock.Time
+			sendOwnshipToOutput(cfg)
+		}
+	}
+}
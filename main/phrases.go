@@ -0,0 +1,177 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	phrases.go: Phrase catalog for text that is shown or spoken to the pilot (alerts in the web
+		UI, audio callouts). globalSettings.Locale selects the phrase set, phrases missing in
+		a locale fall back to English. Log messages and events stay English.
+		Phrases are fmt format strings, the arguments are the same for all locales.
+		The web UI gets the phrase set of the selected locale via /getPhrases.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+var phraseCatalog = map[string]map[string]string{
+	"en": {
+		"descent_alert":    "Unexpected descent!",
+		"obstacle":         "Obstacle!",
+		"terrain_warning":  "Terrain, pull up!",
+		"terrain_caution":  "Caution, terrain",
+		"degraded":         "Degraded Operation",
+		"battery_low":      "Battery low",
+		"overload_paused":  "%s paused",
+		"traffic":          "Traffic",
+		"traffic_alarm":    "Traffic alarm",
+		"clock":            "%d o'clock",
+		"high":             "%d feet high",
+		"low":              "%d feet low",
+		"same_altitude":    "same altitude",
+		"distance_nm":      "%.1f miles",
+		"distance_km":      "%.1f kilometers",
+		"distance_unknown": "distance unknown",
+	},
+	"de": {
+		"descent_alert":    "Unerwarteter Sinkflug!",
+		"obstacle":         "Hindernis!",
+		"terrain_warning":  "Gelände, hochziehen!",
+		"terrain_caution":  "Vorsicht, Gelände",
+		"degraded":         "Eingeschränkter Betrieb",
+		"battery_low":      "Akku schwach",
+		"overload_paused":  "%s pausiert",
+		"traffic":          "Verkehr",
+		"traffic_alarm":    "Verkehrswarnung",
+		"clock":            "%d Uhr",
+		"high":             "%d Fuß höher",
+		"low":              "%d Fuß tiefer",
+		"same_altitude":    "gleiche Höhe",
+		"distance_nm":      "%.1f Meilen",
+		"distance_km":      "%.1f Kilometer",
+		"distance_unknown": "Entfernung unbekannt",
+	},
+	"fr": {
+		"descent_alert":    "Descente inattendue !",
+		"obstacle":         "Obstacle !",
+		"terrain_warning":  "Relief, remontez !",
+		"terrain_caution":  "Attention, relief",
+		"degraded":         "Fonctionnement dégradé",
+		"battery_low":      "Batterie faible",
+		"overload_paused":  "%s en pause",
+		"traffic":          "Trafic",
+		"traffic_alarm":    "Alerte trafic",
+		"clock":            "%d heures",
+		"high":             "%d pieds au-dessus",
+		"low":              "%d pieds en dessous",
+		"same_altitude":    "même altitude",
+		"distance_nm":      "%.1f nautiques",
+		"distance_km":      "%.1f kilomètres",
+		"distance_unknown": "distance inconnue",
+	},
+	"es": {
+		"descent_alert":    "¡Descenso inesperado!",
+		"obstacle":         "¡Obstáculo!",
+		"terrain_warning":  "¡Terreno, arriba!",
+		"terrain_caution":  "Precaución, terreno",
+		"degraded":         "Funcionamiento degradado",
+		"battery_low":      "Batería baja",
+		"overload_paused":  "%s en pausa",
+		"traffic":          "Tráfico",
+		"traffic_alarm":    "Alerta de tráfico",
+		"clock":            "a las %d",
+		"high":             "%d pies por encima",
+		"low":              "%d pies por debajo",
+		"same_altitude":    "misma altitud",
+		"distance_nm":      "%.1f millas",
+		"distance_km":      "%.1f kilómetros",
+		"distance_unknown": "distancia desconocida",
+	},
+}
+
+func isKnownLocale(locale string) bool {
+	_, ok := phraseCatalog[locale]
+	return ok
+}
+
+// phrase returns the localized phrase with the given id, formatted with args.
+func phrase(id string, args ...interface{}) string {
+	format, ok := phraseCatalog[globalSettings.Locale][id]
+	if !ok {
+		format, ok = phraseCatalog[defaultLocale][id]
+	}
+	if !ok {
+		return id
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// phraseSet returns all phrases of the selected locale, completed with the English ones.
+func phraseSet() map[string]string {
+	set := make(map[string]string)
+	for id, format := range phraseCatalog[defaultLocale] {
+		set[id] = format
+	}
+	for id, format := range phraseCatalog[globalSettings.Locale] {
+		set[id] = format
+	}
+	return set
+}
+
+/*
+trafficCallout builds the spoken traffic callout for a target, e.g. "Traffic alarm, 2 o'clock, 500 feet high, 1.2 miles".
+alarmLevel is the FLARM alarm level, relAlt the target's altitude relative to ours in ft (altValid false if unknown).
+*/
+func trafficCallout(ti TrafficInfo, alarmLevel uint8, relAlt int32, altValid bool, ownTrack float32) string {
+	parts := []string{phrase("traffic")}
+	if alarmLevel > 0 {
+		parts[0] = phrase("traffic_alarm")
+	}
+	if ti.BearingDist_valid {
+		clock := int((ti.Bearing-float64(ownTrack)+360+15)/30) % 12
+		if clock == 0 {
+			clock = 12
+		}
+		parts = append(parts, phrase("clock", clock))
+	}
+	if altValid {
+		switch rounded := int32(math.Round(float64(relAlt)/100)) * 100; {
+		case rounded > 0:
+			parts = append(parts, phrase("high", rounded))
+		case rounded < 0:
+			parts = append(parts, phrase("low", -rounded))
+		default:
+			parts = append(parts, phrase("same_altitude"))
+		}
+	}
+	if ti.BearingDist_valid {
+		if globalSettings.Locale == defaultLocale {
+			parts = append(parts, phrase("distance_nm", ti.Distance/1852))
+		} else {
+			parts = append(parts, phrase("distance_km", ti.Distance/1000))
+		}
+	} else {
+		parts = append(parts, phrase("distance_unknown"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// AJAX call - /getPhrases. Responds with the phrase set of the selected locale.
+func handlePhrasesGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	phrasesJSON, _ := json.Marshal(phraseSet())
+	fmt.Fprintf(w, "%s\n", phrasesJSON)
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	powersave.go: Wake-on-traffic power saving for battery powered portable use (e.g. long
+		retrieves after a paragliding flight). If nobody is connected and no aircraft has been
+		seen within the wake radius for a while, Stratux goes idle: the SDRs only listen for
+		a short window every few minutes and the periodic outputs are quiesced. Any aircraft
+		inside the radius or a client connecting wakes it up fully. GPS stays on, so distances
+		to traffic can still be computed.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	POWERSAVE_ACTIVE    = 0 // Normal operation
+	POWERSAVE_IDLE      = 1 // SDRs off, outputs quiesced
+	POWERSAVE_LISTENING = 2 // Idle, but SDRs on to look for traffic
+)
+
+const (
+	powerSaveIdleAfter    = 5 * time.Minute  // No client and no traffic for this long -> idle
+	powerSaveListenPeriod = 2 * time.Minute  // Idle: SDRs are started once per period...
+	powerSaveListenTime   = 30 * time.Second // ...for this long. Includes SDR startup time.
+)
+
+var powerSaveState int32 = POWERSAVE_ACTIVE // Written by powerSaveSupervisor only, read from everywhere
+
+func isPowerSaveIdle() bool {
+	return atomic.LoadInt32(&powerSaveState) != POWERSAVE_ACTIVE
+}
+
+// powerSaveSDRsOff is used by sdrWatcher to shut down all SDRs outside of the listen windows.
+func powerSaveSDRsOff() bool {
+	return atomic.LoadInt32(&powerSaveState) == POWERSAVE_IDLE
+}
+
+func powerSaveStateName(state int32) string {
+	switch state {
+	case POWERSAVE_IDLE:
+		return "Idle"
+	case POWERSAVE_LISTENING:
+		return "Idle (listening for traffic)"
+	}
+	return "Active"
+}
+
+// isClientConnected returns true if any network client is awake, i.e. responds to pings and doesn't reject our packets.
+func isClientConnected() bool {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	for k := range outSockets {
+		if !isSleeping(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrafficNearby returns true if any current target is within the wake radius. Without GPS, any target counts.
+func isTrafficNearby() bool {
+	radius := float64(globalSettings.PowerSaveWakeRadius) * 1852
+	for _, ti := range getTrafficSnapshot().Targets {
+		if ti.Age > 30 {
+			continue
+		}
+		if _, shouldIgnore := isOwnshipTrafficInfo(ti); shouldIgnore {
+			continue
+		}
+		if !ti.BearingDist_valid || ti.Distance <= radius {
+			return true
+		}
+	}
+	return false
+}
+
+func powerSaveSupervisor() {
+	ticker := time.NewTicker(1 * time.Second)
+	lastActivity := stratuxClock.Time
+	var idleSince time.Time
+	for {
+		<-ticker.C
+		old := atomic.LoadInt32(&powerSaveState)
+		state := old
+		if !globalSettings.PowerSave_Enabled || isClientConnected() || isTrafficNearby() {
+			lastActivity = stratuxClock.Time
+			state = POWERSAVE_ACTIVE
+		} else if stratuxClock.Since(lastActivity) > powerSaveIdleAfter {
+			if state == POWERSAVE_ACTIVE {
+				idleSince = stratuxClock.Time
+			}
+			state = POWERSAVE_IDLE
+			if stratuxClock.Since(idleSince)%powerSaveListenPeriod < powerSaveListenTime {
+				state = POWERSAVE_LISTENING
+			}
+		}
+
+		if state != old {
+			if state == POWERSAVE_ACTIVE {
+				logEvent(EVENT_SYSTEM, EVENT_INFO, "Power save: waking up")
+			} else if old == POWERSAVE_ACTIVE {
+				logEvent(EVENT_SYSTEM, EVENT_INFO, "Power save: going idle", "wakeRadiusNm", globalSettings.PowerSaveWakeRadius)
+			}
+			atomic.StoreInt32(&powerSaveState, state)
+		}
+		globalStatus.PowerSave = powerSaveStateName(state)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	privacy.go: Privacy policy for received targets. Pilots can ask not to be tracked:
+		- no-track: the OGN no-track flag. The target must not appear in public tracking.
+		- stealth: the OGN stealth flag, or a FLARM anonymous ID (PFLAA IDType 3).
+		Such targets are still shown on all cockpit outputs (GDL90, FLARM NMEA, web UI),
+		collision avoidance always wins. But they are never passed on: not to feeds that
+		leave the box (OGN dashboard), not to the replay log that users download and share,
+		and not to the heat map.
+		All outputs ask privacyAllows() - the policy lives here and nowhere else.
+		Our own flags (OGNStealth/OGNNoTrack) are handled by the OGN tracker config and ognaprs.go.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Uses of target data beyond the cockpit display
+const (
+	PRIVACY_USE_FEED    = iota // Sent to third parties (internet, club dashboards)
+	PRIVACY_USE_LOG            // Stored in the replay log / exported
+	PRIVACY_USE_HEATMAP        // Accumulated in the traffic heat map
+)
+
+const flarmIDTypeAnonymous = 3 // PFLAA <IDType>, random ID of a FLARM in stealth mode
+
+// ognFlag is a flag of the OGN decoder JSON. Depending on the version, it is sent as 0/1 or false/true.
+type ognFlag bool
+
+func (f *ognFlag) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		*f = false
+		return nil
+	}
+	var v bool
+	if err := json.Unmarshal(b, &v); err == nil {
+		*f = ognFlag(v)
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*f = n != 0
+	return nil
+}
+
+// isPrivateTarget returns true if the target asked not to be tracked.
+func isPrivateTarget(ti TrafficInfo) bool {
+	return ti.NoTrack || ti.Stealth
+}
+
+// privacyAllows returns true if the target may be used for the given PRIVACY_USE_*.
+func privacyAllows(ti TrafficInfo, use int) bool {
+	switch use {
+	case PRIVACY_USE_FEED, PRIVACY_USE_LOG, PRIVACY_USE_HEATMAP:
+		return !isPrivateTarget(ti)
+	}
+	return true
+}
+
+// privacyAllowsOgnMessage is privacyAllows() for a raw OGN decoder message, before it is turned into a target.
+func privacyAllowsOgnMessage(msg OgnMessage, use int) bool {
+	return privacyAllows(TrafficInfo{NoTrack: bool(msg.No_track), Stealth: bool(msg.Stealth)}, use)
+}
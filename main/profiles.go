@@ -0,0 +1,118 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	profiles.go: Geofenced settings profiles. A profile is a set of settings (same keys as
+		/setSettings) attached to a circular geofence, e.g. the home airfield. When the GPS
+		position enters the fence, the profile is applied. When leaving, the settings that
+		were overridden are restored to their previous values.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type settingsProfile struct {
+	Name     string
+	Lat      float64
+	Lon      float64
+	Radius   float64 // meters
+	Settings map[string]interface{}
+}
+
+// Leave the geofence only when we are this factor outside of the radius, to avoid flapping on the boundary.
+const profileExitHysteresis = 1.2
+
+// currentSettingsMap returns the current settings in the same representation as sent to /setSettings.
+func currentSettingsMap() map[string]interface{} {
+	m := make(map[string]interface{})
+	j, _ := json.Marshal(&globalSettings)
+	json.Unmarshal(j, &m)
+	return m
+}
+
+// safeApplySettingsMap applies settings from a profile. Profiles are user supplied, so a wrongly typed
+// value must not take down Stratux.
+func safeApplySettingsMap(m map[string]interface{}) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			addSingleSystemErrorf("profile-apply", "Failed to apply settings profile: %v", err)
+			ok = false
+		}
+	}()
+	applySettingsMap(m)
+	return true
+}
+
+func activateProfile(p settingsProfile) {
+	current := currentSettingsMap()
+	restore := make(map[string]interface{})
+	for key := range p.Settings {
+		if key == "Profiles" || key == "ActiveProfile" || key == "ProfileRestore" {
+			continue
+		}
+		if val, ok := current[key]; ok {
+			restore[key] = val
+		}
+	}
+	log.Printf("Entering geofence of profile %s, applying settings\n", p.Name)
+	globalSettings.ActiveProfile = p.Name
+	globalSettings.ProfileRestore = restore
+	safeApplySettingsMap(p.Settings)
+}
+
+func deactivateProfile() {
+	log.Printf("Leaving geofence of profile %s, restoring settings\n", globalSettings.ActiveProfile)
+	restore := globalSettings.ProfileRestore
+	globalSettings.ActiveProfile = ""
+	globalSettings.ProfileRestore = nil
+	if restore != nil {
+		safeApplySettingsMap(restore)
+	} else {
+		saveSettings()
+	}
+}
+
+func evaluateProfiles() {
+	if !isGPSValid() {
+		return
+	}
+	lat := float64(mySituation.GPSLatitude)
+	lon := float64(mySituation.GPSLongitude)
+
+	// Still inside the active profile?
+	if len(globalSettings.ActiveProfile) > 0 {
+		for _, p := range globalSettings.Profiles {
+			if p.Name == globalSettings.ActiveProfile {
+				dist, _ := distance(lat, lon, p.Lat, p.Lon)
+				if dist <= p.Radius*profileExitHysteresis {
+					return
+				}
+				break
+			}
+		}
+		deactivateProfile()
+	}
+
+	for _, p := range globalSettings.Profiles {
+		dist, _ := distance(lat, lon, p.Lat, p.Lon)
+		if dist <= p.Radius {
+			activateProfile(p)
+			return
+		}
+	}
+}
+
+func profileEvaluator() {
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		<-ticker.C
+		evaluateProfiles()
+	}
+}
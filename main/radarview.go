@@ -0,0 +1,255 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	radarview.go: Data service for the web UI radar page (/radarview websocket).
+		Instead of pushing every traffic update to the browser, each connection gets a view
+		for the zoom level it requested: targets close to us are sent individually, distant
+		targets are merged into clusters, and only changes that are visible at the requested
+		range are sent (as diffs).
+
+		Client -> server: {"Range": <nm>, "AltDiff": <ft>} whenever the zoom changes.
+		Server -> client: globalSettings once, then radarViewUpdate messages.
+*/
+
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	radarViewPixels    = 200.0            // radar screen radius in pixels, positions are decimated to this resolution
+	radarViewKeepalive = 10 * time.Second // resend unchanged targets, so the client doesn't consider them stale
+	radarViewMargin    = 1.3              // also send targets a bit outside of the view, so they can move out smoothly
+)
+
+type radarViewRequest struct {
+	Range   float64 // nm
+	AltDiff float64 // ft
+}
+
+type radarCluster struct {
+	Lat        float32
+	Lng        float32
+	Count      int
+	MinAltDiff int32 // ft, altitude difference of the closest (vertically) target in the cluster
+}
+
+// radarTarget is a target as sent to the client. Icao_addr alone isn't unique, non-ICAO targets of different sources can share it.
+type radarTarget struct {
+	TrafficInfo
+	Key uint32 // trafficInfoKey(), also used in Removed
+}
+
+type radarViewUpdate struct {
+	Targets  []radarTarget // new or changed targets
+	Removed  []uint32      // keys of targets that are no longer in the view (or are now part of a cluster)
+	Clusters []radarCluster
+}
+
+// Decimated state of a target as last sent to the client
+type radarViewSent struct {
+	key    [6]int32
+	time   time.Time
+	resend bool // Zoom changed, send again even if unchanged
+}
+
+type radarViewClient struct {
+	mu   sync.Mutex
+	req  radarViewRequest
+	sent map[uint32]radarViewSent // By trafficInfoKey()
+}
+
+func (c *radarViewClient) request() radarViewRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := c.req
+	if req.Range <= 0 {
+		req.Range = float64(globalSettings.RadarRange)
+	}
+	if req.AltDiff <= 0 {
+		req.AltDiff = float64(globalSettings.RadarLimits)
+	}
+	return req
+}
+
+// decimatedKey quantizes everything visible on the radar to the resolution of the requested range.
+func decimatedKey(ti TrafficInfo, rangeNm float64) [6]int32 {
+	pixelDeg := rangeNm / radarViewPixels / 60 // one pixel in degrees latitude
+	return [6]int32{
+		int32(math.Round(float64(ti.Lat) / pixelDeg)),
+		int32(math.Round(float64(ti.Lng) / pixelDeg)),
+		ti.Alt / 100,
+		int32(ti.Track / 5),
+		int32(ti.Speed / 5),
+		int32(ti.Vvel / 100),
+	}
+}
+
+func (c *radarViewClient) makeUpdate(targets []TrafficInfo) radarViewUpdate {
+	req := c.request()
+	update := radarViewUpdate{Targets: make([]radarTarget, 0), Removed: make([]uint32, 0), Clusters: make([]radarCluster, 0)}
+
+	ownAlt, _, ownAltValid := ownshipAltitude()
+	ownLat := float64(mySituation.GPSLatitude)
+	ownLng := float64(mySituation.GPSLongitude)
+	gpsValid := isGPSValid()
+
+	// Distant targets are clustered in a grid with cells of 1/8 of the range
+	cellSize := req.Range * 1852 / 8
+	cells := make(map[[2]int]*radarCluster)
+	cellMembers := make(map[[2]int][]TrafficInfo)
+
+	individual := make([]TrafficInfo, 0)
+	for _, ti := range targets {
+		var altDiff float64
+		if ownAltValid && ti.Alt != 0 {
+			altDiff = float64(ti.Alt) - float64(ownAlt)
+			if math.Abs(altDiff) > req.AltDiff*radarViewMargin {
+				continue
+			}
+		}
+		if !ti.Position_valid || !gpsValid {
+			individual = append(individual, ti)
+			continue
+		}
+		dist, _, distN, distE := distRect(ownLat, ownLng, float64(ti.Lat), float64(ti.Lng))
+		if dist > req.Range*1852*radarViewMargin {
+			continue
+		}
+		if dist < req.Range*1852/2 {
+			individual = append(individual, ti)
+			continue
+		}
+		cell := [2]int{int(math.Floor(distN / cellSize)), int(math.Floor(distE / cellSize))}
+		cellMembers[cell] = append(cellMembers[cell], ti)
+		cl, ok := cells[cell]
+		if !ok {
+			cl = &radarCluster{MinAltDiff: math.MaxInt32}
+			cells[cell] = cl
+		}
+		cl.Lat += ti.Lat
+		cl.Lng += ti.Lng
+		cl.Count++
+		if int32(math.Abs(altDiff)) < int32(math.Abs(float64(cl.MinAltDiff))) {
+			cl.MinAltDiff = int32(altDiff)
+		}
+	}
+	for cell, cl := range cells {
+		if cl.Count == 1 {
+			individual = append(individual, cellMembers[cell][0])
+			continue
+		}
+		cl.Lat /= float32(cl.Count)
+		cl.Lng /= float32(cl.Count)
+		update.Clusters = append(update.Clusters, *cl)
+	}
+
+	// Diff against what the client already knows
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inView := make(map[uint32]bool)
+	for _, ti := range individual {
+		id := trafficInfoKey(ti)
+		inView[id] = true
+		key := decimatedKey(ti, req.Range)
+		if s, ok := c.sent[id]; ok && !s.resend && s.key == key && stratuxClock.Since(s.time) < radarViewKeepalive {
+			continue
+		}
+		c.sent[id] = radarViewSent{key: key, time: stratuxClock.Time}
+		update.Targets = append(update.Targets, radarTarget{TrafficInfo: ti, Key: id})
+	}
+	for id := range c.sent {
+		if !inView[id] {
+			update.Removed = append(update.Removed, id)
+			delete(c.sent, id)
+		}
+	}
+	return update
+}
+
+// radarViewTargets returns a copy of all current targets that might be shown on the radar.
+func radarViewTargets() []TrafficInfo {
+	snap := getTrafficSnapshot()
+	targets := make([]TrafficInfo, 0, len(snap.Targets))
+	for _, ti := range snap.Targets {
+		isCurrent := (ti.ExtrapolatedPosition && ti.AgeExtrapolation < 2 && ti.Age < 25) || (!ti.ExtrapolatedPosition && ti.Age < 6)
+		if !isCurrent {
+			continue
+		}
+		if _, shouldIgnore := isOwnshipTrafficInfo(ti); shouldIgnore {
+			continue
+		}
+		targets = append(targets, ti)
+	}
+	return targets
+}
+
+// Large ranges don't need a high update rate - aircraft hardly move on screen.
+func radarViewInterval(rangeNm float64) time.Duration {
+	if rangeNm > 10 {
+		return 2 * time.Second
+	}
+	return 1 * time.Second
+}
+
+func handleRadarViewWS(conn *websocket.Conn) {
+	client := &radarViewClient{sent: make(map[uint32]radarViewSent)}
+	done := make(chan struct{})
+
+	// Receive zoom changes from the client. Connection closes when we can't read any more.
+	go func() {
+		defer close(done)
+		for {
+			var req radarViewRequest
+			if err := websocket.JSON.Receive(conn, &req); err != nil {
+				return
+			}
+			client.mu.Lock()
+			if req.Range != client.req.Range {
+				// Force full update for the new zoom level. Keep the entries, so targets that are not in the new
+				// view are sent as removed.
+				for id, sent := range client.sent {
+					sent.resend = true
+					client.sent[id] = sent
+				}
+			}
+			client.req = req
+			client.mu.Unlock()
+		}
+	}()
+
+	if err := websocket.JSON.Send(conn, globalSettings); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	var lastUpdate time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if stratuxClock.Since(lastUpdate) < radarViewInterval(client.request().Range) {
+			continue
+		}
+		lastUpdate = stratuxClock.Time
+		update := client.makeUpdate(radarViewTargets())
+		if err := websocket.JSON.Send(conn, update); err != nil {
+			if globalSettings.DEBUG {
+				log.Printf("radarview: %s\n", err.Error())
+			}
+			return
+		}
+	}
+}
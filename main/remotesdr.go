@@ -0,0 +1,300 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	remotesdr.go: Receivers on the network instead of local dongles, so the antenna and SDR can sit
+		on the hangar roof or the mast while Stratux stays inside. Configured per band
+		(globalSettings.RemoteSDR1090/978/868) as URL:
+		- rtl_tcp://host:port  IQ samples from rtl_tcp. 1090: piped into a local dump1090,
+		                       978: fed to godump978 like a local dongle.
+		- soapy://host[:port]  SoapyRemote server with an RTL-SDR (1090 only, dump1090 talks to it directly).
+		- tcp://host:port      Demodulated output of a decoder on the remote machine: dump1090 JSON
+		                       (--net-stratux-port), dump978 raw messages, or ogn-rx-eu JSON.
+		ogn-rx-eu can only use local dongles, 868 MHz therefore only supports tcp://.
+		A band with a remote receiver doesn't claim a local dongle.
+		Note rtl_tcp at 2 MS/s needs about 40 Mbit/s - use a cable or a good WiFi link.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"../godump978"
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	REMOTE_SDR_RTLTCP = "rtl_tcp"
+	REMOTE_SDR_SOAPY  = "soapy"
+	REMOTE_SDR_TCP    = "tcp"
+)
+
+const (
+	remoteSDRRetryDelay  = 5 * time.Second
+	remoteSDRDialTimeout = 10 * time.Second
+	remoteSDRSoapyPort   = 55132
+	esSampleRate         = 2400000 // dump1090's default rate
+	esCenterFreq         = 1090000000
+)
+
+// rtl_tcp commands: one command byte, followed by a 32 bit big endian parameter
+const (
+	RTLTCP_SET_FREQ       = 0x01
+	RTLTCP_SET_SAMPLERATE = 0x02
+	RTLTCP_SET_GAIN_MODE  = 0x03 // 0 = automatic, 1 = manual
+	RTLTCP_SET_GAIN       = 0x04 // tenths of dB
+	RTLTCP_SET_FREQ_CORR  = 0x05 // ppm
+	RTLTCP_SET_AGC_MODE   = 0x08
+)
+
+var remoteSDRsConnected int32 // For the device count on the status page
+
+// remoteSDRSetting returns the configured remote receiver URL of a band ("1090", "978", "868").
+func remoteSDRSetting(band string) string {
+	switch band {
+	case "1090":
+		return globalSettings.RemoteSDR1090
+	case "978":
+		return globalSettings.RemoteSDR978
+	case "868":
+		return globalSettings.RemoteSDR868
+	}
+	return ""
+}
+
+// parseRemoteSDR splits a remote receiver URL into scheme and host:port.
+func parseRemoteSDR(s string) (scheme string, addr string, err error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case REMOTE_SDR_RTLTCP, REMOTE_SDR_TCP:
+		if len(u.Port()) == 0 {
+			return "", "", fmt.Errorf("%s: port missing", s)
+		}
+	case REMOTE_SDR_SOAPY:
+		if len(u.Port()) == 0 {
+			u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(remoteSDRSoapyPort))
+		}
+	default:
+		return "", "", fmt.Errorf("%s: unknown receiver type, use rtl_tcp://, soapy:// or tcp://", s)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// remoteSDRActive returns true if a band is configured to use a remote receiver (valid or not).
+func remoteSDRActive(band string) bool {
+	return len(strings.TrimSpace(remoteSDRSetting(band))) > 0
+}
+
+// remoteDecoderAddr returns host:port of a remote decoder (tcp://) for a band, "" if there is none.
+func remoteDecoderAddr(band string) string {
+	if scheme, addr, err := parseRemoteSDR(remoteSDRSetting(band)); err == nil && scheme == REMOTE_SDR_TCP {
+		return addr
+	}
+	return ""
+}
+
+// rtlTcpDial connects to rtl_tcp and tunes it. rtl_tcp starts streaming unsigned 8 bit IQ samples after a 12 byte header.
+func rtlTcpDial(addr string, freq, sampleRate uint32, gain int, ppm int) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, remoteSDRDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 12)
+	conn.SetReadDeadline(time.Now().Add(remoteSDRDialTimeout))
+	if _, err := io.ReadFull(conn, hdr); err != nil || string(hdr[:4]) != "RTL0" {
+		conn.Close()
+		return nil, errors.New("not an rtl_tcp server")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	gainMode := uint32(1)
+	if gain <= 0 {
+		gainMode = 0
+	}
+	cmds := [][2]uint32{
+		{RTLTCP_SET_SAMPLERATE, sampleRate},
+		{RTLTCP_SET_FREQ_CORR, uint32(int32(ppm))},
+		{RTLTCP_SET_FREQ, freq},
+		{RTLTCP_SET_AGC_MODE, 0},
+		{RTLTCP_SET_GAIN_MODE, gainMode},
+	}
+	if gain > 0 {
+		cmds = append(cmds, [2]uint32{RTLTCP_SET_GAIN, uint32(gain)})
+	}
+	for _, c := range cmds {
+		cmd := make([]byte, 5)
+		cmd[0] = byte(c[0])
+		binary.BigEndian.PutUint32(cmd[1:], c[1])
+		if _, err := conn.Write(cmd); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// closeOnStop closes c when stop is closed, so a blocking read returns.
+func closeOnStop(c io.Closer, stop <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-stop:
+		c.Close()
+	case <-done:
+	}
+}
+
+// run1090Remote runs dump1090 on a remote IQ source. Its output is read by esListen() as with a local dongle.
+func run1090Remote(scheme, addr string, stop <-chan struct{}) error {
+	args := []string{"--net-stratux-port", "30006", "--net"}
+	var conn net.Conn
+	switch scheme {
+	case REMOTE_SDR_RTLTCP:
+		var err error
+		if conn, err = rtlTcpDial(addr, esCenterFreq, esSampleRate, 0, 0); err != nil {
+			return err
+		}
+		defer conn.Close()
+		args = append(args, "--ifile", "-", "--iformat", "UC8")
+	case REMOTE_SDR_SOAPY:
+		args = append(args, "--device-type", "soapy", "--device", fmt.Sprintf("driver=remote,remote=tcp://%s,remote:driver=rtlsdr", addr))
+	default:
+		<-stop // tcp://, nothing to run, esListen() connects to the remote decoder
+		return nil
+	}
+	cmd := exec.Command("/usr/bin/dump1090", args...)
+	if conn != nil {
+		cmd.Stdin = conn
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	atomic.AddInt32(&remoteSDRsConnected, 1)
+	defer atomic.AddInt32(&remoteSDRsConnected, -1)
+	return cmd.Wait()
+}
+
+// run978Remote feeds IQ samples to godump978, or decoded messages from a remote dump978 to the uplink/traffic parser.
+func run978Remote(scheme, addr string, stop <-chan struct{}) error {
+	var conn net.Conn
+	var err error
+	switch scheme {
+	case REMOTE_SDR_RTLTCP:
+		conn, err = rtlTcpDial(addr, CenterFreq, SampleRate, TunerGain, 0)
+	case REMOTE_SDR_TCP:
+		conn, err = net.DialTimeout("tcp", addr, remoteSDRDialTimeout)
+	default:
+		return errors.New("978 MHz needs rtl_tcp:// or tcp://")
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go closeOnStop(conn, stop, done)
+	atomic.AddInt32(&remoteSDRsConnected, 1)
+	defer atomic.AddInt32(&remoteSDRsConnected, -1)
+
+	if scheme == REMOTE_SDR_RTLTCP {
+		for {
+			buf := make([]byte, rtl.DefaultBufLength) // Owned by godump978 once sent
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			godump978.InChan <- buf
+		}
+	}
+	rdr := bufio.NewReader(conn)
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if o, msgtype := parseInput(strings.TrimSpace(line)); o != nil && msgtype != 0 {
+			relayMessage(msgtype, o)
+		}
+	}
+}
+
+// run868Remote only validates the setting - ognListen() connects to the remote ogn-rx-eu.
+func run868Remote(scheme, addr string, stop <-chan struct{}) error {
+	if scheme != REMOTE_SDR_TCP {
+		return errors.New("868 MHz needs tcp:// (ogn-rx-eu can only use local dongles)")
+	}
+	<-stop
+	return nil
+}
+
+// remoteSDRRunner (re)starts run for a band while it is enabled, and restarts it when the setting changes.
+func remoteSDRRunner(band string, enabled func() bool, run func(scheme, addr string, stop <-chan struct{}) error) {
+	for {
+		setting := remoteSDRSetting(band)
+		if !enabled() || len(strings.TrimSpace(setting)) == 0 {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		scheme, addr, err := parseRemoteSDR(setting)
+		if err != nil {
+			log.Printf("Remote SDR %s MHz: %s\n", band, err.Error())
+			for remoteSDRSetting(band) == setting {
+				time.Sleep(1 * time.Second)
+			}
+			continue
+		}
+
+		stop := make(chan struct{})
+		result := make(chan error, 1)
+		logEvent(EVENT_SDR, EVENT_INFO, "Using remote receiver", "band", band+" MHz", "url", setting)
+		go func() {
+			result <- run(scheme, addr, stop)
+		}()
+		for {
+			select {
+			case err = <-result:
+			case <-time.After(1 * time.Second):
+				if enabled() && remoteSDRSetting(band) == setting {
+					continue
+				}
+				close(stop)
+				err = <-result
+			}
+			break
+		}
+		if err != nil {
+			logEvent(EVENT_SDR, EVENT_WARN, "Remote receiver failed", "band", band+" MHz", "url", setting, "error", err.Error())
+			time.Sleep(remoteSDRRetryDelay)
+		}
+	}
+}
+
+func remoteSDRInit() {
+	go remoteSDRRunner("1090", func() bool { return globalSettings.ES_Enabled && !powerSaveSDRsOff() }, run1090Remote)
+	go remoteSDRRunner("978", func() bool { return globalSettings.UAT_Enabled && !powerSaveSDRsOff() }, run978Remote)
+	go remoteSDRRunner("868", func() bool { return globalSettings.OGN_Enabled && !powerSaveSDRsOff() }, run868Remote)
+}
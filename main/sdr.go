@@ -529,7 +529,7 @@ func (r *regexOGN) hasID(serial string) bool {
 func createUATDev(id int, serial string, idSet bool) error {
 	UATDev = &UAT{indexID: id, serial: serial}
 	if err := UATDev.sdrConfig(); err != nil {
-		log.Printf("UATDev.sdrConfig() failed: %s\n", err)
+		logEvent(EVENT_SDR, EVENT_ERROR, "SDR configuration failed", "band", "978 MHz", "serial", serial, "error", err.Error())
 		UATDev = nil
 		return err
 	}
@@ -538,13 +538,14 @@ func createUATDev(id int, serial string, idSet bool) error {
 	UATDev.closeCh = make(chan int)
 	UATDev.wg.Add(1)
 	go UATDev.read()
+	logEvent(EVENT_SDR, EVENT_INFO, "SDR started", "band", "978 MHz", "serial", serial, "index", id)
 	return nil
 }
 
 func createESDev(id int, serial string, idSet bool) error {
 	ESDev = &ES{indexID: id, serial: serial}
 	if err := ESDev.sdrConfig(); err != nil {
-		log.Printf("ESDev.sdrConfig() failed: %s\n", err)
+		logEvent(EVENT_SDR, EVENT_ERROR, "SDR configuration failed", "band", "1090 MHz", "serial", serial, "error", err.Error())
 		ESDev = nil
 		return err
 	}
@@ -553,13 +554,14 @@ func createESDev(id int, serial string, idSet bool) error {
 	ESDev.closeCh = make(chan int)
 	ESDev.wg.Add(1)
 	go ESDev.read()
+	logEvent(EVENT_SDR, EVENT_INFO, "SDR started", "band", "1090 MHz", "serial", serial, "index", id)
 	return nil
 }
 
 func createOGNDev(id int, serial string, idSet bool) error {
 	OGNDev = &OGN{indexID: id, serial: serial}
 	if err := OGNDev.sdrConfig(); err != nil {
-		log.Printf("OGNDev.sdrConfig() failed: %s\n", err)
+		logEvent(EVENT_SDR, EVENT_ERROR, "SDR configuration failed", "band", "868 MHz", "serial", serial, "error", err.Error())
 		OGNDev = nil
 		return err
 	}
@@ -568,6 +570,7 @@ func createOGNDev(id int, serial string, idSet bool) error {
 	OGNDev.closeCh = make(chan int)
 	OGNDev.wg.Add(1)
 	go OGNDev.read()
+	logEvent(EVENT_SDR, EVENT_INFO, "SDR started", "band", "868 MHz", "serial", serial, "index", id)
 	return nil
 }
 
@@ -664,6 +667,7 @@ func sdrWatcher() {
 		// true when a ReadSync call fails
 		if shutdownUAT {
 			if UATDev != nil {
+				logEvent(EVENT_SDR, EVENT_WARN, "SDR stopped after error", "band", "978 MHz", "serial", UATDev.serial)
 				UATDev.shutdown()
 				UATDev = nil
 			}
@@ -672,6 +676,7 @@ func sdrWatcher() {
 		// true when we get stderr output
 		if shutdownES {
 			if ESDev != nil {
+				logEvent(EVENT_SDR, EVENT_WARN, "SDR stopped after error", "band", "1090 MHz", "serial", ESDev.serial)
 				ESDev.shutdown()
 				ESDev = nil
 			}
@@ -680,6 +685,7 @@ func sdrWatcher() {
 		// true when we get stderr output
 		if shutdownOGN {
 			if OGNDev != nil {
+				logEvent(EVENT_SDR, EVENT_WARN, "SDR stopped after error", "band", "868 MHz", "serial", OGNDev.serial)
 				OGNDev.shutdown()
 				OGNDev = nil
 			}
@@ -687,11 +693,13 @@ func sdrWatcher() {
 		}
 
 		// capture current state
-		esEnabled := globalSettings.ES_Enabled
-		uatEnabled := globalSettings.UAT_Enabled
-		ognEnabled := globalSettings.OGN_Enabled
+		sdrsOff := powerSaveSDRsOff()
+		// Bands with a remote receiver don't use a local dongle, see remotesdr.go
+		esEnabled := globalSettings.ES_Enabled && !sdrsOff && !remoteSDRActive("1090")
+		uatEnabled := globalSettings.UAT_Enabled && !sdrsOff && !remoteSDRActive("978")
+		ognEnabled := globalSettings.OGN_Enabled && !sdrsOff && !remoteSDRActive("868")
 		count := rtl.GetDeviceCount()
-		interfaceCount := count
+		interfaceCount := count + int(atomic.LoadInt32(&remoteSDRsConnected))
 		if globalStatus.UATRadio_connected {
 			interfaceCount++
 		}
@@ -729,7 +737,8 @@ func sdrWatcher() {
 }
 
 func sdrInit() {
-	go sdrWatcher()
-	go uatReader()
+	supervise("sdrWatcher", sdrWatcher)
+	supervise("uatReader", uatReader)
+	remoteSDRInit()
 	go godump978.ProcessDataFromChannel()
 }
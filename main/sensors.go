@@ -84,55 +84,65 @@ func initPressureSensor() (ok bool) {
 	return false
 }
 
-func tempAndPressureSender() {
-	var (
-		temp     float64
-		press    float64
-		altLast  = -9999.9
-		altitude float64
-		err      error
-		dt       = 0.1
-		failNum  uint8
-	)
+// pressureSampler turns raw pressure sensor readings into pressure altitude and vertical speed.
+type pressureSampler struct {
+	reader  sensors.PressureReader
+	dt      float64 // Sample interval in seconds
+	altLast float64
+	vspeed  float32
+	failNum uint8
+}
 
-	// Initialize variables for rate of climb calc
-	u := 5 / (5 + float32(dt)) // Use 5 sec decay time for rate of climb, slightly faster than typical VSI
+func newPressureSampler(reader sensors.PressureReader, dt float64) *pressureSampler {
+	return &pressureSampler{reader: reader, dt: dt, altLast: -9999.9}
+}
 
-	timer := time.NewTicker(time.Duration(1000*dt) * time.Millisecond)
-	for globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
-		<-timer.C
+// sample reads the sensor once and updates the situation. Returns false if the sensor failed too often and was closed.
+func (p *pressureSampler) sample() bool {
+	// Use 5 sec decay time for rate of climb, slightly faster than typical VSI
+	u := 5 / (5 + float32(p.dt))
 
-		// Read temperature and pressure altitude.
-		temp, err = myPressureReader.Temperature()
-		if err != nil {
-			addSingleSystemErrorf("pressure-sensor-temp-read", "AHRS Error: Couldn't read temperature from sensor: %s", err)
-		}
-		press, err = myPressureReader.Pressure()
-		if err != nil {
-			addSingleSystemErrorf("pressure-sensor-pressure-read", "AHRS Error: Couldn't read pressure from sensor: %s", err)
-			failNum++
-			if failNum > numRetries {
-				//				log.Printf("AHRS Error: Couldn't read pressure from sensor %d times, closing BMP: %s", failNum, err)
-				myPressureReader.Close()
-				globalStatus.BMPConnected = false // Try reconnecting a little later
-				break
-			}
+	// Read temperature and pressure altitude.
+	temp, err := p.reader.Temperature()
+	if err != nil {
+		addSingleSystemErrorf("pressure-sensor-temp-read", "AHRS Error: Couldn't read temperature from sensor: %s", err)
+	}
+	press, err := p.reader.Pressure()
+	if err != nil {
+		addSingleSystemErrorf("pressure-sensor-pressure-read", "AHRS Error: Couldn't read pressure from sensor: %s", err)
+		p.failNum++
+		if p.failNum > numRetries {
+			//			log.Printf("AHRS Error: Couldn't read pressure from sensor %d times, closing BMP: %s", p.failNum, err)
+			p.reader.Close()
+			return false
 		}
+	}
+
+	// Update the Situation data.
+	mySituation.muBaro.Lock()
+	mySituation.BaroTemperature = float32(temp)
+	mySituation.muBaro.Unlock()
+	altitude := CalcAltitude(press, globalSettings.AltitudeOffset)
+	if p.altLast < -2000 {
+		p.altLast = altitude // Initialize
+	}
+	// Assuming timer is reasonably accurate, use a regular ewma
+	p.vspeed = u*p.vspeed + (1-u)*float32(altitude-p.altLast)/(float32(p.dt)/60)
+	updateBaroSource(BARO_TYPE_BMP280, float32(altitude), p.vspeed, true)
+	p.altLast = altitude
+	return true
+}
 
-		// Update the Situation data.
-		mySituation.muBaro.Lock()
-		mySituation.BaroLastMeasurementTime = stratuxClock.Time
-		mySituation.BaroTemperature = float32(temp)
-		altitude = CalcAltitude(press, globalSettings.AltitudeOffset)
-		mySituation.BaroPressureAltitude = float32(altitude)
-		if altLast < -2000 {
-			altLast = altitude // Initialize
+func tempAndPressureSender() {
+	dt := 0.1
+	sampler := newPressureSampler(myPressureReader, dt)
+	timer := time.NewTicker(time.Duration(1000*dt) * time.Millisecond)
+	for globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
+		<-timer.C
+		if !sampler.sample() {
+			globalStatus.BMPConnected = false // Try reconnecting a little later
+			break
 		}
-		// Assuming timer is reasonably accurate, use a regular ewma
-		mySituation.BaroVerticalSpeed = u*mySituation.BaroVerticalSpeed + (1-u)*float32(altitude-altLast)/(float32(dt)/60)
-		mySituation.BaroSourceType = BARO_TYPE_BMP280
-		mySituation.muBaro.Unlock()
-		altLast = altitude
 	}
 	//mySituation.BaroPressureAltitude = 99999
 	//mySituation.BaroVerticalSpeed = 99999
@@ -0,0 +1,317 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	settingsschema.go: Versioned settings file. Loading used to decode the whole file into an empty
+		settings struct, so every setting that was added since the file was written came up as zero
+		instead of its default, and a single wrongly typed value reset all of them.
+		Now the file is read as a map, upgraded with the migrations below up to
+		settingsSchemaVersion and applied key by key on top of defaultSettings(). Keys that can't
+		be decoded or fail validation keep their default and are reported - in the log, as a
+		system error and via /getSettingsErrors. /setSettings reports its rejected values there
+		as well.
+		Changing the meaning or name of a setting: bump settingsSchemaVersion and add a
+		migration that converts older files. New settings only need a default.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	settingsSchemaVersion = 1
+	settingsErrorsMax     = 50
+)
+
+type settingsMigration struct {
+	Version     int // Schema version after this migration
+	Description string
+	Migrate     func(m map[string]interface{})
+}
+
+// Applied in order to files with an older SettingsVersion. Files without one are version 0.
+// None yet: version 1 files only added SettingsVersion, older files load unchanged.
+var settingsMigrations = []settingsMigration{}
+
+// settingsError is a rejected value, from the settings file or /setSettings.
+type settingsError struct {
+	Time   time.Time
+	Source string // "file" or "api"
+	Key    string
+	Error  string
+}
+
+var settingsErrors = make([]settingsError, 0)
+var settingsErrorsMutex = &sync.Mutex{}
+
+func addSettingsError(source, key, format string, a ...interface{}) {
+	e := settingsError{Time: time.Now().UTC(), Source: source, Key: key, Error: fmt.Sprintf(format, a...)}
+	log.Printf("settings: %s %s: %s\n", source, key, e.Error)
+	settingsErrorsMutex.Lock()
+	settingsErrors = append(settingsErrors, e)
+	if len(settingsErrors) > settingsErrorsMax {
+		settingsErrors = settingsErrors[len(settingsErrors)-settingsErrorsMax:]
+	}
+	settingsErrorsMutex.Unlock()
+}
+
+// settingsValidationError reports a value rejected by applySettingsMap().
+func settingsValidationError(key, format string, a ...interface{}) {
+	addSettingsError("api", key, format, a...)
+}
+
+// checkSettingType rejects scalar values of the wrong JSON type before applySettingsMap() asserts them.
+// Other fields (lists, objects) are decoded and checked by their own case.
+func checkSettingType(key string, val interface{}) bool {
+	field := reflect.ValueOf(globalSettings).FieldByName(key)
+	if !field.IsValid() {
+		return true // Unknown keys are logged by applySettingsMap()
+	}
+	var ok bool
+	switch field.Kind() {
+	case reflect.Bool:
+		_, ok = val.(bool)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		_, ok = val.(float64)
+	case reflect.String:
+		_, ok = val.(string)
+	default:
+		return true
+	}
+	if !ok {
+		settingsValidationError(key, "wrong type %T, expected %s", val, field.Kind())
+	}
+	return ok
+}
+
+// sanitizeSettings normalizes values from the settings file the way applySettingsMap() does for /setSettings.
+func sanitizeSettings(s *settings) {
+	s.AudioDevice = strings.TrimSpace(s.AudioDevice)
+	s.AudioBluetoothSink = strings.TrimSpace(s.AudioBluetoothSink)
+	s.OGNDashboardAddr = strings.TrimSpace(s.OGNDashboardAddr)
+	s.TowTargetId = strings.ToUpper(strings.TrimSpace(s.TowTargetId))
+	s.AlarmPreset = strings.ToLower(s.AlarmPreset)
+	s.WeatherUplinkRegion = strings.ToLower(s.WeatherUplinkRegion)
+	s.FlarmHwVersion = flarmVersionField(s.FlarmHwVersion)
+	s.FlarmSwVersion = flarmVersionField(s.FlarmSwVersion)
+	s.FlarmObstVersion = flarmVersionField(s.FlarmObstVersion)
+	s.RemoteSDR1090 = strings.TrimSpace(s.RemoteSDR1090)
+	s.RemoteSDR978 = strings.TrimSpace(s.RemoteSDR978)
+	s.RemoteSDR868 = strings.TrimSpace(s.RemoteSDR868)
+	s.AirConnectPasscode = strings.TrimSpace(s.AirConnectPasscode)
+	s.NMEASerialOut_Device = strings.TrimSpace(s.NMEASerialOut_Device)
+	s.AltEncoder_Device = strings.TrimSpace(s.AltEncoder_Device)
+	s.BluetoothName = strings.TrimSpace(s.BluetoothName)
+	for i := range s.AirspaceWarningCategories {
+		s.AirspaceWarningCategories[i] = strings.ToUpper(s.AirspaceWarningCategories[i])
+	}
+	for i, f := range s.NMEAClientFilters {
+		for k := range f.Only {
+			s.NMEAClientFilters[i].Only[k] = strings.ToUpper(strings.TrimSpace(f.Only[k]))
+		}
+		for k := range f.Drop {
+			s.NMEAClientFilters[i].Drop[k] = strings.ToUpper(strings.TrimSpace(f.Drop[k]))
+		}
+	}
+}
+
+// isValidDevicePath accepts a device file, or "" for none.
+func isValidDevicePath(dev string) bool {
+	return len(dev) == 0 || strings.HasPrefix(dev, "/dev/")
+}
+
+// validateSettings resets values that are out of range to their default.
+func validateSettings(s *settings, def *settings) []settingsError {
+	var errs []settingsError
+	reset := func(key, format string, a ...interface{}) {
+		reflect.ValueOf(s).Elem().FieldByName(key).Set(reflect.ValueOf(def).Elem().FieldByName(key))
+		errs = append(errs, settingsError{Key: key, Error: fmt.Sprintf(format, a...) + ", using the default"})
+	}
+	if !isValidNMEAOutRate(s.NMEAOutRate) {
+		reset("NMEAOutRate", "invalid NMEA output rate %d", s.NMEAOutRate)
+	}
+	if s.LowAlarmAGL < 0 {
+		reset("LowAlarmAGL", "negative height %d", s.LowAlarmAGL)
+	}
+	if s.TakeoffAlarmTime < 0 {
+		reset("TakeoffAlarmTime", "negative time %d", s.TakeoffAlarmTime)
+	}
+	if s.LowAlarmMaxLevel < 0 || s.LowAlarmMaxLevel > 3 {
+		reset("LowAlarmMaxLevel", "invalid alarm level %d", s.LowAlarmMaxLevel)
+	}
+	if _, ok := alarmPresets[s.AlarmPreset]; !ok && s.AlarmPreset != ALARM_PRESET_CUSTOM {
+		reset("AlarmPreset", "unknown alarm preset %s", s.AlarmPreset)
+	}
+	if s.AlarmPreset == ALARM_PRESET_CUSTOM && !validAlarmProfile(s.AlarmCustom) {
+		reset("AlarmCustom", "inconsistent alarm thresholds")
+	}
+	if _, ok := weatherRegionPacks[s.WeatherUplinkRegion]; !ok && len(s.WeatherUplinkRegion) > 0 {
+		reset("WeatherUplinkRegion", "unknown weather uplink region %s", s.WeatherUplinkRegion)
+	}
+	if s.FlarmProtocolVersion != 8 && s.FlarmProtocolVersion != 9 {
+		reset("FlarmProtocolVersion", "unsupported FLARM protocol version %d", s.FlarmProtocolVersion)
+	}
+	if s.AntennaGainOffset < -20 || s.AntennaGainOffset > 20 {
+		reset("AntennaGainOffset", "gain offset %d dB out of range (-20 to 20)", s.AntennaGainOffset)
+	}
+	if s.FlarmMaxSentences < 0 {
+		reset("FlarmMaxSentences", "negative sentence rate %d", s.FlarmMaxSentences)
+	}
+	if s.FlarmPriorityTargets < 0 {
+		reset("FlarmPriorityTargets", "negative target count %d", s.FlarmPriorityTargets)
+	}
+	if s.NMEABaroPriority < NMEA_BARO_PRIORITY_LOW || s.NMEABaroPriority > NMEA_BARO_PRIORITY_HIGHEST {
+		reset("NMEABaroPriority", "invalid priority %d", s.NMEABaroPriority)
+	}
+	if s.AirspaceWarningDistance < 0 {
+		reset("AirspaceWarningDistance", "negative distance %d", s.AirspaceWarningDistance)
+	}
+	if s.AirspaceWarningVertical < 0 {
+		reset("AirspaceWarningVertical", "negative height %d", s.AirspaceWarningVertical)
+	}
+	if s.TerrainClearance < 0 {
+		reset("TerrainClearance", "negative height %d", s.TerrainClearance)
+	}
+	if s.NMEAOutUDPBroadcastPort < 1 || s.NMEAOutUDPBroadcastPort > 65535 {
+		reset("NMEAOutUDPBroadcastPort", "invalid port %d", s.NMEAOutUDPBroadcastPort)
+	}
+	if s.NMEAInUDPPort < 0 || s.NMEAInUDPPort > 65535 {
+		reset("NMEAInUDPPort", "invalid port %d", s.NMEAInUDPPort)
+	}
+	if s.OGNTxPower < ognTrackerTxPowerMin || s.OGNTxPower > ognTrackerTxPowerMax {
+		reset("OGNTxPower", "invalid TX power %d dBm", s.OGNTxPower)
+	}
+	if len(s.AirConnectPasscode) == 0 || len(s.AirConnectPasscode) > 16 {
+		reset("AirConnectPasscode", "passcode must have 1 to 16 characters")
+	}
+	if !isValidNMEASerialBaud(s.NMEASerialOut_Baud) {
+		reset("NMEASerialOut_Baud", "unsupported baud rate %d", s.NMEASerialOut_Baud)
+	}
+	if !isValidAltEncoderBaud(s.AltEncoder_Baud) {
+		reset("AltEncoder_Baud", "unsupported baud rate %d", s.AltEncoder_Baud)
+	}
+	if s.AltEncoder_Format != ALT_ENCODER_ICARUS && s.AltEncoder_Format != ALT_ENCODER_TRANSCAL {
+		reset("AltEncoder_Format", "unknown format %d", s.AltEncoder_Format)
+	}
+	if !isValidBluetoothName(s.BluetoothName) {
+		reset("BluetoothName", "name must have 1 to %d printable ASCII characters", bluetoothNameMaxLen)
+	}
+	if !isKnownLocale(s.Locale) {
+		reset("Locale", "unknown locale %s", s.Locale)
+	}
+	if !isValidDevicePath(s.NMEASerialOut_Device) {
+		reset("NMEASerialOut_Device", "not a device: %s", s.NMEASerialOut_Device)
+	}
+	if !isValidDevicePath(s.AltEncoder_Device) {
+		reset("AltEncoder_Device", "not a device: %s", s.AltEncoder_Device)
+	}
+	for key, remote := range map[string]string{"RemoteSDR1090": s.RemoteSDR1090, "RemoteSDR978": s.RemoteSDR978, "RemoteSDR868": s.RemoteSDR868} {
+		if _, _, err := parseRemoteSDR(remote); err != nil && len(remote) > 0 {
+			reset(key, "%s", err.Error())
+		}
+	}
+	if _, err := flarmConfigValuesFromJSON(s.FlarmConfigValues); err != nil {
+		reset("FlarmConfigValues", "%s", err.Error())
+	}
+	for _, f := range s.NMEAClientFilters {
+		if err := validNMEAClientFilter(f); err != nil {
+			reset("NMEAClientFilters", "filter %s: %s", f.Client, err.Error())
+			break
+		}
+	}
+	return errs
+}
+
+// settingsJSONNames returns the JSON names of all settings that are stored in the file.
+func settingsJSONNames() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(settings{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" && f.Tag.Get("json") != "-" {
+			names[f.Name] = true
+		}
+	}
+	return names
+}
+
+// loadSettingsJSON upgrades a settings file to the current schema and applies it on top of the defaults.
+// Sets globalSettings, an error means the file couldn't be parsed at all. migrated: the file should be rewritten.
+func loadSettingsJSON(buf []byte) (migrated bool, err error) {
+	var m map[string]interface{}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return
+	}
+	version := 0
+	if v, ok := m["SettingsVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > settingsSchemaVersion {
+		log.Printf("settings: file is from a newer version (schema %d, we have %d)\n", version, settingsSchemaVersion)
+	}
+	for _, mig := range settingsMigrations {
+		if mig.Version > version {
+			log.Printf("settings: migrating to schema %d: %s\n", mig.Version, mig.Description)
+			mig.Migrate(m)
+			migrated = true
+		}
+	}
+	delete(m, "SettingsVersion")
+
+	globalSettings = settings{}
+	defaultSettings()
+	def := globalSettings
+	// A second set of defaults to decode into: a copy of def would share its slices and maps, and decoding
+	// into those changes the defaults used for resets below.
+	globalSettings = settings{}
+	defaultSettings()
+	s := globalSettings
+	known := settingsJSONNames()
+	var errs []settingsError
+	for key, val := range m {
+		if !known[key] {
+			log.Printf("settings: ignoring unknown setting %s\n", key)
+			continue
+		}
+		j, _ := json.Marshal(map[string]interface{}{key: val})
+		if err := json.Unmarshal(j, &s); err != nil {
+			reflect.ValueOf(&s).Elem().FieldByName(key).Set(reflect.ValueOf(def).FieldByName(key))
+			errs = append(errs, settingsError{Key: key, Error: err.Error() + ", using the default"})
+		}
+	}
+	sanitizeSettings(&s)
+	errs = append(errs, validateSettings(&s, &def)...)
+	s.SettingsVersion = settingsSchemaVersion
+	globalSettings = s
+
+	for _, e := range errs {
+		addSettingsError("file", e.Key, "%s", e.Error)
+	}
+	if len(errs) > 0 {
+		addSingleSystemErrorf("settings-invalid", "%d invalid settings in %s were reset to their defaults, see the settings page", len(errs), configLocation)
+	}
+	return
+}
+
+// AJAX call - /getSettingsErrors. Responds with the recently rejected settings values, POST clears them.
+func handleSettingsErrorsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	settingsErrorsMutex.Lock()
+	if r.Method == "POST" {
+		settingsErrors = make([]settingsError, 0)
+	}
+	errsJSON, _ := json.Marshal(settingsErrors)
+	settingsErrorsMutex.Unlock()
+	fmt.Fprintf(w, "%s\n", errsJSON)
+}
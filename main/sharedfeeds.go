@@ -0,0 +1,148 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sharedfeeds.go: Privacy policies for feeds that publish our own position to third parties
+		(community aggregators, club dashboards). Each feed can have its position truncated to
+		a coarse grid and/or delayed. This only affects the publishing layer - cockpit outputs
+		(GDL90, FLARM NMEA, web UI) always get full precision.
+		MLAT is deliberately not covered: the server needs the exact receiver position.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Feed names for globalSettings.SharedFeedPolicies
+const (
+	FEED_OGN_APRS      = "OGNAPRS"
+	FEED_OGN_DASHBOARD = "OGNDashboard"
+)
+
+const maxSharedFeedDelay = 900 // seconds of position history we keep
+
+type sharedFeedPolicy struct {
+	Feed      string // One of the FEED_* names
+	Precision int    // Position resolution in meters. 0 = full precision
+	Delay     int    // Seconds. 0 = real time
+	AltHAE    bool   // Publish height above ellipsoid instead of MSL altitude
+}
+
+type sharedFeedPosition struct {
+	Time     time.Time // stratuxClock
+	Lat      float64
+	Lon      float64
+	AltFt    float32 // MSL, or HAE if the policy says so
+	Track    float32
+	Speed    float64 // kt
+	VSpeed   float32 // ft/min
+	TurnRate float64 // deg/s
+	hae      float32 // ft, height above ellipsoid
+}
+
+var sharedFeedMutex = &sync.Mutex{}
+var sharedFeedHistory = make([]sharedFeedPosition, 0, maxSharedFeedDelay+1)
+
+func sharedFeedPolicyFor(feed string) sharedFeedPolicy {
+	for _, p := range globalSettings.SharedFeedPolicies {
+		if p.Feed == feed {
+			return p
+		}
+	}
+	return sharedFeedPolicy{Feed: feed}
+}
+
+func currentSharedFeedPosition() sharedFeedPosition {
+	mySituation.muGPS.Lock()
+	defer mySituation.muGPS.Unlock()
+	return sharedFeedPosition{
+		Time:     stratuxClock.Time,
+		Lat:      float64(mySituation.GPSLatitude),
+		Lon:      float64(mySituation.GPSLongitude),
+		AltFt:    mySituation.GPSAltitudeMSL,
+		Track:    mySituation.GPSTrueCourse,
+		Speed:    mySituation.GPSGroundSpeed,
+		VSpeed:   mySituation.GPSVerticalSpeed * 60, // ft/s -> ft/min
+		TurnRate: mySituation.GPSTurnRate,
+		hae:      mySituation.GPSHeightAboveEllipsoid,
+	}
+}
+
+// truncatePosition snaps the position to the center of a grid cell of the given size.
+func truncatePosition(pos *sharedFeedPosition, meters int) {
+	if meters <= 0 {
+		return
+	}
+	latStep := float64(meters) / 111320.0
+	lat := (math.Floor(pos.Lat/latStep) + 0.5) * latStep
+	// Use the cell's latitude for the longitude step, so the grid doesn't depend on the exact position.
+	lonStep := latStep / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	pos.Lat = lat
+	pos.Lon = (math.Floor(pos.Lon/lonStep) + 0.5) * lonStep
+	// Don't give away more altitude precision than position precision.
+	altStep := float32(math.Min(float64(meters)*3.28084, 500))
+	pos.AltFt = float32(math.Round(float64(pos.AltFt/altStep))) * altStep
+}
+
+/*
+sharedFeedPositionFor returns our position as it may be published on the given feed.
+ok is false if there is nothing to publish yet (no GPS, or not enough history for the delay).
+*/
+func sharedFeedPositionFor(feed string) (pos sharedFeedPosition, ok bool) {
+	policy := sharedFeedPolicyFor(feed)
+	delay := policy.Delay
+	if delay > maxSharedFeedDelay {
+		delay = maxSharedFeedDelay
+	}
+	if delay <= 0 {
+		if !isGPSValid() {
+			return pos, false
+		}
+		pos = currentSharedFeedPosition()
+	} else {
+		sharedFeedMutex.Lock()
+		for i := len(sharedFeedHistory) - 1; i >= 0; i-- {
+			if stratuxClock.Since(sharedFeedHistory[i].Time) >= time.Duration(delay)*time.Second {
+				pos, ok = sharedFeedHistory[i], true
+				break
+			}
+		}
+		sharedFeedMutex.Unlock()
+		if !ok {
+			return pos, false
+		}
+	}
+	if policy.AltHAE {
+		pos.AltFt = pos.hae
+	}
+	truncatePosition(&pos, policy.Precision)
+	return pos, true
+}
+
+// sharedFeedRecorder keeps the position history for delayed feeds.
+func sharedFeedRecorder() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		sharedFeedMutex.Lock()
+		// Drop everything older than the maximum delay, and the whole history on GPS loss.
+		// We don't want a delayed feed to publish a position while we don't know where we are now.
+		cut := 0
+		for cut < len(sharedFeedHistory) && stratuxClock.Since(sharedFeedHistory[cut].Time) > (maxSharedFeedDelay+1)*time.Second {
+			cut++
+		}
+		sharedFeedHistory = sharedFeedHistory[cut:]
+		if isGPSValid() {
+			sharedFeedHistory = append(sharedFeedHistory, currentSharedFeedPosition())
+		} else if len(sharedFeedHistory) > 0 {
+			sharedFeedHistory = sharedFeedHistory[:0]
+		}
+		sharedFeedMutex.Unlock()
+	}
+}
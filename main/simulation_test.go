@@ -0,0 +1,382 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	simulation_test.go: Deterministic simulation harness for the tests of alarm logic, FLARM sentence
+		generation and traffic expiration. Almost everything in stratux works on global singletons, so
+		instead of abstracting all of them away, the harness replaces what feeds them:
+		- Clock:   stratuxClock is a manually advanced monotonic (no ticker goroutine)
+		- GPS:     a simGPS produces NMEA sentences that go through processNMEALine()
+		- Sensors: fake sensors.PressureReader/IMUReader, sampled via pressureSampler
+		- SDRs:    a simSDR produces raw receiver lines (dump978, dump1090 JSON, ogn-rx-eu JSON)
+		           that go through the same parsers as the real receiver connections
+
+		Usage:
+			h := newSimHarness(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+			h.GPS = &fakeGPS{Lat: 48.0, Lng: 11.0, AltMSL: 3000, Track: 90, Speed: 100}
+			h.SDRs = append(h.SDRs, &fakeTarget{Addr: 0xABCDEF, Class: MSGCLASS_ES, Lat: 48.01, Lng: 11.0, Alt: 3200, Track: 270, Speed: 90})
+			h.Run(10 * time.Second)
+			targets := h.Traffic()
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"../sensors"
+)
+
+// Simulated inputs, polled by the harness at their rate.
+type simGPS interface {
+	Sentences(t time.Time) []string // NMEA sentences (without checksum) describing the position at UTC time t
+}
+
+type simSDR interface {
+	Messages(t time.Time) []simMessage // Receiver output at UTC time t
+}
+
+type simMessage struct {
+	Class uint8  // MSGCLASS_UAT, MSGCLASS_ES or MSGCLASS_OGN
+	Data  string // Line as sent by dump978/dump1090/ogn-rx-eu
+}
+
+// newFakeClock returns a stratux clock that only moves when advanced.
+func newFakeClock(realTime time.Time) *monotonic {
+	m := &monotonic{}
+	m.SetRealTimeReference(realTime)
+	return m
+}
+
+// advance moves a clock created by newFakeClock forward.
+func (m *monotonic) advance(d time.Duration) {
+	m.Milliseconds += uint64(d / time.Millisecond)
+	m.Time = m.Time.Add(d)
+	m.RealTime = m.RealTime.Add(d)
+}
+
+func simNmeaLatLng(lat, lng float64) string {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns, lat = "S", -lat
+	}
+	if lng < 0 {
+		ew, lng = "W", -lng
+	}
+	latDeg, lngDeg := math.Floor(lat), math.Floor(lng)
+	return fmt.Sprintf("%02.0f%07.4f,%s,%03.0f%07.4f,%s", latDeg, (lat-latDeg)*60, ns, lngDeg, (lng-lngDeg)*60, ew)
+}
+
+// fakeGPS flies a straight line with constant speed and vertical speed.
+type fakeGPS struct {
+	Lat, Lng   float64
+	AltMSL     float64 // ft
+	Track      float64 // deg true
+	Speed      float64 // kts
+	Vvel       float64 // ft/min
+	Satellites int     // 0 = 10
+	NoFix      bool
+	last       time.Time
+}
+
+func (g *fakeGPS) move(t time.Time) {
+	if !g.last.IsZero() {
+		dt := t.Sub(g.last).Seconds()
+		g.Lat, g.Lng = currentGeodesy().Direct(g.Lat, g.Lng, g.Track, g.Speed*1852/3600*dt)
+		g.AltMSL += g.Vvel / 60 * dt
+	}
+	g.last = t
+}
+
+func (g *fakeGPS) Sentences(t time.Time) []string {
+	g.move(t)
+	sats := g.Satellites
+	if sats == 0 {
+		sats = 10
+	}
+	quality, status := 1, "A"
+	if g.NoFix {
+		quality, status = 0, "V"
+	}
+	pos := simNmeaLatLng(g.Lat, g.Lng)
+	return []string{
+		fmt.Sprintf("GPRMC,%s.00,%s,%s,%.1f,%.1f,%s,,,A", t.Format("150405"), status, pos, g.Speed, g.Track, t.Format("020106")),
+		fmt.Sprintf("GPGGA,%s.00,%s,%d,%02d,0.9,%.1f,M,47.0,M,,", t.Format("150405"), pos, quality, sats, g.AltMSL/3.28084),
+	}
+}
+
+// fakeTarget is a traffic target flying a straight line, received by 1090ES or OGN.
+type fakeTarget struct {
+	Addr   uint32
+	Class  uint8 // MSGCLASS_ES or MSGCLASS_OGN
+	Lat    float64
+	Lng    float64
+	Alt    float64 // ft, pressure altitude for ES, MSL for OGN
+	Track  float64 // deg true
+	Speed  float64 // kts
+	Vvel   float64 // ft/min
+	Silent bool    // Stop transmitting, e.g. to test expiration
+	last   time.Time
+}
+
+func (ft *fakeTarget) Messages(t time.Time) []simMessage {
+	if !ft.last.IsZero() {
+		dt := t.Sub(ft.last).Seconds()
+		ft.Lat, ft.Lng = currentGeodesy().Direct(ft.Lat, ft.Lng, ft.Track, ft.Speed*1852/3600*dt)
+		ft.Alt += ft.Vvel / 60 * dt
+	}
+	ft.last = t
+	if ft.Silent {
+		return nil
+	}
+	var data []byte
+	if ft.Class == MSGCLASS_OGN {
+		data, _ = json.Marshal(OgnMessage{
+			Sys:       "FLR",
+			Addr:      fmt.Sprintf("%06X", ft.Addr),
+			Addr_type: 2,
+			Acft_type: "1",
+			Lat_deg:   float32(ft.Lat),
+			Lon_deg:   float32(ft.Lng),
+			Alt_msl_m: float32(ft.Alt / 3.28084),
+			Track_deg: ft.Track,
+			Speed_mps: ft.Speed * 1852 / 3600,
+			Climb_mps: ft.Vvel / 196.85,
+		})
+	} else {
+		lat, lng := float32(ft.Lat), float32(ft.Lng)
+		alt := int(ft.Alt)
+		vvel := int16(ft.Vvel)
+		speed := uint16(ft.Speed)
+		track := uint16(ft.Track)
+		nacp := 9
+		data, _ = json.Marshal(dump1090Data{
+			Icao_addr:      ft.Addr,
+			DF:             17,
+			TypeCode:       11,
+			Lat:            &lat,
+			Lng:            &lng,
+			Position_valid: true,
+			NACp:           &nacp,
+			Alt:            &alt,
+			Vvel:           &vvel,
+			Speed_valid:    true,
+			Speed:          &speed,
+			Track:          &track,
+			Timestamp:      t,
+		})
+	}
+	return []simMessage{{ft.Class, string(data)}}
+}
+
+// fakePressureReader implements sensors.PressureReader with fixed values.
+type fakePressureReader struct {
+	Press float64 // hPa
+	Temp  float64 // deg C
+	Err   error   // Returned by all reads if set
+}
+
+func (p *fakePressureReader) Temperature() (float64, error) { return p.Temp, p.Err }
+func (p *fakePressureReader) Pressure() (float64, error)    { return p.Press, p.Err }
+func (p *fakePressureReader) Close()                        {}
+
+// fakeIMUReader implements sensors.IMUReader with fixed values (level, unaccelerated flight by default).
+type fakeIMUReader struct {
+	G   [3]float64 // deg/s
+	A   [3]float64 // G
+	M   [3]float64
+	Err error
+}
+
+func (r *fakeIMUReader) Read() (int64, float64, float64, float64, float64, float64, float64, float64, float64, float64, error, error) {
+	return stratuxClock.Time.UnixNano(), r.G[0], r.G[1], r.G[2], r.A[0], r.A[1], r.A[2], r.M[0], r.M[1], r.M[2], r.Err, r.Err
+}
+
+func (r *fakeIMUReader) ReadOne() (int64, float64, float64, float64, float64, float64, float64, float64, float64, float64, error, error) {
+	return r.Read()
+}
+
+func (r *fakeIMUReader) Close() {}
+
+type simHarness struct {
+	Clock *monotonic
+	GPS   simGPS
+	SDRs  []simSDR
+	Step  time.Duration // Clock resolution of Run, default 100ms
+
+	start    time.Time
+	pressure *pressureSampler
+	sent     []networkMessage
+}
+
+/*
+newSimHarness resets the global state to a freshly started stratux with default settings
+and a fake clock at the given UTC time. No receivers or senders are started, everything happens in Run.
+*/
+func newSimHarness(start time.Time) *simHarness {
+	stratuxClock = newFakeClock(start)
+	gpsSetsSystemTime = false
+
+	mySituation = SituationData{}
+	mySituation.muGPS = &sync.Mutex{}
+	mySituation.muGPSPerformance = &sync.Mutex{}
+	mySituation.muAttitude = &sync.Mutex{}
+	mySituation.muBaro = &sync.Mutex{}
+	mySituation.muWind = &sync.Mutex{}
+	mySituation.muAirfield = &sync.Mutex{}
+	mySituation.muTerrain = &sync.Mutex{}
+	mySituation.muSatellite = &sync.Mutex{}
+	baroReadings = make(map[uint8]baroReading)
+
+	systemErrsMutex = &sync.Mutex{}
+	systemErrs = make(map[string]string)
+	ADSBTowerMutex = &sync.Mutex{}
+	msgLog = make([]msg, 0)
+
+	if trafficUpdate == nil {
+		trafficUpdate = NewUIBroadcaster()
+		situationUpdate = NewUIBroadcaster()
+		weatherRawUpdate = NewUIBroadcaster()
+	}
+
+	globalStatus = status{}
+	defaultSettings()
+	traffic = make(map[uint32]TrafficInfo)
+	seenTraffic = make(map[uint32]bool)
+	trafficMutex = &sync.Mutex{}
+	OwnshipTrafficInfo = TrafficInfo{}
+	flarmSentAlarmLevels = make(map[uint32]uint8)
+	airborneState = AIRBORNE_UNKNOWN
+	airborneGroundAltValid = false
+	airborneTakeoffAt = time.Time{}
+	degradedModes = 0
+	gpsValidity = GPS_VALIDITY_NOFIX
+	gpsValiditySince = time.Time{}
+
+	// Nothing reads the network queue, Run collects what would have been sent
+	messageQueue = make(chan networkMessage, 1024)
+
+	return &simHarness{Clock: stratuxClock, Step: 100 * time.Millisecond, start: start}
+}
+
+// SetPressureReader installs a (fake) pressure sensor that is sampled on every step.
+func (h *simHarness) SetPressureReader(r sensors.PressureReader) {
+	myPressureReader = r
+	globalStatus.BMPConnected = true
+	h.pressure = newPressureSampler(r, h.Step.Seconds())
+}
+
+// SetIMUReader installs a (fake) IMU.
+func (h *simHarness) SetIMUReader(r sensors.IMUReader) {
+	myIMUReader = r
+	globalStatus.IMUConnected = true
+}
+
+// Now returns the simulated UTC time.
+func (h *simHarness) Now() time.Time {
+	return h.start.Add(h.Clock.Since(time.Time{}))
+}
+
+// Inject feeds a single receiver line through the matching parser.
+func (h *simHarness) Inject(m simMessage) {
+	switch m.Class {
+	case MSGCLASS_UAT:
+		parseInput(m.Data)
+	case MSGCLASS_ES:
+		parseDump1090Message(m.Data)
+	case MSGCLASS_OGN:
+		var ognMsg OgnMessage
+		if err := json.Unmarshal([]byte(m.Data), &ognMsg); err == nil {
+			importOgnTrafficMessage(ognMsg, []byte(m.Data), time.Now())
+		}
+	}
+}
+
+/*
+Run advances the clock by d in steps of h.Step. GPS and SDR inputs are polled once per
+simulated second, the pressure sensor on every step, and the traffic table is aged and
+cleaned up like the 1 Hz traffic sender does (without sending anything). What stratux sends
+on its own, e.g. the FLARM fast path, is collected for Sent().
+*/
+func (h *simHarness) Run(d time.Duration) {
+	end := h.Clock.Time.Add(d)
+	for h.Clock.Time.Before(end) {
+		h.Clock.advance(h.Step)
+		if h.pressure != nil && !h.pressure.sample() {
+			h.pressure = nil
+			globalStatus.BMPConnected = false
+		}
+		h.collectSent()
+		if h.Clock.Milliseconds%1000 != 0 {
+			continue
+		}
+		now := h.Now()
+		if h.GPS != nil {
+			globalStatus.GPS_connected = true
+			for _, s := range h.GPS.Sentences(now) {
+				processNMEALine(appendNMEAChecksum(s))
+			}
+			isGPSValid() // The validity state machine advances when it's checked, by the 1Hz senders in stratux
+		}
+		for _, sdr := range h.SDRs {
+			for _, m := range sdr.Messages(now) {
+				h.Inject(m)
+			}
+		}
+		trafficMutex.Lock()
+		cleanupOldEntries()
+		trafficMutex.Unlock()
+		h.collectSent()
+	}
+}
+
+func (h *simHarness) collectSent() {
+	for {
+		select {
+		case m := <-messageQueue:
+			h.sent = append(h.sent, m)
+		default:
+			return
+		}
+	}
+}
+
+// Sent returns the messages of a NETWORK_* type that were sent since the last call, e.g. the FLARM fast path.
+func (h *simHarness) Sent(msgType uint8) (msgs []string) {
+	h.collectSent()
+	for _, m := range h.sent {
+		if m.msgType == msgType {
+			msgs = append(msgs, string(m.msg))
+		}
+	}
+	h.sent = nil
+	return
+}
+
+// Traffic returns a copy of the traffic table.
+func (h *simHarness) Traffic() map[uint32]TrafficInfo {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	result := make(map[uint32]TrafficInfo, len(traffic))
+	for k, ti := range traffic {
+		result[k] = ti
+	}
+	return result
+}
+
+// FlarmSentences returns the PFLAA output for the current traffic table.
+func (h *simHarness) FlarmSentences() (pflaa []string) {
+	for _, ti := range h.Traffic() {
+		msg, valid, _ := makeFlarmPFLAAString(ti)
+		if valid {
+			pflaa = append(pflaa, msg)
+		}
+	}
+	return
+}
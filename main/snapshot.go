@@ -0,0 +1,129 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	snapshot.go: Immutable snapshots of the shared situation and traffic state for the output
+		encoders. mySituation and the traffic map are updated by many goroutines under several
+		mutexes. Encoders that read them field by field without locking can observe torn state
+		(e.g. latitude of one fix and longitude of the next). Instead, consistent copies are
+		published over atomic pointers and the encoders work on those.
+		A snapshot must never be modified after it has been published.
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type situationSnapshot struct {
+	SituationData
+	GPSValid            bool // isGPSValid() at the time of the snapshot
+	GPSGroundTrackValid bool // isGPSGroundTrackValid() at the time of the snapshot
+	BaroValid           bool // isTempPressValid() at the time of the snapshot
+}
+
+type trafficSnapshot struct {
+	Targets           []TrafficInfo
+	Ownship           TrafficInfo // Our own transponder, as detected by isOwnshipTrafficInfo()
+	Count             int         // Number of targets sent to the EFBs in the last update
+	HighestAlarmLevel uint8       // Highest FLARM alarm level in the last update
+}
+
+var publishedSituation atomic.Value // *situationSnapshot
+var publishedTraffic atomic.Value   // *trafficSnapshot
+
+// situationMutexes returns the mutexes of mySituation in lock order. Writers that hold more than one
+// (parseNMEALine: muGPS, then muGPSPerformance or muSatellite) take them in this order as well.
+func situationMutexes() []*sync.Mutex {
+	return []*sync.Mutex{mySituation.muGPS, mySituation.muGPSPerformance, mySituation.muSatellite, mySituation.muBaro,
+		mySituation.muAttitude, mySituation.muWind, mySituation.muAirfield, mySituation.muTerrain}
+}
+
+// takeSituationSnapshot copies mySituation with all of its mutexes held, so no field is from a different update.
+// It only reads: the GPS validity is the one of the last isGPSValid() call, see situationPublisher().
+func takeSituationSnapshot() *situationSnapshot {
+	s := &situationSnapshot{}
+	mutexes := situationMutexes()
+	for _, mu := range mutexes {
+		mu.Lock()
+	}
+	s.SituationData = mySituation
+	s.BaroValid = isTempPressValid()
+	for i := len(mutexes) - 1; i >= 0; i-- {
+		mutexes[i].Unlock()
+	}
+
+	s.GPSValid = gpsValidityCurrent()
+	fixPresent := stratuxClock.Since(s.GPSLastFixLocalTime) < gpsFixTimeout && globalStatus.GPS_connected && s.GPSFixQuality > 0
+	if !s.GPSValid && !fixPresent {
+		// As isGPSValid() reports a lost fix, but only in the copy (see gpsFixPresent())
+		s.GPSFixQuality = 0
+		s.GPSSatellites = 0
+		s.GPSHorizontalAccuracy = 999999
+		s.GPSVerticalAccuracy = 999999
+		s.GPSNACp = 0
+	}
+	s.GPSGroundTrackValid = s.GPSValid && s.GPSHorizontalAccuracy < 30
+	return s
+}
+
+func publishSituationSnapshot() {
+	publishedSituation.Store(takeSituationSnapshot())
+}
+
+// getSituation returns the latest situation snapshot (at most 100ms old).
+func getSituation() *situationSnapshot {
+	if s, ok := publishedSituation.Load().(*situationSnapshot); ok {
+		return s
+	}
+	return takeSituationSnapshot()
+}
+
+// ownshipAltitude is the snapshot variant of ownshipAltitude() in altitude.go.
+func (s *situationSnapshot) ownshipAltitude() (alt float32, isBaro bool, valid bool) {
+	if s.BaroValid && !isDegraded(DEGRADED_NO_BARO) {
+		return s.BaroPressureAltitude, true, true
+	}
+	if s.GPSValid {
+		return s.GPSAltitudeMSL, false, true
+	}
+	return 0, false, false
+}
+
+// publishTrafficSnapshot is called at the end of sendTrafficUpdates(), with trafficMutex held.
+func publishTrafficSnapshot(count int, highestAlarmLevel uint8) {
+	snap := &trafficSnapshot{
+		Targets:           make([]TrafficInfo, 0, len(traffic)),
+		Ownship:           OwnshipTrafficInfo,
+		Count:             count,
+		HighestAlarmLevel: highestAlarmLevel,
+	}
+	for _, ti := range traffic {
+		snap.Targets = append(snap.Targets, ti)
+	}
+	publishedTraffic.Store(snap)
+}
+
+func getTrafficSnapshot() *trafficSnapshot {
+	if s, ok := publishedTraffic.Load().(*trafficSnapshot); ok {
+		return s
+	}
+	return &trafficSnapshot{Targets: make([]TrafficInfo, 0)}
+}
+
+func situationPublisher() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for {
+		// Advance the GPS validity state (see gpsvalidity.go), the snapshot only reads it
+		mySituation.muGPS.Lock()
+		isGPSValid()
+		mySituation.muGPS.Unlock()
+		publishSituationSnapshot()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,93 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	snapshot_test.go: Situation snapshots against concurrent writers. Run with the race detector,
+		see the gotest target in the Makefile.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Writers update related fields together under their mutex. A snapshot must never show half of an update.
+func TestSituationSnapshotConsistent(t *testing.T) {
+	newSimHarness(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	writer := func(mu *sync.Mutex, set func(v float32)) {
+		defer wg.Done()
+		for v := float32(1); ; v++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mu.Lock()
+			set(v)
+			mu.Unlock()
+		}
+	}
+	wg.Add(3)
+	go writer(mySituation.muGPS, func(v float32) {
+		mySituation.GPSLatitude = v
+		mySituation.GPSLongitude = v
+	})
+	go writer(mySituation.muBaro, func(v float32) {
+		mySituation.BaroPressureAltitude = v
+		mySituation.BaroIndicatedAltitude = v
+	})
+	go writer(mySituation.muAttitude, func(v float32) {
+		mySituation.AHRSPitch = float64(v)
+		mySituation.AHRSRoll = float64(v)
+	})
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 10000; i++ {
+		s := takeSituationSnapshot()
+		if s.GPSLatitude != s.GPSLongitude {
+			t.Fatalf("torn GPS position: lat %f, lng %f", s.GPSLatitude, s.GPSLongitude)
+		}
+		if s.BaroPressureAltitude != s.BaroIndicatedAltitude {
+			t.Fatalf("torn baro altitude: %f, %f", s.BaroPressureAltitude, s.BaroIndicatedAltitude)
+		}
+		if s.AHRSPitch != s.AHRSRoll {
+			t.Fatalf("torn attitude: pitch %f, roll %f", s.AHRSPitch, s.AHRSRoll)
+		}
+	}
+}
+
+// Taking a snapshot must not change the GPS state. A lost fix is only reported in the copy.
+func TestSituationSnapshotReadOnly(t *testing.T) {
+	newSimHarness(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	mySituation.GPSFixQuality = 1
+	mySituation.GPSSatellites = 8
+	mySituation.GPSHorizontalAccuracy = 5
+	mySituation.GPSNACp = 10
+	// GPSLastFixLocalTime is zero: the fix is long gone, isGPSValid() would reset the fields above.
+	stateBefore, transitionsBefore := gpsValidityStatus()
+
+	s := takeSituationSnapshot()
+	if s.GPSValid {
+		t.Errorf("GPS valid without a fix")
+	}
+	if s.GPSFixQuality != 0 || s.GPSSatellites != 0 || s.GPSNACp != 0 {
+		t.Errorf("lost fix not reported in the snapshot: quality %d, satellites %d, NACp %d", s.GPSFixQuality, s.GPSSatellites, s.GPSNACp)
+	}
+	if mySituation.GPSFixQuality != 1 || mySituation.GPSSatellites != 8 || mySituation.GPSHorizontalAccuracy != 5 || mySituation.GPSNACp != 10 {
+		t.Errorf("snapshot modified mySituation")
+	}
+	if state, transitions := gpsValidityStatus(); state != stateBefore || transitions != transitionsBefore {
+		t.Errorf("snapshot changed the GPS validity from %s to %s", stateBefore, state)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	supervisor.go: Restarts long running subsystems (listeners, GPS poller, SDR pipelines) that
+		return or panic, instead of letting them die silently (or taking all of Stratux down
+		with them). Restarts are delayed with exponential backoff, so a subsystem that fails
+		right away (e.g. port in use) doesn't spin. Restart counts are published in
+		globalStatus.SubsystemRestarts.
+		A recovered panic doesn't release mutexes, so subsystems run with supervise() must unlock
+		with defer. Those that don't (the NMEA parser) use superviseNoRecover(): they are restarted
+		when they return, but a panic still takes Stratux down instead of deadlocking it.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	supervisorMinBackoff = 1 * time.Second
+	supervisorMaxBackoff = 60 * time.Second
+	supervisorStableTime = 5 * time.Minute // Running this long resets the backoff
+)
+
+var supervisorMutex = &sync.Mutex{}
+var subsystemRestarts = make(map[string]int)
+
+// runSupervised runs fn and converts a panic into an error.
+func runSupervised(name string, fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s panicked: %v\n%s\n", name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	fn()
+	return nil
+}
+
+func recordSubsystemRestart(name string) {
+	supervisorMutex.Lock()
+	defer supervisorMutex.Unlock()
+	subsystemRestarts[name]++
+	restarts := make(map[string]int, len(subsystemRestarts))
+	for k, v := range subsystemRestarts {
+		restarts[k] = v
+	}
+	globalStatus.SubsystemRestarts = restarts // New map, the status encoders may still be reading the old one
+}
+
+// supervise runs fn in a goroutine and restarts it whenever it returns or panics.
+func supervise(name string, fn func()) {
+	go superviseLoop(name, fn, true)
+}
+
+// superviseNoRecover runs fn in a goroutine and restarts it whenever it returns. Panics are not recovered.
+func superviseNoRecover(name string, fn func()) {
+	go superviseLoop(name, fn, false)
+}
+
+func superviseLoop(name string, fn func(), recoverPanics bool) {
+	backoff := supervisorMinBackoff
+	for {
+		started := stratuxClock.Time
+		var err error
+		if recoverPanics {
+			err = runSupervised(name, fn)
+		} else {
+			fn()
+		}
+		if stratuxClock.Since(started) > supervisorStableTime {
+			backoff = supervisorMinBackoff
+		}
+		reason := "returned"
+		if err != nil {
+			reason = err.Error()
+		}
+		recordSubsystemRestart(name)
+		logEvent(EVENT_SYSTEM, EVENT_WARN, "Subsystem stopped, restarting", "subsystem", name, "reason", reason, "delay", backoff.String())
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+	}
+}
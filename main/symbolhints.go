@@ -0,0 +1,64 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	symbolhints.go: Per target hints for drawing traffic symbols. Whether the track is known
+		(directional vs non-directional symbol), whether the position was reported, coasted
+		by us or only estimated (bearingless Mode S targets), and a coarse confidence class.
+		Published in TrafficInfo for the web UI / traffic API and mapped to the GDL90 traffic
+		report: "tt" validity and the extrapolated flag in the "m" field, and the alert bit.
+*/
+
+package main
+
+const (
+	SYMBOL_POS_REPORTED     = 0 // Position as received
+	SYMBOL_POS_EXTRAPOLATED = 1 // Coasted from the last known position and velocity
+	SYMBOL_POS_ESTIMATED    = 2 // No position, placed at the distance estimated from signal strength
+)
+
+const (
+	SYMBOL_CONF_LOW    = 0
+	SYMBOL_CONF_MEDIUM = 1
+	SYMBOL_CONF_HIGH   = 2
+)
+
+const symbolTrackMaxAge = 10.0 // seconds without velocity update before the track is considered unknown
+
+// computeSymbolHints sets TrackKnown, PositionClass and Confidence. Called by sendTrafficUpdates() after the ages are updated.
+func computeSymbolHints(ti *TrafficInfo) {
+	switch {
+	case !ti.Position_valid:
+		ti.PositionClass = SYMBOL_POS_ESTIMATED
+	case ti.ExtrapolatedPosition:
+		ti.PositionClass = SYMBOL_POS_EXTRAPOLATED
+	default:
+		ti.PositionClass = SYMBOL_POS_REPORTED
+	}
+	ti.TrackKnown = ti.Speed_valid && ti.PositionClass != SYMBOL_POS_ESTIMATED &&
+		stratuxClock.Since(ti.Last_speed).Seconds() < symbolTrackMaxAge
+	ti.Confidence = symbolConfidence(*ti)
+}
+
+func symbolConfidence(ti TrafficInfo) uint8 {
+	if ti.PositionClass == SYMBOL_POS_ESTIMATED {
+		return SYMBOL_CONF_LOW
+	}
+	// OGN/FLARM doesn't report NACp, the others do
+	if ti.Last_source != TRAFFIC_SOURCE_OGN && ti.NACp < 5 { // >= 0.5 NM
+		return SYMBOL_CONF_LOW
+	}
+	if ti.PositionClass == SYMBOL_POS_EXTRAPOLATED || ti.Age > 3 {
+		return SYMBOL_CONF_MEDIUM
+	}
+	switch ti.TargetType {
+	case TARGET_TYPE_TISB, TARGET_TYPE_TISB_S, TARGET_TYPE_MLAT: // Radar or multilateration derived
+		return SYMBOL_CONF_MEDIUM
+	}
+	if ti.Last_source != TRAFFIC_SOURCE_OGN && ti.NACp < 8 { // >= 0.05 NM
+		return SYMBOL_CONF_MEDIUM
+	}
+	return SYMBOL_CONF_HIGH
+}
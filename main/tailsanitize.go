@@ -0,0 +1,70 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	tailsanitize.go: Normalization of tail numbers / call signs for the outputs. Tails come from
+		many sources (ES/UAT call signs, OGN DDB, FlarmNet, SoftRF) and may contain lower case,
+		dashes, umlauts or be empty. EFBs show garbage for characters the protocol doesn't
+		allow, and some glide computers break on NMEA special characters in the PFLAA ID.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const gdl90CallsignLen = 8
+
+/*
+gdl90Callsign returns the 8 byte GDL90 call sign field: '0'-'9', 'A'-'Z' and space only (GDL90 ICD 3.5.1.11),
+upper cased, other characters dropped, padded with spaces. Falls back to the hex address if nothing is left.
+*/
+func gdl90Callsign(tail string, addr uint32) []byte {
+	callsign := gdl90CallsignChars(tail)
+	if len(callsign) == 0 {
+		callsign = fmt.Sprintf("%06X", addr&0xFFFFFF)
+	}
+	field := []byte(callsign)
+	if len(field) > gdl90CallsignLen {
+		field = field[:gdl90CallsignLen]
+	}
+	for len(field) < gdl90CallsignLen {
+		field = append(field, ' ')
+	}
+	return field
+}
+
+// gdl90CallsignChars returns the tail with only the characters allowed in the GDL90 call sign, may be empty.
+func gdl90CallsignChars(tail string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToUpper(strings.TrimSpace(tail)) {
+		if (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || c == ' ' {
+			sb.WriteRune(c)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// flarmTail sanitizes a tail for the PFLAA/PFLAU ID suffix: printable ASCII without NMEA delimiters. May be empty.
+func flarmTail(tail string) string {
+	var sb strings.Builder
+	for _, c := range strings.TrimSpace(tail) {
+		if c > ' ' && c < 0x7f && c != ',' && c != '*' && c != '$' && c != '!' {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// flarmID returns the PFLAA/PFLAU ID: the 6 digit hex address, followed by "!" and the tail if there is one.
+func flarmID(ti TrafficInfo) string {
+	id := fmt.Sprintf("%.6X", ti.Icao_addr&0xFFFFFF)
+	if tail := flarmTail(ti.Tail); len(tail) > 0 {
+		id += "!" + tail + glideBandTailSuffix(ti.GlideBand)
+	}
+	return id
+}
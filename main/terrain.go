@@ -0,0 +1,241 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	terrain.go: Terrain elevation from SRTM tiles (.hgt, 1 or 3 arc seconds, e.g. N47E011.hgt) in
+		terrainDir. Tiles are opened when needed and samples are read from the file, so even
+		SRTM1 tiles don't use memory. Elevations are interpolated between the four surrounding
+		samples.
+		Every second the height above terrain is computed for our position and for our path,
+		projected along the current track, ground speed and vertical speed for terrainLookahead.
+		Airborne, a predicted clearance below globalSettings.TerrainClearance is a caution (not
+		close to an airfield, that's the approach) and a predicted impact within
+		terrainWarningTime a warning. Both are published in mySituation (Terrain*, also on the
+		/situation websocket), spoken and sent as $PSTXT, see makePSTXTString().
+		The elevation is also used for AGL limits of airspaces and for the low altitude alarm phase.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	terrainDir              = "/etc/stratux-terrain"
+	terrainMaxOpenTiles     = 8
+	terrainUpdateInterval   = 1 * time.Second
+	terrainLookahead        = 60  // s
+	terrainLookaheadStep    = 5   // s
+	terrainWarningTime      = 30  // s, predicted impact within this time is a warning
+	terrainWarningMargin    = 100 // ft
+	terrainMinSpeed         = 30  // kts, no alerts below
+	terrainAirfieldSuppress = 3   // NM, no cautions this close to the nearest airfield
+	terrainAudioRepeat      = 10 * time.Second
+)
+
+const (
+	TERRAIN_ALERT_NONE    = 0
+	TERRAIN_ALERT_CAUTION = 1
+	TERRAIN_ALERT_WARNING = 2
+)
+
+type terrainTile struct {
+	f        *os.File // nil if we don't have the tile
+	size     int      // Samples per row and column: 1201 (SRTM3) or 3601 (SRTM1)
+	lastUsed time.Time
+}
+
+var terrainTiles = make(map[string]*terrainTile)
+var terrainMutex = &sync.Mutex{}
+
+var terrainAudioLevel int
+var terrainAudioTime time.Time
+
+// terrainTileName returns the name of the tile containing a position, e.g. N47E011.hgt.
+func terrainTileName(lat, lon float64) string {
+	ns, ew := 'N', 'E'
+	latI, lonI := int(math.Floor(lat)), int(math.Floor(lon))
+	if latI < 0 {
+		ns, latI = 'S', -latI
+	}
+	if lonI < 0 {
+		ew, lonI = 'W', -lonI
+	}
+	return fmt.Sprintf("%c%02d%c%03d.hgt", ns, latI, ew, lonI)
+}
+
+// getTerrainTile returns the tile for a position, opening it if necessary. Called with terrainMutex held.
+func getTerrainTile(lat, lon float64) *terrainTile {
+	name := terrainTileName(lat, lon)
+	if t, ok := terrainTiles[name]; ok {
+		t.lastUsed = stratuxClock.Time
+		return t
+	}
+	if len(terrainTiles) >= terrainMaxOpenTiles {
+		var oldest string
+		for n, t := range terrainTiles {
+			if len(oldest) == 0 || t.lastUsed.Before(terrainTiles[oldest].lastUsed) {
+				oldest = n
+			}
+		}
+		if terrainTiles[oldest].f != nil {
+			terrainTiles[oldest].f.Close()
+		}
+		delete(terrainTiles, oldest)
+	}
+
+	t := &terrainTile{lastUsed: stratuxClock.Time}
+	terrainTiles[name] = t
+	f, err := os.Open(filepath.Join(terrainDir, name))
+	if err != nil {
+		return t
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return t
+	}
+	switch fi.Size() {
+	case 1201 * 1201 * 2:
+		t.size = 1201
+	case 3601 * 3601 * 2:
+		t.size = 3601
+	default:
+		addSingleSystemErrorf("terrain-tile", "Invalid SRTM tile %s (size %d)", name, fi.Size())
+		f.Close()
+		return t
+	}
+	t.f = f
+	return t
+}
+
+// sample returns the elevation in m of one sample, row 0 is the northern edge. ok = false for voids.
+func (t *terrainTile) sample(row, col int) (float64, bool) {
+	buf := make([]byte, 2)
+	if _, err := t.f.ReadAt(buf, int64(row*t.size+col)*2); err != nil {
+		return 0, false
+	}
+	v := int16(binary.BigEndian.Uint16(buf))
+	return float64(v), v != -32768
+}
+
+// terrainElevation returns the terrain elevation in ft MSL, false if we have no data for the position.
+func terrainElevation(lat, lon float64) (float64, bool) {
+	terrainMutex.Lock()
+	defer terrainMutex.Unlock()
+	t := getTerrainTile(lat, lon)
+	if t.f == nil {
+		return 0, false
+	}
+	n := float64(t.size - 1)
+	y := (math.Floor(lat) + 1 - lat) * n
+	x := (lon - math.Floor(lon)) * n
+	row, col := int(math.Min(y, n-1)), int(math.Min(x, n-1))
+	fy, fx := y-float64(row), x-float64(col)
+
+	e00, ok00 := t.sample(row, col)
+	e01, ok01 := t.sample(row, col+1)
+	e10, ok10 := t.sample(row+1, col)
+	e11, ok11 := t.sample(row+1, col+1)
+	if !ok00 || !ok01 || !ok10 || !ok11 {
+		// Void next to us: use the highest valid sample, rather too high than too low
+		elev, ok := math.Inf(-1), false
+		for i, e := range []float64{e00, e01, e10, e11} {
+			if []bool{ok00, ok01, ok10, ok11}[i] {
+				elev, ok = math.Max(elev, e), true
+			}
+		}
+		return elev / 0.3048, ok
+	}
+	elev := e00*(1-fx)*(1-fy) + e01*fx*(1-fy) + e10*(1-fx)*fy + e11*fx*fy
+	return elev / 0.3048, true
+}
+
+func updateTerrain() {
+	s := getSituation()
+	valid := false
+	var elev, hat, minClearance float64
+	var minClearanceTime int
+	alert := TERRAIN_ALERT_NONE
+	if s.GPSValid {
+		lat, lon := float64(s.GPSLatitude), float64(s.GPSLongitude)
+		elev, valid = terrainElevation(lat, lon)
+		hat = float64(s.GPSAltitudeMSL) - elev
+		minClearance = hat
+	}
+	if valid {
+		for t := terrainLookaheadStep; t <= terrainLookahead; t += terrainLookaheadStep {
+			lat, lon := calcLocationForBearingDistance(float64(s.GPSLatitude), float64(s.GPSLongitude), float64(s.GPSTrueCourse), s.GPSGroundSpeed*float64(t)/3600)
+			e, ok := terrainElevation(lat, lon)
+			if !ok {
+				continue
+			}
+			if c := float64(s.GPSAltitudeMSL) + float64(s.GPSVerticalSpeed)*float64(t) - e; c < minClearance {
+				minClearance, minClearanceTime = c, t
+			}
+		}
+
+		if globalSettings.TerrainAlert_Enabled && airborneState == AIRBORNE_FLYING && s.GPSGroundSpeed >= terrainMinSpeed {
+			if minClearance < terrainWarningMargin && minClearanceTime <= terrainWarningTime {
+				alert = TERRAIN_ALERT_WARNING
+			} else if minClearance < float64(globalSettings.TerrainClearance) && !(s.AirfieldValid && s.AirfieldDistance < terrainAirfieldSuppress) {
+				alert = TERRAIN_ALERT_CAUTION
+			}
+		}
+	}
+
+	if alert > TERRAIN_ALERT_NONE && (alert > terrainAudioLevel || stratuxClock.Since(terrainAudioTime) > terrainAudioRepeat) {
+		terrainAudioTime = stratuxClock.Time
+		if alert == TERRAIN_ALERT_WARNING {
+			audioAlert("terrain_warning")
+		} else {
+			audioAlert("terrain_caution")
+		}
+	}
+	terrainAudioLevel = alert
+
+	mySituation.muTerrain.Lock()
+	defer mySituation.muTerrain.Unlock()
+	mySituation.TerrainValid = valid
+	mySituation.TerrainElevation = float32(elev)
+	mySituation.TerrainHeightAbove = float32(hat)
+	mySituation.TerrainMinClearance = float32(minClearance)
+	mySituation.TerrainMinClearanceTime = minClearanceTime
+	mySituation.TerrainAlert = alert
+}
+
+func terrainMonitor() {
+	ticker := time.NewTicker(terrainUpdateInterval)
+	for {
+		<-ticker.C
+		updateTerrain()
+	}
+}
+
+// makePSTXTString creates the proprietary terrain sentence, "" if we have no terrain data:
+//
+//	$PSTXT,<Alert>,<Elevation>,<HeightAboveTerrain>,<MinClearance>,<MinClearanceTime>*cs
+//
+//	Alert               0 = none, 1 = caution, 2 = warning
+//	Elevation           Terrain elevation below us in ft MSL
+//	HeightAboveTerrain  ft, from the GPS altitude
+//	MinClearance        Lowest predicted height above terrain along our path in ft
+//	MinClearanceTime    Seconds until then, 0 = now
+func makePSTXTString() string {
+	s := getSituation()
+	if !s.TerrainValid {
+		return ""
+	}
+	msg := fmt.Sprintf("PSTXT,%d,%d,%d,%d,%d", s.TerrainAlert, int(s.TerrainElevation), int(s.TerrainHeightAbove), int(s.TerrainMinClearance), s.TerrainMinClearanceTime)
+
+	return makeNMEASentence(msg)
+}
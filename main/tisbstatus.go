@@ -0,0 +1,102 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	tisbstatus.go: Determines whether we are inside a TIS-B service volume, so the user knows
+		whether radar (TIS-B) traffic should be expected at all. TIS-B is only uplinked for
+		aircraft that are being served, i.e. that the ground station sees transmitting ADS-B Out.
+		Ground stations announce the served aircraft in the TIS-B/ADS-R service status.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../uatparse"
+)
+
+const tisbStatusTimeout = 60 * time.Second
+
+var tisbMutex = &sync.Mutex{}
+var tisbLastUplink time.Time                   // Last uplink from any ground station
+var tisbSitesSeen = make(map[uint32]time.Time) // TIS-B site ID -> last time we received TIS-B targets from that site
+var tisbLastServiceStatus time.Time            // Last TIS-B/ADS-R service status from any ground station
+var tisbLastServedOwnship time.Time            // Last service status that contained our own address
+
+func isOwnshipAddress(addr uint32) bool {
+	for _, ownCode := range strings.Split(globalSettings.OwnshipModeS, ",") {
+		ownCodeInt, err := strconv.ParseUint(strings.Trim(ownCode, " "), 16, 32)
+		if err == nil && uint32(ownCodeInt) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// tisbUplinkReceived is called for every decoded uplink message.
+func tisbUplinkReceived(uatMsg *uatparse.UATMsg) {
+	tisbMutex.Lock()
+	defer tisbMutex.Unlock()
+	tisbLastUplink = stratuxClock.Time
+	for _, f := range uatMsg.Frames {
+		if f.Frame_type != 15 {
+			continue
+		}
+		tisbLastServiceStatus = stratuxClock.Time
+		for _, addr := range f.TISB_service_addrs {
+			if isOwnshipAddress(addr) {
+				tisbLastServedOwnship = stratuxClock.Time
+			}
+		}
+	}
+}
+
+// tisbTargetReceived is called for every TIS-B target received via UAT.
+func tisbTargetReceived(siteId uint8) {
+	tisbMutex.Lock()
+	tisbSitesSeen[uint32(siteId)] = stratuxClock.Time
+	tisbMutex.Unlock()
+}
+
+func tisbServiceStatus() (status string, sites int) {
+	tisbMutex.Lock()
+	defer tisbMutex.Unlock()
+	for id, t := range tisbSitesSeen {
+		if stratuxClock.Since(t) < tisbStatusTimeout {
+			sites++
+		} else {
+			delete(tisbSitesSeen, id)
+		}
+	}
+	switch {
+	case stratuxClock.Since(tisbLastServedOwnship) < tisbStatusTimeout:
+		status = "Active"
+	case sites > 0 || stratuxClock.Since(tisbLastServiceStatus) < tisbStatusTimeout:
+		// Traffic is uplinked, but not for us. Only targets near other ADS-B Out aircraft will be seen.
+		status = "Not served (no ADS-B Out?)"
+	case stratuxClock.Since(tisbLastUplink) < tisbStatusTimeout:
+		status = "No TIS-B from ground station"
+	default:
+		status = "No ground station"
+	}
+	return
+}
+
+func tisbStatusUpdater() {
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		<-ticker.C
+		if !globalSettings.UAT_Enabled {
+			globalStatus.TISB_service = ""
+			globalStatus.TISB_sites = 0
+			continue
+		}
+		globalStatus.TISB_service, globalStatus.TISB_sites = tisbServiceStatus()
+	}
+}
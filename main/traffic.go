@@ -73,6 +73,7 @@ const (
 	// If we see a proper emitter category and NIC > 7, they'll be reassigned to TYPE_ADSR.
 	TARGET_TYPE_TISB_S = 3
 	TARGET_TYPE_TISB   = 4
+	TARGET_TYPE_MLAT   = 5 // Mode S target with position computed by a network MLAT server (see mlat.go)
 )
 
 type TrafficInfo struct {
@@ -82,6 +83,7 @@ type TrafficInfo struct {
 	Emitter_category    uint8     // Formatted using GDL90 standard, e.g. in a Mode ES report, A7 becomes 0x07, B0 becomes 0x08, etc.
 	OnGround            bool      // Air-ground status. On-ground is "true".
 	Addr_type           uint8     // UAT address qualifier. Used by GDL90 format, so translations for ES TIS-B/ADS-R are needed.
+	TISB_site_id        uint8     // UAT: ID of the ground station that uplinked this TIS-B target
 	TargetType          uint8     // types decribed in const above
 	SignalLevel         float64   // Signal level, dB RSSI.
 	Squawk              int       // Squawk code
@@ -123,10 +125,28 @@ type TrafficInfo struct {
 	Bearing              float64   // Bearing in degrees true to traffic from ownship, if it can be calculated. Units: degrees.
 	Distance             float64   // Distance to traffic from ownship, if it can be calculated. Units: meters.
 	DistanceEstimated    float64   // Estimated distance of the target if real distance can't be calculated, Estimated from signal strength with exponential smoothing.
-	DistanceEstimatedLastTs time.Time // Used to compute moving average
+	DistanceEstimatedLastTs time.Time // Used to compute moving average. Wall clock, like Timestamp
+	GlideBand            uint8     // Glider targets: reachable with our glide ratio? See glideband.go
+	TrackKnown           bool      // Track is current, draw a directional symbol. See symbolhints.go
+	PositionClass        uint8     // SYMBOL_POS_*: reported, extrapolated or estimated
+	Confidence           uint8     // SYMBOL_CONF_*: low, medium, high
+	NoTrack              bool      // Target asked not to be tracked in public. See privacy.go
+	Stealth              bool      // Target is in stealth mode. See privacy.go
+	FlarmSource          string    // Receiver of the target as reported by a FLARM device in PFLAA v9 (FLARM_SOURCE_*), "" = unknown
+	ClosureRate          float64   // Range rate in knots, positive = approaching. See closurerate.go
+	ClosureClass         uint8     // CLOSURE_*: severity hint for coloring the target
+
+	captureTime          time.Time // Receiver capture time of the last position (wall clock), see latency.go
+	latencySource        uint8     // Receiver of the last position, see latency.go
+	latencyOutputPending bool      // Last position not sent yet, see latency.go
 	//FIXME: Rename variables for consistency, especially "Last_".
 }
 
+// stratuxClockTimes returns the fields that hold stratuxClock times, for moving them to another clock (see handover.go).
+func (ti *TrafficInfo) stratuxClockTimes() []*time.Time {
+	return []*time.Time{&ti.Last_seen, &ti.Last_alt, &ti.Last_GnssDiff, &ti.Last_speed, &ti.Last_extrapolation}
+}
+
 type dump1090Data struct {
 	Icao_addr           uint32
 	DF                  int     // Mode S downlink format.
@@ -150,6 +170,7 @@ type dump1090Data struct {
 	Speed_valid         bool
 	Speed               *uint16
 	Track               *uint16
+	FS                  *int      // Flight status of DF4/5/20/21 replies (alert, SPI, on ground), see transponder.go. Nil if dump1090 doesn't decode it
 	Timestamp           time.Time // time traffic last seen, UTC
 }
 
@@ -162,7 +183,7 @@ var traffic map[uint32]TrafficInfo
 var trafficMutex *sync.Mutex
 var seenTraffic map[uint32]bool // Historical list of all ICAO addresses seen.
 
-var OwnshipTrafficInfo TrafficInfo
+var OwnshipTrafficInfo TrafficInfo // Only accessed with trafficMutex held. Outputs use getTrafficSnapshot().Ownship
 
 func convertFeetToMeters(feet float32) float32 {
 	return feet * 0.3048
@@ -268,7 +289,21 @@ func isOwnshipTrafficInfo(ti TrafficInfo) (isOwnshipInfo bool, shouldIgnore bool
 	return
 }
 
+// batchTrafficReport appends a traffic report to the last packet of msgs, or starts a new one.
+func batchTrafficReport(msgs [][]byte, report []byte) [][]byte {
+	cur_n := len(msgs) - 1
+	if len(msgs[cur_n]) >= 35 {
+		// Batch messages into packets with at most 35 traffic reports
+		//  to keep each packet under 1KB.
+		msgs = append(msgs, make([]byte, 0))
+		cur_n++
+	}
+	msgs[cur_n] = append(msgs[cur_n], report...)
+	return msgs
+}
+
 func sendTrafficUpdates() {
+	defer workDone(LOAD_TRAFFIC, time.Now())
 	trafficMutex.Lock()
 	defer trafficMutex.Unlock()
 	cleanupOldEntries()
@@ -285,18 +320,19 @@ func sendTrafficUpdates() {
 		}
 	}
 
-	var currAlt float32
-	currAlt = mySituation.BaroPressureAltitude
-	if currAlt == 99999 {   // no valid BaroAlt, take GPS instead, better than nothing
-		currAlt = mySituation.GPSAltitudeMSL
-	}
+	// no valid BaroAlt, take GPS instead, better than nothing
+	currAlt, _, currAltValid := ownshipAltitude()
 
 	msgs := make([][]byte, 1)
+	msgsOptional := make([][]byte, 1)
 	msgFLARM := ""
 	msgFlarmCount := 0
+	flarmSentences := make([]legacyDisplayTarget, 0) // individual PFLAA sentences for the legacy display output
+	pflaaCandidates := make([]pflaaCandidate, 0)
 	var bestEstimate TrafficInfo
 	var highestAlarmLevel uint8
 	var highestAlarmTraffic TrafficInfo
+	flarmCycleStart()
 
 	if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
 		log.Printf("List of all aircraft being tracked:\n")
@@ -317,6 +353,9 @@ func sendTrafficUpdates() {
 		ti.Age = stratuxClock.Since(ti.Last_seen).Seconds()
 		ti.AgeExtrapolation = stratuxClock.Since(ti.Last_extrapolation).Seconds()
 		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
+		ti.GlideBand = computeGlideBand(ti, currAlt, currAltValid)
+		computeSymbolHints(&ti)
+		computeClosureRate(&ti)
 
 		// Keep non-extrapolated traffic for 6 seconds, but extrapolate for 20
 		isCurrent := (ti.ExtrapolatedPosition && ti.AgeExtrapolation < 2 && ti.Age < 25) || (!ti.ExtrapolatedPosition && ti.Age < 6)
@@ -355,6 +394,7 @@ func sendTrafficUpdates() {
 		if ti.Position_valid && isCurrent { // ... but don't pass stale data to the EFB.
 			//TODO: Coast old traffic? Need to determine how FF, WingX, etc deal with stale targets.
 			logTraffic(ti) // only add to the SQLite log if it's not stale
+			heatmapAdd(ti)
 
 			if isOwnshipTi {
 				if globalSettings.DEBUG {
@@ -362,24 +402,24 @@ func sendTrafficUpdates() {
 				}
 				OwnshipTrafficInfo = ti
 			} else if !shouldIgnore {
-				cur_n := len(msgs) - 1
-				if len(msgs[cur_n]) >= 35 {
-					// Batch messages into packets with at most 35 traffic reports
-					//  to keep each packet under 1KB.
-					cur_n++
-					msgs = append(msgs, make([]byte, 0))
-				}
-				msgs[cur_n] = append(msgs[cur_n], makeTrafficReportMsg(ti)...)
 				thisMsgFLARM, validFLARM, alarmLevel := makeFlarmPFLAAString(ti)
+				// Distant targets without alarm are not sent to clients with a poor Wi-Fi link, see wifilinkquality.go.
+				if alarmLevel == 0 && ti.Distance > wifiPoorLinkTrafficRange {
+					msgsOptional = batchTrafficReport(msgsOptional, makeTrafficReportMsg(ti))
+				} else {
+					msgs = batchTrafficReport(msgs, makeTrafficReportMsg(ti))
+				}
+				if latencyOutput(&ti, alarmLevel) {
+					traffic[key] = ti
+				}
 				if alarmLevel > highestAlarmLevel {
 					highestAlarmLevel = alarmLevel
 					highestAlarmTraffic = ti
 				}
 				//log.Printf(thisMsgFLARM)
 				if validFLARM {
-					//sendNetFLARM(thisMsgFLARM)
-					msgFLARM += thisMsgFLARM
-					msgFlarmCount++
+					pflaaCandidates = append(pflaaCandidates, pflaaCandidate{ti, thisMsgFLARM, alarmLevel})
+					flarmSentences = append(flarmSentences, legacyDisplayTarget{thisMsgFLARM, alarmLevel, ti.Distance})
 					//log.Printf("%v\n",[]byte(thisMsgFLARM))
 				} else {
 					//log.Printf("FLARM output: Traffic %X couldn't be translated\n", ti.Icao_addr)
@@ -404,13 +444,29 @@ func sendTrafficUpdates() {
 			sendGDL90(msg, false)
 		}
 	}
+	for _, msg := range msgsOptional {
+		if len(msg) > 0 {
+			sendOptionalGDL90(msg, false)
+		}
+	}
 
+	for _, c := range schedulePFLAA(pflaaCandidates) {
+		flarmCycleSent(c.ti, c.alarmLevel)
+		msgFLARM += c.msg
+		msgFlarmCount++
+	}
 	sendNetFLARM(msgFLARM)
 	// Also send the nearest best bearingless
 	if bestEstimate.DistanceEstimated > 0 && bestEstimate.DistanceEstimated < 15000 {
-		msg, valid, _ := makeFlarmPFLAAString(bestEstimate)
+		msg, valid, alarmLevel := makeFlarmPFLAAString(bestEstimate)
 		if valid { 
 			sendNetFLARM(msg)
+			flarmSentences = append(flarmSentences, legacyDisplayTarget{msg, alarmLevel, bestEstimate.DistanceEstimated})
+		}
+		// A close Mode-S-only target alarms like any other, PFLAU without bearing
+		if valid && alarmLevel > highestAlarmLevel {
+			highestAlarmLevel = alarmLevel
+			highestAlarmTraffic = bestEstimate
 		}
 
 		if globalSettings.EstimateBearinglessDist && isGPSValid() {
@@ -424,7 +480,12 @@ func sendTrafficUpdates() {
 	}
 
 	msgPFLAU := makeFlarmPFLAUString(highestAlarmTraffic)
+	msgPFLAU = flarmObstacleOutput(msgPFLAU, highestAlarmLevel)
 	sendNetFLARM(msgPFLAU)
+	setLegacyDisplayTraffic(msgPFLAU, flarmSentences)
+	audioTrafficAlert(highestAlarmTraffic, highestAlarmLevel)
+
+	publishTrafficSnapshot(msgFlarmCount, highestAlarmLevel)
 }
 
 // Used to tune to our radios. We compare our estimate to real values for ADS-B Traffic.
@@ -433,10 +494,16 @@ func sendTrafficUpdates() {
 // and have a stronger transponder. Low aircraft are small aircraft with weak transmission power.
 // This is only a wild guess, but seems to help a bit. To do so, we use different estimatedDistFactors for different
 // altitude buckets: <5000ft, 5000-10000ft, >10000ft
+// The learning needs ADS-B traffic around. Until then, globalSettings.AntennaGainOffset corrects for an antenna
+// installation that receives stronger or weaker than the one these factors were found with.
 var estimatedDistFactors [3]float64 = [3]float64{2500.0, 2800.0, 3000.0}
 func estimateDistance(ti *TrafficInfo) {
+	if ti.SignalLevel <= -100 || ti.SignalLevel >= 20 { // -999: unknown
+		return
+	}
+	signal := ti.SignalLevel - float64(globalSettings.AntennaGainOffset)
 	altClass := int32(math.Max(0.0, math.Min(float64(ti.Alt / 5000), 2.0)))
-	dist := math.Pow(2.0, -ti.SignalLevel / 6.0) * estimatedDistFactors[altClass];  // distance approx. in meters, 6dB for double distance
+	dist := math.Pow(2.0, -signal / 6.0) * estimatedDistFactors[altClass];  // distance approx. in meters, 6dB for double distance
 
 	lambda := 0.2;
 	timeDiff := ti.Timestamp.Sub(ti.DistanceEstimatedLastTs).Seconds() * 1000
@@ -448,13 +515,17 @@ func estimateDistance(ti *TrafficInfo) {
 
 	expon := math.Exp(-timeDiff / 100 * lambda);
 	//log.Printf("timediff: %f, expon: %f", timeDiff, expon)
-	ti.DistanceEstimated = ti.DistanceEstimated * expon + dist * (1 - expon);
+	if ti.DistanceEstimated == 0 {
+		ti.DistanceEstimated = dist // First reply. Smoothing from 0 would make every new target look close
+	} else {
+		ti.DistanceEstimated = ti.DistanceEstimated * expon + dist * (1 - expon);
+	}
 
 	// Only learn from 1090ES ADS-B targets
 	// We ignore targets that are too far away (a lot of signal strength fluctuation), too close (non-reception cone or ownship)
 	// and of course extrapolated targets and invalid signal levels
 	if ti.BearingDist_valid && ti.Distance < 50000 && ti.Distance > 1500 && ti.Last_source == TRAFFIC_SOURCE_1090ES &&
-		ti.TargetType == TARGET_TYPE_ADSB && ti.SignalLevel > -30 && ti.SignalLevel < 0 && !ti.ExtrapolatedPosition {
+		ti.TargetType == TARGET_TYPE_ADSB && signal > -30 && signal < 0 && !ti.ExtrapolatedPosition {
 		var errorFactor float64
 		if ti.DistanceEstimated > ti.Distance {
 			errorFactor = -(ti.DistanceEstimated / ti.Distance)
@@ -470,21 +541,9 @@ func estimateDistance(ti *TrafficInfo) {
 
 }
 
- // calculates coordinates of a point defined by a location, a bearing, and a distance, thanks to 0x74-0x62
+// calculates coordinates of a point defined by a location, a bearing, and a distance, see geodesy.go
 func calcLocationForBearingDistance(lat1, lon1, bearingDeg, distanceNm float64) (lat2, lon2 float64) {
-	lat1Rad := radians(lat1)
-	lon1Rad := radians(lon1)
-	bearingRad := radians(bearingDeg)
-	distanceRad := distanceNm / (180 * 60 / math.Pi)
-
-	lat2Rad := math.Asin(math.Sin(lat1Rad)*math.Cos(distanceRad) + math.Cos(lat1Rad)*math.Sin(distanceRad)*math.Cos(bearingRad))
-	distanceLon := -math.Atan2(math.Sin(bearingRad)*math.Sin(distanceRad)*math.Cos(lat1Rad), math.Cos(distanceRad)-math.Sin(lat1Rad)*math.Sin(lat2Rad))
-	lon2Rad := math.Mod(lon1Rad-distanceLon+math.Pi, 2.0*math.Pi) - math.Pi
-
-	lat2 = degrees(lat2Rad)
-	lon2 = degrees(lon2Rad)
-
-	return
+	return currentGeodesy().Direct(lat1, lon1, bearingDeg, distanceNm*1852.0)
 }
 
 func calculateModeSFakeTargets(bearinglessTi TrafficInfo) []TrafficInfo {
@@ -503,6 +562,68 @@ func calculateModeSFakeTargets(bearinglessTi TrafficInfo) []TrafficInfo {
 	return result
 }
 
+// High byte of the traffic map keys of non-ICAO targets. OGN and FLARM use 1-3 (see ogn.go, flarm-nmea.go),
+// UAT and 1090ES targets this plus their address qualifier, so the two never share a key.
+const trafficKeyQualifierBase = 0x10
+
+/*
+	trafficKey returns the key of a UAT or 1090ES target in the traffic map. ICAO addressed targets are
+	keyed by their address, so the same aircraft received via ES, UAT, TIS-B and ADS-R is merged. Non-ICAO
+	addresses (TIS-B track files, self-assigned and surface vehicle addresses) are only unique together
+	with their address qualifier, so it goes into the high byte - like for OGN, but in a range of its own.
+*/
+func trafficKey(addr uint32, addrType uint8) uint32 {
+	if isICAOAddrType(addrType) {
+		return addr
+	}
+	return uint32(trafficKeyQualifierBase+addrType)<<24 | addr
+}
+
+// trafficInfoKey identifies a target of any source, for maps that follow the targets of the traffic map.
+func trafficInfoKey(ti TrafficInfo) uint32 {
+	if ti.Last_source == TRAFFIC_SOURCE_OGN && !isICAOAddrType(ti.Addr_type) {
+		return 1<<24 | ti.Icao_addr // Non-ICAO OGN/FLARM keys, see ogn.go
+	}
+	return trafficKey(ti.Icao_addr, ti.Addr_type)
+}
+
+// isICAOAddrType: 0 = ADS-B with ICAO address, 2 = TIS-B/ADS-R with ICAO address.
+func isICAOAddrType(addrType uint8) bool {
+	return addrType == 0 || addrType == 2
+}
+
+/*
+	esAddressQualifier maps the DF17/18 address qualifier to target type and UAT address qualifier.
+	For DF18 the CA field is the control field (CF). dump1090 additionally flags addresses that are
+	not ICAO addresses (TIS-B IMF bit, CF 1 and 5) with bit 25.
+	ok is false for Mode S replies (always ICAO, no target type change).
+*/
+func esAddressQualifier(df int, cf int, nonICAO bool) (targetType uint8, addrType uint8, ok bool) {
+	switch {
+	case df == 17:
+		return TARGET_TYPE_ADSB, 0, true
+	case df != 18:
+		return 0, 0, false
+	case cf == 0: // ADS-B from non-transponder device, ICAO address
+		return TARGET_TYPE_ADSB, 0, true
+	case cf == 1: // ADS-B from non-transponder device with other address, e.g. surface vehicles
+		return TARGET_TYPE_ADSB, 1, true
+	case cf == 2 || cf == 3: // Fine/coarse TIS-B
+		if nonICAO {
+			return TARGET_TYPE_TISB, 3, true
+		}
+		return TARGET_TYPE_TISB, 2, true
+	case cf == 5: // TIS-B with non-ICAO address
+		return TARGET_TYPE_TISB, 3, true
+	case cf == 6: // ADS-R
+		if nonICAO {
+			return TARGET_TYPE_ADSR, 6, true
+		}
+		return TARGET_TYPE_ADSR, 2, true
+	}
+	return 0, 0, false // CF 4 (management) and 7 (reserved)
+}
+
 func postProcessTraffic(ti *TrafficInfo) {
 	estimateDistance(ti)
 }
@@ -516,11 +637,17 @@ func registerTrafficUpdate(ti TrafficInfo) {
 		}
 	*/ // Send all traffic to the websocket and let JS sort it out. This will provide user indication of why they see 1000 ES messages and no traffic.
 	trafficUpdate.SendJSON(ti)
+	flarmFastPath(ti)
+	aircraftStatsUpdate(ti)
 }
 
 func isTrafficAlertable(ti TrafficInfo) bool {
 	// Set alert bit if possible and traffic is within some threshold
 	// TODO: Could be more intelligent, taking into account headings etc.
+	if ti.PositionClass == SYMBOL_POS_ESTIMATED {
+		// Made up position (see calculateModeSFakeTargets), only the estimated distance means something.
+		return ti.DistanceEstimated < 3704
+	}
 	if !ti.BearingDist_valid {
 		// If not able to calculate the distance to the target, let the alert bit be set always.
 		return true
@@ -606,12 +733,12 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 	// 0 - - -   On ground
 	// 1 - - -   Airborne
 
-	// Define tt type / validity
-	if ti.Speed_valid {
+	// Define tt type / validity. Without a current track, EFBs draw a non-directional symbol.
+	if ti.TrackKnown {
 		msg[12] = msg[12] | 0x01 // assume true track
 	}
 
-	if ti.ExtrapolatedPosition {
+	if ti.PositionClass != SYMBOL_POS_REPORTED {
 		msg[12] = msg[12] | 0x04
 	}
 
@@ -638,14 +765,8 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 
 	msg[18] = ti.Emitter_category
 
-	// msg[19] to msg[26] are "call sign" (tail).
-	for i := 0; i < len(ti.Tail) && i < 8; i++ {
-		c := byte(ti.Tail[i])
-		if c != 20 && !((c >= 48) && (c <= 57)) && !((c >= 65) && (c <= 90)) && c != 'e' && c != 'u' && c != 'a' && c != 'r' && c != 't' { // See p.24, FAA ref.
-			c = byte(20)
-		}
-		msg[19+i] = c
-	}
+	// msg[19] to msg[26] are "call sign" (tail). See p.24, FAA ref.
+	copy(msg[19:27], gdl90Callsign(ti.Tail, ti.Icao_addr))
 
 	//msg[27] is priority / emergency status per GDL90 spec (DO260B and DO282B are same codes)
 	msg[27] = ti.PriorityStatus << 4
@@ -657,8 +778,8 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 // Decoded data is used to update a TrafficInfo object, keyed to the 24-bit ICAO code contained in the
 // downlink message.
 // Inputs are a checksum-verified hex string corresponding to the 18 or 34-byte UAT
-// message, and an int representing UAT signal amplitude (0-1000).
-func parseDownlinkReport(s string, signalLevel int) {
+// message, an int representing UAT signal amplitude (0-1000) and the time the message arrived from the receiver.
+func parseDownlinkReport(s string, signalLevel int, received time.Time) {
 
 	var ti TrafficInfo
 	s = s[1:]
@@ -669,12 +790,13 @@ func parseDownlinkReport(s string, signalLevel int) {
 	msg_type := (uint8(frame[0]) >> 3) & 0x1f
 	addr_type := uint8(frame[0]) & 0x07
 	icao_addr := (uint32(frame[1]) << 16) | (uint32(frame[2]) << 8) | uint32(frame[3])
+	key := trafficKey(icao_addr, addr_type)
 
 	trafficMutex.Lock()
 	defer trafficMutex.Unlock()
 
 	// Retrieve previous information on this ICAO code.
-	if val, ok := traffic[icao_addr]; ok { // if we've already seen it, copy it in to do updates as it may contain some useful information like "tail" from 1090ES.
+	if val, ok := traffic[key]; ok { // if we've already seen it, copy it in to do updates as it may contain some useful information like "tail" from 1090ES.
 		ti = val
 		//log.Printf("Existing target %X imported for UAT update\n", icao_addr)
 	} else {
@@ -683,10 +805,12 @@ func parseDownlinkReport(s string, signalLevel int) {
 		ti.Icao_addr = icao_addr
 		ti.ExtrapolatedPosition = false
 
-		thisReg, validReg := icao2reg(icao_addr)
-		if validReg {
-			ti.Reg = thisReg
-			ti.Tail = thisReg
+		if isICAOAddrType(addr_type) {
+			thisReg, validReg := icao2reg(icao_addr)
+			if validReg {
+				ti.Reg = thisReg
+				ti.Tail = thisReg
+			}
 		}
 	}
 
@@ -988,26 +1112,22 @@ func parseDownlinkReport(s string, signalLevel int) {
 
 	//	fmt.Printf("ns_vel %d, ew_vel %d, track %d, speed_valid %t, speed %d, vvel_geo %t, vvel %d\n", ns_vel, ew_vel, track, speed_valid, speed, vvel_geo, vvel)
 
-	/*
-		utc_coupled := false
-		tisb_site_id := uint8(0)
-
-		if (uint8(frame[0]) & 7) == 2 || (uint8(frame[0]) & 7) == 3 { //TODO: Meaning?
-			tisb_site_id = uint8(frame[16]) & 0x0f
-		} else {
-			utc_coupled = (uint8(frame[16]) & 0x08) != 0
-		}
-	*/
-
-	//	fmt.Printf("tisb_site_id %d, utc_coupled %t\n", tisb_site_id, utc_coupled)
+	// The last 4 bits of the state vector carry the UTC coupling flag for ADS-B, and the ID of the
+	// ground station that generated the target for TIS-B (address qualifier 2 = ICAO address, 3 = track file ID)
+	if addr_type == 2 || addr_type == 3 {
+		ti.TISB_site_id = uint8(frame[16]) & 0x0f
+		tisbTargetReceived(ti.TISB_site_id)
+	}
 
 	ti.Timestamp = time.Now()
 
 	ti.Last_source = TRAFFIC_SOURCE_UAT
+	latencyDecoded(&ti, TRAFFIC_SOURCE_UAT, received)
 	postProcessTraffic(&ti)
-	traffic[ti.Icao_addr] = ti
+	traffic[key] = ti
+	debugConsolePublish(DEBUG_SOURCE_UAT, s, ti)
 	registerTrafficUpdate(ti)
-	seenTraffic[ti.Icao_addr] = true // Mark as seen.
+	seenTraffic[key] = true // Mark as seen.
 }
 
 func esListen() {
@@ -1017,329 +1137,344 @@ func esListen() {
 			continue
 		}
 		dump1090Addr := "127.0.0.1:30006"
+		if remote := remoteDecoderAddr("1090"); len(remote) > 0 {
+			dump1090Addr = remote
+		}
 		inConn, err := net.Dial("tcp", dump1090Addr)
 		if err != nil { // Local connection failed.
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		rdr := bufio.NewReader(inConn)
+		var busySince time.Time
 		for globalSettings.ES_Enabled || globalSettings.Ping_Enabled {
+			if !busySince.IsZero() {
+				workDone(LOAD_ES, busySince) // Everything between two reads is decoding work
+			}
 			//log.Printf("ES enabled. Ready to read next message from dump1090\n")
 			buf, err := rdr.ReadString('\n')
 			//log.Printf("String read from dump1090\n")
 			if err != nil { // Must have disconnected?
 				break
 			}
-			buf = strings.Trim(buf, "\r\n")
-
-			// Log the message to the message counter in any case.
-			var thisMsg msg
-			thisMsg.MessageClass = MSGCLASS_ES
-			thisMsg.TimeReceived = stratuxClock.Time
-			thisMsg.Data = buf
-			msgLogAppend(thisMsg)
-
-			var eslog esmsg
-			eslog.TimeReceived = stratuxClock.Time
-			eslog.Data = buf
-			logESMsg(eslog) // log raw dump1090:30006 output to SQLite log
-
-			var newTi *dump1090Data
-			err = json.Unmarshal([]byte(buf), &newTi)
-			if err != nil {
-				log.Printf("can't read ES traffic information from %s: %s\n", buf, err.Error())
-				continue
-			}
+			busySince = time.Now()
+			parseDump1090Message(buf)
+		}
+	}
+}
 
-			if newTi.Icao_addr == 0x07FFFFFF { // used to signal heartbeat
-				if globalSettings.DEBUG {
-					log.Printf("No traffic last 60 seconds. Heartbeat message from dump1090: %s\n", buf)
-				}
-				continue // don't process heartbeat messages
-			}
+// parseDump1090Message decodes one line of dump1090's JSON output (port 30006) into the traffic table.
+func parseDump1090Message(buf string) {
+	buf = strings.Trim(buf, "\r\n")
+
+	// Log the message to the message counter in any case.
+	var thisMsg msg
+	thisMsg.MessageClass = MSGCLASS_ES
+	thisMsg.TimeReceived = stratuxClock.Time
+	thisMsg.Data = buf
+	msgLogAppend(thisMsg)
+
+	var eslog esmsg
+	eslog.TimeReceived = stratuxClock.Time
+	eslog.Data = buf
+	logESMsg(eslog) // log raw dump1090:30006 output to SQLite log
+
+	var newTi *dump1090Data
+	err := json.Unmarshal([]byte(buf), &newTi)
+	if err != nil {
+		log.Printf("can't read ES traffic information from %s: %s\n", buf, err.Error())
+		return
+	}
 
-			if (newTi.Icao_addr & 0x01000000) != 0 { // bit 25 used by dump1090 to signal non-ICAO address
-				newTi.Icao_addr = newTi.Icao_addr & 0x00FFFFFF
-				if globalSettings.DEBUG {
-					log.Printf("Non-ICAO address %X sent by dump1090. This is typical for TIS-B.\n", newTi.Icao_addr)
-				}
-			}
-			icao := uint32(newTi.Icao_addr)
-			var ti TrafficInfo
+	if newTi.Icao_addr == 0x07FFFFFF { // used to signal heartbeat
+		if globalSettings.DEBUG {
+			log.Printf("No traffic last 60 seconds. Heartbeat message from dump1090: %s\n", buf)
+		}
+		return // don't process heartbeat messages
+	}
 
-			trafficMutex.Lock()
+	nonICAO := (newTi.Icao_addr & 0x01000000) != 0
+	if nonICAO { // bit 25 used by dump1090 to signal non-ICAO address
+		newTi.Icao_addr = newTi.Icao_addr & 0x00FFFFFF
+		if globalSettings.DEBUG {
+			log.Printf("Non-ICAO address %X sent by dump1090. This is typical for TIS-B.\n", newTi.Icao_addr)
+		}
+	}
+	icao := uint32(newTi.Icao_addr)
+	targetType, addrType, qualified := esAddressQualifier(newTi.DF, newTi.CA, nonICAO)
+	key := trafficKey(icao, addrType) // Mode S replies: addrType 0, always ICAO
+	if !nonICAO && isOwnshipAddress(icao) {
+		transponderReplyReceived(newTi)
+	}
+	var ti TrafficInfo
 
-			// Retrieve previous information on this ICAO code.
-			if val, ok := traffic[icao]; ok { // if we've already seen it, copy it in to do updates
-				ti = val
-				//log.Printf("Existing target %X imported for ES update\n", icao)
-			} else {
-				//log.Printf("New target %X created for ES update\n",newTi.Icao_addr)
-				ti.Last_seen = stratuxClock.Time // need to initialize to current stratuxClock so it doesn't get cut before we have a chance to populate a position message
-				ti.Last_alt = stratuxClock.Time  // ditto.
-				ti.Icao_addr = icao
-				ti.ExtrapolatedPosition = false
-				ti.Last_source = TRAFFIC_SOURCE_1090ES
-
-				thisReg, validReg := icao2reg(icao)
-				if validReg {
-					ti.Reg = thisReg
-					ti.Tail = thisReg
-				}
-			}
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock() // esListen is supervised, see supervisor.go
 
-			if newTi.SignalLevel > 0 {
-				ti.SignalLevel = 10 * math.Log10(newTi.SignalLevel)
-			} else {
-				ti.SignalLevel = -999
+	// Retrieve previous information on this ICAO code.
+	if val, ok := traffic[key]; ok { // if we've already seen it, copy it in to do updates
+		ti = val
+		//log.Printf("Existing target %X imported for ES update\n", icao)
+	} else {
+		//log.Printf("New target %X created for ES update\n",newTi.Icao_addr)
+		ti.Last_seen = stratuxClock.Time // need to initialize to current stratuxClock so it doesn't get cut before we have a chance to populate a position message
+		ti.Last_alt = stratuxClock.Time  // ditto.
+		ti.Icao_addr = icao
+		ti.ExtrapolatedPosition = false
+		ti.Last_source = TRAFFIC_SOURCE_1090ES
+
+		if isICAOAddrType(addrType) { // A track file number doesn't tell anything about the registration
+			thisReg, validReg := icao2reg(icao)
+			if validReg {
+				ti.Reg = thisReg
+				ti.Tail = thisReg
 			}
+		}
+	}
 
-			// generate human readable summary of message types for debug
-			//TODO: Use for ES message statistics?
-			/*
-				var s1 string
-				if newTi.DF == 17 {
-					s1 = "ADS-B"
-				}
-				if newTi.DF == 18 {
-					s1 = "ADS-R / TIS-B"
-				}
+	if newTi.SignalLevel > 0 {
+		ti.SignalLevel = 10 * math.Log10(newTi.SignalLevel)
+	} else {
+		ti.SignalLevel = -999
+	}
 
-				if newTi.DF == 4 || newTi.DF == 20 {
-					s1 = "Surveillance, Alt. Reply"
-				}
+	// generate human readable summary of message types for debug
+	//TODO: Use for ES message statistics?
+	/*
+		var s1 string
+		if newTi.DF == 17 {
+			s1 = "ADS-B"
+		}
+		if newTi.DF == 18 {
+			s1 = "ADS-R / TIS-B"
+		}
 
-				if newTi.DF == 5 || newTi.DF == 21 {
-					s1 = "Surveillance, Ident. Reply"
-				}
+		if newTi.DF == 4 || newTi.DF == 20 {
+			s1 = "Surveillance, Alt. Reply"
+		}
 
-				if newTi.DF == 11 {
-					s1 = "All-call Reply"
-				}
+		if newTi.DF == 5 || newTi.DF == 21 {
+			s1 = "Surveillance, Ident. Reply"
+		}
 
-				if newTi.DF == 0 {
-					s1 = "Short Air-Air Surv."
-				}
+		if newTi.DF == 11 {
+			s1 = "All-call Reply"
+		}
 
-				if newTi.DF == 16 {
-					s1 = "Long Air-Air Surv."
-				}
-			*/
-			//log.Printf("Mode S message from icao=%X, DF=%02d, CA=%02d, TC=%02d (%s)\n", ti.Icao_addr, newTi.DF, newTi.CA, newTi.TypeCode, s1)
+		if newTi.DF == 0 {
+			s1 = "Short Air-Air Surv."
+		}
 
-			// Altitude will be sent by dump1090 for ES ADS-B/TIS-B (DF=17 and DF=18)
-			// and Mode S messages (DF=0, DF = 4, and DF = 20).
+		if newTi.DF == 16 {
+			s1 = "Long Air-Air Surv."
+		}
+	*/
+	//log.Printf("Mode S message from icao=%X, DF=%02d, CA=%02d, TC=%02d (%s)\n", ti.Icao_addr, newTi.DF, newTi.CA, newTi.TypeCode, s1)
 
-			ti.AltIsGNSS = newTi.AltIsGNSS
+	// Altitude will be sent by dump1090 for ES ADS-B/TIS-B (DF=17 and DF=18)
+	// and Mode S messages (DF=0, DF = 4, and DF = 20).
 
-			if newTi.Alt != nil {
-				ti.Alt = int32(*newTi.Alt)
-				ti.Last_alt = stratuxClock.Time
-			}
+	ti.AltIsGNSS = newTi.AltIsGNSS
 
-			if newTi.GnssDiffFromBaroAlt != nil {
-				ti.GnssDiffFromBaroAlt = int32(*newTi.GnssDiffFromBaroAlt) // we can estimate pressure altitude from GNSS height with this parameter!
-				ti.Last_GnssDiff = stratuxClock.Time
-				ti.Last_GnssDiffAlt = ti.Alt
-			}
+	if newTi.Alt != nil {
+		ti.Alt = int32(*newTi.Alt)
+		ti.Last_alt = stratuxClock.Time
+	}
 
-			// Position updates are provided only by ES messages (DF=17 and DF=18; multiple TCs)
-			if newTi.Position_valid { // i.e. DF17 or DF18 message decoded successfully by dump1090
-				valid_position := true
-				var lat, lng float32
+	if newTi.GnssDiffFromBaroAlt != nil {
+		ti.GnssDiffFromBaroAlt = int32(*newTi.GnssDiffFromBaroAlt) // we can estimate pressure altitude from GNSS height with this parameter!
+		ti.Last_GnssDiff = stratuxClock.Time
+		ti.Last_GnssDiffAlt = ti.Alt
+	}
 
-				if newTi.Lat != nil {
-					lat = float32(*newTi.Lat)
-				} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
-					valid_position = false
-					//log.Printf("Missing latitude in DF=17/18 airborne position message\n")
-				}
+	// Position updates are provided only by ES messages (DF=17 and DF=18; multiple TCs)
+	if newTi.Position_valid { // i.e. DF17 or DF18 message decoded successfully by dump1090
+		valid_position := true
+		var lat, lng float32
 
-				if newTi.Lng != nil {
-					lng = float32(*newTi.Lng)
-				} else { //
-					valid_position = false
-					//log.Printf("Missing longitude in DF=17 airborne position message\n")
-				}
+		if newTi.Lat != nil {
+			lat = float32(*newTi.Lat)
+		} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
+			valid_position = false
+			//log.Printf("Missing latitude in DF=17/18 airborne position message\n")
+		}
 
-				if valid_position {
-					ti.Lat = lat
-					ti.Lng = lng
-					if isGPSValid() {
-						ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
-						ti.BearingDist_valid = true
-					}
-					ti.Position_valid = true
-					ti.ExtrapolatedPosition = false
-					ti.Last_seen = stratuxClock.Time // only update "last seen" data on position updates
-				}
-			} else {
-				// Old traffic had no position and update doesn't have a position either -> assume Mode-S only
-				if !ti.Position_valid {
-					ti.Last_seen = ti.Last_alt
-				}
-			}
+		if newTi.Lng != nil {
+			lng = float32(*newTi.Lng)
+		} else { //
+			valid_position = false
+			//log.Printf("Missing longitude in DF=17 airborne position message\n")
+		}
 
-			if newTi.Speed_valid { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
-				valid_speed := true
-				var speed uint16
-				var track float32
+		if valid_position {
+			ti.Lat = lat
+			ti.Lng = lng
+			if isGPSValid() {
+				ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+				ti.BearingDist_valid = true
+			}
+			ti.Position_valid = true
+			ti.ExtrapolatedPosition = false
+			ti.Last_seen = stratuxClock.Time // only update "last seen" data on position updates
+		}
+	} else {
+		// Old traffic had no position and update doesn't have a position either -> assume Mode-S only
+		if !ti.Position_valid {
+			ti.Last_seen = ti.Last_alt
+		}
+	}
 
-				if newTi.Track != nil {
-					track = float32(*newTi.Track)
-				} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
-					valid_speed = false
-					//log.Printf("Missing track in DF=17/18 TC19 airborne velocity message\n")
-				}
+	if newTi.Speed_valid { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
+		valid_speed := true
+		var speed uint16
+		var track float32
 
-				if newTi.Speed != nil {
-					speed = uint16(*newTi.Speed)
-				} else { //
-					valid_speed = false
-					//log.Printf("Missing speed in DF=17/18 TC19 airborne velocity message\n")
-				}
+		if newTi.Track != nil {
+			track = float32(*newTi.Track)
+		} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
+			valid_speed = false
+			//log.Printf("Missing track in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-				if newTi.Vvel != nil {
-					ti.Vvel = int16(*newTi.Vvel)
-				} else { // we'll still make the message without a valid vertical speed.
-					//log.Printf("Missing vertical speed in DF=17/18 TC19 airborne velocity message\n")
-				}
+		if newTi.Speed != nil {
+			speed = uint16(*newTi.Speed)
+		} else { //
+			valid_speed = false
+			//log.Printf("Missing speed in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-				if valid_speed {
-					ti.Track = track
-					ti.Speed = speed
-					ti.Speed_valid = true
-					ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates
-				}
-			} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) { // invalid speed on velocity message only
-				ti.Speed_valid = false
-			}
+		if newTi.Vvel != nil {
+			ti.Vvel = int16(*newTi.Vvel)
+		} else { // we'll still make the message without a valid vertical speed.
+			//log.Printf("Missing vertical speed in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-			// Determine NIC (navigation integrity category) from type code and subtype code
-			if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode >= 5 && newTi.TypeCode <= 22) && (newTi.TypeCode != 19) {
-				nic := 0 // default for unknown or missing NIC
-				switch newTi.TypeCode {
-				case 0, 8, 18, 22:
-					nic = 0
-				case 17:
-					nic = 1
-				case 16:
-					if newTi.SubtypeCode == 1 {
-						nic = 3
-					} else {
-						nic = 2
-					}
-				case 15:
-					nic = 4
-				case 14:
-					nic = 5
-				case 13:
-					nic = 6
-				case 12:
-					nic = 7
-				case 11:
-					if newTi.SubtypeCode == 1 {
-						nic = 9
-					} else {
-						nic = 8
-					}
-				case 10, 21:
-					nic = 10
-				case 9, 20:
-					nic = 11
-				}
-				ti.NIC = nic
+		if valid_speed {
+			ti.Track = track
+			ti.Speed = speed
+			ti.Speed_valid = true
+			ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates
+		}
+	} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) { // invalid speed on velocity message only
+		ti.Speed_valid = false
+	}
 
-				if (ti.NACp < 7) && (ti.NACp < ti.NIC) {
-					ti.NACp = ti.NIC // initialize to NIC, since NIC is sent with every position report, and not all emitters report NACp.
-				}
+	// Determine NIC (navigation integrity category) from type code and subtype code
+	if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode >= 5 && newTi.TypeCode <= 22) && (newTi.TypeCode != 19) {
+		nic := 0 // default for unknown or missing NIC
+		switch newTi.TypeCode {
+		case 0, 8, 18, 22:
+			nic = 0
+		case 17:
+			nic = 1
+		case 16:
+			if newTi.SubtypeCode == 1 {
+				nic = 3
+			} else {
+				nic = 2
 			}
-
-			if newTi.NACp != nil {
-				ti.NACp = *newTi.NACp
+		case 15:
+			nic = 4
+		case 14:
+			nic = 5
+		case 13:
+			nic = 6
+		case 12:
+			nic = 7
+		case 11:
+			if newTi.SubtypeCode == 1 {
+				nic = 9
+			} else {
+				nic = 8
 			}
+		case 10, 21:
+			nic = 10
+		case 9, 20:
+			nic = 11
+		}
+		ti.NIC = nic
 
-			if newTi.Emitter_category != nil {
-				ti.Emitter_category = uint8(*newTi.Emitter_category) // validate dump1090 on live traffic
-			}
+		if (ti.NACp < 7) && (ti.NACp < ti.NIC) {
+			ti.NACp = ti.NIC // initialize to NIC, since NIC is sent with every position report, and not all emitters report NACp.
+		}
+	}
 
-			if newTi.Squawk != nil {
-				ti.Squawk = int(*newTi.Squawk) // only provided by Mode S messages, so we don't do this in parseUAT.
-			}
-			// Set the target type. DF=18 messages are sent by ground station, so we look at CA
-			// (repurposed to Control Field in DF18) to determine if it's ADS-R or TIS-B.
-			if newTi.DF == 17 {
-				ti.TargetType = TARGET_TYPE_ADSB
-				ti.Addr_type = 0
-			} else if newTi.DF == 18 {
-				if newTi.CA == 6 {
-					ti.TargetType = TARGET_TYPE_ADSR
-					ti.Addr_type = 2
-				} else if newTi.CA == 2 { // 2 = TIS-B with ICAO address, 5 = TIS-B without ICAO address
-					ti.TargetType = TARGET_TYPE_TISB
-					ti.Addr_type = 2
-				} else if newTi.CA == 5 {
-					ti.TargetType = TARGET_TYPE_TISB
-					ti.Addr_type = 3
-				}
-			}
+	if newTi.NACp != nil {
+		ti.NACp = *newTi.NACp
+	}
 
-			if newTi.OnGround != nil { // DF=11 messages don't report "on ground" status so we need to check for valid values.
-				ti.OnGround = bool(*newTi.OnGround)
-			}
+	if newTi.Emitter_category != nil {
+		ti.Emitter_category = uint8(*newTi.Emitter_category) // validate dump1090 on live traffic
+	}
 
-			if (newTi.Tail != nil) && ((newTi.DF == 17) || (newTi.DF == 18) || (newTi.DF == 20) || (newTi.DF == 21)) { // DF=17 or DF=18, Type Code 1-4 , DF=20 Altitude Reply (often with Ident in Comm-B) DF=21 Identity Reply
-				ti.Tail = *newTi.Tail
-				ti.Tail = strings.Trim(ti.Tail, " ") // remove extraneous spaces
-			}
+	if newTi.Squawk != nil {
+		ti.Squawk = int(*newTi.Squawk) // only provided by Mode S messages, so we don't do this in parseUAT.
+	}
+	// Set the target type. DF=18 messages are sent by ground station, so we look at CA
+	// (repurposed to Control Field in DF18) to determine if it's ADS-R or TIS-B.
+	if qualified {
+		ti.TargetType = targetType
+		ti.Addr_type = addrType
+	}
 
-			// This is a hack to show the source of the traffic on moving maps.
-
-			if globalSettings.DisplayTrafficSource {
-				type_code := " "
-				switch ti.TargetType {
-				case TARGET_TYPE_ADSB:
-					type_code = "a"
-				case TARGET_TYPE_ADSR:
-					type_code = "r"
-				case TARGET_TYPE_TISB:
-					type_code = "t"
-				}
+	if newTi.OnGround != nil { // DF=11 messages don't report "on ground" status so we need to check for valid values.
+		ti.OnGround = bool(*newTi.OnGround)
+	}
 
-				if len(ti.Tail) == 0 {
-					ti.Tail = "e" + type_code
-				} else if len(ti.Tail) < 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
-					ti.Tail = "e" + type_code + ti.Tail
-				} else if len(ti.Tail) == 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
-					ti.Tail = "e" + type_code + ti.Tail[1:]
-				} else if len(ti.Tail) > 1 { // bounds checking
-					ti.Tail = "e" + type_code + ti.Tail[2:]
+	if (newTi.Tail != nil) && ((newTi.DF == 17) || (newTi.DF == 18) || (newTi.DF == 20) || (newTi.DF == 21)) { // DF=17 or DF=18, Type Code 1-4 , DF=20 Altitude Reply (often with Ident in Comm-B) DF=21 Identity Reply
+		ti.Tail = *newTi.Tail
+		ti.Tail = strings.Trim(ti.Tail, " ") // remove extraneous spaces
+	}
 
-				}
-			}
+	// This is a hack to show the source of the traffic on moving maps.
 
-			if newTi.DF == 17 || newTi.DF == 18 {
-				ti.Last_source = TRAFFIC_SOURCE_1090ES // only update traffic source on ADS-B messages. Prevents source on UAT ADS-B targets with Mode S transponders from "flickering" every time we get an altitude or DF11 update.
-			}
-			ti.Timestamp = newTi.Timestamp // only update "last seen" data on position updates
+	if globalSettings.DisplayTrafficSource {
+		type_code := " "
+		switch ti.TargetType {
+		case TARGET_TYPE_ADSB:
+			type_code = "a"
+		case TARGET_TYPE_ADSR:
+			type_code = "r"
+		case TARGET_TYPE_TISB:
+			type_code = "t"
+		case TARGET_TYPE_MLAT:
+			type_code = "m"
+		}
 
-			/*
-				s_out, err := json.Marshal(ti)
-				if err != nil {
-					log.Printf("Error generating output: %s\n", err.Error())
-				} else {
-					log.Printf("%X (DF%d) => %s\n", ti.Icao_addr, newTi.DF, string(s_out))
-				}
-			*/
-			postProcessTraffic(&ti)
-			traffic[ti.Icao_addr] = ti // Update information on this ICAO code.
-			registerTrafficUpdate(ti)
-			seenTraffic[ti.Icao_addr] = true // Mark as seen.
-			//log.Printf("%v\n",traffic)
-			trafficMutex.Unlock()
+		if len(ti.Tail) == 0 {
+			ti.Tail = "e" + type_code
+		} else if len(ti.Tail) < 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
+			ti.Tail = "e" + type_code + ti.Tail
+		} else if len(ti.Tail) == 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
+			ti.Tail = "e" + type_code + ti.Tail[1:]
+		} else if len(ti.Tail) > 1 { // bounds checking
+			ti.Tail = "e" + type_code + ti.Tail[2:]
 
 		}
 	}
+
+	if newTi.DF == 17 || newTi.DF == 18 {
+		ti.Last_source = TRAFFIC_SOURCE_1090ES // only update traffic source on ADS-B messages. Prevents source on UAT ADS-B targets with Mode S transponders from "flickering" every time we get an altitude or DF11 update.
+	}
+	ti.Timestamp = newTi.Timestamp // only update "last seen" data on position updates
+	if newTi.Position_valid {
+		latencyDecoded(&ti, TRAFFIC_SOURCE_1090ES, newTi.Timestamp)
+	}
+
+	/*
+		s_out, err := json.Marshal(ti)
+		if err != nil {
+			log.Printf("Error generating output: %s\n", err.Error())
+		} else {
+			log.Printf("%X (DF%d) => %s\n", ti.Icao_addr, newTi.DF, string(s_out))
+		}
+	*/
+	postProcessTraffic(&ti)
+	traffic[key] = ti // Update information on this ICAO code.
+	debugConsolePublish(DEBUG_SOURCE_ES, buf, ti)
+	registerTrafficUpdate(ti)
+	seenTraffic[key] = true // Mark as seen.
+	//log.Printf("%v\n",traffic)
 }
 
 func trafficInfoExtrapolator() {
@@ -1673,6 +1808,9 @@ func initTraffic() {
 	traffic = make(map[uint32]TrafficInfo)
 	seenTraffic = make(map[uint32]bool)
 	trafficMutex = &sync.Mutex{}
-	go esListen()
-	go ognListen()
+	supervise("esListen", esListen)
+	supervise("ognListen", ognListen)
+	supervise("ognAprsReporter", ognAprsReporter)
+	go mlatClient() // Not supervised, a restart would leave mlat-client running
+	supervise("mlatListen", mlatListen)
 }
@@ -0,0 +1,74 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	traffic_test.go: Expiration of targets from the traffic table, see simulation_test.go.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A target that stops transmitting stays in the table for 60s (tail number etc. are kept), then it's removed.
+func TestTrafficExpiresAfterSilence(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	target := &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.02, Lng: 11.0, Alt: 3500, Track: 180, Speed: 100}
+	h.SDRs = append(h.SDRs, target)
+	h.Run(2 * time.Second)
+	if _, ok := h.Traffic()[alarmTestAddr]; !ok {
+		t.Fatalf("target not in the traffic table")
+	}
+
+	target.Silent = true
+	h.Run(60 * time.Second)
+	if _, ok := h.Traffic()[alarmTestAddr]; !ok {
+		t.Errorf("target removed before 60s without messages")
+	}
+	h.Run(2 * time.Second)
+	if _, ok := h.Traffic()[alarmTestAddr]; ok {
+		t.Errorf("target still in the traffic table after 62s without messages")
+	}
+}
+
+// Only the silent target expires. Each message resets the expiration of its own target, whatever the source.
+func TestTrafficExpiresPerTarget(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	silent := &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.02, Lng: 11.0, Alt: 3500, Track: 180, Speed: 100}
+	h.SDRs = append(h.SDRs, silent,
+		&fakeTarget{Addr: 0xABCDE0, Class: MSGCLASS_ES, Lat: 47.98, Lng: 11.0, Alt: 3500, Track: 0, Speed: 100},
+		&fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_OGN, Lat: 48.0, Lng: 11.03, Alt: 3500, Track: 270, Speed: 60})
+	h.Run(2 * time.Second)
+	if n := len(h.Traffic()); n != 3 {
+		t.Fatalf("%d targets in the traffic table, want 3", n)
+	}
+
+	silent.Silent = true
+	h.Run(65 * time.Second)
+	targets := h.Traffic()
+	if _, ok := targets[alarmTestAddr]; ok {
+		t.Errorf("silent ADS-B target not expired")
+	}
+	if _, ok := targets[0xABCDE0]; !ok {
+		t.Errorf("ADS-B target expired while transmitting")
+	}
+	if _, ok := targets[1<<24|alarmTestAddr]; !ok {
+		t.Errorf("FLARM target with the same address as the silent ADS-B target expired")
+	}
+}
+
+// Last_seen, which the expiration is based on, is the stratux clock of the last message.
+func TestTrafficLastSeen(t *testing.T) {
+	h := newAlarmTestHarness(t)
+	h.SDRs = append(h.SDRs, &fakeTarget{Addr: alarmTestAddr, Class: MSGCLASS_ES, Lat: 48.02, Lng: 11.0, Alt: 3500, Track: 180, Speed: 100})
+	h.Run(2 * time.Second)
+
+	ti := h.Traffic()[alarmTestAddr]
+	if age := stratuxClock.Since(ti.Last_seen); age < 0 || age > time.Second {
+		t.Errorf("target last seen %s ago, want within the last second", age)
+	}
+}
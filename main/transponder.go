@@ -0,0 +1,187 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	transponder.go: Monitor of our own transponder. Replies from the configured ownship address
+		(globalSettings.OwnshipModeS) that the 1090 receiver hears are decoded into what the
+		transponder actually broadcasts: squawk, ident (SPI), pressure altitude, flight ID and
+		whether it sends ADS-B. The altitude is compared to our own baro altitude, so an encoder
+		that is off shows up in a ramp check, before ATC has to tell.
+		We only hear replies while something interrogates the transponder (radar, TCAS) - on the
+		ground often nothing does, an ADS-B out transponder is heard anyway.
+		Ident, alert and the on ground state of surveillance replies come from the flight status field
+		(FS in the dump1090 JSON). Only a dump1090 build that decodes it into its traffic output sends
+		it - without, IdentKnown stays false and the status page shows ident as unknown instead of off.
+		Published via /getTransponder for the status page.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	transponderIdentHold   = 18 * time.Second // SPI is set for about 18 s after pressing IDENT, older SPI replies are stale
+	transponderAdsbTimeout = 60 * time.Second
+)
+
+// Flight status (FS) of surveillance replies DF4/5/20/21
+const (
+	FS_AIRBORNE       = 0
+	FS_GROUND         = 1
+	FS_ALERT_AIRBORNE = 2
+	FS_ALERT_GROUND   = 3
+	FS_ALERT_SPI      = 4
+	FS_SPI            = 5
+)
+
+type transponderState struct {
+	address    uint32
+	lastSeen   time.Time
+	squawk     int // Digits as in the code, e.g. 7000
+	lastSquawk time.Time
+	alt        int32 // ft, pressure altitude
+	lastAlt    time.Time
+	lastIdent  time.Time // Last reply with SPI
+	spi        bool      // Last surveillance reply had SPI
+	alert      bool
+	fsOk       bool // Had a reply with flight status, so spi and alert are known
+	onGround   bool
+	onGroundOk bool
+	callsign   string
+	lastAdsb   time.Time
+	replies    map[int]uint32 // By downlink format
+}
+
+// transponderStatus is the JSON representation for the web UI. Ages in seconds, -1 = never.
+type transponderStatus struct {
+	Heard             bool
+	Address           string
+	Age               float64
+	Squawk            int
+	SquawkAge         float64
+	Emergency         string // Meaning of an emergency squawk
+	Ident             bool
+	IdentKnown        bool // False if dump1090 doesn't send the flight status, Ident and Alert are meaningless then
+	IdentAge          float64
+	Alert             bool // Squawk changed recently or emergency
+	OnGround          bool
+	OnGroundKnown     bool
+	Altitude          int32 // ft
+	AltitudeAge       float64
+	AltitudeDiff      int32 // ft, transmitted altitude - our baro altitude
+	AltitudeDiffValid bool
+	Callsign          string
+	ADSB              bool
+	Replies           map[string]uint32 // Count by downlink format, e.g. "DF4"
+}
+
+var transponder = transponderState{replies: make(map[int]uint32)}
+var transponderMutex = &sync.Mutex{}
+
+// transponderReplyReceived is called by parseDump1090Message() for every message from the ownship address.
+func transponderReplyReceived(newTi *dump1090Data) {
+	if newTi.DF == 18 {
+		return // TIS-B/ADS-R about us, not from us
+	}
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	if newTi.Icao_addr != transponder.address {
+		transponder = transponderState{address: newTi.Icao_addr, replies: make(map[int]uint32)}
+	}
+	now := stratuxClock.Time
+	transponder.lastSeen = now
+	transponder.replies[newTi.DF]++
+	if newTi.DF == 17 {
+		transponder.lastAdsb = now
+	}
+	if newTi.Squawk != nil {
+		transponder.squawk = *newTi.Squawk
+		transponder.lastSquawk = now
+	}
+	if newTi.Alt != nil && !newTi.AltIsGNSS {
+		transponder.alt = int32(*newTi.Alt)
+		transponder.lastAlt = now
+	}
+	if newTi.Tail != nil {
+		transponder.callsign = strings.TrimSpace(*newTi.Tail)
+	}
+	if newTi.FS != nil && (newTi.DF == 4 || newTi.DF == 5 || newTi.DF == 20 || newTi.DF == 21) {
+		fs := *newTi.FS
+		transponder.fsOk = true
+		transponder.spi = fs == FS_ALERT_SPI || fs == FS_SPI
+		if transponder.spi {
+			transponder.lastIdent = now
+		}
+		transponder.alert = fs == FS_ALERT_AIRBORNE || fs == FS_ALERT_GROUND || fs == FS_ALERT_SPI
+		if fs <= FS_ALERT_GROUND {
+			transponder.onGround = fs == FS_GROUND || fs == FS_ALERT_GROUND
+			transponder.onGroundOk = true
+		}
+	} else if newTi.OnGround != nil {
+		transponder.onGround = *newTi.OnGround
+		transponder.onGroundOk = true
+	}
+}
+
+func transponderAge(t time.Time) float64 {
+	if t.IsZero() {
+		return -1
+	}
+	return stratuxClock.Since(t).Seconds()
+}
+
+func emergencySquawk(squawk int) string {
+	switch squawk {
+	case 7500:
+		return "Unlawful interference"
+	case 7600:
+		return "Radio failure"
+	case 7700:
+		return "Emergency"
+	}
+	return ""
+}
+
+// getTransponderStatus returns what our transponder was last heard broadcasting.
+func getTransponderStatus() transponderStatus {
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	t := transponder
+	status := transponderStatus{
+		Heard:         !t.lastSeen.IsZero(),
+		Age:           transponderAge(t.lastSeen),
+		Squawk:        t.squawk,
+		SquawkAge:     transponderAge(t.lastSquawk),
+		Emergency:     emergencySquawk(t.squawk),
+		IdentAge:      transponderAge(t.lastIdent),
+		IdentKnown:    t.fsOk,
+		Alert:         t.alert,
+		OnGround:      t.onGround,
+		OnGroundKnown: t.onGroundOk,
+		Altitude:      t.alt,
+		AltitudeAge:   transponderAge(t.lastAlt),
+		Callsign:      t.callsign,
+		Replies:       make(map[string]uint32, len(t.replies)),
+	}
+	if !status.Heard {
+		return status
+	}
+	status.Address = fmt.Sprintf("%06X", t.address)
+	status.Ident = t.spi && stratuxClock.Since(t.lastIdent) < transponderIdentHold
+	status.ADSB = !t.lastAdsb.IsZero() && stratuxClock.Since(t.lastAdsb) < transponderAdsbTimeout
+	if !t.lastAlt.IsZero() && isTempPressValid() {
+		status.AltitudeDiff = t.alt - int32(mySituation.BaroPressureAltitude)
+		status.AltitudeDiffValid = true
+	}
+	for df, n := range t.replies {
+		status.Replies[fmt.Sprintf("DF%d", df)] = n
+	}
+	return status
+}
@@ -0,0 +1,76 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	uatreportout.go: Per output forwarding of raw UAT basic/long reports (GDL90 message IDs 30/31).
+		Some EFBs decode the raw downlink reports themselves, others choke on the volume in
+		busy airspace. Outputs (identified by their UDP port) listed in
+		globalSettings.UATReportOutputs can disable the forwarding or cap it to a rate, all
+		other outputs get every report as before. Uplinks (weather) are not affected.
+*/
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+type uatReportOutputConfig struct {
+	Port    uint32  // UDP port of the network output, see globalSettings.NetworkOutputs
+	Disable bool    // Don't forward raw UAT reports at all
+	Rate    float64 // Max. reports per second to each client on this port. 0 = unlimited
+}
+
+// Token bucket per client (ip:port), only accessed with netMutex held. Removed with the client, see refreshConnectedClients().
+type uatReportBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var uatReportBuckets = make(map[string]*uatReportBucket)
+
+func uatReportOutputConfigFor(port uint32) (uatReportOutputConfig, bool) {
+	for _, cfg := range globalSettings.UATReportOutputs {
+		if cfg.Port == port {
+			return cfg, true
+		}
+	}
+	return uatReportOutputConfig{}, false
+}
+
+/*
+uatReportAllowed decides if a raw UAT report may be sent to the client now. Short bursts of up to
+one second worth of reports are let through, so the reports of a busy second aren't all dropped
+at the end. Must be called with netMutex held.
+*/
+func uatReportAllowed(client string, port uint32) bool {
+	cfg, ok := uatReportOutputConfigFor(port)
+	if !ok {
+		return true
+	}
+	if cfg.Disable {
+		return false
+	}
+	if cfg.Rate <= 0 {
+		return true
+	}
+	burst := math.Max(cfg.Rate, 1)
+	b, ok := uatReportBuckets[client]
+	if !ok {
+		b = &uatReportBucket{tokens: burst, last: stratuxClock.Time}
+		uatReportBuckets[client] = b
+	}
+	b.tokens += stratuxClock.Since(b.last).Seconds() * cfg.Rate
+	b.last = stratuxClock.Time
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	uplinkarchive.go: Keeps recently received FIS-B uplink frames and serves them as a
+		GDL90 stream over TCP. A client that connects late (backup tablet, second Stratux)
+		first gets all archived frames and then the live uplinks, so it has the full weather
+		picture immediately instead of waiting for the ground stations to retransmit.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	uplinkArchivePort   = ":4001"
+	uplinkArchiveMaxAge = 20 * time.Minute // Older products are superseded or expired on the EFB anyway
+	uplinkArchiveMaxLen = 5000             // The oldest frame is dropped for a new one beyond this
+)
+
+type uplinkArchiveEntry struct {
+	received time.Time // stratuxClock
+	msg      []byte    // prepared GDL90 uplink message
+}
+
+var uplinkArchive map[string]*uplinkArchiveEntry // keyed by frame content, so repeated transmissions only refresh the time
+var uplinkArchiveClients map[net.Conn]chan []byte
+var uplinkArchiveMutex *sync.Mutex
+
+// uplinkArchiveAdd stores a GDL90 uplink message and forwards it to all connected subscribers.
+func uplinkArchiveAdd(msg []byte) {
+	if !globalSettings.UplinkArchive_Enabled {
+		return
+	}
+	uplinkArchiveMutex.Lock()
+	defer uplinkArchiveMutex.Unlock()
+
+	key := string(msg)
+	if e, ok := uplinkArchive[key]; ok {
+		e.received = stratuxClock.Time
+	} else {
+		if len(uplinkArchive) >= uplinkArchiveMaxLen {
+			uplinkArchiveEvictOldest()
+		}
+		uplinkArchive[key] = &uplinkArchiveEntry{received: stratuxClock.Time, msg: msg}
+	}
+
+	for _, ch := range uplinkArchiveClients {
+		select {
+		case ch <- msg:
+		default: // client too slow, drop
+		}
+	}
+}
+
+// uplinkArchiveEvictOldest removes the least recently received frame. Caller holds uplinkArchiveMutex.
+func uplinkArchiveEvictOldest() {
+	var oldestKey string
+	var oldest *uplinkArchiveEntry
+	for key, e := range uplinkArchive {
+		if oldest == nil || e.received.Before(oldest.received) {
+			oldestKey, oldest = key, e
+		}
+	}
+	if oldest != nil {
+		delete(uplinkArchive, oldestKey)
+	}
+}
+
+// uplinkArchiveRemoveClient unregisters a client and closes its channel, which ends its writer loop.
+// Called by both the reader and the writer of a connection, whichever notices the end first.
+func uplinkArchiveRemoveClient(conn net.Conn) {
+	uplinkArchiveMutex.Lock()
+	defer uplinkArchiveMutex.Unlock()
+	if ch, ok := uplinkArchiveClients[conn]; ok {
+		delete(uplinkArchiveClients, conn)
+		close(ch)
+	}
+}
+
+func uplinkArchiveCleanup() {
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		<-ticker.C
+		uplinkArchiveMutex.Lock()
+		for key, e := range uplinkArchive {
+			if stratuxClock.Since(e.received) > uplinkArchiveMaxAge || !globalSettings.UplinkArchive_Enabled {
+				delete(uplinkArchive, key)
+			}
+		}
+		uplinkArchiveMutex.Unlock()
+	}
+}
+
+func handleUplinkArchiveConnection(conn net.Conn) {
+	defer conn.Close()
+	log.Printf("Uplink archive client connected: %s\n", conn.RemoteAddr().String())
+
+	// Register first, so we don't miss anything that arrives while sending the catch-up.
+	ch := make(chan []byte, 1024)
+	uplinkArchiveMutex.Lock()
+	catchUp := make([][]byte, 0, len(uplinkArchive))
+	for _, e := range uplinkArchive {
+		catchUp = append(catchUp, e.msg)
+	}
+	uplinkArchiveClients[conn] = ch
+	uplinkArchiveMutex.Unlock()
+
+	defer func() {
+		uplinkArchiveRemoveClient(conn)
+		log.Printf("Uplink archive client disconnected: %s\n", conn.RemoteAddr().String())
+	}()
+
+	// Clients don't send anything. Reading notices a disconnect even if there are no uplinks to write,
+	// as outside the US.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		uplinkArchiveRemoveClient(conn)
+	}()
+
+	for _, msg := range catchUp {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+
+	for msg := range ch {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func uplinkArchiveListener() {
+	ln, err := listenTCP(uplinkArchivePort)
+	if err != nil {
+		log.Printf("Uplink archive: can't listen on %s: %s\n", uplinkArchivePort, err.Error())
+		return
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Uplink archive: accept failed: %s\n", err.Error())
+			continue
+		}
+		if !globalSettings.UplinkArchive_Enabled {
+			conn.Close()
+			continue
+		}
+		go handleUplinkArchiveConnection(conn)
+	}
+}
+
+func initUplinkArchive() {
+	uplinkArchive = make(map[string]*uplinkArchiveEntry)
+	uplinkArchiveClients = make(map[net.Conn]chan []byte)
+	uplinkArchiveMutex = &sync.Mutex{}
+	go uplinkArchiveCleanup()
+	go uplinkArchiveListener()
+}
@@ -0,0 +1,246 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	usbserialscan.go: Autodetection of USB serial devices that no udev rule knows (see
+		image/10-stratux.rules), e.g. FLARM mice, SoftRF or OGN Trackers with a different USB bridge
+		than the ones we have rules for, or a u-blox module behind a generic USB UART.
+		New /dev/ttyUSB* and /dev/ttyACM* devices are probed at the usual baud rates and classified by
+		what they send. The result is used by initGPSSerial() if there is no known GPS device, and by
+		flarmSerialManager() for additional FLARM devices, so these don't need the network push path.
+		Devices we know or use otherwise are never opened here.
+*/
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	usbSerialScanInterval = 10 * time.Second
+	usbSerialRetry        = 60 * time.Second // Probe silent devices again after this, they might have been switched on since
+)
+
+const (
+	USB_SERIAL_TYPE_NONE       = ""
+	USB_SERIAL_TYPE_UBLOX      = "u-blox"
+	USB_SERIAL_TYPE_OGNTRACKER = "OGN Tracker"
+	USB_SERIAL_TYPE_FLARM      = "FLARM/SoftRF"
+	USB_SERIAL_TYPE_NMEA       = "NMEA GPS"
+)
+
+var usbSerialPatterns = []string{"/dev/ttyUSB*", "/dev/ttyACM*"}
+var usbSerialBaudrates = []int{115200, 38400, 19200, 9600, 4800}
+
+// Symlinks of devices with udev rules or other users. Their targets are never probed.
+var usbSerialKnownPatterns = []string{"/dev/ublox*", "/dev/prolific*", "/dev/serialout*", "/dev/uatradio", "/dev/serialin*",
+	"/dev/softrf_dongle*", "/dev/flarm*", "/dev/ping", "/dev/softrf", "/dev/battery*"}
+
+// usbSerialDevice is the probe result of one device, also its JSON status.
+type usbSerialDevice struct {
+	Device string
+	Type   string // USB_SERIAL_TYPE_*, USB_SERIAL_TYPE_NONE = no NMEA at any baud rate
+	Baud   int
+	probed time.Time
+}
+
+var usbSerialDevices = make(map[string]*usbSerialDevice) // By device path
+var usbSerialMutex = &sync.Mutex{}
+
+// usbSerialInUse returns the devices we must not open: known by udev rules or used already.
+func usbSerialInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	for _, pattern := range usbSerialKnownPatterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			inUse[resolveSerialDevice(m)] = true
+		}
+	}
+	if serialConfig != nil && globalStatus.GPS_connected {
+		inUse[resolveSerialDevice(serialConfig.Name)] = true
+	}
+	if len(globalSettings.NMEASerialOut_Device) > 0 {
+		inUse[resolveSerialDevice(globalSettings.NMEASerialOut_Device)] = true
+	}
+	if len(globalSettings.AltEncoder_Device) > 0 {
+		inUse[resolveSerialDevice(globalSettings.AltEncoder_Device)] = true
+	}
+	flarmSerialMutex.Lock()
+	for dev := range flarmSerialDevices {
+		inUse[dev] = true
+	}
+	flarmSerialMutex.Unlock()
+	return inUse
+}
+
+// classifyUSBSerialData returns what kind of device sent data, USB_SERIAL_TYPE_NONE if it contains no valid NMEA.
+func classifyUSBSerialData(data []byte) string {
+	nmea, ublox, flarm, ogn := false, false, false, false
+	for _, line := range strings.Split(string(data), "\n") {
+		idx := strings.Index(line, "$")
+		if idx < 0 {
+			continue
+		}
+		s, ok := validateNMEAChecksum(strings.TrimSpace(line[idx:]))
+		if !ok {
+			continue
+		}
+		nmea = true
+		id := nmeaSentenceID(line[idx:])
+		switch {
+		case strings.HasPrefix(id, "POGN"):
+			ogn = true
+		case strings.HasPrefix(id, "PFLA"):
+			flarm = true
+		case id == "PUBX" || (strings.HasSuffix(id, "TXT") && strings.Contains(strings.ToLower(s), "u-blox")):
+			ublox = true
+		}
+	}
+	switch {
+	case !nmea:
+		return USB_SERIAL_TYPE_NONE
+	case ogn: // OGN Trackers often also send $PFLAA and u-blox messages
+		return USB_SERIAL_TYPE_OGNTRACKER
+	case flarm:
+		return USB_SERIAL_TYPE_FLARM
+	case ublox || bytes.Contains(data, []byte{0xB5, 0x62}):
+		return USB_SERIAL_TYPE_UBLOX
+	}
+	return USB_SERIAL_TYPE_NMEA
+}
+
+// probeUSBSerialDevice tries all baud rates until the device sends valid NMEA.
+func probeUSBSerialDevice(device string) (string, int) {
+	for _, baud := range usbSerialBaudrates {
+		p, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud, ReadTimeout: time.Millisecond * 2500})
+		if err != nil {
+			return USB_SERIAL_TYPE_NONE, 0
+		}
+		time.Sleep(3 * time.Second)
+		buffer := make([]byte, 10000)
+		n, _ := p.Read(buffer)
+		p.Close()
+		if t := classifyUSBSerialData(buffer[:n]); t != USB_SERIAL_TYPE_NONE {
+			return t, baud
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return USB_SERIAL_TYPE_NONE, 0
+}
+
+// usbSerialScanner probes new USB serial devices and forgets the ones that were unplugged.
+func usbSerialScanner() {
+	ticker := time.NewTicker(usbSerialScanInterval)
+	for {
+		<-ticker.C
+		if !globalSettings.GPS_Enabled || isPowerSaveIdle() {
+			continue
+		}
+		present := make(map[string]bool)
+		for _, pattern := range usbSerialPatterns {
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				present[m] = true
+			}
+		}
+
+		usbSerialMutex.Lock()
+		for dev := range usbSerialDevices {
+			if !present[dev] {
+				log.Printf("USB serial device %s removed\n", dev)
+				delete(usbSerialDevices, dev)
+			}
+		}
+		usbSerialMutex.Unlock()
+
+		inUse := usbSerialInUse()
+		for dev := range present {
+			usbSerialMutex.Lock()
+			d, known := usbSerialDevices[dev]
+			retry := known && d.Type == USB_SERIAL_TYPE_NONE && stratuxClock.Since(d.probed) > usbSerialRetry
+			usbSerialMutex.Unlock()
+			if (known && !retry) || inUse[dev] {
+				continue
+			}
+			t, baud := probeUSBSerialDevice(dev)
+			usbSerialMutex.Lock()
+			usbSerialDevices[dev] = &usbSerialDevice{Device: dev, Type: t, Baud: baud, probed: stratuxClock.Time}
+			usbSerialMutex.Unlock()
+			if t != USB_SERIAL_TYPE_NONE {
+				log.Printf("Detected %s on USB serial device %s with baud %d\n", t, dev, baud)
+				logEvent(EVENT_GPS, EVENT_INFO, "USB serial device detected", "device", dev, "type", t)
+			}
+		}
+	}
+}
+
+// usbSerialGPSDevice returns the autodetected device initGPSSerial() should use, in the order of the udev
+// based detection: u-blox before OGN Tracker/FLARM before anything else that sends positions.
+func usbSerialGPSDevice() (usbSerialDevice, bool) {
+	usbSerialMutex.Lock()
+	defer usbSerialMutex.Unlock()
+	for _, t := range []string{USB_SERIAL_TYPE_UBLOX, USB_SERIAL_TYPE_OGNTRACKER, USB_SERIAL_TYPE_FLARM, USB_SERIAL_TYPE_NMEA} {
+		for _, dev := range sortedUSBSerialDevices() {
+			if d := usbSerialDevices[dev]; d.Type == t {
+				return *d, true
+			}
+		}
+	}
+	return usbSerialDevice{}, false
+}
+
+// usbSerialGPSType is the GPS_detected_type for an autodetected device. A u-blox behind a USB UART is
+// configured like one on the GPIO UART, everything else is used as NMEA like /dev/serialin.
+func usbSerialGPSType(d usbSerialDevice) uint {
+	if d.Type == USB_SERIAL_TYPE_UBLOX {
+		return GPS_TYPE_UART
+	}
+	return GPS_TYPE_SERIAL
+}
+
+// usbSerialFlarmDevices returns the autodetected devices flarmSerialManager() can use for traffic.
+func usbSerialFlarmDevices() []string {
+	usbSerialMutex.Lock()
+	defer usbSerialMutex.Unlock()
+	ret := make([]string, 0)
+	for _, dev := range sortedUSBSerialDevices() {
+		if t := usbSerialDevices[dev].Type; t == USB_SERIAL_TYPE_OGNTRACKER || t == USB_SERIAL_TYPE_FLARM {
+			ret = append(ret, dev)
+		}
+	}
+	return ret
+}
+
+// sortedUSBSerialDevices returns the device paths in a stable order. Caller holds usbSerialMutex.
+func sortedUSBSerialDevices() []string {
+	devs := make([]string, 0, len(usbSerialDevices))
+	for dev := range usbSerialDevices {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+	return devs
+}
+
+// getUSBSerialStatus returns the autodetected devices for globalStatus.
+func getUSBSerialStatus() []usbSerialDevice {
+	usbSerialMutex.Lock()
+	defer usbSerialMutex.Unlock()
+	ret := make([]usbSerialDevice, 0)
+	for _, dev := range sortedUSBSerialDevices() {
+		if d := usbSerialDevices[dev]; d.Type != USB_SERIAL_TYPE_NONE {
+			ret = append(ret, *d)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,99 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	vario.go: Vario output on the NMEA outputs, for XCSoar/LK8000 users without a separate vario.
+		The climb rate is filtered from the pressure altitude of the selected baro source with an
+		alpha-beta filter, which reacts faster than smoothing BaroVerticalSpeed again. It is a
+		plain (not total energy compensated) vario: we have no airspeed.
+		Sent at varioOutInterval, faster than the 1 Hz position sentences, as
+		  $POV,P,<static pressure hPa>,E,<climb m/s>   OpenVario
+		  $LXWP0,N,,<pressure altitude m>,<climb m/s>,,,,,,,,   LX
+		Only with a real baro: no output for GPS altitude or the baro guess from traffic.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	varioOutInterval = 250 * time.Millisecond
+	varioMaxGap      = 2 * time.Second // Restart the filter after a gap in baro measurements
+	varioAlpha       = 0.15            // Filter gains per update at varioOutInterval, about 2s response
+	varioBeta        = 0.012
+)
+
+type varioFilter struct {
+	alt   float64 // m
+	climb float64 // m/s
+	last  time.Time
+	valid bool
+}
+
+var vario varioFilter
+
+// update feeds a new pressure altitude measurement (m) taken at t.
+func (f *varioFilter) update(alt float64, t time.Time) {
+	if f.valid && t.Equal(f.last) {
+		return // No new measurement since the last update
+	}
+	dt := t.Sub(f.last).Seconds()
+	if !f.valid || dt <= 0 || dt > varioMaxGap.Seconds() {
+		f.alt, f.climb, f.last, f.valid = alt, 0, t, true
+		return
+	}
+	f.alt += f.climb * dt
+	r := alt - f.alt
+	f.alt += varioAlpha * r
+	f.climb += varioBeta * r / dt
+	f.last = t
+}
+
+// varioBaroValid is true if the selected baro source is a real pressure measurement.
+func varioBaroValid() bool {
+	return isTempPressValid() && !isDegraded(DEGRADED_NO_BARO) && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE
+}
+
+// isaPressure returns the static pressure in hPa for a pressure altitude in m (ISA troposphere).
+func isaPressure(alt float64) float64 {
+	return 1013.25 * math.Pow(1-alt/44330.77, 5.25588)
+}
+
+func makePOVString(alt, climb float64) string {
+	msg := fmt.Sprintf("POV,P,%.2f,E,%.2f", isaPressure(alt), climb)
+	return makeNMEASentence(msg)
+}
+
+func makeLXWP0String(alt, climb float64) string {
+	msg := fmt.Sprintf("LXWP0,N,,%.1f,%.2f,,,,,,,,", alt, climb)
+	return makeNMEASentence(msg)
+}
+
+// varioSender filters the baro altitude and sends the vario sentences.
+func varioSender() {
+	ticker := time.NewTicker(varioOutInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if !varioBaroValid() {
+			vario.valid = false
+			continue
+		}
+		mySituation.muBaro.Lock()
+		alt := float64(mySituation.BaroPressureAltitude) / 3.28084
+		t := mySituation.BaroLastMeasurementTime
+		mySituation.muBaro.Unlock()
+		vario.update(alt, t)
+
+		if !globalSettings.NMEAOut_Vario || isPowerSaveIdle() || isGroundStation() {
+			continue
+		}
+		sendNetFLARM(makePOVString(vario.alt, vario.climb) + makeLXWP0String(vario.alt, vario.climb))
+	}
+}
@@ -0,0 +1,266 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	weatheruplink.go: UAT uplink emulation for regions without FIS-B. When internet is available,
+		METARs and TAFs for the stations of the selected region pack (globalSettings.WeatherUplinkRegion)
+		are fetched from aviationweather.gov and re-broadcast as GDL90 uplink messages (0x07),
+		framed like a FIS-B ground station would send them: DLAC text products (413), one report
+		per info frame, with the pseudo ground station at the region's coordinates. EFBs that only
+		render FIS-B weather then show it like in the US.
+		Reports are re-sent every weatherUplinkBroadcastInterval, so they don't expire in the EFB
+		while we are out of hotspot range. They are dropped after weatherUplinkMaxAge.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	weatherUplinkMetarURL          = "https://aviationweather.gov/api/data/metar?format=raw&ids="
+	weatherUplinkTafURL            = "https://aviationweather.gov/api/data/taf?format=raw&ids="
+	weatherUplinkFetchInterval     = 10 * time.Minute
+	weatherUplinkRetryInterval     = 1 * time.Minute // No internet - try again soon
+	weatherUplinkBroadcastInterval = 60 * time.Second
+	weatherUplinkMaxAge            = 2 * time.Hour
+	weatherUplinkTimeout           = 30 * time.Second
+	weatherUplinkProductText       = 413
+	weatherUplinkFrameHeader       = 8 // UAT uplink header, followed by the info frames
+)
+
+// A weatherRegionPack is a set of stations, broadcast from a pseudo ground station.
+type weatherRegionPack struct {
+	Name     string
+	Lat, Lon float64 // Pseudo ground station, roughly the center of the region
+	Stations []string
+}
+
+var weatherRegionPacks = map[string]weatherRegionPack{
+	"eu-central": {"Germany, Austria, Switzerland", 49.5, 10.5,
+		[]string{"EDDF", "EDDM", "EDDH", "EDDB", "EDDL", "EDDS", "EDDK", "EDDN", "EDDP", "EDDV", "EDDW", "EDFH", "EDNY", "LOWW", "LOWS", "LOWI", "LOWG", "LSZH", "LSGG", "LSZB", "LSZA"}},
+	"uk-ireland": {"United Kingdom, Ireland", 53.0, -3.0,
+		[]string{"EGLL", "EGKK", "EGSS", "EGGW", "EGCC", "EGBB", "EGGD", "EGHI", "EGNX", "EGNM", "EGNT", "EGPH", "EGPF", "EGPD", "EGAA", "EIDW", "EICK", "EINN"}},
+	"france-benelux": {"France, Belgium, Netherlands, Luxembourg", 48.0, 3.0,
+		[]string{"LFPG", "LFPO", "LFLL", "LFML", "LFMN", "LFBO", "LFBD", "LFRS", "LFSB", "LFST", "LFLS", "EBBR", "EBLG", "EBOS", "ELLX", "EHAM", "EHRD", "EHEH", "EHGG"}},
+	"nordic": {"Scandinavia, Finland", 61.0, 16.0,
+		[]string{"EKCH", "EKBI", "ESSA", "ESGG", "ESMS", "ESNU", "ENGM", "ENBR", "ENZV", "ENVA", "EFHK", "EFTU", "EFOU"}},
+	"iberia": {"Spain, Portugal", 40.0, -4.0,
+		[]string{"LEMD", "LEBL", "LEVC", "LEMG", "LEZL", "LEBB", "LPPT", "LPPR", "LPFR"}},
+	"italy": {"Italy", 43.0, 12.0,
+		[]string{"LIRF", "LIMC", "LIML", "LIPZ", "LIPE", "LIRN", "LICC", "LIEE"}},
+	"central-east": {"Poland, Czechia, Slovakia, Hungary, Slovenia", 49.5, 18.0,
+		[]string{"EPWA", "EPKK", "EPGD", "EPWR", "LKPR", "LKTB", "LZIB", "LHBP", "LJLJ"}},
+}
+
+type weatherUplinkReport struct {
+	text    string // "METAR EDDF 161150Z ...", as in a FIS-B text product
+	fetched time.Time
+}
+
+var weatherUplinkReports = make(map[string]weatherUplinkReport) // By type and station
+var weatherUplinkMutex = &sync.Mutex{}
+
+// weatherUplinkRegion returns the selected region pack, false if uplink emulation is off.
+func weatherUplinkRegion() (weatherRegionPack, bool) {
+	pack, ok := weatherRegionPacks[globalSettings.WeatherUplinkRegion]
+	return pack, ok
+}
+
+// fetchWeatherUplinkReports downloads the raw reports of one type for all stations of the region.
+func fetchWeatherUplinkReports(reportType, url string, stations []string) error {
+	client := &http.Client{Timeout: weatherUplinkTimeout}
+	req, err := http.NewRequest("GET", url+strings.Join(stations, ","), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "stratux/"+stratuxVersion)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	// One report per line. TAFs may continue on indented lines.
+	var reports []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " ")
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, " ") && len(reports) > 0 {
+			reports[len(reports)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		reports = append(reports, strings.TrimSpace(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	weatherUplinkMutex.Lock()
+	defer weatherUplinkMutex.Unlock()
+	for _, r := range reports {
+		x := strings.Fields(r)
+		if x[0] == "TAF" || x[0] == "METAR" || x[0] == "SPECI" {
+			x = x[1:]
+		}
+		if len(x) > 0 && (x[0] == "AMD" || x[0] == "COR") {
+			x = x[1:]
+		}
+		if len(x) < 3 {
+			continue
+		}
+		weatherUplinkReports[reportType+x[0]] = weatherUplinkReport{text: reportType + " " + strings.Join(x, " "), fetched: time.Now()}
+	}
+	return nil
+}
+
+// Same table as uatparse, index = 6 bit code
+const dlacAlphabet = "\x03ABCDEFGHIJKLMNOPQRSTUVWXYZ\x1A\t\x1E\n| !\"#$%&'()*+,-./0123456789:;<=>?"
+
+// dlacEncode packs text into DLAC (6 bit characters, 4 per 3 bytes). Characters DLAC doesn't have become blanks.
+func dlacEncode(s string) []byte {
+	s = strings.ToUpper(s)
+	chars := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := strings.IndexByte(dlacAlphabet, s[i])
+		if c < 0 || s[i] == '\t' {
+			c = strings.IndexByte(dlacAlphabet, ' ')
+		}
+		chars = append(chars, byte(c))
+	}
+	for len(chars)%4 != 0 {
+		chars = append(chars, 0) // ETX
+	}
+	ret := make([]byte, 0, len(chars)*3/4)
+	for i := 0; i < len(chars); i += 4 {
+		ret = append(ret, chars[i]<<2|chars[i+1]>>4, chars[i+1]<<4|chars[i+2]>>2, chars[i+2]<<6|chars[i+3])
+	}
+	return ret
+}
+
+// makeTextInfoFrame returns a FIS-B info frame with one text report (product 413, hours/minutes time format).
+func makeTextInfoFrame(text string, t time.Time) []byte {
+	payload := dlacEncode(text + "\x1E")
+	maxPayload := UPLINK_FRAME_DATA_BYTES - weatherUplinkFrameHeader - 2 - 4
+	if len(payload) > maxPayload {
+		payload = payload[:maxPayload] // Very long TAF, no segmentation
+	}
+	length := 4 + len(payload)
+	frame := make([]byte, 2+length)
+	frame[0] = byte(length >> 1)
+	frame[1] = byte(length&0x01) << 7 // Frame type 0: FIS-B APDU
+	apdu := frame[2:]
+	apdu[0] = byte(weatherUplinkProductText >> 6 & 0x1f) // A, G, P, S flags clear
+	apdu[1] = byte(weatherUplinkProductText&0x3f) << 2   // t_opt 0: hours, minutes
+	apdu[2] = byte(t.Hour())<<2 | byte(t.Minute())>>4
+	apdu[3] = byte(t.Minute()&0x0f) << 4
+	copy(apdu[4:], payload)
+	return frame
+}
+
+// makeUplinkFrames packs info frames into as few uplink frames as possible.
+func makeUplinkFrames(pack weatherRegionPack, infoFrames [][]byte) [][]byte {
+	lat := int32(pack.Lat * 16777216 / 360)
+	if lat < 0 {
+		lat += 8388608
+	}
+	lon := int32(pack.Lon * 16777216 / 360)
+	if lon < 0 {
+		lon += 16777216
+	}
+	newFrame := func() []byte {
+		f := make([]byte, weatherUplinkFrameHeader, UPLINK_FRAME_DATA_BYTES)
+		f[0] = byte(lat >> 15)
+		f[1] = byte(lat >> 7)
+		f[2] = byte(lat<<1) | byte(lon>>23)&0x01
+		f[3] = byte(lon >> 15)
+		f[4] = byte(lon >> 7)
+		f[5] = byte(lon<<1) | 0x01 // Position valid
+		f[6] = 0x80 | 0x20         // UTC coupled, application data valid
+		return f
+	}
+
+	var frames [][]byte
+	cur := newFrame()
+	for _, info := range infoFrames {
+		if len(cur)+len(info) > UPLINK_FRAME_DATA_BYTES {
+			frames = append(frames, cur)
+			cur = newFrame()
+		}
+		cur = append(cur, info...)
+	}
+	if len(cur) > weatherUplinkFrameHeader {
+		frames = append(frames, cur)
+	}
+	for i, f := range frames {
+		frames[i] = f[:UPLINK_FRAME_DATA_BYTES] // Zero padded, a zero length info frame ends the list
+	}
+	return frames
+}
+
+// broadcastWeatherUplink sends all current reports of the region.
+func broadcastWeatherUplink(pack weatherRegionPack) {
+	now := time.Now().UTC()
+	var infoFrames [][]byte
+	weatherUplinkMutex.Lock()
+	for k, r := range weatherUplinkReports {
+		if time.Since(r.fetched) > weatherUplinkMaxAge {
+			delete(weatherUplinkReports, k)
+			continue
+		}
+		infoFrames = append(infoFrames, makeTextInfoFrame(r.text, now))
+	}
+	weatherUplinkMutex.Unlock()
+
+	for _, f := range makeUplinkFrames(pack, infoFrames) {
+		relayMessage(MSGTYPE_UPLINK, f)
+	}
+}
+
+func weatherUplinkEmulator() {
+	ticker := time.NewTicker(weatherUplinkBroadcastInterval)
+	var nextFetch time.Time
+	region := ""
+	for {
+		pack, ok := weatherUplinkRegion()
+		if globalSettings.WeatherUplinkRegion != region {
+			// Region changed, don't send the old stations from the new location
+			weatherUplinkMutex.Lock()
+			weatherUplinkReports = make(map[string]weatherUplinkReport)
+			weatherUplinkMutex.Unlock()
+			region = globalSettings.WeatherUplinkRegion
+			nextFetch = time.Time{}
+		}
+		if ok && time.Now().After(nextFetch) {
+			err := fetchWeatherUplinkReports("METAR", weatherUplinkMetarURL, pack.Stations)
+			if err == nil {
+				err = fetchWeatherUplinkReports("TAF", weatherUplinkTafURL, pack.Stations)
+			}
+			if err != nil {
+				log.Printf("Weather uplink (%s): %s\n", region, err.Error())
+				nextFetch = time.Now().Add(weatherUplinkRetryInterval)
+			} else {
+				nextFetch = time.Now().Add(weatherUplinkFetchInterval)
+			}
+		}
+		if ok {
+			broadcastWeatherUplink(pack)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,164 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wifilinkquality.go: Rate-adaptive Wi-Fi output. The signal and retry statistics of every
+		station on our AP are polled from the driver (iw station dump). Clients at the edge of
+		the RF range (low signal or many retries) get the optional traffic cut:
+		weather uplinks, raw UAT reports and targets without alarm beyond
+		wifiPoorLinkTrafficRange. Ownship, heartbeats, AHRS and everything with an alarm
+		still goes out, so the little airtime the client has left is used for what matters.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	wifiLinkPollInterval     = 5 * time.Second
+	wifiLinkPoorSignal       = -82   // dBm, link becomes poor below
+	wifiLinkGoodSignal       = -77   // dBm, and good again above (hysteresis)
+	wifiLinkPoorRetryRatio   = 0.5   // tx retries per tx packet since the last poll
+	wifiLinkGoodRetryRatio   = 0.3   //
+	wifiPoorLinkTrafficRange = 18520 // m (10 nm). Farther targets without alarm are optional
+)
+
+type wifiStation struct {
+	signal    int // dBm
+	txPackets uint64
+	txRetries uint64
+	txFailed  uint64
+}
+
+var wifiStations map[string]wifiStation // by IP, as of the last poll. Only used by wifiLinkMonitor()
+
+/*
+parseStationDump parses the output of `iw dev wlan0 station dump`, by MAC:
+
+	Station 11:22:33:44:55:66 (on wlan0)
+		tx packets:	1234
+		tx retries:	56
+		tx failed:	2
+		signal:  	-60 [-60] dBm
+*/
+func parseStationDump(out string) map[string]wifiStation {
+	ret := make(map[string]wifiStation)
+	mac := ""
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Station ") {
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				mac = strings.ToLower(fields[1])
+				ret[mac] = wifiStation{}
+			}
+			continue
+		}
+		x := strings.SplitN(line, ":", 2)
+		if len(mac) == 0 || len(x) != 2 {
+			continue
+		}
+		fields := strings.Fields(x[1])
+		if len(fields) == 0 {
+			continue
+		}
+		st := ret[mac]
+		switch x[0] {
+		case "signal":
+			st.signal, _ = strconv.Atoi(fields[0])
+		case "tx packets":
+			st.txPackets, _ = strconv.ParseUint(fields[0], 10, 64)
+		case "tx retries":
+			st.txRetries, _ = strconv.ParseUint(fields[0], 10, 64)
+		case "tx failed":
+			st.txFailed, _ = strconv.ParseUint(fields[0], 10, 64)
+		}
+		ret[mac] = st
+	}
+	return ret
+}
+
+// readArpTable returns the IP for each MAC on wlan0 from /proc/net/arp.
+func readArpTable() map[string]string {
+	ret := make(map[string]string)
+	dat, err := ioutil.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ret
+	}
+	// IP address       HW type     Flags       HW address            Mask     Device
+	for _, line := range strings.Split(string(dat), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 6 && fields[5] == "wlan0" {
+			ret[strings.ToLower(fields[3])] = fields[0]
+		}
+	}
+	return ret
+}
+
+// isPoorLink returns true if optional traffic should not be sent to this client.
+func isPoorLink(netconn networkConnection) bool {
+	return globalSettings.WiFiLinkAdapt_Enabled && netconn.PoorLink
+}
+
+func wifiLinkMonitor() {
+	wifiStations = make(map[string]wifiStation)
+	ticker := time.NewTicker(wifiLinkPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if isX86DebugMode() {
+			continue
+		}
+		out, err := exec.Command("iw", "dev", "wlan0", "station", "dump").Output()
+		if err != nil {
+			continue
+		}
+		arp := readArpTable()
+		stations := make(map[string]wifiStation)
+		for mac, st := range parseStationDump(string(out)) {
+			if ip, ok := arp[mac]; ok {
+				stations[ip] = st
+			}
+		}
+
+		netMutex.Lock()
+		for k, netconn := range outSockets {
+			st, ok := stations[netconn.Ip]
+			if !ok {
+				continue // Not on our AP (e.g. a static IP on ethernet)
+			}
+			retryRatio := 0.0
+			if prev, ok := wifiStations[netconn.Ip]; ok && st.txPackets > prev.txPackets && st.txRetries >= prev.txRetries {
+				retryRatio = float64(st.txRetries-prev.txRetries) / float64(st.txPackets-prev.txPackets)
+			}
+			poor := netconn.PoorLink
+			if poor {
+				poor = st.signal < wifiLinkGoodSignal || retryRatio > wifiLinkGoodRetryRatio
+			} else {
+				poor = st.signal < wifiLinkPoorSignal || retryRatio > wifiLinkPoorRetryRatio
+			}
+			if poor != netconn.PoorLink && globalSettings.WiFiLinkAdapt_Enabled {
+				if poor {
+					log.Printf("%s:%d - poor Wi-Fi link (signal %d dBm, %.0f%% retries), sending essential traffic only.\n", netconn.Ip, netconn.Port, st.signal, retryRatio*100)
+				} else {
+					log.Printf("%s:%d - Wi-Fi link recovered (signal %d dBm), sending all traffic.\n", netconn.Ip, netconn.Port, st.signal)
+				}
+			}
+			netconn.LinkSignal = st.signal
+			netconn.LinkRetryRatio = retryRatio
+			netconn.PoorLink = poor
+			outSockets[k] = netconn
+		}
+		netMutex.Unlock()
+		wifiStations = stations
+	}
+}
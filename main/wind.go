@@ -0,0 +1,267 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wind.go: Wind estimate and head/cross wind components. We have no airspeed of our own, so the
+		wind is estimated from GPS while circling: flying a full circle at constant airspeed, the
+		air velocity averages out and the mean ground velocity vector is the wind. Every circle
+		(thermalling, holding, pattern turns) refines the estimate.
+		In straight flight, if an air data source gives us the true airspeed (IAS of $LXWP0, see
+		updateTAS()), the wind is also estimated with the zigzag method: the ground velocities of
+		a few different tracks all lie on a circle with radius TAS around the wind vector.
+		Components are published in mySituation for the current track and for the runway heading
+		entered by the user (globalSettings.RunwayHeading).
+		The estimate is sent as $WIMWV,<from, degrees true>,T,<knots>,N,A if NMEAOut_WIMWV is set.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	windMinGroundSpeed = 20.0             // knots, below that we are probably on the ground
+	windMinTurnRate    = 2.0              // degrees/second, slower turns are not circling
+	windMaxAge         = 30 * time.Minute // Estimates older than that are dropped
+	windSmoothing      = 0.5              // Weight of a new circle against the previous estimate
+
+	windTASTimeout        = 3 * time.Second
+	windZigzagWindow      = 60 * time.Second // Samples older than that are dropped
+	windZigzagMinSpread   = 20.0             // degrees, tracks must differ at least this much
+	windZigzagMaxResidual = 5.0              // knots rms, worse fits are rejected (TAS or wind not constant)
+	windZigzagSmoothing   = 0.2              // Weaker than a circle, small track differences amplify errors
+)
+
+type windSample struct {
+	vx, vy float64 // ground velocity, knots east/north
+	turned float64 // degrees turned since the previous sample, right positive
+}
+
+var windSamples []windSample
+var windTurned float64 // Sum of windSamples[].turned
+var windLastTrack float64
+
+type windZigzagSample struct {
+	vx, vy float64 // ground velocity, knots east/north
+	track  float64
+	tas    float64 // knots
+	t      time.Time
+}
+
+var windZigzagSamples []windZigzagSample
+
+var windTAS float64 // knots
+var windTASTime time.Time
+var windTASMutex = &sync.Mutex{}
+
+// updateTAS is called by air data sources with the current true airspeed in knots.
+func updateTAS(tas float64) {
+	windTASMutex.Lock()
+	windTAS, windTASTime = tas, stratuxClock.Time
+	windTASMutex.Unlock()
+}
+
+// currentTAS returns the true airspeed, ok = false if no air data source sent it recently.
+func currentTAS() (float64, bool) {
+	windTASMutex.Lock()
+	defer windTASMutex.Unlock()
+	if windTASTime.IsZero() || stratuxClock.Since(windTASTime) > windTASTimeout {
+		return 0, false
+	}
+	return windTAS, true
+}
+
+// windVector returns the vector the wind blows towards (knots east/north) for a "from" direction.
+func windVector(from, speed float64) (float64, float64) {
+	rad := (from + 180) * math.Pi / 180
+	return speed * math.Sin(rad), speed * math.Cos(rad)
+}
+
+// windComponents returns the headwind (negative = tailwind) and crosswind (positive = from the right) for a heading.
+func windComponents(from, speed, heading float64) (head, cross float64) {
+	rel := (from - heading) * math.Pi / 180
+	return speed * math.Cos(rel), speed * math.Sin(rel)
+}
+
+func resetWindCircle() {
+	windSamples = windSamples[:0]
+	windTurned = 0
+}
+
+// addWindSample feeds one GPS sample. Returns true and the mean ground velocity once per completed circle.
+func addWindSample(track, gs, turnRate float64) (bool, float64, float64) {
+	if gs < windMinGroundSpeed || math.Abs(turnRate) < windMinTurnRate {
+		resetWindCircle()
+		return false, 0, 0
+	}
+	turned := 0.0
+	if len(windSamples) > 0 {
+		turned = math.Mod(track-windLastTrack+540, 360) - 180
+		if turned*windTurned < 0 {
+			resetWindCircle() // Reversed the turn
+			turned = 0
+		}
+	}
+	windLastTrack = track
+	s := windSample{turned: turned}
+	s.vx, s.vy = gs*math.Sin(track*math.Pi/180), gs*math.Cos(track*math.Pi/180)
+	windSamples = append(windSamples, s)
+	windTurned += turned
+	if math.Abs(windTurned) < 360 {
+		return false, 0, 0
+	}
+	// Keep exactly one circle. The first sample's turn is before the circle starts.
+	for len(windSamples) > 1 && math.Abs(windTurned-windSamples[1].turned) >= 360 {
+		windSamples = windSamples[1:]
+		windTurned -= windSamples[0].turned
+	}
+	var vx, vy float64
+	for _, s := range windSamples[1:] {
+		vx += s.vx
+		vy += s.vy
+	}
+	n := float64(len(windSamples) - 1)
+	// The next circle starts here, so every circle is one estimate and not every sample after the first circle
+	windSamples = append(windSamples[:0], windSamples[len(windSamples)-1])
+	windTurned = 0
+	return true, vx / n, vy / n
+}
+
+func resetWindZigzag() {
+	windZigzagSamples = windZigzagSamples[:0]
+}
+
+// addWindZigzagSample feeds one GPS sample with the TAS at that time. Returns true and the wind (blowing
+// towards vx/vy) once the samples have enough different tracks and fit a constant wind.
+func addWindZigzagSample(track, gs, tas float64) (bool, float64, float64) {
+	for len(windZigzagSamples) > 0 && stratuxClock.Since(windZigzagSamples[0].t) > windZigzagWindow {
+		windZigzagSamples = windZigzagSamples[1:]
+	}
+	s := windZigzagSample{track: track, tas: tas, t: stratuxClock.Time}
+	s.vx, s.vy = gs*math.Sin(track*math.Pi/180), gs*math.Cos(track*math.Pi/180)
+	windZigzagSamples = append(windZigzagSamples, s)
+
+	minRel, maxRel := 0.0, 0.0
+	for _, s := range windZigzagSamples {
+		rel := math.Mod(s.track-windZigzagSamples[0].track+540, 360) - 180
+		minRel, maxRel = math.Min(minRel, rel), math.Max(maxRel, rel)
+	}
+	if maxRel-minRel < windZigzagMinSpread {
+		return false, 0, 0
+	}
+
+	// |g - w| = TAS for every sample. Subtracting the mean of these equations (squared) leaves
+	// (g - mean g) * w = ((|g|^2 - mean |g|^2) - (TAS^2 - mean TAS^2)) / 2, linear in w: least squares.
+	n := float64(len(windZigzagSamples))
+	var mx, my, mg2, ma2 float64
+	for _, s := range windZigzagSamples {
+		mx += s.vx / n
+		my += s.vy / n
+		mg2 += (s.vx*s.vx + s.vy*s.vy) / n
+		ma2 += s.tas * s.tas / n
+	}
+	var sxx, sxy, syy, bx, by float64
+	for _, s := range windZigzagSamples {
+		dx, dy := s.vx-mx, s.vy-my
+		r := ((s.vx*s.vx + s.vy*s.vy - mg2) - (s.tas*s.tas - ma2)) / 2
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+		bx += dx * r
+		by += dy * r
+	}
+	det := sxx*syy - sxy*sxy
+	if math.Abs(det) < 1e-6 {
+		return false, 0, 0
+	}
+	wx, wy := (syy*bx-sxy*by)/det, (sxx*by-sxy*bx)/det
+
+	var residual float64
+	for _, s := range windZigzagSamples {
+		e := math.Hypot(s.vx-wx, s.vy-wy) - s.tas
+		residual += e * e / n
+	}
+	resetWindZigzag()
+	if math.Sqrt(residual) > windZigzagMaxResidual || math.Hypot(wx, wy) > math.Sqrt(ma2) {
+		return false, 0, 0 // Wind can't be faster than we fly, that's a bad fit as well
+	}
+	return true, wx, wy
+}
+
+// updateWind stores a new estimate (wind blowing towards vx/vy) with the weight against the previous one, and the components in mySituation.
+func updateWind(vx, vy, weight float64) {
+	mySituation.muWind.Lock()
+	defer mySituation.muWind.Unlock()
+	if mySituation.WindValid {
+		pvx, pvy := windVector(float64(mySituation.WindDirection), float64(mySituation.WindSpeed))
+		vx = pvx + weight*(vx-pvx)
+		vy = pvy + weight*(vy-pvy)
+	}
+	mySituation.WindSpeed = float32(math.Hypot(vx, vy))
+	mySituation.WindDirection = float32(math.Mod(math.Atan2(vx, vy)*180/math.Pi+180+360, 360))
+	mySituation.WindLastEstimateTime = stratuxClock.Time
+	mySituation.WindValid = true
+}
+
+func updateWindComponents(track float64, trackValid bool) {
+	mySituation.muWind.Lock()
+	defer mySituation.muWind.Unlock()
+	if mySituation.WindValid && stratuxClock.Since(mySituation.WindLastEstimateTime) > windMaxAge {
+		mySituation.WindValid = false
+	}
+	mySituation.WindHeadwind, mySituation.WindCrosswind = 0, 0
+	mySituation.WindRunwayHeadwind, mySituation.WindRunwayCrosswind = 0, 0
+	if !mySituation.WindValid {
+		return
+	}
+	from, speed := float64(mySituation.WindDirection), float64(mySituation.WindSpeed)
+	if trackValid {
+		head, cross := windComponents(from, speed, track)
+		mySituation.WindHeadwind, mySituation.WindCrosswind = float32(head), float32(cross)
+	}
+	if globalSettings.RunwayHeading > 0 {
+		head, cross := windComponents(from, speed, float64(globalSettings.RunwayHeading))
+		mySituation.WindRunwayHeadwind, mySituation.WindRunwayCrosswind = float32(head), float32(cross)
+	}
+}
+
+func windEstimator() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		situation := getSituation()
+		trackValid := situation.GPSGroundTrackValid && situation.GPSGroundSpeed >= windMinGroundSpeed
+		if trackValid {
+			if ok, vx, vy := addWindSample(float64(situation.GPSTrueCourse), situation.GPSGroundSpeed, situation.GPSTurnRate); ok {
+				updateWind(vx, vy, windSmoothing)
+			}
+			if tas, ok := currentTAS(); ok && math.Abs(situation.GPSTurnRate) < windMinTurnRate {
+				if ok, vx, vy := addWindZigzagSample(float64(situation.GPSTrueCourse), situation.GPSGroundSpeed, tas); ok {
+					updateWind(vx, vy, windZigzagSmoothing)
+				}
+			} else {
+				resetWindZigzag()
+			}
+		} else {
+			resetWindCircle()
+			resetWindZigzag()
+		}
+		updateWindComponents(float64(situation.GPSTrueCourse), trackValid)
+	}
+}
+
+// makeWIMWVString returns the wind estimate as $WIMWV, empty if there is none.
+func makeWIMWVString() string {
+	s := getSituation()
+	if !s.WindValid {
+		return ""
+	}
+	msg := fmt.Sprintf("WIMWV,%d,T,%.1f,N,A", int(math.Round(float64(s.WindDirection)))%360, s.WindSpeed)
+	return makeNMEASentence(msg)
+}
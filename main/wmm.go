@@ -0,0 +1,227 @@
+/*
+	Copyright (c) 2020 Adrian Batzill
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wmm.go: Magnetic variation from the World Magnetic Model (WMM2025, NOAA/NGA), degree and order 12.
+		Used for the variation fields of $GPRMC and magnetic track/heading outputs. Several panel
+		displays reject a GPRMC without variation. Accuracy is well below 1° outside the polar
+		regions. The model is valid 2025-2030, later dates are extrapolated with the secular
+		variation - the error grows slowly (a few tenths of a degree per year) until the
+		coefficients are updated.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	wmmEpoch        = 2025.0
+	wmmMaxDegree    = 12
+	wmmRefRadius    = 6371.2 // km, geomagnetic reference radius
+	wmmWGS84A       = 6378.137
+	wmmWGS84F       = 1 / 298.257223563
+	wmmCacheDist    = 0.1 // degrees lat/lon - the variation changes slowly, don't recompute for every sentence
+	wmmCacheTimeout = 1 * time.Hour
+)
+
+// WMM2025.COF: n, m, g, h (nT), g dot, h dot (nT/year)
+var wmmCoefficients = [][6]float64{
+	{1, 0, -29351.8, 0.0, 12.0, 0.0},
+	{1, 1, -1410.8, 4545.4, 9.7, -21.5},
+	{2, 0, -2556.6, 0.0, -11.6, 0.0},
+	{2, 1, 2951.1, -3133.6, -5.2, -27.7},
+	{2, 2, 1649.3, -815.1, -8.0, -12.1},
+	{3, 0, 1361.0, 0.0, -1.3, 0.0},
+	{3, 1, -2404.1, -56.6, -4.2, 4.0},
+	{3, 2, 1243.8, 237.5, 0.4, -0.3},
+	{3, 3, 453.6, -549.5, -15.6, -4.1},
+	{4, 0, 895.0, 0.0, -1.6, 0.0},
+	{4, 1, 799.5, 278.6, -2.4, -1.1},
+	{4, 2, 55.7, -133.9, -6.0, 4.1},
+	{4, 3, -281.1, 212.0, 5.6, 1.6},
+	{4, 4, 12.1, -375.6, -7.0, -4.4},
+	{5, 0, -233.2, 0.0, 0.6, 0.0},
+	{5, 1, 368.9, 45.4, 1.4, -0.5},
+	{5, 2, 187.2, 220.2, 0.0, 2.2},
+	{5, 3, -138.7, -122.9, 0.6, 0.4},
+	{5, 4, -142.0, 43.0, 2.2, 1.7},
+	{5, 5, 20.9, 106.1, 0.9, 1.9},
+	{6, 0, 64.4, 0.0, -0.2, 0.0},
+	{6, 1, 63.8, -18.4, -0.4, 0.3},
+	{6, 2, 76.9, 16.8, 0.9, -1.6},
+	{6, 3, -115.7, 48.8, 1.2, -0.4},
+	{6, 4, -40.9, -59.8, -0.9, 0.9},
+	{6, 5, 14.9, 10.9, 0.3, 0.7},
+	{6, 6, -60.7, 72.7, 0.9, 0.9},
+	{7, 0, 79.5, 0.0, -0.0, 0.0},
+	{7, 1, -77.0, -48.9, -0.1, 0.6},
+	{7, 2, -8.8, -14.4, -0.1, 0.5},
+	{7, 3, 59.3, -1.0, 0.5, -0.8},
+	{7, 4, 15.8, 23.4, -0.1, 0.0},
+	{7, 5, 2.5, -7.4, -0.8, -1.0},
+	{7, 6, -11.1, -25.1, -0.8, 0.6},
+	{7, 7, 14.2, -2.3, 0.8, -0.2},
+	{8, 0, 23.2, 0.0, -0.1, 0.0},
+	{8, 1, 10.8, 7.1, 0.2, -0.2},
+	{8, 2, -17.5, -12.6, 0.0, 0.5},
+	{8, 3, 2.0, 11.4, 0.5, -0.4},
+	{8, 4, -21.7, -9.7, -0.1, 0.4},
+	{8, 5, 16.9, 12.7, 0.3, -0.5},
+	{8, 6, 15.0, 0.7, 0.2, -0.6},
+	{8, 7, -16.8, -5.2, -0.0, 0.3},
+	{8, 8, 0.9, 3.9, 0.2, 0.2},
+	{9, 0, 4.6, 0.0, -0.0, 0.0},
+	{9, 1, 7.8, -24.8, -0.1, -0.3},
+	{9, 2, 3.0, 12.2, 0.1, 0.3},
+	{9, 3, -0.2, 8.3, 0.3, -0.3},
+	{9, 4, -2.5, -3.3, -0.3, 0.3},
+	{9, 5, -13.1, -5.2, 0.0, 0.2},
+	{9, 6, 2.4, 7.2, 0.3, -0.1},
+	{9, 7, 8.6, -0.6, -0.1, -0.2},
+	{9, 8, -8.7, 0.8, 0.1, 0.4},
+	{9, 9, -12.9, 10.0, -0.1, 0.1},
+	{10, 0, -1.3, 0.0, 0.1, 0.0},
+	{10, 1, -6.4, 3.3, 0.0, 0.0},
+	{10, 2, 0.2, 0.0, 0.1, -0.0},
+	{10, 3, 2.0, 2.4, 0.1, -0.2},
+	{10, 4, -1.0, 5.3, -0.0, 0.1},
+	{10, 5, -0.6, -9.1, -0.3, -0.1},
+	{10, 6, -0.9, 0.4, 0.0, 0.1},
+	{10, 7, 1.5, -4.2, -0.1, 0.0},
+	{10, 8, 0.9, -3.8, -0.1, -0.1},
+	{10, 9, -2.7, 0.9, -0.0, 0.2},
+	{10, 10, -3.9, -9.1, -0.0, -0.0},
+	{11, 0, 2.9, 0.0, 0.0, 0.0},
+	{11, 1, -1.5, 0.0, -0.0, -0.0},
+	{11, 2, -2.5, 2.9, 0.0, 0.1},
+	{11, 3, 2.4, -0.6, 0.0, -0.0},
+	{11, 4, -0.6, 0.2, 0.0, 0.1},
+	{11, 5, -0.1, 0.5, -0.1, -0.0},
+	{11, 6, -0.6, -0.3, 0.0, -0.0},
+	{11, 7, -0.1, -1.2, -0.0, 0.1},
+	{11, 8, 1.1, -1.7, -0.1, -0.0},
+	{11, 9, -1.0, -2.9, -0.1, 0.0},
+	{11, 10, -0.2, -1.8, -0.1, 0.0},
+	{11, 11, 2.6, -2.3, -0.1, 0.0},
+	{12, 0, -2.0, 0.0, 0.0, 0.0},
+	{12, 1, -0.2, -1.3, 0.0, -0.0},
+	{12, 2, 0.3, 0.7, -0.0, 0.0},
+	{12, 3, 1.2, 1.0, -0.0, -0.1},
+	{12, 4, -1.3, -1.4, -0.0, 0.1},
+	{12, 5, 0.6, -0.0, -0.0, -0.0},
+	{12, 6, 0.6, 0.6, 0.1, -0.0},
+	{12, 7, 0.5, -0.1, -0.0, -0.0},
+	{12, 8, -0.1, 0.8, 0.0, 0.0},
+	{12, 9, -0.4, 0.1, 0.0, -0.0},
+	{12, 10, -0.2, -1.0, -0.1, -0.0},
+	{12, 11, -1.3, 0.1, -0.0, 0.0},
+	{12, 12, -0.7, 0.2, -0.1, -0.1},
+}
+
+// decimalYear converts t to a fractional year, as used by the model.
+func decimalYear(t time.Time) float64 {
+	t = t.UTC()
+	start := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+	return float64(t.Year()) + t.Sub(start).Seconds()/end.Sub(start).Seconds()
+}
+
+// wmmDeclination returns the magnetic variation in degrees (positive = east) at a geodetic position.
+// altKm: height above the WGS84 ellipsoid.
+func wmmDeclination(lat, lon, altKm float64, year float64) float64 {
+	// The model is singular at the poles
+	lat = math.Max(-89.9999, math.Min(89.9999, lat))
+	phi := radians(lat)
+	lambda := radians(lon)
+
+	// Geodetic to geocentric spherical coordinates
+	e2 := wmmWGS84F * (2 - wmmWGS84F)
+	rc := wmmWGS84A / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	p := (rc + altKm) * math.Cos(phi)
+	z := (rc*(1-e2) + altKm) * math.Sin(phi)
+	r := math.Sqrt(p*p + z*z)
+	phiC := math.Asin(z / r)
+
+	// Schmidt semi-normalized associated Legendre functions of the colatitude and their derivatives
+	cosT, sinT := math.Sin(phiC), math.Cos(phiC)
+	var P, dP [wmmMaxDegree + 1][wmmMaxDegree + 1]float64
+	P[0][0] = 1
+	for n := 1; n <= wmmMaxDegree; n++ {
+		if n == 1 {
+			P[1][1], dP[1][1] = sinT, cosT
+		} else {
+			k := math.Sqrt(float64(2*n-1) / float64(2*n))
+			P[n][n] = k * sinT * P[n-1][n-1]
+			dP[n][n] = k * (cosT*P[n-1][n-1] + sinT*dP[n-1][n-1])
+		}
+		for m := 0; m < n; m++ {
+			k1 := float64(2*n - 1)
+			k2 := 0.0
+			if n >= 2 {
+				k2 = math.Sqrt(float64((n-1)*(n-1) - m*m))
+			}
+			norm := math.Sqrt(float64(n*n - m*m))
+			var p2, dp2 float64
+			if n >= 2 && m <= n-2 {
+				p2, dp2 = P[n-2][m], dP[n-2][m]
+			}
+			P[n][m] = (k1*cosT*P[n-1][m] - k2*p2) / norm
+			dP[n][m] = (k1*(cosT*dP[n-1][m]-sinT*P[n-1][m]) - k2*dp2) / norm
+		}
+	}
+
+	// Field in geocentric coordinates. X north, Y east, Z down.
+	dt := year - wmmEpoch
+	var x, y float64
+	var zc float64
+	for _, c := range wmmCoefficients {
+		n, m := int(c[0]), int(c[1])
+		g := c[2] + dt*c[4]
+		h := c[3] + dt*c[5]
+		ar := math.Pow(wmmRefRadius/r, float64(n+2))
+		cosM, sinM := math.Cos(float64(m)*lambda), math.Sin(float64(m)*lambda)
+		x += ar * (g*cosM + h*sinM) * dP[n][m]
+		y += ar * float64(m) * (g*sinM - h*cosM) * P[n][m] / sinT
+		zc -= ar * float64(n+1) * (g*cosM + h*sinM) * P[n][m]
+	}
+	// Rotate to the geodetic frame. Y is the same in both, so only X changes.
+	psi := phiC - phi
+	x = x*math.Cos(psi) - zc*math.Sin(psi)
+	return degrees(math.Atan2(y, x))
+}
+
+var wmmCache struct {
+	sync.Mutex
+	lat, lon  float64
+	computed  time.Time
+	variation float64
+}
+
+// magneticVariation returns the variation at a position now (degrees, positive = east), cached for nearby positions.
+func magneticVariation(lat, lon float32) float64 {
+	wmmCache.Lock()
+	defer wmmCache.Unlock()
+	if !wmmCache.computed.IsZero() && time.Since(wmmCache.computed) < wmmCacheTimeout &&
+		math.Abs(float64(lat)-wmmCache.lat) < wmmCacheDist && math.Abs(float64(lon)-wmmCache.lon) < wmmCacheDist {
+		return wmmCache.variation
+	}
+	wmmCache.lat, wmmCache.lon = float64(lat), float64(lon)
+	wmmCache.variation = wmmDeclination(float64(lat), float64(lon), 0, decimalYear(time.Now()))
+	wmmCache.computed = time.Now()
+	return wmmCache.variation
+}
+
+// magneticTrack converts a true track or heading to magnetic at a position.
+func magneticTrack(trueTrack float64, lat, lon float32) float64 {
+	mt := math.Mod(trueTrack-magneticVariation(lat, lon), 360)
+	if mt < 0 {
+		mt += 360
+	}
+	return mt
+}
@@ -45,6 +45,8 @@ type UATFrame struct {
 	Product_id uint32
 	// Text data, if applicable.
 	Text_data []string
+	// Addresses of aircraft the ground station provides TIS-B/ADS-R service for (frame type 15).
+	TISB_service_addrs []uint32
 
 	// Flags.
 	a_f bool
@@ -76,6 +78,8 @@ type UATMsg struct {
 	Lat    float64
 	Lon    float64
 	Frames []*UATFrame
+	// TIS-B site ID of the ground station (uplink frames only).
+	TISB_site_id uint32
 }
 
 func dlac_decode(data []byte, data_len uint32) string {
@@ -482,7 +486,7 @@ func (f *UATFrame) decodeAirmet() {
 	fmt.Fprintf(ioutil.Discard, "\n\n\n")
 }
 
-func (f *UATFrame) decodeInfoFrame() {
+func (f *UATFrame) decodeInfoFrame(weather bool) {
 
 	if len(f.Raw_data) < 2 {
 		return // Can't determine Product_id.
@@ -490,8 +494,13 @@ func (f *UATFrame) decodeInfoFrame() {
 
 	f.Product_id = ((uint32(f.Raw_data[0]) & 0x1f) << 6) | (uint32(f.Raw_data[1]) >> 2)
 
-	if f.Frame_type != 0 {
-		return // Not FIS-B.
+	if f.Frame_type == 15 {
+		f.decodeTISBServiceStatus()
+		return
+	}
+
+	if f.Frame_type != 0 || !weather {
+		return // Not FIS-B, or FIS-B products not wanted.
 	}
 
 	f.decodeTimeFormat()
@@ -513,7 +522,34 @@ func (f *UATFrame) decodeInfoFrame() {
 	//	logger.Printf("pos=%d,len=%d,t_opt=%d,product_id=%d, time=%d:%d\n", frame_start, frame_len, t_opt, product_id, fisb_hours, fisb_minutes)
 }
 
+/*
+	TIS-B/ADS-R service status ("TIS-B heartbeat"). The payload is a list of 4 byte entries:
+	 one byte reserved, followed by the 24 bit address of an aircraft that the ground station
+	 currently provides TIS-B/ADS-R service for.
+*/
+func (f *UATFrame) decodeTISBServiceStatus() {
+	f.TISB_service_addrs = make([]uint32, 0)
+	for i := 0; i+4 <= len(f.Raw_data); i += 4 {
+		addr := (uint32(f.Raw_data[i+1]) << 16) | (uint32(f.Raw_data[i+2]) << 8) | uint32(f.Raw_data[i+3])
+		if addr != 0 {
+			f.TISB_service_addrs = append(f.TISB_service_addrs, addr)
+		}
+	}
+}
+
 func (u *UATMsg) DecodeUplink() error {
+	return u.decodeUplink(true)
+}
+
+/*
+	DecodeUplinkNoWeather decodes position, TIS-B site and the frame headers (product IDs, TIS-B service status)
+	of an uplink, but not the FIS-B products, which are the expensive part.
+*/
+func (u *UATMsg) DecodeUplinkNoWeather() error {
+	return u.decodeUplink(false)
+}
+
+func (u *UATMsg) decodeUplink(weather bool) error {
 	//	position_valid := (uint32(frame[5]) & 0x01) != 0
 	frame := u.msg
 
@@ -540,9 +576,9 @@ func (u *UATMsg) DecodeUplink() error {
 	//	utc_coupled := (uint32(frame[6]) & 0x80) != 0
 	app_data_valid := (uint32(frame[6]) & 0x20) != 0
 	//	slot_id := uint32(frame[6]) & 0x1f
-	//	tisb_site_id := uint32(frame[7]) >> 4
+	u.TISB_site_id = uint32(frame[7]) >> 4
 
-	//	logger.Printf("position_valid=%t, %.04f, %.04f, %t, %t, %d, %d\n", position_valid, lat, lon, utc_coupled, app_data_valid, slot_id, tisb_site_id)
+	//	logger.Printf("position_valid=%t, %.04f, %.04f, %t, %t, %d, %d\n", position_valid, lat, lon, utc_coupled, app_data_valid, slot_id, u.TISB_site_id)
 
 	if !app_data_valid {
 		return nil // Not sure when this even happens?
@@ -573,7 +609,7 @@ func (u *UATMsg) DecodeUplink() error {
 		thisFrame.frame_length = frame_length
 		thisFrame.Frame_type = frame_type
 
-		thisFrame.decodeInfoFrame()
+		thisFrame.decodeInfoFrame(weather)
 
 		// Save the decoded frame.
 		u.Frames = append(u.Frames, thisFrame)
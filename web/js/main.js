@@ -10,6 +10,7 @@ var URL_DELETELOGFILE       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/deletelogfil
 var URL_DEV_TOGGLE_GET      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/develmodetoggle";
 var URL_DOWNLOADAHRSLOGFILES = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadahrslogs";
 var URL_DOWNLOADDB          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloaddb";
+var URL_DELETENMEACAPTURE   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/deletenmeacapture";
 var URL_DOWNLOADLOGFILE     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadlog";
 var URL_GMETER_RESET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/resetGMeter";
 var URL_REBOOT              = URL_HOST_PROTOCOL + URL_HOST_BASE + "/reboot";
@@ -17,11 +18,19 @@ var URL_RESTARTAPP          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/restart";
 var URL_SATELLITES_GET      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSatellites";
 var URL_SETTINGS_GET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSettings";
 var URL_SETTINGS_SET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setSettings";
+var URL_CREDENTIALS_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getCredentials";
+var URL_SETTINGS_ERRORS     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSettingsErrors";
 var URL_SHUTDOWN            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/shutdown";
 var URL_STATUS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getStatus";
 var URL_TOWERS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getTowers";
 var URL_UPDATE_UPLOAD       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/updateUpload";
 var URL_GET_SITUATION       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSituation";
+var URL_EVENTS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getEvents";
+var URL_PHRASES_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getPhrases";
+var URL_IGC_FILES_GET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getIGCFiles";
+var URL_IGC_UPLOADS_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getIGCUploads";
+var URL_IGC_UPLOAD          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/uploadIGC";
+var URL_TRANSPONDER_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getTransponder";
 
 var URL_DEVELOPER_WS        = "ws://" + URL_HOST_BASE + "/developer";
 var URL_GPS_WS              = "ws://" + URL_HOST_BASE + "/situation";
@@ -29,6 +38,8 @@ var URL_STATUS_WS           = "ws://" + URL_HOST_BASE + "/status";
 var URL_TRAFFIC_WS          = "ws://" + URL_HOST_BASE + "/traffic";
 var URL_WEATHER_WS          = "ws://" + URL_HOST_BASE + "/weather";
 var URL_RADAR_WS            = "ws://" + URL_HOST_BASE + "/radar";
+var URL_RADARVIEW_WS        = "ws://" + URL_HOST_BASE + "/radarview";
+var URL_DEBUGCONSOLE_WS     = "ws://" + URL_HOST_BASE + "/debugconsole";
 
 // define the module with dependency on mobile-angular-ui
 //var app = angular.module('stratux', ['ngRoute', 'mobile-angular-ui', 'mobile-angular-ui.gestures', 'appControllers']);
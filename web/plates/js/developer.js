@@ -146,6 +146,15 @@ function DeveloperCtrl($rootScope, $scope, $state, $http, $interval) {
         });
     };
 
+	$scope.postDeleteNMEACapture = function () {
+		$http.post(URL_DELETENMEACAPTURE).
+		then(function (response) {
+			// do nothing
+		}, function (response) {
+			// do nothing
+		});
+	};
+
 	$scope.postDownloadDB = function () {
 		$http.post(URL_DOWNLOADDB).
 		then(function (response) {
@@ -156,6 +165,77 @@ function DeveloperCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	$scope.EventSubsystem = "";
+	$scope.Events = [];
+	$scope.loadEvents = function () {
+		$http.get(URL_EVENTS_GET, { params: { subsystem: $scope.EventSubsystem, limit: 50 } }).
+		then(function (response) {
+			$scope.Events = response.data.reverse(); // newest first
+		}, function (response) {
+			// do nothing
+		});
+	};
+	$scope.formatEventFields = function (fields) {
+		if (!fields)
+			return "";
+		return Object.keys(fields).map(function (k) { return k + "=" + fields[k]; }).join(" ");
+	};
+	$scope.loadEvents();
+
+	// Traffic debug console. Frames are only sent by Stratux while the console is running.
+	var debugConsoleMaxFrames = 200;
+	var debugSocket = null;
+	$scope.DebugFrames = [];
+	$scope.DebugConsoleRunning = false;
+	$scope.DebugConsolePaused = false;
+	$scope.DebugSource = "";
+	$scope.DebugAddr = "";
+
+	$scope.debugFrameFilter = function (f) {
+		if ($scope.DebugSource !== "" && f.Source !== $scope.DebugSource)
+			return false;
+		return $scope.DebugAddr === "" || f.Addr.indexOf($scope.DebugAddr.toUpperCase()) >= 0;
+	};
+
+	function stopDebugConsole() {
+		if (debugSocket !== null) {
+			debugSocket.onclose = null;
+			debugSocket.close();
+			debugSocket = null;
+		}
+		$scope.DebugConsoleRunning = false;
+	}
+
+	$scope.toggleDebugConsole = function () {
+		if ($scope.DebugConsoleRunning) {
+			stopDebugConsole();
+			return;
+		}
+		debugSocket = new WebSocket(URL_DEBUGCONSOLE_WS);
+		$scope.DebugConsoleRunning = true;
+		$scope.DebugConsolePaused = false;
+		debugSocket.onclose = function () {
+			debugSocket = null;
+			$scope.DebugConsoleRunning = false;
+			$scope.$apply();
+		};
+		debugSocket.onmessage = function (msg) {
+			if ($scope.DebugConsolePaused)
+				return;
+			var frame = JSON.parse(msg.data);
+			if (!$scope.debugFrameFilter(frame))
+				return; // don't let other traffic push the interesting frames out
+			$scope.DebugFrames.unshift(frame); // newest first
+			if ($scope.DebugFrames.length > debugConsoleMaxFrames)
+				$scope.DebugFrames.length = debugConsoleMaxFrames;
+			$scope.$apply();
+		};
+	};
+
+	$state.get('developer').onExit = function () {
+		stopDebugConsole();
+	};
+
 	connect($scope); // connect - opens a socket and listens for messages
 
 }
@@ -170,6 +170,10 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         $scope.gps_track = situation.GPSTrueCourse.toFixed(1);
         $scope.gps_speed = situation.GPSGroundSpeed.toFixed(1);
         $scope.gps_vert_speed = situation.GPSVerticalSpeed.toFixed(1);
+        loadWind(situation);
+        loadAirfield(situation);
+        loadAirspace(situation);
+        loadTerrain(situation);
         if ($scope.gps_lat == 0 && $scope.gps_lon == 0) {
             $scope.gps_lat = "--";
             $scope.gps_lon = "--";
@@ -189,8 +193,10 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         $scope.gps_time = Date.parse(situation.GPSLastGPSTimeStratuxTime);
         if ($scope.gps_time - $scope.press_time < 1000) {
             $scope.ahrs_alt = Math.round(situation.BaroPressureAltitude.toFixed(0));
+            $scope.ahrs_ind_alt = Math.round(situation.BaroIndicatedAltitude.toFixed(0));
         } else {
             $scope.ahrs_alt = "---";
+            $scope.ahrs_ind_alt = "---";
         }
 
         $scope.ahrs_time = Date.parse(situation.AHRSLastAttitudeTime);
@@ -310,6 +316,70 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         setGeoReferenceMap(situation.GPSLatitude, situation.GPSLongitude);
     }
 
+    // Head/cross wind components as text, e.g. "12 head, 5 from right"
+    function windComponentsText(head, cross) {
+        var text = Math.abs(head).toFixed(0) + (head >= 0 ? " head, " : " tail, ");
+        return text + Math.abs(cross).toFixed(0) + (cross >= 0 ? " from right" : " from left");
+    }
+
+    function loadWind(situation) {
+        if (!situation.WindValid) {
+            $scope.wind = "--";
+            $scope.wind_track = "--";
+            $scope.wind_runway = "";
+            return;
+        }
+        $scope.wind = situation.WindDirection.toFixed(0) + "\u00b0 @ " + situation.WindSpeed.toFixed(0) + " KTS";
+        $scope.wind_track = windComponentsText(situation.WindHeadwind, situation.WindCrosswind);
+        $scope.wind_runway = $scope.RunwayHeading > 0 ? windComponentsText(situation.WindRunwayHeadwind, situation.WindRunwayCrosswind) : "";
+    }
+
+    function loadAirfield(situation) {
+        if (!situation.AirfieldValid) {
+            $scope.airfield = "--";
+            $scope.airfield_frequency = "--";
+            return;
+        }
+        $scope.airfield = (situation.AirfieldICAO ? situation.AirfieldICAO + " " : "") + situation.AirfieldName + ", " +
+            situation.AirfieldDistance.toFixed(1) + " NM " + situation.AirfieldBearing.toFixed(0) + "\u00b0";
+        if (situation.AirfieldFrequency) {
+            $scope.airfield_frequency = situation.AirfieldFrequency + (situation.AirfieldFrequencyType ? " (" + situation.AirfieldFrequencyType + ")" : "");
+        } else {
+            $scope.airfield_frequency = "--";
+        }
+    }
+
+    function loadAirspace(situation) {
+        var warnings = situation.AirspaceWarnings || [];
+        $scope.airspace_warnings = warnings.map(function (w) {
+            return {
+                text: w.Category + " " + w.Name + " (" + w.Bottom + " - " + w.Top + ")" +
+                    (w.Inside ? ": inside" : ": " + (w.Distance / 1852).toFixed(1) + " NM"),
+                inside: w.Inside
+            };
+        });
+    }
+
+    function loadTerrain(situation) {
+        $scope.terrain_alert = situation.TerrainValid ? situation.TerrainAlert : 0;
+        if (!situation.TerrainValid) {
+            $scope.terrain_elevation = "--";
+            $scope.terrain_height = "--";
+            return;
+        }
+        $scope.terrain_elevation = situation.TerrainElevation.toFixed(0) + " ft";
+        $scope.terrain_height = situation.TerrainHeightAbove.toFixed(0) + " ft";
+    }
+
+    var runwayHeading = 0; // as saved in the settings
+
+    $scope.updateRunwayHeading = function () {
+        if (($scope.RunwayHeading !== undefined) && ($scope.RunwayHeading !== null) && ($scope.RunwayHeading !== runwayHeading)) {
+            runwayHeading = parseInt($scope.RunwayHeading);
+            $http.post(URL_SETTINGS_SET, angular.toJson({"RunwayHeading": runwayHeading}));
+        }
+    };
+
     function resetSituation() { // mySituation
         $scope.raw_data = "error getting gps / ahrs status";
         $scope.ahrs_heading = "---";
@@ -447,6 +517,8 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         then(function (response) {
             settings = angular.fromJson(response.data);
             $scope.IMU_Sensor_Enabled = settings.IMU_Sensor_Enabled;
+            runwayHeading = settings.RunwayHeading;
+            $scope.RunwayHeading = runwayHeading;
             if (settings.GLimits === "" || settings.GLimits === undefined) {
                 settings.GLimits = "-1.76 4.4";
             }
@@ -8,4 +8,27 @@ function LogsCtrl($scope, $state, $http) {
 	// just a couple environment variables that may bve useful for dev/debugging but otherwise not significant
 	$scope.userAgent = navigator.userAgent;
     $scope.deviceViewport = 'screen = ' + window.screen.width + ' x ' + window.screen.height;
+
+	// Recorded flights and their upload state, see igc.go and igcupload.go
+	$scope.igcFiles = [];
+	$scope.igcUploads = {};
+
+	function loadIgc() {
+		$http.get(URL_IGC_FILES_GET).then(function (response) {
+			$scope.igcFiles = response.data || [];
+		});
+		$http.get(URL_IGC_UPLOADS_GET).then(function (response) {
+			$scope.igcUploads = response.data || {};
+		});
+	}
+
+	$scope.uploadIgc = function (name) {
+		$http.post(URL_IGC_UPLOAD + '?file=' + encodeURIComponent(name)).then(function (response) {
+			loadIgc();
+		}, function (response) {
+			$scope.igcUploadError = response.data;
+		});
+	};
+
+	loadIgc();
 }
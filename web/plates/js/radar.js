@@ -257,6 +257,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			traffic.planeimg = radar.rScreen.group();
 			traffic.planeimg.path('m 32,6.5 0.5,0.9 0.4,1.4 5.3,0.1 -5.3,0.1 0.1,0.5 0.3,0.1 0.6,0.4 0.4,0.4 0.4,0.8 1.1,7.1 0.1,0.8 3.7,1.7 22.2,1.3 0.5,0.1 0.3,0.3 0.3,0.7 0.2,6 -0.1,0.1 -26.5,2.8 -0.3,0.1 -0.4,0.3 -0.3,0.5 -0.1,0.3 -0.9,6.3 -1.7,10.3 9.5,0 0.2,0.1 0.2,0.2 -0.1,4.6 -0.2,0.2 -8.8,0 -1.1,-2.4 -0.2,2.5 -0.3,2.5 -0.3,-2.5 -0.2,-2.5 -1.1,2.4 -8.8,0 -0.2,-0.2 -0.1,-4.6 0.2,-0.2 0.2,-0.1 9.5,0 -1.7,-10.3 -0.9,-6.3 -0.1,-0.3 -0.3,-0.5 -0.4,-0.3 -0.3,-0.1 -26.5,-2.8 -0.1,-0.1 0.2,-6 0.3,-0.7 0.3,-0.3 0.5,-0.1 22.2,-1.3 3.7,-1.7 0,-0.8 1.2,-7.1 0.4,-0.8 0.4,-0.4 0.6,-0.4 0.3,-0.1 0.1,-0.5 -5.3,-0.1 5.3,-0.1 0.4,-1.4 z')
 			    .addClass('plane')
+			    .addClass(['', '', '', 'planeClosing', 'planeClosingFast'][traffic.closure || 0])
 			    .size(30, 30)
 			    .center(distx, disty + 3);
 			traffic.planeimg.circle(2).center(distx, disty).addClass('planeRotationPoint');
@@ -291,8 +292,13 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		if (doUpdate == 1) radar.update();  // only necessary if changes were done
 	}
 
+	// Radar view updates identify targets by Key, Icao_addr alone isn't unique for non-ICAO targets
+	function trafficId(obj) {
+		return ('Key' in obj) ? obj.Key : obj.Icao_addr;
+	}
+
 	function setAircraft(obj, new_traffic) {
-		new_traffic.icao_int = obj.Icao_addr;
+		new_traffic.icao_int = trafficId(obj);
 		new_traffic.targettype = obj.TargetType;
 		var timestamp = Date.parse(obj.Timestamp);
 		var timeLack = -1;
@@ -309,7 +315,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		var n = Math.round(obj.Alt / 25) * 25;
 		new_traffic.altitude = n;
 
-		if (obj.Speed_valid) {
+		if (obj.TrackKnown) { // directional symbol only with a current track
 			new_traffic.nspeed = Math.round(obj.Speed / 5) * 5;
 			new_traffic.heading = Math.round(obj.Track / 5) * 5;
 		} else {
@@ -323,14 +329,80 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		new_traffic.Last_alt = Date.parse(obj.Last_alt);
 		new_traffic.dist = (obj.Distance / 1852);
 		new_traffic.tail = obj.Tail;  //registration No
+		new_traffic.closure = obj.ClosureClass || 0; // see closurerate.go
+	}
+
+	function removeAircraft(icao) {
+		for (var i = $scope.data_list.length; i > 0; i--) {
+			var traffic = $scope.data_list[i - 1];
+			if (traffic.icao_int !== icao) continue;
+			if (traffic.planeimg) {
+				traffic.planeimg.remove().forget();
+				traffic.planetext.remove().forget();
+				traffic.planetextOut.remove().forget();
+				traffic.planespeed.remove().forget();
+				traffic.planetail.remove().forget();
+			}
+			if (traffic.trace) {
+				traffic.trace.remove().forget();
+				traffic.trace = '';
+			}
+			$scope.data_list.splice(i - 1, 1);
+		}
+		for (var i = $scope.data_list_invalid.length; i > 0; i--) {
+			if ($scope.data_list_invalid[i - 1].icao_int !== icao) continue;
+			if ($scope.data_list_invalid[i - 1].circ) {
+				$scope.data_list_invalid[i - 1].circ.remove().forget();
+			}
+			$scope.data_list_invalid.splice(i - 1, 1);
+		}
+	}
+
+	// Distant targets are sent as clusters by the server. Draw them as circle with the number of aircraft.
+	function drawClusters(clusters) {
+		var radius_earth = 6371008.8;  // in meters
+		if ($scope.clusterimg) {
+			$scope.clusterimg.remove().forget();
+			$scope.clusterimg = null;
+		}
+		if (!clusters || clusters.length == 0) return;
+		$scope.clusterimg = radar.rScreen.group();
+		for (var i = 0; i < clusters.length; i++) {
+			var cl = clusters[i];
+			var avgLat = radiansRel((Lat + cl.Lat) / 2);
+			var distanceLat = (radiansRel(cl.Lat - Lat) * radius_earth) / 1852;
+			var distanceLng = ((radiansRel(cl.Lng - Long) * radius_earth) / 1852) * Math.abs(Math.cos(avgLat));
+			var distx = Math.round(200 / DisplayRadius * distanceLng);
+			var disty = -Math.round(200 / DisplayRadius * distanceLat);
+			$scope.clusterimg.circle(24).center(distx, disty).addClass('greenCirc');
+			$scope.clusterimg.text(String(cl.Count)).center(distx, disty).rotate(GPSCourse, distx, disty).addClass('textCirc');
+		}
 	}
 
 	function onMessageNew(msg) {
 		var message = JSON.parse(msg.data);
 		if ('RadarLimits' in message || 'RadarRange' in message) {
 			onSettingsMessage(message);
+			sendRadarViewRequest();
+			return;
+		}
+		if ('Targets' in message) {  // radar view update, only contains changes
+			for (var i = 0; i < message.Removed.length; i++) {
+				removeAircraft(message.Removed[i]);
+			}
+			for (var i = 0; i < message.Targets.length; i++) {
+				onTrafficMessage(message.Targets[i]);
+			}
+			drawClusters(message.Clusters);
+			if (radar) radar.update();
+			$scope.$apply();
 			return;
 		}
+		onTrafficMessage(message);
+		$scope.$apply();
+	}
+
+	function onTrafficMessage(message) {
 		//$scope.raw_data = angular.toJson(msg.data, true);
 
 		// we need to use an array so AngularJS can perform sorting; it also means we need to loop to find an aircraft in the traffic set
@@ -344,7 +416,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			altDiffValid = true;
 		}
 		for (var i = 0, len = $scope.data_list.length; i < len; i++) {
-			if ($scope.data_list[i].icao_int === message.Icao_addr) {
+			if ($scope.data_list[i].icao_int === trafficId(message)) {
 				setAircraft(message, $scope.data_list[i]);
 				if (message.Position_valid) checkCollisionVectorValid($scope.data_list[i]);
 				validIdx = i;
@@ -354,7 +426,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 
 		if (validIdx < 0) {  // not yet found
 			for (var i = 0, len = $scope.data_list_invalid.length; i < len; i++) {
-				if ($scope.data_list_invalid[i].icao_int === message.Icao_addr) {
+				if ($scope.data_list_invalid[i].icao_int === trafficId(message)) {
 					setAircraft(message, $scope.data_list_invalid[i]);
 					if (!message.Position_valid) checkCollisionVector($scope.data_list_invalid[i]);
 					//console.log($scope.data_list_invalid[i]);
@@ -407,8 +479,6 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			}
 			$scope.data_list_invalid.splice(invalidIdx, 1);
 		}
-
-		$scope.$apply();
 	}
 
 	function connect($scope) {
@@ -416,7 +486,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			return;  // we are getting called once after clicking away from the status page
 
 		if (($scope.rsocket === undefined) || ($scope.rsocket === null)) {
-			rsocket = new WebSocket(URL_RADAR_WS);
+			rsocket = new WebSocket(URL_RADARVIEW_WS);
 		        //console.log("rsocket created %x\n",rsocket);
 			$scope.rsocket = rsocket;                  // store socket in scope for enter/exit usage
 		}
@@ -663,6 +733,7 @@ function displaySoundStatus(speech, soundMode) {
 function communicateLimits(threshold, radarrange, $http) {  //tell raspi the limits for callback
 	AltDiffThreshold = threshold / 100;
 	DisplayRadius = radarrange;
+	sendRadarViewRequest();
 	var newsettings = {
 		'RadarLimits': threshold,
 		'RadarRange': radarrange
@@ -676,6 +747,15 @@ function communicateLimits(threshold, radarrange, $http) {  //tell raspi the lim
 	});
 }
 
+// Tell the radar view service which range we display, so it can cluster and decimate accordingly
+function sendRadarViewRequest() {
+	if ((typeof rsocket === 'undefined') || (rsocket === null) || (rsocket.readyState !== 1)) return;
+	rsocket.send(angular.toJson({
+		'Range': DisplayRadius,
+		'AltDiff': AltDiffThreshold * 100
+	}));
+}
+
 function onSettingsMessage(message) {
 	AltDiffThreshold = message.RadarLimits / 100;
 	DisplayRadius = message.RadarRange;
@@ -8,7 +8,7 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 	$scope.$parent.helppage = 'plates/settings-help.html';
 
 	var toggles = ['UAT_Enabled', 'ES_Enabled', 'OGN_Enabled', 'Ping_Enabled', 'GPS_Enabled', 'IMU_Sensor_Enabled',
-		'BMP_Sensor_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog', 'AHRSLog', 'GDL90MSLAlt_Enabled', 'SkyDemonAndroidHack', 'EstimateBearinglessDist', 'DarkMode'];
+		'BMP_Sensor_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog', 'AHRSLog', 'GDL90MSLAlt_Enabled', 'SkyDemonAndroidHack', 'EstimateBearinglessDist', 'DarkMode', 'MLAT_Enabled', 'UplinkArchive_Enabled', 'OGNAprsReport_Enabled', 'TowAutoDetect', 'DescentAlert_Enabled', 'OverloadShedding_Enabled', 'GroundStation_Enabled', 'PowerSave_Enabled', 'GlideTailSuffix', 'OGNDashboard_Enabled', 'NMEACapture_Enabled', 'DDBUpdate_Enabled', 'OGNTrackerFeed_Enabled', 'WiFiLinkAdapt_Enabled', 'BatteryTelemetry_Enabled', 'Audio_Enabled', 'AudioVario_Enabled', 'GroundAlarmSuppress', 'IGCUpload_Enabled', 'PGRMZ_GPSFallback', 'NMEAOut_GPVTG', 'NMEAOut_GPGLL', 'NMEAOut_GNTalker', 'FlarmOutStealth', 'ObstacleAlarm_Enabled', 'AirspaceWarning_Enabled', 'TerrainAlert_Enabled', 'AirConnectPasscode_Enabled', 'Bluetooth_Enabled', 'BluetoothSPP', 'BluetoothBLE', 'NMEAOutUDPBroadcast_Enabled', 'NMEAOut_Vario', 'NMEAOut_WIMWV', 'NMEAOut_Heading'];
 
 	var settings = {};
 	for (var i = 0; i < toggles.length; i++) {
@@ -18,11 +18,7 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 
 	$http.get(URL_STATUS_GET).then(function(response) {
 		var status = angular.fromJson(response.data);
-		var gpsHardwareCode = (status.GPS_detected_type & 0x0f);
-		if (gpsHardwareCode == 3)
-			$scope.hasOgnTracker = true;
-		else
-			$scope.hasOgnTracker = false;
+		$scope.hasOgnTracker = status.OGNTracker_connected;
 	});
 
 	function loadSettings(data) {
@@ -54,6 +50,11 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 
 		$scope.PPM = settings.PPM;
 		$scope.AltitudeOffset = settings.AltitudeOffset;
+		$scope.AltitudeSource = settings.AltitudeSource.toString();
+		$scope.NMEABaroPriority = settings.NMEABaroPriority.toString();
+		$scope.Geodesy = settings.Geodesy.toString();
+		$scope.Locale = settings.Locale;
+		$scope.QNH = settings.QNH;
 		$scope.WatchList = settings.WatchList;
 		$scope.OwnshipModeS = settings.OwnshipModeS;
 		$scope.DeveloperMode = settings.DeveloperMode;
@@ -61,10 +62,26 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
         $scope.GDL90MSLAlt_Enabled = settings.GDL90MSLAlt_Enabled;
 		$scope.SkyDemonAndroidHack = settings.SkyDemonAndroidHack;
 		$scope.EstimateBearinglessDist = settings.EstimateBearinglessDist
+		$scope.AntennaGainOffset = settings.AntennaGainOffset;
 		$scope.StaticIps = settings.StaticIps;
+		$scope.NMEAOutTCPPorts = settings.NMEAOutTCPPorts;
+		$scope.NMEAOutUDPBroadcast_Enabled = settings.NMEAOutUDPBroadcast_Enabled;
+		$scope.NMEAOutUDPBroadcastPort = settings.NMEAOutUDPBroadcastPort;
+		$scope.NMEAInUDPPort = settings.NMEAInUDPPort;
+		$scope.NMEASerialOut_Device = settings.NMEASerialOut_Device;
+		$scope.NMEASerialOut_Baud = settings.NMEASerialOut_Baud.toString();
+		$scope.AltEncoder_Device = settings.AltEncoder_Device;
+		$scope.AltEncoder_Baud = settings.AltEncoder_Baud.toString();
+		$scope.AltEncoder_Format = settings.AltEncoder_Format.toString();
+		$scope.AirConnectPasscode_Enabled = settings.AirConnectPasscode_Enabled;
+		$scope.AirConnectPasscode = settings.AirConnectPasscode;
+		$scope.Bluetooth_Enabled = settings.Bluetooth_Enabled;
+		$scope.BluetoothName = settings.BluetoothName;
+		$scope.BluetoothSPP = settings.BluetoothSPP;
+		$scope.BluetoothBLE = settings.BluetoothBLE;
+		$scope.LegacyDisplayIps = settings.LegacyDisplayIps;
 
         $scope.WiFiSSID = settings.WiFiSSID;
-        $scope.WiFiPassphrase = settings.WiFiPassphrase;
         $scope.WiFiSecurityEnabled = settings.WiFiSecurityEnabled;
         $scope.WiFiChannel = settings.WiFiChannel;
 		$scope.WiFiSmartEnabled = settings.WiFiSmartEnabled;
@@ -78,10 +95,83 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		$scope.OGNAddrType = settings.OGNAddrType.toString();
 		$scope.OGNAddr = settings.OGNAddr;
 		$scope.OGNAcftType = settings.OGNAcftType.toString();
+		$scope.OGNTxPower = settings.OGNTxPower;
 		$scope.OGNPilot = settings.OGNPilot;
+		$scope.OGNStealth = settings.OGNStealth;
+		$scope.OGNNoTrack = settings.OGNNoTrack;
+		$scope.OGNAprsReport_Enabled = settings.OGNAprsReport_Enabled;
+		$scope.TowAutoDetect = settings.TowAutoDetect;
+		$scope.OGNDashboard_Enabled = settings.OGNDashboard_Enabled;
+		$scope.NMEACapture_Enabled = settings.NMEACapture_Enabled;
+		$scope.DDBUpdate_Enabled = settings.DDBUpdate_Enabled;
+		$scope.OGNTrackerFeed_Enabled = settings.OGNTrackerFeed_Enabled;
+		$scope.WiFiLinkAdapt_Enabled = settings.WiFiLinkAdapt_Enabled;
+		$scope.BatteryTelemetry_Enabled = settings.BatteryTelemetry_Enabled;
+		$scope.Audio_Enabled = settings.Audio_Enabled;
+		$scope.AudioVario_Enabled = settings.AudioVario_Enabled;
+		$scope.GroundAlarmSuppress = settings.GroundAlarmSuppress;
+		$scope.IGCUpload_Enabled = settings.IGCUpload_Enabled;
+		$scope.PGRMZ_GPSFallback = settings.PGRMZ_GPSFallback;
+		$scope.NMEAOut_GPVTG = settings.NMEAOut_GPVTG;
+		$scope.NMEAOut_GPGLL = settings.NMEAOut_GPGLL;
+		$scope.NMEAOut_GNTalker = settings.NMEAOut_GNTalker;
+		$scope.NMEAOut_Vario = settings.NMEAOut_Vario;
+		$scope.NMEAOut_WIMWV = settings.NMEAOut_WIMWV;
+		$scope.NMEAOut_Heading = settings.NMEAOut_Heading;
+		$scope.FlarmOutStealth = settings.FlarmOutStealth;
+		$scope.ObstacleAlarm_Enabled = settings.ObstacleAlarm_Enabled;
+		$scope.AirspaceWarning_Enabled = settings.AirspaceWarning_Enabled;
+		$scope.AirspaceWarningDistance = settings.AirspaceWarningDistance;
+		$scope.AirspaceWarningVertical = settings.AirspaceWarningVertical;
+		$scope.AirspaceWarningCategories = settings.AirspaceWarningCategories;
+		$scope.TerrainAlert_Enabled = settings.TerrainAlert_Enabled;
+		$scope.TerrainClearance = settings.TerrainClearance;
+		$scope.DescentAlert_Enabled = settings.DescentAlert_Enabled;
+		$scope.OverloadShedding_Enabled = settings.OverloadShedding_Enabled;
+		$scope.GroundStation_Enabled = settings.GroundStation_Enabled;
+		$scope.GroundStationLat = settings.GroundStationLat;
+		$scope.GroundStationLng = settings.GroundStationLng;
+		$scope.GroundStationAlt = settings.GroundStationAlt;
+		$scope.PowerSave_Enabled = settings.PowerSave_Enabled;
+		$scope.PowerSaveWakeRadius = settings.PowerSaveWakeRadius;
+		$scope.GlideRatio = settings.GlideRatio;
+		$scope.LowAlarmAGL = settings.LowAlarmAGL;
+		$scope.NMEAOutRate = settings.NMEAOutRate.toString();
+		$scope.TakeoffAlarmTime = settings.TakeoffAlarmTime;
+		$scope.LowAlarmMaxLevel = settings.LowAlarmMaxLevel.toString();
+		$scope.FlarmRange = settings.FlarmRange;
+		$scope.FlarmMaxSentences = settings.FlarmMaxSentences;
+		$scope.FlarmProtocolVersion = settings.FlarmProtocolVersion.toString();
+		$scope.FlarmPriorityTargets = settings.FlarmPriorityTargets;
+		$scope.AlarmPreset = settings.AlarmPreset || "standard";
+		$scope.AlarmCustom = angular.copy(settings.AlarmCustom);
+		$scope.WeGlideUserId = settings.WeGlideUserId;
+		$scope.WeGlideAircraftId = settings.WeGlideAircraftId;
+		$scope.FlarmHwVersion = settings.FlarmHwVersion;
+		$scope.FlarmSwVersion = settings.FlarmSwVersion;
+		$scope.FlarmObstVersion = settings.FlarmObstVersion;
+		$scope.WeatherUplinkRegion = settings.WeatherUplinkRegion || "";
+		$scope.RemoteSDR1090 = settings.RemoteSDR1090;
+		$scope.RemoteSDR978 = settings.RemoteSDR978;
+		$scope.RemoteSDR868 = settings.RemoteSDR868;
+		$scope.BatteryAlertVoltage = settings.BatteryAlertVoltage;
+		$scope.DataLogDecimals = settings.DataLogDecimals;
+		$scope.AudioDevice = settings.AudioDevice;
+		$scope.AudioBluetoothSink = settings.AudioBluetoothSink;
+		$scope.AudioVolumeAlarm = settings.AudioVolumeAlarm;
+		$scope.AudioVolumeCallout = settings.AudioVolumeCallout;
+		$scope.AudioVolumeVario = settings.AudioVolumeVario;
+		$scope.GlideTailSuffix = settings.GlideTailSuffix;
+		$scope.OGNDashboardAddr = settings.OGNDashboardAddr;
+		$scope.DescentAlertRate = settings.DescentAlertRate;
 
 		$scope.PWMDutyMin = settings.PWMDutyMin;
 
+		$scope.MLAT_Enabled = settings.MLAT_Enabled;
+		$scope.MLAT_Server = settings.MLAT_Server;
+		$scope.MLAT_User = settings.MLAT_User;
+		$scope.UplinkArchive_Enabled = settings.UplinkArchive_Enabled;
+
 		// Update theme
 		$scope.$parent.updateTheme($scope.DarkMode);
 	}
@@ -105,6 +195,8 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		$http.post(URL_SETTINGS_SET, msg).
 		then(function (response) {
 			loadSettings(response.data);
+			getCredentials();
+			getSettingsErrors();
 			// $scope.$apply();
 		}, function (response) {
 			$scope.rawSettings = "error setting settings";
@@ -115,7 +207,34 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		});
 	}
 
+	function getCredentials() {
+		$http.get(URL_CREDENTIALS_GET).
+		then(function (response) {
+			$scope.WiFiPassphraseSet = response.data.WiFiPassphrase === true;
+			$scope.WeGlideDateOfBirthSet = response.data.WeGlideDateOfBirth === true;
+		});
+	}
+
+	// Values Stratux rejected, from the settings file or from this page
+	function getSettingsErrors() {
+		$http.get(URL_SETTINGS_ERRORS).
+		then(function (response) {
+			$scope.SettingsErrors = response.data;
+		});
+	}
+
+	$scope.clearSettingsErrors = function () {
+		$http.post(URL_SETTINGS_ERRORS).
+		then(function (response) {
+			$scope.SettingsErrors = response.data;
+		});
+	};
+
+	$scope.WiFiPassphrase = ""; // Never sent by Stratux, empty keeps the stored one
+	$scope.WeGlideDateOfBirth = ""; // Same
 	getSettings();
+	getCredentials();
+	getSettingsErrors();
 
     // Reset all settings from a button on the page
     $scope.resetSettings = function () {
@@ -175,6 +294,16 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updatemlat = function () {
+		if ($scope.MLAT_Server !== settings["MLAT_Server"] || $scope.MLAT_User !== settings["MLAT_User"]) {
+			var newsettings = {
+				"MLAT_Server": $scope.MLAT_Server || "",
+				"MLAT_User": $scope.MLAT_User || ""
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.updatewatchlist = function () {
 		if ($scope.WatchList !== settings["WatchList"]) {
 			settings["WatchList"] = "";
@@ -200,6 +329,106 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updatelegacydisplayips = function () {
+		if ($scope.LegacyDisplayIps !== settings.LegacyDisplayIps) {
+			var newsettings = {
+				"LegacyDisplayIps": $scope.LegacyDisplayIps === undefined? "" : $scope.LegacyDisplayIps.join(' ')
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEAOutTCPPorts = function () {
+		if ($scope.NMEAOutTCPPorts !== settings.NMEAOutTCPPorts) {
+			var newsettings = {
+				"NMEAOutTCPPorts": $scope.NMEAOutTCPPorts === undefined? [] : $scope.NMEAOutTCPPorts.filter(function (p) { return p !== ""; }).map(Number)
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEAOutUDPBroadcastPort = function () {
+		if (($scope.NMEAOutUDPBroadcastPort !== undefined) && ($scope.NMEAOutUDPBroadcastPort !== null) && ($scope.NMEAOutUDPBroadcastPort !== settings["NMEAOutUDPBroadcastPort"])) {
+			settings["NMEAOutUDPBroadcastPort"] = parseInt($scope.NMEAOutUDPBroadcastPort);
+			var newsettings = {
+				"NMEAOutUDPBroadcastPort": settings["NMEAOutUDPBroadcastPort"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEAInUDPPort = function () {
+		if (($scope.NMEAInUDPPort !== undefined) && ($scope.NMEAInUDPPort !== null) && ($scope.NMEAInUDPPort !== settings["NMEAInUDPPort"])) {
+			settings["NMEAInUDPPort"] = parseInt($scope.NMEAInUDPPort);
+			var newsettings = {
+				"NMEAInUDPPort": settings["NMEAInUDPPort"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEASerialOutDevice = function () {
+		if (($scope.NMEASerialOut_Device !== undefined) && ($scope.NMEASerialOut_Device !== settings["NMEASerialOut_Device"])) {
+			settings["NMEASerialOut_Device"] = $scope.NMEASerialOut_Device;
+			var newsettings = {
+				"NMEASerialOut_Device": settings["NMEASerialOut_Device"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEASerialOutBaud = function () {
+		if (parseInt($scope.NMEASerialOut_Baud) !== settings["NMEASerialOut_Baud"]) {
+			settings["NMEASerialOut_Baud"] = parseInt($scope.NMEASerialOut_Baud);
+			var newsettings = {
+				"NMEASerialOut_Baud": settings["NMEASerialOut_Baud"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAltEncoderDevice = function () {
+		if (($scope.AltEncoder_Device !== undefined) && ($scope.AltEncoder_Device !== settings["AltEncoder_Device"])) {
+			settings["AltEncoder_Device"] = $scope.AltEncoder_Device;
+			var newsettings = {
+				"AltEncoder_Device": settings["AltEncoder_Device"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAltEncoder = function () {
+		if ((parseInt($scope.AltEncoder_Baud) !== settings["AltEncoder_Baud"]) || (parseInt($scope.AltEncoder_Format) !== settings["AltEncoder_Format"])) {
+			settings["AltEncoder_Baud"] = parseInt($scope.AltEncoder_Baud);
+			settings["AltEncoder_Format"] = parseInt($scope.AltEncoder_Format);
+			var newsettings = {
+				"AltEncoder_Baud": settings["AltEncoder_Baud"],
+				"AltEncoder_Format": settings["AltEncoder_Format"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAirConnectPasscode = function () {
+		if ($scope.AirConnectPasscode && $scope.AirConnectPasscode !== settings["AirConnectPasscode"]) {
+			settings["AirConnectPasscode"] = $scope.AirConnectPasscode;
+			var newsettings = {
+				"AirConnectPasscode": settings["AirConnectPasscode"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateBluetoothName = function () {
+		if ($scope.BluetoothName && $scope.BluetoothName !== settings["BluetoothName"]) {
+			settings["BluetoothName"] = $scope.BluetoothName;
+			var newsettings = {
+				"BluetoothName": settings["BluetoothName"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.updatestaticips = function () {
 		if ($scope.StaticIps !== settings.StaticIps) {
 			var newsettings = {
@@ -222,6 +451,357 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateDescentAlertRate = function () {
+		if (($scope.DescentAlertRate !== undefined) && ($scope.DescentAlertRate !== null) && ($scope.DescentAlertRate !== settings["DescentAlertRate"])) {
+			settings["DescentAlertRate"] = parseInt($scope.DescentAlertRate);
+			var newsettings = {
+				"DescentAlertRate": settings["DescentAlertRate"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateGroundStation = function () {
+		var newsettings = {};
+		['GroundStationLat', 'GroundStationLng'].forEach(function (key) {
+			if (($scope[key] !== undefined) && ($scope[key] !== null) && ($scope[key] !== settings[key])) {
+				settings[key] = parseFloat($scope[key]);
+				newsettings[key] = settings[key];
+			}
+		});
+		if (($scope.GroundStationAlt !== undefined) && ($scope.GroundStationAlt !== null) && ($scope.GroundStationAlt !== settings["GroundStationAlt"])) {
+			settings["GroundStationAlt"] = parseInt($scope.GroundStationAlt);
+			newsettings["GroundStationAlt"] = settings["GroundStationAlt"];
+		}
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updatePowerSaveWakeRadius = function () {
+		if (($scope.PowerSaveWakeRadius !== undefined) && ($scope.PowerSaveWakeRadius !== null) && ($scope.PowerSaveWakeRadius !== settings["PowerSaveWakeRadius"])) {
+			settings["PowerSaveWakeRadius"] = parseInt($scope.PowerSaveWakeRadius);
+			var newsettings = {
+				"PowerSaveWakeRadius": settings["PowerSaveWakeRadius"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAntennaGainOffset = function () {
+		if (($scope.AntennaGainOffset !== undefined) && ($scope.AntennaGainOffset !== null) && ($scope.AntennaGainOffset !== settings["AntennaGainOffset"])) {
+			settings["AntennaGainOffset"] = parseInt($scope.AntennaGainOffset);
+			var newsettings = {
+				"AntennaGainOffset": settings["AntennaGainOffset"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAirspaceWarningDistance = function () {
+		if (($scope.AirspaceWarningDistance !== undefined) && ($scope.AirspaceWarningDistance !== null) && ($scope.AirspaceWarningDistance !== settings["AirspaceWarningDistance"])) {
+			settings["AirspaceWarningDistance"] = parseInt($scope.AirspaceWarningDistance);
+			var newsettings = {
+				"AirspaceWarningDistance": settings["AirspaceWarningDistance"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAirspaceWarningVertical = function () {
+		if (($scope.AirspaceWarningVertical !== undefined) && ($scope.AirspaceWarningVertical !== null) && ($scope.AirspaceWarningVertical !== settings["AirspaceWarningVertical"])) {
+			settings["AirspaceWarningVertical"] = parseInt($scope.AirspaceWarningVertical);
+			var newsettings = {
+				"AirspaceWarningVertical": settings["AirspaceWarningVertical"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAirspaceWarningCategories = function () {
+		if ($scope.AirspaceWarningCategories !== settings.AirspaceWarningCategories) {
+			var newsettings = {
+				"AirspaceWarningCategories": $scope.AirspaceWarningCategories === undefined? "" : $scope.AirspaceWarningCategories.join(' ')
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateTerrainClearance = function () {
+		if (($scope.TerrainClearance !== undefined) && ($scope.TerrainClearance !== null) && ($scope.TerrainClearance !== settings["TerrainClearance"])) {
+			settings["TerrainClearance"] = parseInt($scope.TerrainClearance);
+			var newsettings = {
+				"TerrainClearance": settings["TerrainClearance"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateFlarmRange = function () {
+		if (($scope.FlarmRange !== undefined) && ($scope.FlarmRange !== null) && ($scope.FlarmRange !== settings["FlarmRange"])) {
+			settings["FlarmRange"] = parseInt($scope.FlarmRange);
+			var newsettings = {
+				"FlarmRange": settings["FlarmRange"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateFlarmProtocolVersion = function () {
+		if (parseInt($scope.FlarmProtocolVersion) !== settings["FlarmProtocolVersion"]) {
+			settings["FlarmProtocolVersion"] = parseInt($scope.FlarmProtocolVersion);
+			var newsettings = {
+				"FlarmProtocolVersion": settings["FlarmProtocolVersion"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateFlarmScheduling = function () {
+		var newsettings = {};
+		var dirty = false;
+		['FlarmMaxSentences', 'FlarmPriorityTargets'].forEach(function (key) {
+			if (($scope[key] !== undefined) && ($scope[key] !== null) && (parseInt($scope[key]) !== settings[key])) {
+				settings[key] = parseInt($scope[key]);
+				newsettings[key] = settings[key];
+				dirty = true;
+			}
+		});
+		if (dirty) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAudioVolumeAlarm = function () {
+		if (($scope.AudioVolumeAlarm !== undefined) && ($scope.AudioVolumeAlarm !== null) && ($scope.AudioVolumeAlarm !== settings["AudioVolumeAlarm"])) {
+			settings["AudioVolumeAlarm"] = parseInt($scope.AudioVolumeAlarm);
+			var newsettings = {
+				"AudioVolumeAlarm": settings["AudioVolumeAlarm"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAudioVolumeCallout = function () {
+		if (($scope.AudioVolumeCallout !== undefined) && ($scope.AudioVolumeCallout !== null) && ($scope.AudioVolumeCallout !== settings["AudioVolumeCallout"])) {
+			settings["AudioVolumeCallout"] = parseInt($scope.AudioVolumeCallout);
+			var newsettings = {
+				"AudioVolumeCallout": settings["AudioVolumeCallout"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAudioVolumeVario = function () {
+		if (($scope.AudioVolumeVario !== undefined) && ($scope.AudioVolumeVario !== null) && ($scope.AudioVolumeVario !== settings["AudioVolumeVario"])) {
+			settings["AudioVolumeVario"] = parseInt($scope.AudioVolumeVario);
+			var newsettings = {
+				"AudioVolumeVario": settings["AudioVolumeVario"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAudioDevice = function () {
+		if (($scope.AudioDevice !== undefined) && ($scope.AudioDevice !== settings["AudioDevice"])) {
+			settings["AudioDevice"] = $scope.AudioDevice || "";
+			var newsettings = {
+				"AudioDevice": settings["AudioDevice"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAudioBluetoothSink = function () {
+		if (($scope.AudioBluetoothSink !== undefined) && ($scope.AudioBluetoothSink !== settings["AudioBluetoothSink"])) {
+			settings["AudioBluetoothSink"] = $scope.AudioBluetoothSink || "";
+			var newsettings = {
+				"AudioBluetoothSink": settings["AudioBluetoothSink"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateDataLogDecimals = function () {
+		if (($scope.DataLogDecimals !== undefined) && ($scope.DataLogDecimals !== null) && ($scope.DataLogDecimals !== settings["DataLogDecimals"])) {
+			settings["DataLogDecimals"] = parseInt($scope.DataLogDecimals);
+			var newsettings = {
+				"DataLogDecimals": settings["DataLogDecimals"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateBatteryAlertVoltage = function () {
+		if (($scope.BatteryAlertVoltage !== undefined) && ($scope.BatteryAlertVoltage !== null) && ($scope.BatteryAlertVoltage !== settings["BatteryAlertVoltage"])) {
+			settings["BatteryAlertVoltage"] = parseFloat($scope.BatteryAlertVoltage);
+			var newsettings = {
+				"BatteryAlertVoltage": settings["BatteryAlertVoltage"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateAlarmPreset = function () {
+		var newsettings = {
+			"AlarmPreset": $scope.AlarmPreset
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateAlarmCustom = function () {
+		if (!$scope.AlarmCustom || angular.equals($scope.AlarmCustom, settings["AlarmCustom"]))
+			return;
+		var custom = {};
+		for (var key in $scope.AlarmCustom) {
+			custom[key] = parseFloat($scope.AlarmCustom[key]);
+		}
+		settings["AlarmCustom"] = angular.copy(custom);
+		var newsettings = {
+			"AlarmCustom": custom
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateWeGlide = function () {
+		var newsettings = {};
+		if (($scope.WeGlideUserId !== undefined) && ($scope.WeGlideUserId !== null) && ($scope.WeGlideUserId !== settings["WeGlideUserId"])) {
+			settings["WeGlideUserId"] = newsettings["WeGlideUserId"] = parseInt($scope.WeGlideUserId);
+		}
+		if ($scope.WeGlideDateOfBirth) {
+			newsettings["WeGlideDateOfBirth"] = $scope.WeGlideDateOfBirth;
+			$scope.WeGlideDateOfBirth = "";
+			$scope.WeGlideDateOfBirthSet = true;
+		}
+		if (($scope.WeGlideAircraftId !== undefined) && ($scope.WeGlideAircraftId !== null) && ($scope.WeGlideAircraftId !== settings["WeGlideAircraftId"])) {
+			settings["WeGlideAircraftId"] = newsettings["WeGlideAircraftId"] = parseInt($scope.WeGlideAircraftId);
+		}
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateFlarmVersion = function () {
+		var newsettings = {};
+		['FlarmHwVersion', 'FlarmSwVersion', 'FlarmObstVersion'].forEach(function (key) {
+			if (($scope[key] !== undefined) && ($scope[key] !== settings[key])) {
+				settings[key] = newsettings[key] = $scope[key] || "";
+			}
+		});
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateRemoteSDR = function () {
+		var newsettings = {};
+		['RemoteSDR1090', 'RemoteSDR978', 'RemoteSDR868'].forEach(function (key) {
+			if (($scope[key] !== undefined) && ($scope[key] !== settings[key])) {
+				settings[key] = newsettings[key] = $scope[key] || "";
+			}
+		});
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateWeatherUplinkRegion = function () {
+		if (($scope.WeatherUplinkRegion !== undefined) && ($scope.WeatherUplinkRegion !== settings["WeatherUplinkRegion"])) {
+			settings["WeatherUplinkRegion"] = $scope.WeatherUplinkRegion;
+			var newsettings = {
+				"WeatherUplinkRegion": settings["WeatherUplinkRegion"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateNMEAOutRate = function () {
+		if (parseInt($scope.NMEAOutRate) !== settings["NMEAOutRate"]) {
+			settings["NMEAOutRate"] = parseInt($scope.NMEAOutRate);
+			var newsettings = {
+				"NMEAOutRate": settings["NMEAOutRate"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateLowAlarm = function () {
+		var newsettings = {};
+		if (($scope.LowAlarmAGL !== undefined) && ($scope.LowAlarmAGL !== null) && ($scope.LowAlarmAGL !== settings["LowAlarmAGL"])) {
+			settings["LowAlarmAGL"] = parseInt($scope.LowAlarmAGL);
+			newsettings["LowAlarmAGL"] = settings["LowAlarmAGL"];
+		}
+		if (($scope.TakeoffAlarmTime !== undefined) && ($scope.TakeoffAlarmTime !== null) && ($scope.TakeoffAlarmTime !== settings["TakeoffAlarmTime"])) {
+			settings["TakeoffAlarmTime"] = parseInt($scope.TakeoffAlarmTime);
+			newsettings["TakeoffAlarmTime"] = settings["TakeoffAlarmTime"];
+		}
+		if (parseInt($scope.LowAlarmMaxLevel) !== settings["LowAlarmMaxLevel"]) {
+			settings["LowAlarmMaxLevel"] = parseInt($scope.LowAlarmMaxLevel);
+			newsettings["LowAlarmMaxLevel"] = settings["LowAlarmMaxLevel"];
+		}
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateGlideRatio = function () {
+		if (($scope.GlideRatio !== undefined) && ($scope.GlideRatio !== null) && ($scope.GlideRatio !== settings["GlideRatio"])) {
+			settings["GlideRatio"] = parseInt($scope.GlideRatio);
+			var newsettings = {
+				"GlideRatio": settings["GlideRatio"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateOGNDashboardAddr = function () {
+		if (($scope.OGNDashboardAddr !== undefined) && ($scope.OGNDashboardAddr !== settings["OGNDashboardAddr"])) {
+			settings["OGNDashboardAddr"] = $scope.OGNDashboardAddr || "";
+			var newsettings = {
+				"OGNDashboardAddr": settings["OGNDashboardAddr"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateQNH = function () {
+		if (($scope.QNH !== undefined) && ($scope.QNH !== null) && ($scope.QNH !== settings["QNH"])) {
+			settings["QNH"] = parseFloat($scope.QNH);
+			var newsettings = {
+				"QNH": settings["QNH"]
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateGeodesy = function () {
+		var newsettings = {
+			"Geodesy": parseInt($scope.Geodesy)
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateLocale = function () {
+		var newsettings = {
+			"Locale": $scope.Locale
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateAltitudeSource = function () {
+		var newsettings = {
+			"AltitudeSource": parseInt($scope.AltitudeSource)
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateNMEABaroPriority = function () {
+		var newsettings = {
+			"NMEABaroPriority": parseInt($scope.NMEABaroPriority)
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
     $scope.updateGLimits = function () {
         if ($scope.GLimits !== settings["GLimits"]) {
             settings["GLimits"] = $scope.GLimits;
@@ -333,7 +913,7 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
                 $scope.WiFiErrors.Errors = true;
             }
 
-        if ($scope.WiFiSecurityEnabled) {
+        if ($scope.WiFiSecurityEnabled && ($scope.WiFiPassphrase.length > 0 || !$scope.WiFiPassphraseSet)) {
             if (!isValidWPA($scope.WiFiPassphrase)) {
                 $scope.WiFiErrors.WiFiPassphrase = "Your WiFi Password, " + $scope.WiFiPassphrase +
                     ", contains invalid characters.";
@@ -349,7 +929,6 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
             var newsettings = {
                 "WiFiSSID" :  $scope.WiFiSSID,
                 "WiFiSecurityEnabled" : $scope.WiFiSecurityEnabled,
-                "WiFiPassphrase" : $scope.WiFiPassphrase,
                 "WiFiChannel" : parseInt($scope.WiFiChannel),
 				"WiFiSmartEnabled": $scope.WiFiSmartEnabled,
 				"WiFiIPAddress" : $scope.WiFiIPAddress,
@@ -357,6 +936,10 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 				"WiFiDirectPin": $scope.WiFiDirectPin
             };
 
+            if ($scope.WiFiPassphrase.length > 0) {
+                newsettings["WiFiPassphrase"] = $scope.WiFiPassphrase;
+            }
+
             // console.log(angular.toJson(newsettings));
             setSettings(angular.toJson(newsettings));
             $scope.Ui.turnOn("modalSuccessWiFi");
@@ -371,7 +954,10 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 			"OGNAddrType": parseInt($scope.OGNAddrType),
 			"OGNAddr": $scope.OGNAddr,
 			"OGNAcftType": parseInt($scope.OGNAcftType),
-			"OGNPilot": $scope.OGNPilot
+			"OGNTxPower": parseInt($scope.OGNTxPower),
+			"OGNPilot": $scope.OGNPilot,
+			"OGNStealth": $scope.OGNStealth,
+			"OGNNoTrack": $scope.OGNNoTrack
 		};
 		setSettings(angular.toJson(newsettings));
 
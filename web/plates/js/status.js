@@ -47,6 +47,8 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.Ping_connected = status.Ping_connected;
 			$scope.Connected_Users = status.Connected_Users;
 			$scope.UAT_messages_last_minute = status.UAT_messages_last_minute;
+			$scope.TISB_service = status.TISB_service;
+			$scope.TISB_sites = status.TISB_sites;
 			$scope.UAT_messages_max = status.UAT_messages_max;
 			$scope.ES_messages_last_minute = status.ES_messages_last_minute;
 			$scope.ES_messages_max = status.ES_messages_max;
@@ -57,7 +59,23 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.GPS_satellites_tracked = status.GPS_satellites_tracked;
 			$scope.GPS_satellites_seen = status.GPS_satellites_seen;
 			$scope.GPS_solution = status.GPS_solution;
+			$scope.GPS_validity = status.GPS_validity;
+			$scope.GPS_validity_changes = status.GPS_validity_changes;
+			$scope.FlarmSerialDevices = status.FlarmSerialDevices;
+			$scope.NMEAInputs = status.NMEAInputs;
+			$scope.NMEAInputStats = status.NMEAInputStats;
+			$scope.USBSerialDevices = status.USBSerialDevices;
 			$scope.OGN_noise_db = status.OGN_noise_db;
+			$scope.AltitudeSource = status.AltitudeSource;
+			$scope.DescentAlert = status.DescentAlert;
+			$scope.DegradedModes = status.DegradedModes || [];
+			$scope.Load = status.Load;
+			$scope.PowerSave = status.PowerSave;
+			$scope.Battery = status.Battery;
+			$scope.GroundAlarmSuppressed = status.GroundAlarmSuppressed;
+			$scope.LowAltitudeAlarmLimit = status.LowAltitudeAlarmLimit;
+			$scope.SubsystemRestarts = status.SubsystemRestarts || {};
+			$scope.hasSubsystemRestarts = Object.keys($scope.SubsystemRestarts).length > 0;
 			$scope.OGN_gain_db = status.OGN_gain_db;
 			$scope.OGN_Status_url = "http://" + window.location.hostname + ":8082/rf-spectro.jpg";
 
@@ -196,6 +214,27 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	// Alert texts in the selected language, English until loaded.
+	$scope.Phrases = {
+		"descent_alert": "Unexpected descent!",
+		"degraded": "Degraded Operation",
+		"overload_paused": "%s paused"
+	};
+
+	function getPhrases() {
+		$http.get(URL_PHRASES_GET).
+		then(function (response) {
+			$scope.Phrases = angular.fromJson(response.data);
+		}, function (response) {
+			// nop
+		});
+	};
+
+	$scope.phrase = function (id, arg) {
+		var text = $scope.Phrases[id] || id;
+		return arg === undefined ? text : text.replace('%s', arg);
+	};
+
 	function getTowers() {
 		// Simple GET request example (note: responce is asynchronous)
 		$http.get(URL_TOWERS_GET).
@@ -214,10 +253,20 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	function getTransponder() {
+		$http.get(URL_TRANSPONDER_GET).
+		then(function (response) {
+			$scope.Transponder = angular.fromJson(response.data);
+		}, function (response) {
+			$scope.Transponder = undefined;
+		});
+	};
+
 	// periodically get the tower list
 	var updateTowers = $interval(function () {
 		// refresh tower count once each 5 seconds (aka polling)
 		getTowers();
+		getTransponder();
 	}, (5 * 1000), 0, false);
 
     var clicks = 0;
@@ -268,5 +317,6 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
     }
 	// Status Controller tasks
 	setHardwareVisibility();
+	getPhrases();
 	connect($scope); // connect - opens a socket and listens for messages
 };
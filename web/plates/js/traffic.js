@@ -139,6 +139,9 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval) {
 		new_traffic.bearing = Math.round(obj.Bearing); // degrees true 
 		new_traffic.dist = (obj.Distance/1852); // nautical miles
 		new_traffic.distEst = obj.DistanceEstimated / 1852;
+		new_traffic.glide = ["", "reachable", "above glide", "below"][obj.GlideBand || 0]; // see glideband.go
+		new_traffic.closure = obj.ClosureClass >= 3 ? Math.round(obj.ClosureRate) : null; // see closurerate.go, only for closing targets
+		new_traffic.closureFast = obj.ClosureClass == 4;
 		// return new_aircraft;
 	}
 